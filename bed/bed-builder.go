@@ -0,0 +1,103 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"sync"
+)
+
+// A Builder collects the regions and tracks of a bed, for example
+// while parsing several BED files in parallel. Unlike AddRegion on a
+// Bed, the methods of a Builder are safe for concurrent use.
+//
+// Once all regions are added, Freeze turns the collected regions into
+// a FrozenBed, after which the Builder can no longer be used.
+type Builder struct {
+	mutex  sync.Mutex
+	bed    *Bed
+	frozen bool
+}
+
+// NewBuilder allocates and initializes an empty Builder.
+func NewBuilder() *Builder {
+	return &Builder{bed: NewBed()}
+}
+
+func (builder *Builder) lock() {
+	builder.mutex.Lock()
+	if builder.frozen {
+		builder.mutex.Unlock()
+		panic("bed: Builder used after Freeze")
+	}
+}
+
+// AddRegion adds a region to the bed that is being built.
+func (builder *Builder) AddRegion(region *Region) {
+	builder.lock()
+	defer builder.mutex.Unlock()
+	AddRegion(builder.bed, region)
+}
+
+// AddRegions adds several regions to the bed that is being built,
+// acquiring the lock of the Builder only once.
+func (builder *Builder) AddRegions(regions []*Region) {
+	builder.lock()
+	defer builder.mutex.Unlock()
+	for _, region := range regions {
+		AddRegion(builder.bed, region)
+	}
+}
+
+// AddBed adds the regions and tracks of a bed to the bed that is
+// being built. The regions themselves are shared, not copied.
+func (builder *Builder) AddBed(bed *Bed) {
+	builder.lock()
+	defer builder.mutex.Unlock()
+	for chrom, regions := range bed.RegionMap {
+		builder.bed.RegionMap[chrom] = append(builder.bed.RegionMap[chrom], regions...)
+	}
+	builder.bed.Tracks = append(builder.bed.Tracks, bed.Tracks...)
+}
+
+// Freeze sorts the regions that were added to the Builder, and
+// returns them as a FrozenBed. Any further use of the Builder panics.
+func (builder *Builder) Freeze() *FrozenBed {
+	builder.lock()
+	defer builder.mutex.Unlock()
+	builder.frozen = true
+	sortRegions(builder.bed)
+	return &FrozenBed{RegionIndex: NewRegionIndex(builder.bed), bed: builder.bed}
+}
+
+// A FrozenBed is a bed that can no longer be modified. It can
+// therefore be queried by many goroutines at the same time without any
+// locking, for example by the filters of a parallel pipeline. The
+// queries are those of its RegionIndex.
+type FrozenBed struct {
+	*RegionIndex
+	bed *Bed
+}
+
+// Bed returns the regions and tracks of a FrozenBed as a Bed, for use
+// with functions that expect a Bed, such as the region filters. The
+// regions are sorted. The result is shared by all callers, and must
+// not be modified.
+func (frozen *FrozenBed) Bed() *Bed {
+	return frozen.bed
+}
@@ -20,8 +20,13 @@ package bed
 
 import (
 	"bufio"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -30,36 +35,159 @@ import (
 
 // Helper function for parsing a track line field.
 func splitTrackField(field string) (string, string) {
-	split := strings.Split(field, "=")
+	split := strings.SplitN(field, "=", 2)
+	if len(split) < 2 {
+		return split[0], ""
+	}
 	return split[0], split[1]
 }
 
-// ParseBed parses a BED file. See
+// Splits a track line into fields separated by spaces or tabs. Double
+// quotes group words into a single field, and are removed.
+func splitTrackLine(line string) (fields []string) {
+	var field []byte
+	inField, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inField {
+				fields = append(fields, string(field))
+				field, inField = field[:0], false
+			}
+		default:
+			field = append(field, c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, string(field))
+	}
+	return fields
+}
+
+// A ColumnLayout determines how the columns after the end position
+// of a BED region are interpreted.
+type ColumnLayout int
+
+// Available column layouts.
+const (
+	// The layout of the BED specification: the 4th column is the
+	// name, followed by score, strand, and so on.
+	StandardLayout ColumnLayout = iota
+	// The 4th column is the score, as in chrom/start/end/score files.
+	// The name of each region is left empty, and any further columns
+	// are interpreted as strand, thickStart, and so on.
+	ScoreLayout
+)
+
+// ParseOptions controls optional behavior of ParseBedWithOptions.
+type ParseOptions struct {
+	// The interpretation of the optional columns. The default is
+	// StandardLayout.
+	ColumnLayout ColumnLayout
+	// If true, warn when the file looks like it uses 1-based
+	// coordinates. This is a heuristic only: a BED file in which no
+	// region starts at position 0 is reported as possibly 1-based,
+	// since genuine 0-based files almost always contain at least one
+	// region starting at 0. Regions are never converted.
+	DetectOneBased bool
+	// If true, remove duplicate regions and combine overlapping
+	// regions with Collapse, and log how many regions were combined.
+	// Tracks are not preserved.
+	CollapseOverlaps bool
+	// If true, collapsed regions list the names of the regions they
+	// were combined from. Only used with CollapseOverlaps.
+	UnionNames bool
+}
+
+// An inputFile reads from an opened input file, decompressing it if
+// necessary.
+type inputFile struct {
+	io.Reader
+	file       *os.File
+	gzipReader *gzip.Reader
+}
+
+// Opens an input file for reading. If the name is "/dev/stdin", the
+// input is read from os.Stdin. Input that starts with the gzip magic
+// bytes is decompressed transparently, regardless of its name. This
+// includes BGZF files, which consist of concatenated gzip members.
+func openInput(filename string) (*inputFile, error) {
+	input := &inputFile{file: os.Stdin}
+	if filename != "/dev/stdin" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		input.file = file
+	}
+	reader := bufio.NewReader(input.file)
+	input.Reader = reader
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			_ = input.Close()
+			return nil, err
+		}
+		input.gzipReader = gzipReader
+		input.Reader = gzipReader
+	}
+	return input, nil
+}
+
+// Close closes an input file, unless it is os.Stdin.
+func (input *inputFile) Close() (err error) {
+	if input.gzipReader != nil {
+		err = input.gzipReader.Close()
+	}
+	if input.file != os.Stdin {
+		if nerr := input.file.Close(); err == nil {
+			err = nerr
+		}
+	}
+	return err
+}
+
+// ParseBed parses a BED file. Files compressed with gzip or bgzip are
+// decompressed transparently, and the name "/dev/stdin" reads from
+// standard input. See
 // https://genome.ucsc.edu/FAQ/FAQformat.html#format1
 func ParseBed(filename string) (b *Bed, err error) {
+	return ParseBedWithOptions(filename, ParseOptions{})
+}
+
+// ParseBedWithOptions parses a BED file like ParseBed, using the
+// given options.
+func ParseBedWithOptions(filename string, options ParseOptions) (b *Bed, err error) {
 
 	bed := NewBed()
 
 	// open file
-	file, err := os.Open(filename)
+	input, err := openInput(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
-		if nerr := file.Close(); err == nil {
+		if nerr := input.Close(); err == nil {
 			err = nerr
 		}
 	}()
 
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(input)
 
 	var track *Track // for storing the current track
 
 	for scanner.Scan() {
 		line := scanner.Text()
+		if isSkippedLine(line) {
+			continue
+		}
 		data := strings.Split(line, "\t")
 		// check if the line is a new track
-		if data[0] == "track" {
+		if isTrackLine(line) {
 			// create new track, store the old one
 			if track != nil {
 				bed.Tracks = append(bed.Tracks, track)
@@ -67,26 +195,16 @@ func ParseBed(filename string) (b *Bed, err error) {
 			// all track entries are optional
 			// parse and collect those that are used
 			fields := make(map[string]string)
-			for _, field := range data[1:] {
+			for _, field := range splitTrackLine(line)[1:] {
 				key, val := splitTrackField(field)
 				fields[key] = val
 			}
 			track = NewTrack(fields)
 		} else {
 			// parse a region entry
-			chrom := utils.Intern(data[0])
-			var err error
-			start, err := strconv.Atoi(data[1])
-			if err != nil {
-				return nil, fmt.Errorf("invalid bed region start: %v ", err)
-			}
-			end, err := strconv.Atoi(data[2])
-			if err != nil {
-				return nil, fmt.Errorf("invalid bed region end: %v ", err)
-			}
-			region, err := NewRegion(chrom, int32(start), int32(end), data[3:])
+			region, err := parseRegionLine(data, options.ColumnLayout)
 			if err != nil {
-				return nil, fmt.Errorf("invalid bed region: %v ", err)
+				return nil, err
 			}
 			AddRegion(bed, region)
 			if track != nil {
@@ -98,7 +216,304 @@ func ParseBed(filename string) (b *Bed, err error) {
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("error while reading bed file: %v ", err)
 	}
+	if track != nil {
+		bed.Tracks = append(bed.Tracks, track)
+	}
+	if options.DetectOneBased && len(bed.RegionMap) > 0 && !hasZeroStart(bed) {
+		log.Println("Warning: No region in", filename, "starts at position 0. The file may use 1-based instead of 0-based coordinates.")
+	}
+	if options.CollapseOverlaps {
+		collapsed, stats := Collapse(bed, options.UnionNames)
+		log.Println("Collapsed", stats.Regions, "regions in", filename, "into", stats.Collapsed, "regions, including", stats.Duplicates, "duplicates.")
+		return collapsed, nil
+	}
 	// Make sure bed regions are sorted.
 	sortRegions(bed)
 	return bed, nil
 }
+
+// Returns true for lines of a BED file that do not contain data:
+// empty lines, comment lines, and browser lines.
+func isSkippedLine(line string) bool {
+	return strings.TrimSpace(line) == "" || line[0] == '#' ||
+		line == "browser" || strings.HasPrefix(line, "browser ") || strings.HasPrefix(line, "browser\t")
+}
+
+// Returns true for track lines of a BED file.
+func isTrackLine(line string) bool {
+	return line == "track" || strings.HasPrefix(line, "track ") || strings.HasPrefix(line, "track\t")
+}
+
+// Parses the tab-separated columns of a BED line that describes a
+// region.
+func parseRegionLine(data []string, layout ColumnLayout) (*Region, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("invalid bed region: expected at least 3 columns, got %v ", len(data))
+	}
+	chrom := utils.Intern(data[0])
+	start, err := strconv.Atoi(data[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid bed region start: %v ", err)
+	}
+	end, err := strconv.Atoi(data[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid bed region end: %v ", err)
+	}
+	fields := data[3:]
+	if layout == ScoreLayout && len(fields) > 0 {
+		fields = append([]string{""}, fields...)
+	}
+	region, err := NewRegion(chrom, int32(start), int32(end), fields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bed region: %v ", err)
+	}
+	return region, nil
+}
+
+// Returns true if any region of the bed starts at position 0.
+func hasZeroStart(bed *Bed) bool {
+	for _, regions := range bed.RegionMap {
+		for _, region := range regions {
+			if region.Start == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Formats an optional region field as it appears in a BED file.
+func formatRegionField(field interface{}) string {
+	switch val := field.(type) {
+	case string:
+		return val
+	case int:
+		return strconv.Itoa(val)
+	case utils.Symbol:
+		return *val
+	case ItemRgb:
+		return val.String()
+	case []int32:
+		var buf []byte
+		for _, n := range val {
+			buf = strconv.AppendInt(buf, int64(n), 10)
+			buf = append(buf, ',')
+		}
+		return string(buf)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// Formats a track line field, quoting values that contain spaces.
+func formatTrackField(key, val string) string {
+	if strings.ContainsAny(val, " \t") {
+		return key + "=\"" + val + "\""
+	}
+	return key + "=" + val
+}
+
+// Writes a single region as a BED line.
+func formatRegion(out *bufio.Writer, region *Region) {
+	fmt.Fprint(out, *region.Chrom, "\t", region.Start, "\t", region.End)
+	for _, field := range region.OptionalFields {
+		fmt.Fprint(out, "\t", formatRegionField(field))
+	}
+	fmt.Fprint(out, "\n")
+}
+
+// Format writes the tracks and regions of a bed in BED format, such
+// that ParseBed can read them back. Each track is written as a track
+// line, with its fields sorted by key, followed by its regions in the
+// order in which they are stored in the track. Regions that belong to
+// no track are written before the first track line, ordered by
+// chromosome name and start position. Optional fields are written in
+// the order defined by the BED format.
+func Format(w io.Writer, bed *Bed) error {
+	out := bufio.NewWriter(w)
+	inTrack := make(map[*Region]bool)
+	for _, track := range bed.Tracks {
+		for _, region := range track.Regions {
+			inTrack[region] = true
+		}
+	}
+	for _, region := range allSortedRegions(bed) {
+		if !inTrack[region] {
+			formatRegion(out, region)
+		}
+	}
+	for _, track := range bed.Tracks {
+		keys := make([]string, 0, len(track.Fields))
+		for key := range track.Fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprint(out, "track")
+		for _, key := range keys {
+			fmt.Fprint(out, " ", formatTrackField(key, track.Fields[key]))
+		}
+		fmt.Fprint(out, "\n")
+		for _, region := range track.Regions {
+			formatRegion(out, region)
+		}
+	}
+	return out.Flush()
+}
+
+// WriteBed writes the tracks and regions of a bed to a BED file, as
+// described for Format.
+func WriteBed(bed *Bed, filename string) (err error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	return Format(file, bed)
+}
+
+// WriteShards writes each shard to a separate BED file named
+// outputPrefix-shardN.bed in the outputPath directory, and writes a
+// manifest named outputPrefix-shards.txt that lists the shard files
+// and the number of bases each of them covers, separated by a tab.
+func WriteShards(shards []*Bed, outputPath, outputPrefix string) (err error) {
+	manifestName := filepath.Join(outputPath, outputPrefix+"-shards.txt")
+	manifest, err := os.Create(manifestName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := manifest.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	out := bufio.NewWriter(manifest)
+	for i, shard := range shards {
+		shardName := filepath.Join(outputPath, fmt.Sprintf("%v-shard%v.bed", outputPrefix, i+1))
+		if err := WriteBed(shard, shardName); err != nil {
+			return fmt.Errorf("%v, while writing shard %v", err, shardName)
+		}
+		fmt.Fprint(out, shardName, "\t", CoveredBases(shard), "\n")
+	}
+	return out.Flush()
+}
+
+// A RegionsFileFormat selects one of the layouts that samtools accepts
+// for a regions file.
+type RegionsFileFormat int
+
+// Available regions file layouts.
+const (
+	// One region per line as chrom<TAB>start<TAB>end, with 0-based,
+	// half-open coordinates as in BED files. samtools interprets such
+	// a file with these coordinates when its name ends in .bed.
+	TabRegions RegionsFileFormat = iota
+	// One region per line as chrom:start-end, with 1-based, inclusive
+	// coordinates as in samtools region strings.
+	ColonRegions
+)
+
+// WriteRegionsFile writes the regions of a bed in a format that
+// samtools accepts as a regions file, ordered by chromosome name and
+// start position.
+func WriteRegionsFile(bed *Bed, w io.Writer, format RegionsFileFormat) error {
+	out := bufio.NewWriter(w)
+	for _, region := range allSortedRegions(bed) {
+		switch format {
+		case TabRegions:
+			fmt.Fprint(out, *region.Chrom, "\t", region.Start, "\t", region.End, "\n")
+		case ColonRegions:
+			fmt.Fprint(out, *region.Chrom, ":", region.Start+1, "-", region.End, "\n")
+		default:
+			return fmt.Errorf("unknown regions file format %v", format)
+		}
+	}
+	return out.Flush()
+}
+
+// ParseChromSizes parses a chrom.sizes file, which lists a chromosome
+// name and its length on each line, separated by a tab. Any further
+// columns are ignored, so a FASTA index (.fai) file can be parsed as
+// well. Empty lines are skipped.
+func ParseChromSizes(filename string) (lengths map[utils.Symbol]int32, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	lengths = make(map[utils.Symbol]int32)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		data := strings.Split(line, "\t")
+		if len(data) < 2 {
+			return nil, fmt.Errorf("invalid chrom.sizes line: %v", line)
+		}
+		length, err := strconv.ParseInt(data[1], 10, 32)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid chromosome length: %v", data[1])
+		}
+		lengths[utils.Intern(data[0])] = int32(length)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading chrom.sizes file: %v", err)
+	}
+	return lengths, nil
+}
+
+// A LoadError collects the errors that occurred while loading several
+// files, keyed by filename.
+type LoadError map[string]error
+
+func (err LoadError) Error() string {
+	filenames := make([]string, 0, len(err))
+	for filename := range err {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	var msg strings.Builder
+	for i, filename := range filenames {
+		if i > 0 {
+			msg.WriteString("; ")
+		}
+		fmt.Fprintf(&msg, "%v: %v", filename, err[filename])
+	}
+	return msg.String()
+}
+
+// LoadBedDir parses all BED files that match a glob pattern, for
+// example "panels/*.bed*", keyed by their base filename. Files with a
+// .gz extension are decompressed transparently. Files that cannot be
+// parsed do not stop the other files from being loaded: their errors
+// are collected and returned as a LoadError, together with the beds
+// that could be loaded.
+func LoadBedDir(pattern string) (map[string]*Bed, error) {
+	filenames, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	beds := make(map[string]*Bed, len(filenames))
+	errs := make(LoadError)
+	for _, filename := range filenames {
+		bed, err := ParseBed(filename)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+		beds[filepath.Base(filename)] = bed
+	}
+	if len(errs) > 0 {
+		return beds, errs
+	}
+	return beds, nil
+}
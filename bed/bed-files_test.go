@@ -0,0 +1,648 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestParseBedCRLF(t *testing.T) {
+	bed, err := ParseBed("testdata/crlf.bed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bed.RegionMap) != 1 {
+		t.Error("ParseBed CRLF 1 failed")
+	}
+	regions := bed.RegionMap[utils.Intern("chr1")]
+	if len(regions) != 2 {
+		t.Fatal("ParseBed CRLF 2 failed")
+	}
+	if regions[0].Name() != "region1" || regions[0].OptionalFields[brScore] != 500 || regions[0].Strand() != SF {
+		t.Error("ParseBed CRLF 3 failed")
+	}
+	if regions[1].OptionalFields[brScore] != 0 || regions[1].Strand() != SR {
+		t.Error("ParseBed CRLF 4 failed")
+	}
+}
+
+func TestGenomeBed(t *testing.T) {
+	lengths, err := ParseChromSizes("testdata/hg38.chrom.sizes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lengths) != 3 || lengths[utils.Intern("chrM")] != 16569 {
+		t.Error("ParseChromSizes failed")
+	}
+	bed := GenomeBed(lengths)
+	if len(bed.RegionMap) != len(lengths) {
+		t.Error("GenomeBed 1 failed")
+	}
+	for chrom, length := range lengths {
+		regions := bed.RegionMap[chrom]
+		if len(regions) != 1 || regions[0].Start != 0 || regions[0].End != length {
+			t.Error("GenomeBed 2 failed for", *chrom)
+		}
+	}
+}
+
+func TestFilterByMappability(t *testing.T) {
+	track, err := ParseBedGraph("testdata/mappability.bedgraph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := makeRegion("chr1", 10, 90, "good")
+	mixed := makeRegion("chr1", 50, 150, "mixed")
+	uncovered := makeRegion("chr1", 140, 160, "uncovered")
+	kept, dropped := FilterByMappability(makeBed(good, mixed, uncovered), track, 0.5)
+	regions := kept.RegionMap[utils.Intern("chr1")]
+	if len(regions) != 2 || regions[0] != good || regions[1] != mixed {
+		t.Error("FilterByMappability 1 failed")
+	}
+	if len(dropped) != 1 || dropped[0].Region != uncovered || dropped[0].Score != 0.1 {
+		t.Error("FilterByMappability 2 failed")
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	chr1 := utils.Intern("chr1")
+	lengths := map[utils.Symbol]int32{chr1: 1000}
+	regions := []*Region{
+		makeRegion("chr1", 100, 200),
+		makeRegion("chr1", 300, 250),
+		makeRegion("chr1", 400, 400),
+		makeRegion("chr1", 900, 248956422),
+		makeRegion("chrUn", 0, 10),
+		makeRegion("chr1", -5, 10),
+	}
+	expected := [][]AnomalyReason{
+		{NegativeStart},
+		{NegativeLength},
+		{ZeroLength},
+		{BeyondChromosomeEnd},
+		{UnknownChromosome},
+	}
+	anomalies := DetectAnomalies(makeBed(regions...), lengths)
+	if len(anomalies) != len(expected) {
+		t.Fatal("DetectAnomalies 1 failed")
+	}
+	for i, anomaly := range anomalies {
+		if len(anomaly.Reasons) != len(expected[i]) || anomaly.Reasons[0] != expected[i][0] {
+			t.Error("DetectAnomalies 2 failed for", anomaly.Region.Start, anomaly.Reasons)
+		}
+	}
+	if len(DetectAnomalies(makeBed(regions[0]), nil)) != 0 {
+		t.Error("DetectAnomalies 3 failed")
+	}
+}
+
+func TestChromTargetReport(t *testing.T) {
+	header := sam.NewHeader()
+	header.SQ = []utils.StringMap{{"SN": "chr2", "LN": "500"}, {"SN": "chr1", "LN": "1000"}}
+	bed := makeBed(
+		makeRegion("chr1", 100, 200),
+		makeRegion("chr1", 150, 300),
+		makeRegion("chr1", 900, 1100),
+		makeRegion("chrUn", 0, 10),
+	)
+	report, err := ChromTargetReport(bed, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ChromTargetCoverage{
+		{Chrom: utils.Intern("chr2"), Length: 500, TargetedBases: 0, Fraction: 0, InHeader: true},
+		{Chrom: utils.Intern("chr1"), Length: 1000, TargetedBases: 300, Fraction: 0.3, InHeader: true},
+		{Chrom: utils.Intern("chrUn"), TargetedBases: 10},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Error("ChromTargetReport failed", report)
+	}
+	var out bytes.Buffer
+	if err := WriteChromTargetReport(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "chrom\tlength\ttargeted\tfraction\tstatus\n"+
+		"chr2\t500\t0\t0.000000\tok\n"+
+		"chr1\t1000\t300\t0.300000\tok\n"+
+		"chrUn\t0\t10\t0.000000\tERROR: not in header\n" {
+		t.Error("WriteChromTargetReport failed", out.String())
+	}
+}
+
+func TestCoverageRatios(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "baseline.tsv")
+	if err := ioutil.WriteFile(filename, []byte("# expected depths\n\nr1\t20\textra\nr2\t0\nr3\t10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseBaseline(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, map[string]float64{"r1": 20, "r2": 0, "r3": 10}) {
+		t.Error("ParseBaseline failed", expected)
+	}
+	invalid := filepath.Join(dir, "invalid.tsv")
+	if err := ioutil.WriteFile(invalid, []byte("r1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseBaseline(invalid); err == nil {
+		t.Error("ParseBaseline with invalid line failed")
+	}
+	bed := makeBed(
+		makeRegion("chr2", 0, 50, "r3"),
+		makeRegion("chr1", 100, 200, "r1"),
+		makeRegion("chr1", 300, 400, "r2"),
+		makeRegion("chr1", 500, 600, "r4"),
+		makeRegion("chr1", 700, 800, "r5"),
+	)
+	observed := map[string]float64{"r1": 10, "r2": 5, "r3": 0, "r4": 7}
+	ratios := CoverageRatios(bed, observed, expected)
+	if len(ratios) != 2 ||
+		ratios[0].Region.Name() != "r1" || ratios[0].Observed != 10 || ratios[0].Expected != 20 || ratios[0].Log2Ratio != -1 ||
+		ratios[1].Region.Name() != "r3" || !math.IsInf(ratios[1].Log2Ratio, -1) {
+		t.Fatal("CoverageRatios failed", ratios)
+	}
+	var out bytes.Buffer
+	if err := WriteCoverageRatios(&out, ratios); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "chrom\tstart\tend\tname\tobserved\texpected\tlog2ratio\n"+
+		"chr1\t100\t200\tr1\t10.0000\t20.0000\t-1.0000\n"+
+		"chr2\t0\t50\tr3\t0.0000\t10.0000\t-Inf\n" {
+		t.Error("WriteCoverageRatios failed", out.String())
+	}
+}
+
+func TestDetectOneBased(t *testing.T) {
+	dir := t.TempDir()
+	oneBased := filepath.Join(dir, "one-based.bed")
+	if err := ioutil.WriteFile(oneBased, []byte("chr1\t1\t100\nchr2\t1\t50\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	zeroBased := filepath.Join(dir, "zero-based.bed")
+	if err := ioutil.WriteFile(zeroBased, []byte("chr1\t1\t100\nchr2\t0\t50\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range []struct {
+		filename string
+		detect   bool
+		warning  bool
+	}{
+		{oneBased, true, true},
+		{oneBased, false, false},
+		{zeroBased, true, false},
+	} {
+		logOutput.Reset()
+		bed, err := ParseBedWithOptions(test.filename, ParseOptions{DetectOneBased: test.detect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bed.RegionMap) != 2 {
+			t.Error("DetectOneBased changed the regions")
+		}
+		if warning := strings.Contains(logOutput.String(), "1-based"); warning != test.warning {
+			t.Error("DetectOneBased failed", test.filename, test.detect)
+		}
+		logOutput.Reset()
+		if _, err := ParseCompactRegionIndex(test.filename, ParseOptions{DetectOneBased: test.detect}); err != nil {
+			t.Fatal(err)
+		}
+		if warning := strings.Contains(logOutput.String(), "1-based"); warning != test.warning {
+			t.Error("DetectOneBased with ParseCompactRegionIndex failed", test.filename, test.detect)
+		}
+	}
+}
+
+func TestScoreLayout(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "scores.bed")
+	if err := ioutil.WriteFile(filename, []byte("chr1\t0\t100\t500\t-\nchr1\t200\t300\t42\nchr1\t400\t500\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bed, err := ParseBedWithOptions(filename, ParseOptions{ColumnLayout: ScoreLayout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions := bed.RegionMap[utils.Intern("chr1")]
+	if len(regions) != 3 {
+		t.Fatal("ScoreLayout 1 failed")
+	}
+	if score, ok := regions[0].Score(); !ok || score != 500 || regions[0].Name() != "" || regions[0].Strand() != SR {
+		t.Error("ScoreLayout 2 failed")
+	}
+	if score, ok := regions[1].Score(); !ok || score != 42 || regions[1].Strand() != nil {
+		t.Error("ScoreLayout 3 failed")
+	}
+	if _, ok := regions[2].Score(); ok {
+		t.Error("ScoreLayout 4 failed")
+	}
+	if _, err := ParseBedWithOptions(filename, ParseOptions{}); err == nil {
+		t.Error("ScoreLayout 5 failed")
+	}
+}
+
+func TestLoadBedDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elprep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "plain.bed"), []byte("chr1\t0\t100\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.bed"), []byte("chr1\tzero\t100\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filepath.Join(dir, "compressed.bed.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipped := gzip.NewWriter(file)
+	if _, err := zipped.Write([]byte("chr2\t10\t20\nchr2\t30\t40\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipped.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	beds, err := LoadBedDir(filepath.Join(dir, "*.bed*"))
+	if loadErr, ok := err.(LoadError); !ok || len(loadErr) != 1 || loadErr[filepath.Join(dir, "broken.bed")] == nil {
+		t.Error("LoadBedDir 1 failed")
+	}
+	if len(beds) != 2 || len(beds["plain.bed"].RegionMap[utils.Intern("chr1")]) != 1 ||
+		len(beds["compressed.bed.gz"].RegionMap[utils.Intern("chr2")]) != 2 {
+		t.Error("LoadBedDir 2 failed")
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	input := "chrX\t5\t10\n" +
+		"track description=\"first track\" name=first\n" +
+		"chr1\t100\t200\ttx1\t0\t+\t100\t200\t0\t2\t10,20,\t0,80,\n" +
+		"track\tname=second\n" +
+		"chr2\t0\t50\tr2\t900\t-\n"
+	dir, err := ioutil.TempDir("", "elprep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "input.bed")
+	if err := ioutil.WriteFile(filename, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bed, err := ParseBed(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bed.Tracks) != 2 || bed.Tracks[0].Fields["description"] != "first track" || len(bed.Tracks[1].Regions) != 1 {
+		t.Fatal("ParseBed tracks failed")
+	}
+	var out bytes.Buffer
+	if err := Format(&out, bed); err != nil {
+		t.Fatal(err)
+	}
+	expected := "chrX\t5\t10\n" +
+		"track description=\"first track\" name=first\n" +
+		"chr1\t100\t200\ttx1\t0\t+\t100\t200\t0\t2\t10,20,\t0,80,\n" +
+		"track name=second\n" +
+		"chr2\t0\t50\tr2\t900\t-\n"
+	if out.String() != expected {
+		t.Error("Format failed")
+	}
+	filename = filepath.Join(dir, "output.bed")
+	if err := WriteBed(bed, filename); err != nil {
+		t.Fatal(err)
+	}
+	if written, err := ioutil.ReadFile(filename); err != nil || string(written) != expected {
+		t.Error("WriteBed failed")
+	}
+}
+
+func TestParseGTF(t *testing.T) {
+	chr1 := utils.Intern("chr1")
+	bed, err := ParseRegions("testdata/genes.gtf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions := bed.RegionMap[chr1]
+	if len(regions) != 2 || regions[0].Start != 999 || regions[0].End != 1100 || regions[1].Start != 2000 || regions[1].End != 2200 {
+		t.Fatal("ParseGTF collapse failed")
+	}
+	if regions[1].Name() != "ABC" || regions[1].Strand() != SF {
+		t.Error("ParseGTF fields failed")
+	}
+	if regions := bed.RegionMap[utils.Intern("chr2")]; len(regions) != 1 || regions[0].Name() != "G2" || regions[0].Strand() != SR {
+		t.Error("ParseGTF gene_id failed")
+	}
+	bed, err = ParseGTF("testdata/genes.gtf", GTFOptions{FeatureTypes: []string{"CDS"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := bed.RegionMap[chr1]; len(regions) != 1 || regions[0].Start != 2050 || regions[0].Name() != "T1" {
+		t.Error("ParseGTF CDS failed")
+	}
+
+	bed, err = ParseRegions("testdata/genes.gff3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions = bed.RegionMap[chr1]
+	if len(regions) != 2 || regions[1].Start != 2000 || regions[1].End != 2200 || regions[1].Name() != "ABC" {
+		t.Error("ParseGTF GFF3 failed")
+	}
+}
+
+func TestParseIntervalList(t *testing.T) {
+	bed, dict, err := ParseIntervalList("testdata/targets.interval_list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions := bed.RegionMap[utils.Intern("chr1")]
+	if len(regions) != 1 || regions[0].Start != 100 || regions[0].End != 200 || regions[0].Name() != "target1" {
+		t.Error("ParseIntervalList chr1 failed")
+	}
+	if regions := bed.RegionMap[utils.Intern("chr2")]; len(regions) != 1 || regions[0].Start != 0 || regions[0].Strand() != SR {
+		t.Error("ParseIntervalList chr2 failed")
+	}
+	header := sam.NewHeader()
+	header.SQ = append(header.SQ, utils.StringMap{"SN": "chr1", "LN": "10000"}, utils.StringMap{"SN": "chr2", "LN": "5000"}, utils.StringMap{"SN": "chr3", "LN": "100"})
+	if err := CompareSequenceDictionaries(dict, header); err != nil {
+		t.Error("CompareSequenceDictionaries 1 failed")
+	}
+	header.SQ[1]["LN"] = "5001"
+	if err := CompareSequenceDictionaries(dict, header); err == nil {
+		t.Error("CompareSequenceDictionaries 2 failed")
+	}
+	header.SQ = header.SQ[:1]
+	if err := CompareSequenceDictionaries(dict, header); err == nil {
+		t.Error("CompareSequenceDictionaries 3 failed")
+	}
+}
+
+func TestParseBedGzipMagic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elprep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Two gzip members, as in BGZF files, in a file without .gz extension.
+	var buf bytes.Buffer
+	for _, content := range []string{"chr1\t0\t100\n", "chr1\t200\t300\n"} {
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filename := filepath.Join(dir, "compressed.bed")
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bed, err := ParseBed(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := bed.RegionMap[utils.Intern("chr1")]; len(regions) != 2 || regions[1].Start != 200 {
+		t.Error("ParseBed gzip magic failed")
+	}
+}
+
+func TestValidateBedFile(t *testing.T) {
+	lengths, err := ParseChromSizes("testdata/hg38.chrom.sizes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := ValidateBedFile("testdata/invalid.bed", lengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Lines != 7 || report.Regions != 5 {
+		t.Error("ValidateBedFile counts failed")
+	}
+	expected := []struct {
+		line int
+		kind string
+	}{
+		{3, MalformedLine},
+		{4, OverlappingRegion},
+		{5, NegativeLength.String()},
+		{6, UnknownChromosome.String()},
+		{7, BeyondChromosomeEnd.String()},
+	}
+	if len(report.Issues) != len(expected) {
+		t.Fatal("ValidateBedFile issues failed")
+	}
+	for i, issue := range report.Issues {
+		if issue.Line != expected[i].line || issue.Kind != expected[i].kind {
+			t.Error("ValidateBedFile issue failed:", issue)
+		}
+	}
+}
+
+func TestHeaderLines(t *testing.T) {
+	bed, err := ParseBedWithOptions("testdata/header.bed", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := bed.RegionMap[utils.Intern("chr1")]; len(regions) != 2 || len(bed.Tracks) != 1 {
+		t.Error("ParseBedWithOptions header lines failed")
+	}
+	report, err := ValidateBedFile("testdata/header.bed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Lines != 7 || report.Regions != 2 || len(report.Issues) != 0 {
+		t.Error("ValidateBedFile header lines failed")
+	}
+	index, err := ParseCompactRegionIndex("testdata/header.bed", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := index.OverlapQuery(utils.Intern("chr1"), 0, 1000); len(regions) != 2 || regions[1].Name() != "r2" {
+		t.Error("ParseCompactRegionIndex header lines failed")
+	}
+}
+
+func TestParseBigBed(t *testing.T) {
+	bed, err := ParseBigBed("testdata/small.bb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions := bed.RegionMap[utils.Intern("chr1")]
+	if len(regions) != 2 || regions[0].Start != 100 || regions[0].End != 200 || regions[0].Name() != "r1" || regions[1].Strand() != SR {
+		t.Error("ParseBigBed chr1 failed")
+	}
+	if score, _ := regions[0].Score(); score != 500 {
+		t.Error("ParseBigBed score failed")
+	}
+	if regions := bed.RegionMap[utils.Intern("chr2")]; len(regions) != 1 || regions[0].Name() != "r3" {
+		t.Error("ParseBigBed chr2 failed")
+	}
+	bed, err = ParseBigBedRange("testdata/small.bb", "chr1", 150, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bed.RegionMap) != 1 || len(bed.RegionMap[utils.Intern("chr1")]) != 1 {
+		t.Error("ParseBigBedRange failed")
+	}
+	if bed, err = ParseBigBedRange("testdata/small.bb", "chrX", 0, 100); err != nil || len(bed.RegionMap) != 0 {
+		t.Error("ParseBigBedRange unknown chromosome failed")
+	}
+	if _, err := ParseBigBed("testdata/crlf.bed"); err == nil {
+		t.Error("ParseBigBed magic failed")
+	}
+}
+
+func TestSelectTracks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elprep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tracks.bed")
+	input := "track name=capture description=\"exome capture\"\n" +
+		"chr1\t500\t600\n" +
+		"chr1\t100\t200\n" +
+		"track name=blacklist\n" +
+		"chr1\t150\t160\n"
+	if err := ioutil.WriteFile(filename, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bed, err := ParseBed(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := TrackRegionMap(bed.Tracks[0])[utils.Intern("chr1")]; len(regions) != 2 || regions[0].Start != 100 {
+		t.Error("TrackRegionMap failed")
+	}
+	capture, err := SelectTracks(bed, "^exome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(capture.Tracks) != 1 || len(capture.RegionMap[utils.Intern("chr1")]) != 2 {
+		t.Error("SelectTracks description failed")
+	}
+	blacklist, err := SelectTracks(bed, "^blacklist$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := blacklist.RegionMap[utils.Intern("chr1")]; len(regions) != 1 || regions[0].Start != 150 {
+		t.Error("SelectTracks name failed")
+	}
+}
+
+func TestLiftover(t *testing.T) {
+	lift, err := ParseChainFile(filepath.Join("testdata", "liftover.chain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chr1, chr2, chr3 := utils.Intern("chr1"), utils.Intern("chr2"), utils.Intern("chr3")
+	bed := NewBed()
+	AddRegion(bed, &Region{Chrom: chr1, Start: 150, End: 250, OptionalFields: []interface{}{"gap", 0, SF}})
+	AddRegion(bed, &Region{Chrom: chr1, Start: 120, End: 180})
+	AddRegion(bed, &Region{Chrom: chr1, Start: 200, End: 210})
+	AddRegion(bed, &Region{Chrom: chr2, Start: 10, End: 20, OptionalFields: []interface{}{"reverse", 0, SF}})
+	AddRegion(bed, &Region{Chrom: chr3, Start: 0, End: 10})
+	lifted, report := lift.Lift(bed, 0.8)
+	if regions := lifted.RegionMap[chr1]; len(regions) != 2 ||
+		regions[0].Start != 520 || regions[0].End != 580 ||
+		regions[1].Start != 550 || regions[1].End != 640 {
+		t.Error("Lift chr1 failed")
+	}
+	if regions := lifted.RegionMap[chr2]; len(regions) != 1 ||
+		regions[0].Start != 480 || regions[0].End != 490 || regions[0].Strand() != SR {
+		t.Error("Lift reverse strand failed")
+	}
+	if report.Regions != 5 || report.Lifted != 3 || len(report.Issues) != 3 ||
+		report.Issues[0].Kind != PartiallyDeletedInNew || !report.Issues[0].Lifted || report.Issues[0].Fraction != 0.9 ||
+		report.Issues[1].Kind != DeletedInNew || report.Issues[1].Region.Start != 200 ||
+		report.Issues[2].Kind != DeletedInNew || report.Issues[2].Region.Chrom != chr3 {
+		t.Error("Lift report failed")
+	}
+	if _, report = lift.Lift(bed, 0.95); report.Lifted != 2 || report.Issues[0].Lifted {
+		t.Error("Lift minMatch failed")
+	}
+}
+
+func TestParseCompactRegionIndex(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "compact.bed")
+	input := "track name=test\n" +
+		"chr1\t500\t600\tb\t0\t-\n" +
+		"chr2\t0\t10\n" +
+		"chr1\t100\t200\ta\t0\t+\n" +
+		"chr1\t150\t550\n"
+	if err := ioutil.WriteFile(filename, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	index, err := ParseCompactRegionIndex(filename, ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference, err := ParseBed(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chr1 := utils.Intern("chr1")
+	regions := index.OverlapQuery(chr1, 180, 520)
+	expected := NewRegionIndex(reference).OverlapQuery(chr1, 180, 520)
+	if len(regions) != 3 || len(expected) != 3 {
+		t.Fatal("ParseCompactRegionIndex OverlapQuery failed")
+	}
+	for i, region := range regions {
+		if region.Chrom != expected[i].Chrom || region.Start != expected[i].Start || region.End != expected[i].End ||
+			len(region.OptionalFields) != len(expected[i].OptionalFields) ||
+			(len(region.OptionalFields) > 0 && !reflect.DeepEqual(region.OptionalFields, expected[i].OptionalFields)) {
+			t.Error("ParseCompactRegionIndex decoding failed")
+		}
+	}
+	if minus := index.OverlapQueryStrand(chr1, 0, 1000, SR); len(minus) != 1 || minus[0].Name() != "b" {
+		t.Error("ParseCompactRegionIndex OverlapQueryStrand failed")
+	}
+	if !index.Overlaps(utils.Intern("chr2"), 5, 6) || index.Overlaps(chr1, 600, 700) {
+		t.Error("ParseCompactRegionIndex Overlaps failed")
+	}
+	if err := ioutil.WriteFile(filename, []byte("chr1\t0\t10\tname\tnoscore\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseCompactRegionIndex(filename, ParseOptions{}); err == nil {
+		t.Error("ParseCompactRegionIndex invalid fields failed")
+	}
+	if _, err := ParseCompactRegionIndex(filename, ParseOptions{CollapseOverlaps: true}); err == nil {
+		t.Error("ParseCompactRegionIndex CollapseOverlaps failed")
+	}
+}
@@ -0,0 +1,318 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// A RegionIndex supports efficient queries for the regions of a bed
+// that overlap with a given range. Per chromosome, the regions are
+// sorted by start position, and for each region the largest end
+// position of all regions up to and including it is recorded, so a
+// query only needs two binary searches to find the candidate regions,
+// plus a scan over the candidates.
+//
+// The start and end positions are stored in parallel slices. A
+// RegionIndex created by NewRegionIndex additionally refers to the
+// regions of the bed. A compact RegionIndex created by
+// ParseCompactRegionIndex instead stores the optional fields of the
+// regions in their textual form, and only decodes them into Region
+// values for the regions returned by a query. This avoids a pointer
+// and an OptionalFields slice per region, which matters for beds with
+// tens of millions of regions.
+type RegionIndex struct {
+	chroms map[utils.Symbol]*chromIndex
+}
+
+type chromIndex struct {
+	chrom        utils.Symbol
+	starts, ends []int32 // sorted by start position
+	// maxEnds[i] is the largest end of regions 0..i.
+	maxEnds []int32
+	// The regions, or nil if the index is compact.
+	regions []*Region
+	// In a compact index, the optional fields of region i are
+	// extras[offsets[i]:offsets[i+1]], separated by tabs.
+	extras  []byte
+	offsets []uint32
+}
+
+// Records the largest end positions of the regions.
+func (index *chromIndex) initMaxEnds() {
+	index.maxEnds = make([]int32, len(index.ends))
+	for i, end := range index.ends {
+		index.maxEnds[i] = end
+		if i > 0 && index.maxEnds[i-1] > end {
+			index.maxEnds[i] = index.maxEnds[i-1]
+		}
+	}
+}
+
+// NewRegionIndex creates a RegionIndex for the regions of a bed. The
+// bed itself is not modified, and later changes to the bed are not
+// reflected in the index.
+func NewRegionIndex(bed *Bed) *RegionIndex {
+	index := &RegionIndex{chroms: make(map[utils.Symbol]*chromIndex, len(bed.RegionMap))}
+	for chrom, regions := range bed.RegionMap {
+		sorted := sortedRegions(regions)
+		cindex := &chromIndex{
+			chrom:   chrom,
+			starts:  make([]int32, len(sorted)),
+			ends:    make([]int32, len(sorted)),
+			regions: sorted,
+		}
+		for i, region := range sorted {
+			cindex.starts[i] = region.Start
+			cindex.ends[i] = region.End
+		}
+		cindex.initMaxEnds()
+		index.chroms[chrom] = cindex
+	}
+	return index
+}
+
+// ParseCompactRegionIndex parses a BED file directly into a compact
+// RegionIndex, without creating a Bed. The same lines as in
+// ParseBedWithOptions are skipped, as well as track lines. The
+// optional fields of all regions are checked while parsing, so
+// queries never encounter invalid fields. The filename "/dev/stdin"
+// refers to standard input. CollapseOverlaps is not supported, and
+// results in an error.
+func ParseCompactRegionIndex(filename string, options ParseOptions) (index *RegionIndex, err error) {
+	if options.CollapseOverlaps {
+		return nil, fmt.Errorf("cannot collapse overlapping regions of %v in a compact region index", filename)
+	}
+	input, err := openInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := input.Close(); err == nil {
+			err = nerr
+		}
+	}()
+
+	index = &RegionIndex{chroms: make(map[utils.Symbol]*chromIndex)}
+	var current *chromIndex
+	zeroStart := false
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isSkippedLine(line) || isTrackLine(line) {
+			continue
+		}
+		data := strings.SplitN(line, "\t", 4)
+		if len(data) < 3 {
+			return nil, fmt.Errorf("invalid bed region: expected at least 3 columns, got %v ", len(data))
+		}
+		start, err := strconv.Atoi(data[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bed region start: %v ", err)
+		}
+		end, err := strconv.Atoi(data[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bed region end: %v ", err)
+		}
+		if start == 0 {
+			zeroStart = true
+		}
+		if current == nil || *current.chrom != data[0] {
+			chrom := utils.Intern(data[0])
+			if current = index.chroms[chrom]; current == nil {
+				current = &chromIndex{chrom: chrom, offsets: []uint32{0}}
+				index.chroms[chrom] = current
+			}
+		}
+		if len(data) == 4 {
+			fields := strings.Split(data[3], "\t")
+			if options.ColumnLayout == ScoreLayout {
+				fields = append([]string{""}, fields...)
+			}
+			if _, err := initializeRegionFields(fields); err != nil {
+				return nil, fmt.Errorf("invalid bed region: %v ", err)
+			}
+			current.extras = append(current.extras, strings.Join(fields, "\t")...)
+		}
+		current.starts = append(current.starts, int32(start))
+		current.ends = append(current.ends, int32(end))
+		current.offsets = append(current.offsets, uint32(len(current.extras)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading bed file: %v ", err)
+	}
+	if options.DetectOneBased && len(index.chroms) > 0 && !zeroStart {
+		log.Println("Warning: No region in", filename, "starts at position 0. The file may use 1-based instead of 0-based coordinates.")
+	}
+	for _, cindex := range index.chroms {
+		cindex.sort()
+		cindex.initMaxEnds()
+	}
+	return index, nil
+}
+
+// Sorts the regions of a compact index by start position.
+func (index *chromIndex) sort() {
+	n := len(index.starts)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return index.starts[order[i]] < index.starts[order[j]]
+	})
+	starts := make([]int32, n)
+	ends := make([]int32, n)
+	extras := make([]byte, 0, len(index.extras))
+	offsets := make([]uint32, 1, n+1)
+	for i, j := range order {
+		starts[i] = index.starts[j]
+		ends[i] = index.ends[j]
+		extras = append(extras, index.extras[index.offsets[j]:index.offsets[j+1]]...)
+		offsets = append(offsets, uint32(len(extras)))
+	}
+	index.starts, index.ends, index.extras, index.offsets = starts, ends, extras, offsets
+}
+
+// Returns region i, decoding it if the index is compact.
+func (index *chromIndex) region(i int) *Region {
+	if index.regions != nil {
+		return index.regions[i]
+	}
+	region := &Region{Chrom: index.chrom, Start: index.starts[i], End: index.ends[i]}
+	if extras := index.extras[index.offsets[i]:index.offsets[i+1]]; len(extras) > 0 {
+		// The fields were checked by ParseCompactRegionIndex.
+		region.OptionalFields, _ = initializeRegionFields(strings.Split(string(extras), "\t"))
+	}
+	return region
+}
+
+// Returns the range of regions that may overlap with the 0-based,
+// half-open range [start, end).
+func (index *chromIndex) candidates(start, end int32) (lo, hi int) {
+	hi = sort.Search(len(index.starts), func(i int) bool {
+		return index.starts[i] >= end
+	})
+	lo = sort.Search(hi, func(i int) bool {
+		return index.maxEnds[i] > start
+	})
+	return lo, hi
+}
+
+// OverlapQuery returns the regions on the given chromosome that
+// overlap with the 0-based, half-open range [start, end), sorted by
+// start position. For a compact index, the regions are decoded anew
+// for each query.
+func (index *RegionIndex) OverlapQuery(chrom utils.Symbol, start, end int32) (result []*Region) {
+	chromIndex, found := index.chroms[chrom]
+	if !found {
+		return nil
+	}
+	lo, hi := chromIndex.candidates(start, end)
+	for i := lo; i < hi; i++ {
+		if chromIndex.ends[i] > start {
+			result = append(result, chromIndex.region(i))
+		}
+	}
+	return result
+}
+
+// Overlaps determines whether any region on the given chromosome
+// overlaps with the 0-based, half-open range [start, end). Unlike
+// OverlapQuery, this does not allocate.
+func (index *RegionIndex) Overlaps(chrom utils.Symbol, start, end int32) bool {
+	chromIndex, found := index.chroms[chrom]
+	if !found {
+		return false
+	}
+	lo, hi := chromIndex.candidates(start, end)
+	for i := lo; i < hi; i++ {
+		if chromIndex.ends[i] > start {
+			return true
+		}
+	}
+	return false
+}
+
+// OverlapQueryStrand is like OverlapQuery, but only returns regions on
+// the given strand, which is either SF or SR, for example for
+// strand-specific RNA-seq data. Regions without a strand are not
+// returned.
+func (index *RegionIndex) OverlapQueryStrand(chrom utils.Symbol, start, end int32, strand utils.Symbol) (result []*Region) {
+	chromIndex, found := index.chroms[chrom]
+	if !found {
+		return nil
+	}
+	lo, hi := chromIndex.candidates(start, end)
+	for i := lo; i < hi; i++ {
+		if chromIndex.ends[i] > start {
+			if region := chromIndex.region(i); region.Strand() == strand {
+				result = append(result, region)
+			}
+		}
+	}
+	return result
+}
+
+// NearestQuery returns a region on the given chromosome that is
+// nearest to the 0-based, half-open range [start, end), provided at
+// most maxDistance bases lie between them, or nil otherwise. If any
+// region overlaps with the range, the overlapping region with the
+// smallest start position is returned. Of two regions at the same
+// distance, the one to the left of the range is returned.
+func (index *RegionIndex) NearestQuery(chrom utils.Symbol, start, end, maxDistance int32) *Region {
+	chromIndex, found := index.chroms[chrom]
+	if !found {
+		return nil
+	}
+	lo, hi := chromIndex.candidates(start, end)
+	for i := lo; i < hi; i++ {
+		if chromIndex.ends[i] > start {
+			return chromIndex.region(i)
+		}
+	}
+	// No region overlaps, so all regions before hi end at or before
+	// start, and the one ending last is the nearest on the left.
+	nearest, distance := -1, maxDistance+1
+	if hi > 0 {
+		maxEnd := chromIndex.maxEnds[hi-1]
+		if d := start - maxEnd; d < distance {
+			nearest = sort.Search(hi, func(i int) bool {
+				return chromIndex.maxEnds[i] >= maxEnd
+			})
+			distance = d
+		}
+	}
+	if hi < len(chromIndex.starts) {
+		if d := chromIndex.starts[hi] - end; d < distance {
+			nearest = hi
+		}
+	}
+	if nearest < 0 {
+		return nil
+	}
+	return chromIndex.region(nearest)
+}
@@ -0,0 +1,1115 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// Determines whether chrom1 comes before chrom2 in the natural order
+// of chromosome names, where runs of digits are compared by their
+// numeric value, so that chr2 comes before chr10. Names that only
+// differ in leading zeros are ordered byte by byte.
+func chromLess(chrom1, chrom2 utils.Symbol) bool {
+	if c := sam.NaturalCompare(*chrom1, *chrom2); c != 0 {
+		return c < 0
+	}
+	return *chrom1 < *chrom2
+}
+
+// Returns the chromosomes of a bed in natural order, see chromLess.
+func sortedChroms(bed *Bed) []utils.Symbol {
+	chroms := make([]utils.Symbol, 0, len(bed.RegionMap))
+	for chrom := range bed.RegionMap {
+		chroms = append(chroms, chrom)
+	}
+	sort.Slice(chroms, func(i, j int) bool {
+		return chromLess(chroms[i], chroms[j])
+	})
+	return chroms
+}
+
+// Returns a copy of the given regions, sorted by start position, and
+// by end position for equal starts.
+func sortedRegions(regions []*Region) []*Region {
+	result := append([]*Region(nil), regions...)
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Start != result[j].Start {
+			return result[i].Start < result[j].Start
+		}
+		return result[i].End < result[j].End
+	})
+	return result
+}
+
+// Returns the number of bases shared by two regions on the same
+// chromosome, or a value <= 0 if they do not overlap.
+func overlapLength(r1, r2 *Region) int32 {
+	start, end := r1.Start, r1.End
+	if r2.Start > start {
+		start = r2.Start
+	}
+	if r2.End < end {
+		end = r2.End
+	}
+	return end - start
+}
+
+// An IntersectPair records an overlap between a region of a first
+// Bed and a region of a second Bed.
+type IntersectPair struct {
+	A, B *Region
+	// The number of bases shared by A and B.
+	Overlap int32
+}
+
+// IntersectReport reports each pair of overlapping regions from a
+// and b, together with the number of overlapping bases, similar to
+// bedtools intersect -wo. Regions of a that overlap with several
+// regions of b are reported once for each of them.
+//
+// If leftOuterJoin is true, regions of a that do not overlap with any
+// region of b are reported as well, with a nil B and an Overlap of 0,
+// similar to bedtools intersect -loj. Otherwise they are omitted.
+//
+// Pairs are reported per chromosome, ordered by the start positions
+// of the regions of a and then of b.
+func IntersectReport(a, b *Bed, leftOuterJoin bool) (pairs []IntersectPair) {
+	for _, chrom := range sortedChroms(a) {
+		pairs = intersectChrom(a.RegionMap[chrom], b.RegionMap[chrom], leftOuterJoin, pairs)
+	}
+	return pairs
+}
+
+// Appends the IntersectPairs of the given regions of the same
+// chromosome to pairs, as described for IntersectReport.
+func intersectChrom(aUnsorted, bUnsorted []*Region, leftOuterJoin bool, pairs []IntersectPair) []IntersectPair {
+	aRegions := sortedRegions(aUnsorted)
+	bRegions := sortedRegions(bUnsorted)
+	var active []*Region
+	j := 0
+	for _, aRegion := range aRegions {
+		// Regions of b that end before aRegion starts cannot overlap
+		// with any of the remaining regions of a.
+		k := 0
+		for _, bRegion := range active {
+			if bRegion.End > aRegion.Start {
+				active[k] = bRegion
+				k++
+			}
+		}
+		active = active[:k]
+		for ; j < len(bRegions) && bRegions[j].Start < aRegion.End; j++ {
+			if bRegions[j].End > aRegion.Start {
+				active = append(active, bRegions[j])
+			}
+		}
+		found := false
+		for _, bRegion := range active {
+			if overlap := overlapLength(aRegion, bRegion); overlap > 0 {
+				pairs = append(pairs, IntersectPair{A: aRegion, B: bRegion, Overlap: overlap})
+				found = true
+			}
+		}
+		if !found && leftOuterJoin {
+			pairs = append(pairs, IntersectPair{A: aRegion})
+		}
+	}
+	return pairs
+}
+
+// Returns the region covered by both a region of a and a region of b
+// that overlap. The resulting region shares the optional fields of
+// the region of a.
+func overlapRegion(a, b *Region) *Region {
+	start, end := a.Start, a.End
+	if b.Start > start {
+		start = b.Start
+	}
+	if b.End < end {
+		end = b.End
+	}
+	return &Region{Chrom: a.Chrom, Start: start, End: end, OptionalFields: a.OptionalFields}
+}
+
+// Returns the regions covered by both regions of each pair.
+func overlapRegions(pairs []IntersectPair) []*Region {
+	regions := make([]*Region, len(pairs))
+	for i, pair := range pairs {
+		regions[i] = overlapRegion(pair.A, pair.B)
+	}
+	return regions
+}
+
+// Intersect returns a new, sorted Bed with the stretches that are
+// covered by both a region of a and a region of b, similar to
+// bedtools intersect. A region of a that overlaps with several
+// regions of b results in several regions. The resulting regions
+// share the optional fields of the regions of a.
+func Intersect(a, b *Bed) *Bed {
+	return Collect(IntersectStream(Stream(a), Stream(b)))
+}
+
+// ScopedIntersect is like Intersect, but only considers the given
+// chromosomes and skips all others, which avoids selecting the
+// chromosomes of a and b first.
+func ScopedIntersect(a, b *Bed, chroms []utils.Symbol) *Bed {
+	result := NewBed()
+	for _, chrom := range chroms {
+		aRegions, bRegions := a.RegionMap[chrom], b.RegionMap[chrom]
+		if len(aRegions) == 0 || len(bRegions) == 0 {
+			continue
+		}
+		if pairs := intersectChrom(aRegions, bRegions, false, nil); len(pairs) > 0 {
+			result.RegionMap[chrom] = overlapRegions(pairs)
+		}
+	}
+	sortRegions(result)
+	return result
+}
+
+// A RegionRelation describes how two regions are positioned relative
+// to each other.
+type RegionRelation int
+
+// Possible relations between two regions a and b, as reported by
+// Relationship.
+const (
+	// a and b do not overlap and do not touch, or are on different
+	// chromosomes.
+	Disjoint RegionRelation = iota
+	// a and b have the same start and end positions.
+	Equal
+	// a contains b, but they are not equal.
+	AContainsB
+	// b contains a, but they are not equal.
+	BContainsA
+	// a overlaps the left end of b.
+	OverlapLeft
+	// a overlaps the right end of b.
+	OverlapRight
+	// a ends where b starts, or b ends where a starts.
+	Adjacent
+)
+
+func (relation RegionRelation) String() string {
+	switch relation {
+	case Disjoint:
+		return "Disjoint"
+	case Equal:
+		return "Equal"
+	case AContainsB:
+		return "AContainsB"
+	case BContainsA:
+		return "BContainsA"
+	case OverlapLeft:
+		return "OverlapLeft"
+	case OverlapRight:
+		return "OverlapRight"
+	case Adjacent:
+		return "Adjacent"
+	default:
+		return fmt.Sprintf("RegionRelation(%d)", int(relation))
+	}
+}
+
+// Relationship determines the relation between two regions.
+func Relationship(a, b *Region) RegionRelation {
+	switch {
+	case a.Chrom != b.Chrom:
+		return Disjoint
+	case a.Start == b.Start && a.End == b.End:
+		return Equal
+	case a.End == b.Start || b.End == a.Start:
+		return Adjacent
+	case a.End < b.Start || b.End < a.Start:
+		return Disjoint
+	case a.Start <= b.Start && b.End <= a.End:
+		return AContainsB
+	case b.Start <= a.Start && a.End <= b.End:
+		return BContainsA
+	case a.Start < b.Start:
+		return OverlapLeft
+	default:
+		return OverlapRight
+	}
+}
+
+// Returns all regions of a bed, ordered by chromosome name and start
+// position.
+func allSortedRegions(bed *Bed) (regions []*Region) {
+	for _, chrom := range sortedChroms(bed) {
+		regions = append(regions, sortedRegions(bed.RegionMap[chrom])...)
+	}
+	return regions
+}
+
+// Returns the number of bases a region covers.
+func regionLength(region *Region) int64 {
+	return int64(region.End - region.Start)
+}
+
+// SplitByBases divides the regions of a bed into at most nrOfShards
+// shards of consecutive regions, such that each shard covers roughly
+// the same number of bases. Regions are never split, and each region
+// is assigned to exactly one shard. Bases covered by overlapping
+// regions are counted once per region.
+func SplitByBases(bed *Bed, nrOfShards int) (shards []*Bed) {
+	if nrOfShards < 1 {
+		nrOfShards = 1
+	}
+	regions := allSortedRegions(bed)
+	var total int64
+	for _, region := range regions {
+		total += regionLength(region)
+	}
+	var shard *Bed
+	var covered int64
+	for _, region := range regions {
+		length := regionLength(region)
+		// Start a new shard when the middle of the region lies beyond
+		// the share of the current shard.
+		if shard == nil || (len(shards) < nrOfShards &&
+			(covered+length/2)*int64(nrOfShards) > total*int64(len(shards))) {
+			shard = NewBed()
+			shards = append(shards, shard)
+		}
+		AddRegion(shard, region)
+		covered += length
+	}
+	return shards
+}
+
+// SplitBySize divides the regions of a bed into shards of consecutive
+// regions, such that each shard covers at most shardSize bases.
+// Regions are never split, and each region is assigned to exactly one
+// shard, so a region that is larger than shardSize forms a shard on
+// its own.
+func SplitBySize(bed *Bed, shardSize int64) (shards []*Bed) {
+	var shard *Bed
+	var covered int64
+	for _, region := range allSortedRegions(bed) {
+		length := regionLength(region)
+		if shard == nil || covered+length > shardSize {
+			shard = NewBed()
+			shards = append(shards, shard)
+			covered = 0
+		}
+		AddRegion(shard, region)
+		covered += length
+	}
+	return shards
+}
+
+// CoveredBases returns the number of bases covered by the regions of
+// a bed. Bases covered by overlapping regions are counted once per
+// region.
+func CoveredBases(bed *Bed) (total int64) {
+	for _, regions := range bed.RegionMap {
+		for _, region := range regions {
+			total += regionLength(region)
+		}
+	}
+	return total
+}
+
+// Merge combines overlapping and adjacent regions of a bed into
+// single regions, and returns the result as a new, sorted Bed. Tracks
+// are not preserved.
+//
+// A merged region keeps the strand if all regions it was merged from
+// have the same strand, in which case its name is "." and its score
+// is 0. Otherwise the merged region has no optional fields.
+func Merge(bed *Bed) *Bed {
+	return Collect(MergeStream(Stream(bed)))
+}
+
+// CollapseStats reports how many regions Collapse combined.
+type CollapseStats struct {
+	// The number of regions before and after collapsing.
+	Regions, Collapsed int
+	// The number of regions with the same chromosome, start, and end
+	// position as an earlier region.
+	Duplicates int
+}
+
+// Merged returns the number of regions that were combined with other
+// regions.
+func (stats CollapseStats) Merged() int {
+	return stats.Regions - stats.Collapsed
+}
+
+// Collapse removes duplicate regions from a bed, and combines
+// overlapping regions into single regions, and returns the result as
+// a new, sorted Bed. Unlike Merge, adjacent regions that do not
+// overlap are not combined. Tracks are not preserved.
+//
+// A collapsed region keeps the strand if all regions it was combined
+// from have the same strand. If unionNames is true, the name of a
+// collapsed region lists the distinct names of the regions it was
+// combined from, separated by commas, in order of their start
+// positions. Otherwise, or if none of the regions has a name, its
+// name is ".", or it has no optional fields if it also has no strand.
+func Collapse(bed *Bed, unionNames bool) (*Bed, CollapseStats) {
+	result := NewBed()
+	var stats CollapseStats
+	in := Stream(bed)
+	region := in.Next()
+	for region != nil {
+		collapsed := &Region{Chrom: region.Chrom, Start: region.Start, End: region.End}
+		strand := region.Strand()
+		var names []string
+		seen := make(map[string]bool)
+		addName := func(name string) {
+			if unionNames && name != "" && name != "." && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		addName(region.Name())
+		ranges := map[[2]int32]bool{{region.Start, region.End}: true}
+		stats.Regions++
+		for region = in.Next(); region != nil && region.Chrom == collapsed.Chrom && region.Start < collapsed.End; region = in.Next() {
+			stats.Regions++
+			if key := [2]int32{region.Start, region.End}; ranges[key] {
+				stats.Duplicates++
+			} else {
+				ranges[key] = true
+			}
+			if region.End > collapsed.End {
+				collapsed.End = region.End
+			}
+			if region.Strand() != strand {
+				strand = nil
+			}
+			addName(region.Name())
+		}
+		name := "."
+		if len(names) > 0 {
+			name = strings.Join(names, ",")
+		}
+		if strand != nil {
+			collapsed.OptionalFields = []interface{}{name, 0, strand}
+		} else if name != "." {
+			collapsed.OptionalFields = []interface{}{name}
+		}
+		AddRegion(result, collapsed)
+		stats.Collapsed++
+	}
+	return result, stats
+}
+
+// A Reference provides access to reference sequences by contig name,
+// like fasta.MappedFasta and fasta.ConcurrentFasta.
+type Reference interface {
+	Seq(contig string) []byte
+}
+
+// EffectiveTargetSize computes the number of bases covered by the
+// regions of a bed, counting bases covered by overlapping regions
+// only once. It returns both this raw size, and the effective size
+// that excludes bases that are N in the reference, or that lie
+// outside of the reference sequence.
+func EffectiveTargetSize(bed *Bed, ref Reference) (raw, effective int64) {
+	merged := Merge(bed)
+	for _, chrom := range sortedChroms(merged) {
+		seq := ref.Seq(*chrom)
+		for _, region := range merged.RegionMap[chrom] {
+			raw += regionLength(region)
+			end := region.End
+			if end > int32(len(seq)) {
+				end = int32(len(seq))
+			}
+			for pos := region.Start; pos < end; pos++ {
+				if base := seq[pos]; base != 'N' && base != 'n' {
+					effective++
+				}
+			}
+		}
+	}
+	return raw, effective
+}
+
+// FilterByNameRegex returns a new Bed with only those regions of the
+// given bed whose name matches the given regular expression. Regions
+// without a name are never included. Returns an error if the pattern
+// cannot be compiled. Tracks are not preserved.
+func FilterByNameRegex(bed *Bed, pattern string) (*Bed, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	result := NewBed()
+	for chrom, regions := range bed.RegionMap {
+		var filtered []*Region
+		for _, region := range regions {
+			if name := region.Name(); name != "" && re.MatchString(name) {
+				filtered = append(filtered, region)
+			}
+		}
+		if len(filtered) > 0 {
+			result.RegionMap[chrom] = filtered
+		}
+	}
+	return result, nil
+}
+
+// SelectTracks returns a new Bed with only the tracks of the given
+// bed whose name or description matches the given regular
+// expression, and only the regions of those tracks, so that for
+// example the capture track of a multi-track BED file can be used as
+// targets without its blacklist track. Regions that do not belong to
+// any track are never included. Returns an error if the pattern
+// cannot be compiled. The regions of the resulting Bed are sorted.
+func SelectTracks(bed *Bed, pattern string) (*Bed, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	result := NewBed()
+	for _, track := range bed.Tracks {
+		if re.MatchString(track.Fields["name"]) || re.MatchString(track.Fields["description"]) {
+			result.Tracks = append(result.Tracks, track)
+			for _, region := range track.Regions {
+				AddRegion(result, region)
+			}
+		}
+	}
+	sortRegions(result)
+	return result, nil
+}
+
+// AssignIDs numbers the regions of a bed in the natural order of
+// chromosome names (chr2 before chr10), then by start position, and
+// by end position for equal starts, and sets the name of each unnamed region to an
+// ID of the form prefix_000001 based on that number. If force is
+// true, existing names are overwritten as well. The IDs only depend
+// on the regions in the bed, so they are reproducible across runs.
+func AssignIDs(bed *Bed, prefix string, force bool) {
+	for i, region := range allSortedRegions(bed) {
+		if !force && region.Name() != "" {
+			continue
+		}
+		id := fmt.Sprintf("%v_%06d", prefix, i+1)
+		if len(region.OptionalFields) > brName {
+			region.OptionalFields[brName] = id
+		} else {
+			region.OptionalFields = []interface{}{id}
+		}
+	}
+}
+
+// A depthSegment is a maximal stretch of a chromosome that is covered
+// by the same number of regions.
+type depthSegment struct {
+	Start, End int32
+	Depth      int
+}
+
+// Decomposes the given regions into disjoint segments, each annotated
+// with the number of regions that cover it. Uncovered stretches are
+// omitted. The result is sorted by start position.
+func depthSegments(regions []*Region) (segments []depthSegment) {
+	type event struct {
+		pos   int32
+		delta int
+	}
+	events := make([]event, 0, 2*len(regions))
+	for _, region := range regions {
+		events = append(events, event{region.Start, 1}, event{region.End, -1})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].pos < events[j].pos
+	})
+	depth := 0
+	for i := 0; i < len(events); {
+		pos := events[i].pos
+		for ; i < len(events) && events[i].pos == pos; i++ {
+			depth += events[i].delta
+		}
+		if depth > 0 && i < len(events) {
+			segments = append(segments, depthSegment{Start: pos, End: events[i].pos, Depth: depth})
+		}
+	}
+	return segments
+}
+
+// CoalesceByDepth returns a new, sorted Bed with the stretches of the
+// given bed that are covered by at least minCount regions, for
+// example to determine the consensus of several replicates. Adjacent
+// stretches are combined, so a minCount of 1 yields the union of all
+// regions. The resulting regions have no optional fields.
+func CoalesceByDepth(bed *Bed, minCount int) *Bed {
+	result := NewBed()
+	for chrom, regions := range bed.RegionMap {
+		var coalesced []*Region
+		for _, segment := range depthSegments(regions) {
+			if segment.Depth < minCount {
+				continue
+			}
+			if n := len(coalesced); n > 0 && coalesced[n-1].End == segment.Start {
+				coalesced[n-1].End = segment.End
+				continue
+			}
+			coalesced = append(coalesced, &Region{Chrom: chrom, Start: segment.Start, End: segment.End})
+		}
+		if len(coalesced) > 0 {
+			result.RegionMap[chrom] = coalesced
+		}
+	}
+	return result
+}
+
+// SplitIntoN returns a new, sorted Bed in which each region of the
+// given bed is divided into n contiguous sub-regions of equal width,
+// where the last sub-region absorbs any remainder. Regions that are
+// shorter than n bases are divided into sub-regions of 1 base each,
+// and therefore result in fewer than n sub-regions. Each sub-region
+// is named after its region, followed by an underscore and its
+// 1-based bin index. Returns an error if n is not positive.
+func SplitIntoN(bed *Bed, n int) (*Bed, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of sub-regions %v, must be positive", n)
+	}
+	result := NewBed()
+	for _, region := range allSortedRegions(bed) {
+		length := region.End - region.Start
+		bins := int32(n)
+		if length < bins {
+			bins = length
+		}
+		if bins == 0 {
+			continue
+		}
+		width := length / bins
+		name := region.Name()
+		for i := int32(0); i < bins; i++ {
+			start := region.Start + i*width
+			end := start + width
+			if i == bins-1 {
+				end = region.End
+			}
+			binName := strconv.Itoa(int(i + 1))
+			if name != "" {
+				binName = name + "_" + binName
+			}
+			AddRegion(result, &Region{
+				Chrom:          region.Chrom,
+				Start:          start,
+				End:            end,
+				OptionalFields: []interface{}{binName},
+			})
+		}
+	}
+	return result, nil
+}
+
+// FilterByNeighborDensity returns a new, sorted Bed with only those
+// regions of the given bed that have at least minNeighbors other
+// regions on the same chromosome within window bases, that is,
+// regions that overlap with it or that are separated from it by a gap
+// of at most window bases. Regions near the ends of a chromosome are
+// treated the same as other regions. Tracks are not preserved.
+func FilterByNeighborDensity(bed *Bed, window, minNeighbors int32) *Bed {
+	result := NewBed()
+	for chrom, index := range NewRegionIndex(bed).chroms {
+		regions, maxEnds := index.regions, index.maxEnds
+		var filtered []*Region
+		for i, region := range regions {
+			var neighbors int32
+			for j := i - 1; j >= 0 && maxEnds[j] >= region.Start-window && neighbors < minNeighbors; j-- {
+				if regions[j].End >= region.Start-window {
+					neighbors++
+				}
+			}
+			for j := i + 1; j < len(regions) && regions[j].Start <= region.End+window && neighbors < minNeighbors; j++ {
+				neighbors++
+			}
+			if neighbors >= minNeighbors {
+				filtered = append(filtered, region)
+			}
+		}
+		if len(filtered) > 0 {
+			result.RegionMap[chrom] = filtered
+		}
+	}
+	return result
+}
+
+// RotateRegions returns a new, sorted Bed in which the regions of
+// each chromosome are shifted by the same random offset, wrapping
+// around at the end of the chromosome. Regions that wrap around are
+// split in two parts at the chromosome end. Unlike a free shuffle,
+// which places each region independently, this preserves the region
+// lengths as well as the gaps between regions (treating each
+// chromosome as circular), which gives a more conservative null
+// model for enrichment tests.
+//
+// The offsets are determined by the seed, so the same seed always
+// gives the same result. The lengths map must contain a length for
+// each chromosome of the bed, and regions must not extend beyond
+// that length. Optional fields are shared with the original regions.
+func RotateRegions(bed *Bed, lengths map[utils.Symbol]int32, seed int64) (*Bed, error) {
+	rnd := rand.New(rand.NewSource(seed))
+	result := NewBed()
+	for _, chrom := range sortedChroms(bed) {
+		length, found := lengths[chrom]
+		if !found || length <= 0 {
+			return nil, fmt.Errorf("no valid length for chromosome %v", *chrom)
+		}
+		offset := rnd.Int31n(length)
+		for _, region := range sortedRegions(bed.RegionMap[chrom]) {
+			if region.Start < 0 || region.End > length {
+				return nil, fmt.Errorf("bed region %v:%v-%v extends beyond chromosome length %v", *chrom, region.Start, region.End, length)
+			}
+			start := (region.Start + offset) % length
+			end := start + region.End - region.Start
+			if end <= length {
+				AddRegion(result, &Region{Chrom: chrom, Start: start, End: end, OptionalFields: region.OptionalFields})
+				continue
+			}
+			AddRegion(result, &Region{Chrom: chrom, Start: start, End: length, OptionalFields: region.OptionalFields})
+			AddRegion(result, &Region{Chrom: chrom, Start: 0, End: end - length, OptionalFields: region.OptionalFields})
+		}
+	}
+	sortRegions(result)
+	return result, nil
+}
+
+// A RegionClass labels a region according to whether it overlaps with
+// any region of an annotation.
+type RegionClass struct {
+	Region *Region
+	// True if the region overlaps with at least one annotation region.
+	Genic bool
+	// The name of the annotation region with the largest overlap, or
+	// the empty string if there is none or if it has no name.
+	Annotation string
+}
+
+// ClassifyAgainst labels each region of query as genic if it overlaps
+// with any region of annotation, or as intergenic otherwise. If a
+// region overlaps with several annotation regions, the name of the
+// one with the largest overlap is reported, and the leftmost one in
+// case of ties. Results are ordered by chromosome name and start
+// position of the query regions.
+func ClassifyAgainst(query, annotation *Bed) (classes []RegionClass) {
+	var best IntersectPair
+	for _, pair := range IntersectReport(query, annotation, true) {
+		if best.A == pair.A {
+			if pair.Overlap > best.Overlap {
+				best = pair
+			}
+			continue
+		}
+		if best.A != nil {
+			classes = append(classes, regionClass(best))
+		}
+		best = pair
+	}
+	if best.A != nil {
+		classes = append(classes, regionClass(best))
+	}
+	return classes
+}
+
+func regionClass(pair IntersectPair) RegionClass {
+	if pair.B == nil {
+		return RegionClass{Region: pair.A}
+	}
+	return RegionClass{Region: pair.A, Genic: true, Annotation: pair.B.Name()}
+}
+
+// WeightedBaseCount sums the lengths of the regions of a bed, each
+// multiplied by the score of the region. Overlapping regions are not
+// merged, since scores belong to individual regions, so bases covered
+// by several regions contribute once for each of them. Regions
+// without a score are weighted by 1 if missingScoreIsOne is true, and
+// by 0 otherwise.
+func WeightedBaseCount(bed *Bed, missingScoreIsOne bool) (total float64) {
+	for _, regions := range bed.RegionMap {
+		for _, region := range regions {
+			var score float64
+			if n, ok := region.Score(); ok {
+				score = float64(n)
+			} else if missingScoreIsOne {
+				score = 1
+			}
+			total += float64(regionLength(region)) * score
+		}
+	}
+	return total
+}
+
+// Returns the position of the given sorted positions that is nearest
+// to pos, if it is at most maxDistance away. Otherwise, returns pos.
+func snap(positions []int32, pos, maxDistance int32) int32 {
+	i := sort.Search(len(positions), func(i int) bool {
+		return positions[i] >= pos
+	})
+	nearest, distance := pos, maxDistance+1
+	if i < len(positions) && positions[i]-pos < distance {
+		nearest, distance = positions[i], positions[i]-pos
+	}
+	if i > 0 && pos-positions[i-1] < distance {
+		nearest = positions[i-1]
+	}
+	return nearest
+}
+
+// SnapToFeatures returns a new, sorted Bed in which the start of each
+// query region is moved to the nearest start of a feature region, and
+// the end of each query region to the nearest end of a feature
+// region, on the same chromosome. Boundaries are only moved if the
+// nearest feature boundary is at most maxSnap bases away, and if the
+// snapped region is not empty. Optional fields are shared with the
+// original regions.
+func SnapToFeatures(query, features *Bed, maxSnap int32) *Bed {
+	result := NewBed()
+	for chrom, regions := range query.RegionMap {
+		var starts, ends []int32
+		for _, feature := range features.RegionMap[chrom] {
+			starts = append(starts, feature.Start)
+			ends = append(ends, feature.End)
+		}
+		sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+		sort.Slice(ends, func(i, j int) bool { return ends[i] < ends[j] })
+		for _, region := range regions {
+			start := snap(starts, region.Start, maxSnap)
+			end := snap(ends, region.End, maxSnap)
+			if start >= end {
+				start, end = region.Start, region.End
+			}
+			AddRegion(result, &Region{Chrom: chrom, Start: start, End: end, OptionalFields: region.OptionalFields})
+		}
+	}
+	sortRegions(result)
+	return result
+}
+
+// MergeBeds combines the regions of several beds, and merges
+// overlapping and adjacent regions as in Merge.
+func MergeBeds(beds []*Bed) *Bed {
+	combined := NewBed()
+	for _, bed := range beds {
+		for chrom, regions := range bed.RegionMap {
+			combined.RegionMap[chrom] = append(combined.RegionMap[chrom], regions...)
+		}
+	}
+	return Merge(combined)
+}
+
+// A SourcedRegion is a merged region together with the labels of the
+// beds that contributed to it.
+type SourcedRegion struct {
+	Region *Region
+	// Labels of the contributing beds, in input order.
+	Sources []string
+}
+
+// MergeBedsWithSources merges the regions of several beds like
+// MergeBeds, and reports for each merged region which of the beds
+// contributed to it. The labels identify the beds, in the same order.
+// The merged regions have no optional fields, and are ordered by
+// chromosome name and start position.
+func MergeBedsWithSources(beds []*Bed, labels []string) ([]SourcedRegion, error) {
+	if len(beds) != len(labels) {
+		return nil, fmt.Errorf("number of labels %v does not match number of beds %v", len(labels), len(beds))
+	}
+	type sourced struct {
+		region *Region
+		source int
+	}
+	perChrom := make(map[utils.Symbol][]sourced)
+	for source, bed := range beds {
+		for chrom, regions := range bed.RegionMap {
+			for _, region := range regions {
+				perChrom[chrom] = append(perChrom[chrom], sourced{region, source})
+			}
+		}
+	}
+	chroms := make([]utils.Symbol, 0, len(perChrom))
+	for chrom := range perChrom {
+		chroms = append(chroms, chrom)
+	}
+	sort.Slice(chroms, func(i, j int) bool { return *chroms[i] < *chroms[j] })
+	var result []SourcedRegion
+	for _, chrom := range chroms {
+		entries := perChrom[chrom]
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].region.Start < entries[j].region.Start
+		})
+		var contributed []bool
+		flush := func() {
+			n := len(result) - 1
+			for source, ok := range contributed {
+				if ok {
+					result[n].Sources = append(result[n].Sources, labels[source])
+				}
+			}
+		}
+		for _, entry := range entries {
+			if n := len(result); contributed != nil && entry.region.Start <= result[n-1].Region.End {
+				if entry.region.End > result[n-1].Region.End {
+					result[n-1].Region.End = entry.region.End
+				}
+				contributed[entry.source] = true
+				continue
+			}
+			if contributed != nil {
+				flush()
+			}
+			result = append(result, SourcedRegion{Region: &Region{Chrom: chrom, Start: entry.region.Start, End: entry.region.End}})
+			contributed = make([]bool, len(beds))
+			contributed[entry.source] = true
+		}
+		if contributed != nil {
+			flush()
+		}
+	}
+	return result, nil
+}
+
+// A TSSAnnotation records the transcription start site nearest to a
+// region.
+type TSSAnnotation struct {
+	Region *Region
+	// False if there is no gene on the chromosome of the region, in
+	// which case Gene and Distance are not set.
+	Found bool
+	// The name of the gene whose TSS is nearest to the region.
+	Gene string
+	// The signed distance from the TSS to the nearest base of the
+	// region, relative to the orientation of the gene: positive if the
+	// region lies downstream of the TSS, negative if it lies upstream,
+	// and 0 if the region contains the TSS.
+	Distance int32
+}
+
+type tss struct {
+	pos     int32
+	reverse bool
+	gene    string
+}
+
+// AnnotateTSSDistance annotates each query region with the nearest
+// transcription start site (TSS) of the given genes. The TSS of a
+// gene on the forward strand, or without a strand, is its first base
+// at Start. The TSS of a gene on the reverse strand is its last base,
+// at End-1, since End is exclusive. If several TSSs are equally near,
+// the leftmost one is chosen. Results are ordered by chromosome name
+// and start position of the query regions.
+func AnnotateTSSDistance(query, genes *Bed) (annotations []TSSAnnotation) {
+	sites := make(map[utils.Symbol][]tss)
+	for chrom, regions := range genes.RegionMap {
+		for _, gene := range regions {
+			site := tss{pos: gene.Start, gene: gene.Name()}
+			if gene.Strand() == SR {
+				site.pos, site.reverse = gene.End-1, true
+			}
+			sites[chrom] = append(sites[chrom], site)
+		}
+	}
+	for _, chromSites := range sites {
+		sort.SliceStable(chromSites, func(i, j int) bool {
+			return chromSites[i].pos < chromSites[j].pos
+		})
+	}
+	for _, region := range allSortedRegions(query) {
+		chromSites := sites[region.Chrom]
+		if len(chromSites) == 0 {
+			annotations = append(annotations, TSSAnnotation{Region: region})
+			continue
+		}
+		i := sort.Search(len(chromSites), func(i int) bool {
+			return chromSites[i].pos >= region.Start
+		})
+		var site tss
+		var offset int32
+		switch {
+		case i < len(chromSites) && chromSites[i].pos < region.End:
+			site = chromSites[i]
+		case i == len(chromSites) || (i > 0 && region.Start-chromSites[i-1].pos <= chromSites[i].pos-(region.End-1)):
+			site = chromSites[i-1]
+			offset = region.Start - site.pos
+		default:
+			site = chromSites[i]
+			offset = region.End - 1 - site.pos
+		}
+		if site.reverse {
+			offset = -offset
+		}
+		annotations = append(annotations, TSSAnnotation{Region: region, Found: true, Gene: site.gene, Distance: offset})
+	}
+	return annotations
+}
+
+// MergeCapped merges overlapping and adjacent regions of a bed like
+// Merge, but splits each merged region into consecutive pieces of
+// maxLen bases, where the last piece may be shorter, so that no
+// resulting region is longer than maxLen. The pieces tile the merged
+// region without gaps or overlaps. The resulting regions have no
+// optional fields. Returns an error if maxLen is not positive.
+func MergeCapped(bed *Bed, maxLen int32) (*Bed, error) {
+	if maxLen <= 0 {
+		return nil, fmt.Errorf("invalid maximum region length %v, must be positive", maxLen)
+	}
+	result := NewBed()
+	for _, chrom := range sortedChroms(bed) {
+		var capped []*Region
+		var start, end int32
+		open := false
+		flush := func() {
+			for ; end-start > maxLen; start += maxLen {
+				capped = append(capped, &Region{Chrom: chrom, Start: start, End: start + maxLen})
+			}
+			capped = append(capped, &Region{Chrom: chrom, Start: start, End: end})
+		}
+		for _, region := range sortedRegions(bed.RegionMap[chrom]) {
+			if open && region.Start <= end {
+				if region.End > end {
+					end = region.End
+				}
+				continue
+			}
+			if open {
+				flush()
+			}
+			start, end, open = region.Start, region.End, true
+		}
+		if open {
+			flush()
+			result.RegionMap[chrom] = capped
+		}
+	}
+	return result, nil
+}
+
+// Returns the absolute value of a 32-bit integer.
+func abs32(x int32) int32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// UnmatchedWithin matches the regions of a with the regions of b on
+// the same chromosome, treating two regions as equal if their start
+// positions and their end positions each differ by at most tol. Each
+// region of a, in order of start position, is greedily matched with
+// the nearest region of b that is not matched yet. Returns the
+// regions of a and of b that remain without a match, ordered by
+// chromosome name and start position.
+func UnmatchedWithin(a, b *Bed, tol int32) (onlyA, onlyB []*Region) {
+	chroms := sortedChroms(a)
+	for _, chrom := range sortedChroms(b) {
+		if _, found := a.RegionMap[chrom]; !found {
+			chroms = append(chroms, chrom)
+		}
+	}
+	sort.Slice(chroms, func(i, j int) bool {
+		return *chroms[i] < *chroms[j]
+	})
+	for _, chrom := range chroms {
+		aRegions := sortedRegions(a.RegionMap[chrom])
+		bRegions := sortedRegions(b.RegionMap[chrom])
+		matched := make([]bool, len(bRegions))
+		for _, aRegion := range aRegions {
+			best := -1
+			var bestDistance int32
+			for j := sort.Search(len(bRegions), func(j int) bool {
+				return bRegions[j].Start >= aRegion.Start-tol
+			}); j < len(bRegions) && bRegions[j].Start <= aRegion.Start+tol; j++ {
+				if matched[j] {
+					continue
+				}
+				endDistance := abs32(bRegions[j].End - aRegion.End)
+				if endDistance > tol {
+					continue
+				}
+				if distance := abs32(bRegions[j].Start-aRegion.Start) + endDistance; best < 0 || distance < bestDistance {
+					best, bestDistance = j, distance
+				}
+			}
+			if best < 0 {
+				onlyA = append(onlyA, aRegion)
+			} else {
+				matched[best] = true
+			}
+		}
+		for j, bRegion := range bRegions {
+			if !matched[j] {
+				onlyB = append(onlyB, bRegion)
+			}
+		}
+	}
+	return onlyA, onlyB
+}
+
+// EqualWithin determines whether two beds have the same regions,
+// allowing the start and end positions of matching regions to differ
+// by at most tol, for example to compare panels that were padded
+// slightly differently. Optional fields are ignored. See
+// UnmatchedWithin for how regions are matched, and for reporting the
+// regions that differ.
+func EqualWithin(a, b *Bed, tol int32) bool {
+	onlyA, onlyB := UnmatchedWithin(a, b, tol)
+	return len(onlyA) == 0 && len(onlyB) == 0
+}
+
+// Pad returns a new, sorted Bed in which each region of the given bed
+// is extended by padding bases on each side, similar to the interval
+// padding of GATK. Regions are clamped to start at position 0 at the
+// earliest, and, if lengths is not nil and lists the chromosome of a
+// region, to end at the end of the chromosome at the latest. Padded
+// regions keep their name, score, and strand, but not the fields
+// from thickStart onwards, which would no longer match the padded
+// coordinates. Overlapping padded regions are not merged. Tracks are
+// not preserved.
+func Pad(bed *Bed, padding int32, lengths map[utils.Symbol]int32) *Bed {
+	result := NewBed()
+	for chrom, regions := range bed.RegionMap {
+		padded := make([]*Region, len(regions))
+		for i, region := range regions {
+			start, end := region.Start-padding, region.End+padding
+			if start < 0 {
+				start = 0
+			}
+			if length, found := lengths[chrom]; found && end > length {
+				end = length
+			}
+			fields := region.OptionalFields
+			if len(fields) > brThickStart {
+				fields = fields[:brThickStart]
+			}
+			padded[i] = &Region{Chrom: chrom, Start: start, End: end, OptionalFields: fields}
+		}
+		result.RegionMap[chrom] = padded
+	}
+	sortRegions(result)
+	return result
+}
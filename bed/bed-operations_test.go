@@ -0,0 +1,1012 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func makeRegion(chrom string, start, end int32, fields ...string) *Region {
+	region, err := NewRegion(utils.Intern(chrom), start, end, fields)
+	if err != nil {
+		panic(err)
+	}
+	return region
+}
+
+func makeBed(regions ...*Region) *Bed {
+	bed := NewBed()
+	for _, region := range regions {
+		AddRegion(bed, region)
+	}
+	sortRegions(bed)
+	return bed
+}
+
+func TestIntersectReport(t *testing.T) {
+	a1 := makeRegion("chr1", 100, 200, "a1")
+	a2 := makeRegion("chr1", 500, 600, "a2")
+	a3 := makeRegion("chr2", 0, 50, "a3")
+	b1 := makeRegion("chr1", 50, 120, "b1")
+	b2 := makeRegion("chr1", 150, 160, "b2")
+	b3 := makeRegion("chr1", 190, 300, "b3")
+	b4 := makeRegion("chr1", 200, 250, "b4")
+	a := makeBed(a1, a2, a3)
+	b := makeBed(b4, b3, b2, b1)
+
+	pairs := IntersectReport(a, b, false)
+	expected := []IntersectPair{{a1, b1, 20}, {a1, b2, 10}, {a1, b3, 10}}
+	if len(pairs) != len(expected) {
+		t.Fatal("IntersectReport 1 failed")
+	}
+	for i, pair := range pairs {
+		if pair != expected[i] {
+			t.Error("IntersectReport 2 failed")
+		}
+	}
+
+	pairs = IntersectReport(a, b, true)
+	expected = append(expected, IntersectPair{a2, nil, 0}, IntersectPair{a3, nil, 0})
+	if len(pairs) != len(expected) {
+		t.Fatal("IntersectReport 3 failed")
+	}
+	for i, pair := range pairs {
+		if pair != expected[i] {
+			t.Error("IntersectReport 4 failed")
+		}
+	}
+
+	if len(IntersectReport(b, NewBed(), false)) != 0 {
+		t.Error("empty IntersectReport failed")
+	}
+}
+
+func TestScopedIntersect(t *testing.T) {
+	a := makeBed(
+		makeRegion("chr1", 100, 200, "a1"),
+		makeRegion("chr2", 100, 200, "a2"),
+		makeRegion("chr3", 100, 200, "a3"),
+	)
+	b := makeBed(
+		makeRegion("chr1", 150, 160),
+		makeRegion("chr1", 190, 300),
+		makeRegion("chr2", 0, 120),
+	)
+	result := Intersect(a, b)
+	if len(result.RegionMap) != 2 || len(result.RegionMap[utils.Intern("chr1")]) != 2 {
+		t.Fatal("Intersect failed")
+	}
+	if r := result.RegionMap[utils.Intern("chr1")][1]; r.Start != 190 || r.End != 200 || r.Name() != "a1" {
+		t.Error("Intersect region failed")
+	}
+	result = ScopedIntersect(a, b, []utils.Symbol{utils.Intern("chr2"), utils.Intern("chr3"), utils.Intern("chrX")})
+	if len(result.RegionMap) != 1 {
+		t.Fatal("ScopedIntersect failed")
+	}
+	if r := result.RegionMap[utils.Intern("chr2")]; len(r) != 1 || r[0].Start != 100 || r[0].End != 120 {
+		t.Error("ScopedIntersect region failed")
+	}
+}
+
+func benchmarkBeds() (a, b *Bed) {
+	a, b = NewBed(), NewBed()
+	for c := 1; c <= 22; c++ {
+		chrom := utils.Intern("chr" + strconv.Itoa(c))
+		for i := int32(0); i < 10000; i++ {
+			AddRegion(a, &Region{Chrom: chrom, Start: i * 1000, End: i*1000 + 500})
+			AddRegion(b, &Region{Chrom: chrom, Start: i*1000 + 250, End: i*1000 + 750})
+		}
+	}
+	return a, b
+}
+
+func selectChroms(bed *Bed, chroms []utils.Symbol) *Bed {
+	result := NewBed()
+	for _, chrom := range chroms {
+		for _, region := range bed.RegionMap[chrom] {
+			AddRegion(result, region)
+		}
+	}
+	return result
+}
+
+func BenchmarkScopedIntersect(b *testing.B) {
+	x, y := benchmarkBeds()
+	chroms := []utils.Symbol{utils.Intern("chr17")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ScopedIntersect(x, y, chroms)
+	}
+}
+
+func BenchmarkSelectThenIntersect(b *testing.B) {
+	x, y := benchmarkBeds()
+	chroms := []utils.Symbol{utils.Intern("chr17")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Intersect(selectChroms(x, chroms), selectChroms(y, chroms))
+	}
+}
+
+func TestProjectToTranscript(t *testing.T) {
+	// Two exons: [1000,1100) and [1500,1600).
+	plus := makeRegion("chr1", 1000, 1600, "tx", "0", "+", "1000", "1600", "0", "2", "100,100,", "0,500,")
+	if pos, ok := ProjectToTranscript(plus, 1520); !ok || pos != 120 {
+		t.Error("ProjectToTranscript second exon failed")
+	}
+	if pos, ok := ProjectToTranscript(plus, 1050); !ok || pos != 50 {
+		t.Error("ProjectToTranscript first exon failed")
+	}
+	if _, ok := ProjectToTranscript(plus, 1200); ok {
+		t.Error("ProjectToTranscript intron failed")
+	}
+	if _, ok := ProjectToTranscript(plus, 1600); ok {
+		t.Error("ProjectToTranscript outside failed")
+	}
+	minus := makeRegion("chr1", 1000, 1600, "tx", "0", "-", "1000", "1600", "0", "2", "100,100,", "0,500,")
+	if pos, ok := ProjectToTranscript(minus, 1520); !ok || pos != 79 {
+		t.Error("ProjectToTranscript reverse strand failed")
+	}
+}
+
+func TestRelationship(t *testing.T) {
+	a := makeRegion("chr1", 100, 200)
+	cases := []struct {
+		b        *Region
+		relation RegionRelation
+	}{
+		{makeRegion("chr2", 100, 200), Disjoint},
+		{makeRegion("chr1", 300, 400), Disjoint},
+		{makeRegion("chr1", 100, 200), Equal},
+		{makeRegion("chr1", 120, 180), AContainsB},
+		{makeRegion("chr1", 100, 150), AContainsB},
+		{makeRegion("chr1", 50, 250), BContainsA},
+		{makeRegion("chr1", 150, 250), OverlapLeft},
+		{makeRegion("chr1", 50, 150), OverlapRight},
+		{makeRegion("chr1", 200, 300), Adjacent},
+		{makeRegion("chr1", 0, 100), Adjacent},
+	}
+	for _, c := range cases {
+		if relation := Relationship(a, c.b); relation != c.relation {
+			t.Error("Relationship failed for", c.b.Start, c.b.End, "got", relation, "expected", c.relation)
+		}
+	}
+	if OverlapLeft.String() != "OverlapLeft" {
+		t.Error("RegionRelation.String failed")
+	}
+}
+
+func TestSplitByBases(t *testing.T) {
+	bed := makeBed(
+		makeRegion("chr1", 0, 100),
+		makeRegion("chr1", 200, 300),
+		makeRegion("chr1", 400, 500),
+		makeRegion("chr2", 0, 100),
+	)
+	shards := SplitByBases(bed, 2)
+	if len(shards) != 2 {
+		t.Fatal("SplitByBases 1 failed")
+	}
+	if CoveredBases(shards[0]) != 200 || CoveredBases(shards[1]) != 200 {
+		t.Error("SplitByBases 2 failed")
+	}
+	if len(shards[1].RegionMap[utils.Intern("chr2")]) != 1 {
+		t.Error("SplitByBases 3 failed")
+	}
+	if len(SplitByBases(bed, 10)) != 4 {
+		t.Error("SplitByBases 4 failed")
+	}
+	shards = SplitByBases(makeBed(
+		makeRegion("chr1", 0, 100),
+		makeRegion("chr1", 200, 300),
+		makeRegion("chr2", 0, 500),
+	), 2)
+	if len(shards) != 2 || CoveredBases(shards[0]) != 200 {
+		t.Error("SplitByBases 5 failed")
+	}
+	shards = SplitBySize(bed, 250)
+	if len(shards) != 2 || CoveredBases(shards[0]) != 200 {
+		t.Error("SplitBySize failed")
+	}
+}
+
+type testReference map[string][]byte
+
+func (ref testReference) Seq(contig string) []byte {
+	return ref[contig]
+}
+
+func TestEffectiveTargetSize(t *testing.T) {
+	ref := testReference{"chr1": []byte("ACGTNNNNACGTacgtnnnn")}
+	bed := makeBed(
+		makeRegion("chr1", 0, 6),
+		makeRegion("chr1", 4, 10),
+		makeRegion("chr1", 14, 24),
+		makeRegion("chr2", 0, 5),
+	)
+	raw, effective := EffectiveTargetSize(bed, ref)
+	if raw != 25 {
+		t.Error("EffectiveTargetSize raw failed")
+	}
+	if effective != 8 {
+		t.Error("EffectiveTargetSize effective failed")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	bed := makeBed(
+		makeRegion("chr1", 0, 100, "a", "0", "+"),
+		makeRegion("chr1", 50, 150, "b", "0", "+"),
+		makeRegion("chr1", 150, 200, "c", "0", "+"),
+		makeRegion("chr1", 300, 400, "d", "0", "+"),
+		makeRegion("chr1", 350, 450, "e", "0", "-"),
+		makeRegion("chr1", 500, 600),
+	)
+	regions := Merge(bed).RegionMap[utils.Intern("chr1")]
+	if len(regions) != 3 {
+		t.Fatal("Merge 1 failed")
+	}
+	if regions[0].Start != 0 || regions[0].End != 200 || regions[0].Strand() != SF {
+		t.Error("Merge same strand failed")
+	}
+	if regions[1].Start != 300 || regions[1].End != 450 || regions[1].Strand() != nil {
+		t.Error("Merge mixed strand failed")
+	}
+	if regions[2].Start != 500 || regions[2].End != 600 || len(regions[2].OptionalFields) != 0 {
+		t.Error("Merge unstranded failed")
+	}
+}
+
+func TestBoundingRegion(t *testing.T) {
+	chrom := utils.Intern("chr1")
+	region, err := BoundingRegion(chrom, []int32{500, 120, 980, 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region.Chrom != chrom || region.Start != 120 || region.End != 981 || len(region.OptionalFields) != 0 {
+		t.Error("BoundingRegion failed")
+	}
+	if _, err := BoundingRegion(chrom, nil); err == nil {
+		t.Error("empty BoundingRegion failed")
+	}
+}
+
+func TestAssignIDs(t *testing.T) {
+	newBed := func() *Bed {
+		return makeBed(
+			makeRegion("chr2", 0, 100),
+			makeRegion("chr1", 500, 600),
+			makeRegion("chr1", 100, 200, "named"),
+		)
+	}
+	names := func(bed *Bed) (result []string) {
+		for _, region := range allSortedRegions(bed) {
+			result = append(result, region.Name())
+		}
+		return result
+	}
+	bed1, bed2 := newBed(), newBed()
+	AssignIDs(bed1, "target", false)
+	AssignIDs(bed2, "target", false)
+	names1, names2 := names(bed1), names(bed2)
+	expected := []string{"named", "target_000002", "target_000003"}
+	for i, name := range names1 {
+		if name != expected[i] || name != names2[i] {
+			t.Error("AssignIDs 1 failed")
+		}
+	}
+	AssignIDs(bed1, "target", true)
+	if names(bed1)[0] != "target_000001" {
+		t.Error("AssignIDs 2 failed")
+	}
+	// Chromosomes are numbered in natural order, and equal starts by end.
+	long := makeRegion("chr2", 0, 200)
+	short := makeRegion("chr2", 0, 100)
+	chr10 := makeRegion("chr10", 0, 100)
+	AssignIDs(makeBed(chr10, long, short), "target", false)
+	if short.Name() != "target_000001" || long.Name() != "target_000002" || chr10.Name() != "target_000003" {
+		t.Error("AssignIDs 3 failed")
+	}
+}
+
+func TestCoalesceByDepth(t *testing.T) {
+	// Three replicates of overlapping peaks.
+	bed := makeBed(
+		makeRegion("chr1", 100, 200),
+		makeRegion("chr1", 150, 250),
+		makeRegion("chr1", 180, 300),
+		makeRegion("chr1", 400, 500),
+		makeRegion("chr1", 500, 600),
+	)
+	chr1 := utils.Intern("chr1")
+	regions := CoalesceByDepth(bed, 2).RegionMap[chr1]
+	if len(regions) != 1 || regions[0].Start != 150 || regions[0].End != 250 {
+		t.Error("CoalesceByDepth 2 failed")
+	}
+	regions = CoalesceByDepth(bed, 3).RegionMap[chr1]
+	if len(regions) != 1 || regions[0].Start != 180 || regions[0].End != 200 {
+		t.Error("CoalesceByDepth 3 failed")
+	}
+	regions = CoalesceByDepth(bed, 1).RegionMap[chr1]
+	union := Merge(bed).RegionMap[chr1]
+	if len(regions) != len(union) {
+		t.Fatal("CoalesceByDepth 1 failed")
+	}
+	for i, region := range regions {
+		if region.Start != union[i].Start || region.End != union[i].End {
+			t.Error("CoalesceByDepth 1 failed")
+		}
+	}
+}
+
+func TestWriteRegionsFile(t *testing.T) {
+	bed := makeBed(
+		makeRegion("chr2", 0, 1),
+		makeRegion("chr1", 99, 200, "x"),
+	)
+	var buf bytes.Buffer
+	if err := WriteRegionsFile(bed, &buf, TabRegions); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "chr1\t99\t200\nchr2\t0\t1\n" {
+		t.Error("WriteRegionsFile tab format failed")
+	}
+	buf.Reset()
+	if err := WriteRegionsFile(bed, &buf, ColonRegions); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "chr1:100-200\nchr2:1-1\n" {
+		t.Error("WriteRegionsFile colon format failed")
+	}
+}
+
+func TestSplitIntoN(t *testing.T) {
+	bed := makeBed(makeRegion("chr1", 1000, 1100, "gene"), makeRegion("chr1", 2000, 2002))
+	split, err := SplitIntoN(bed, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions := split.RegionMap[utils.Intern("chr1")]
+	expected := []struct {
+		start, end int32
+		name       string
+	}{
+		{1000, 1025, "gene_1"},
+		{1025, 1050, "gene_2"},
+		{1050, 1075, "gene_3"},
+		{1075, 1100, "gene_4"},
+		{2000, 2001, "1"},
+		{2001, 2002, "2"},
+	}
+	if len(regions) != len(expected) {
+		t.Fatal("SplitIntoN 1 failed")
+	}
+	for i, region := range regions {
+		if region.Start != expected[i].start || region.End != expected[i].end || region.Name() != expected[i].name {
+			t.Error("SplitIntoN 2 failed")
+		}
+	}
+	if _, err := SplitIntoN(bed, 0); err == nil {
+		t.Error("SplitIntoN 3 failed")
+	}
+}
+
+func TestFilterByNeighborDensity(t *testing.T) {
+	bed := makeBed(
+		makeRegion("chr1", 0, 10, "dense1"),
+		makeRegion("chr1", 20, 30, "dense2"),
+		makeRegion("chr1", 35, 50, "dense3"),
+		makeRegion("chr1", 1000, 1010, "isolated"),
+		makeRegion("chr2", 0, 10, "alone"),
+	)
+	filtered := FilterByNeighborDensity(bed, 25, 2)
+	regions := filtered.RegionMap[utils.Intern("chr1")]
+	if len(regions) != 3 || regions[0].Name() != "dense1" || regions[2].Name() != "dense3" {
+		t.Error("FilterByNeighborDensity 1 failed")
+	}
+	if len(filtered.RegionMap) != 1 {
+		t.Error("FilterByNeighborDensity 2 failed")
+	}
+	if len(FilterByNeighborDensity(bed, 5, 2).RegionMap) != 0 {
+		t.Error("FilterByNeighborDensity 3 failed")
+	}
+}
+
+func TestRotateRegions(t *testing.T) {
+	chr1 := utils.Intern("chr1")
+	lengths := map[utils.Symbol]int32{chr1: 1000}
+	bed := makeBed(
+		makeRegion("chr1", 100, 200),
+		makeRegion("chr1", 300, 350),
+		makeRegion("chr1", 900, 1000),
+	)
+	rotated1, err := RotateRegions(bed, lengths, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated2, _ := RotateRegions(bed, lengths, 42)
+	regions1, regions2 := rotated1.RegionMap[chr1], rotated2.RegionMap[chr1]
+	if len(regions1) != len(regions2) {
+		t.Fatal("RotateRegions determinism failed")
+	}
+	for i, region := range regions1 {
+		if region.Start != regions2[i].Start || region.End != regions2[i].End {
+			t.Error("RotateRegions determinism failed")
+		}
+	}
+	if CoveredBases(rotated1) != CoveredBases(bed) {
+		t.Error("RotateRegions length preservation failed")
+	}
+	if _, err := RotateRegions(bed, map[utils.Symbol]int32{}, 42); err == nil {
+		t.Error("RotateRegions missing length failed")
+	}
+}
+
+func TestClassifyAgainst(t *testing.T) {
+	genic := makeRegion("chr1", 120, 140)
+	intergenic := makeRegion("chr1", 300, 400)
+	ambiguous := makeRegion("chr1", 480, 560)
+	query := makeBed(ambiguous, intergenic, genic)
+	annotation := makeBed(
+		makeRegion("chr1", 100, 200, "GENE1"),
+		makeRegion("chr1", 450, 500, "GENE2"),
+		makeRegion("chr1", 510, 600, "GENE3"),
+	)
+	expected := []RegionClass{
+		{genic, true, "GENE1"},
+		{intergenic, false, ""},
+		{ambiguous, true, "GENE3"},
+	}
+	classes := ClassifyAgainst(query, annotation)
+	if len(classes) != len(expected) {
+		t.Fatal("ClassifyAgainst 1 failed")
+	}
+	for i, class := range classes {
+		if class != expected[i] {
+			t.Error("ClassifyAgainst 2 failed for", class.Region.Start)
+		}
+	}
+}
+
+func TestWeightedBaseCount(t *testing.T) {
+	bed := makeBed(
+		makeRegion("chr1", 0, 100, "a", "10"),
+		makeRegion("chr1", 50, 150, "b", "500"),
+		makeRegion("chr1", 200, 210, "c"),
+	)
+	if WeightedBaseCount(bed, false) != 51000 {
+		t.Error("WeightedBaseCount 1 failed")
+	}
+	if WeightedBaseCount(bed, true) != 51010 {
+		t.Error("WeightedBaseCount 2 failed")
+	}
+}
+
+func TestSnapToFeatures(t *testing.T) {
+	exons := makeBed(
+		makeRegion("chr1", 1000, 1200, "exon1"),
+		makeRegion("chr1", 2000, 2300, "exon2"),
+	)
+	query := makeBed(makeRegion("chr1", 1003, 1150, "target"))
+	regions := SnapToFeatures(query, exons, 10).RegionMap[utils.Intern("chr1")]
+	if len(regions) != 1 || regions[0].Start != 1000 || regions[0].End != 1150 || regions[0].Name() != "target" {
+		t.Error("SnapToFeatures 1 failed")
+	}
+	regions = SnapToFeatures(query, exons, 2).RegionMap[utils.Intern("chr1")]
+	if regions[0].Start != 1003 || regions[0].End != 1150 {
+		t.Error("SnapToFeatures 2 failed")
+	}
+}
+
+func TestMergeBedsWithSources(t *testing.T) {
+	beds := []*Bed{
+		makeBed(makeRegion("chr1", 100, 200)),
+		makeBed(makeRegion("chr1", 500, 600)),
+		makeBed(makeRegion("chr1", 150, 300), makeRegion("chr1", 550, 560)),
+	}
+	merged, err := MergeBedsWithSources(beds, []string{"kit1", "kit2", "kit3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 2 {
+		t.Fatal("MergeBedsWithSources 1 failed")
+	}
+	if merged[0].Region.Start != 100 || merged[0].Region.End != 300 ||
+		len(merged[0].Sources) != 2 || merged[0].Sources[0] != "kit1" || merged[0].Sources[1] != "kit3" {
+		t.Error("MergeBedsWithSources 2 failed")
+	}
+	if merged[1].Region.Start != 500 || merged[1].Region.End != 600 ||
+		len(merged[1].Sources) != 2 || merged[1].Sources[0] != "kit2" || merged[1].Sources[1] != "kit3" {
+		t.Error("MergeBedsWithSources 3 failed")
+	}
+	if len(MergeBeds(beds).RegionMap[utils.Intern("chr1")]) != 2 {
+		t.Error("MergeBeds failed")
+	}
+	if _, err := MergeBedsWithSources(beds, []string{"kit1"}); err == nil {
+		t.Error("MergeBedsWithSources 4 failed")
+	}
+}
+
+func TestInsertSorted(t *testing.T) {
+	bed := NewBed()
+	for _, start := range []int32{500, 100, 300, 100, 900, 0} {
+		bed.InsertSorted(makeRegion("chr1", start, start+10))
+	}
+	regions := bed.RegionMap[utils.Intern("chr1")]
+	if len(regions) != 6 {
+		t.Fatal("InsertSorted 1 failed")
+	}
+	for i := 1; i < len(regions); i++ {
+		if regions[i-1].Start > regions[i].Start {
+			t.Error("InsertSorted 2 failed")
+		}
+	}
+}
+
+func TestAnnotateTSSDistance(t *testing.T) {
+	genes := makeBed(
+		makeRegion("chr1", 1000, 5000, "PLUS", "0", "+"),
+		makeRegion("chr1", 10000, 20000, "MINUS", "0", "-"),
+	)
+	downstreamPlus := makeRegion("chr1", 1100, 1200)
+	upstreamPlus := makeRegion("chr1", 800, 900)
+	overlapping := makeRegion("chr1", 990, 1010)
+	downstreamMinus := makeRegion("chr1", 19000, 19500)
+	upstreamMinus := makeRegion("chr1", 20100, 20200)
+	query := makeBed(downstreamPlus, upstreamPlus, overlapping, downstreamMinus, upstreamMinus, makeRegion("chr2", 0, 10))
+	expected := []TSSAnnotation{
+		{upstreamPlus, true, "PLUS", -101},
+		{overlapping, true, "PLUS", 0},
+		{downstreamPlus, true, "PLUS", 100},
+		{downstreamMinus, true, "MINUS", 500},
+		{upstreamMinus, true, "MINUS", -101},
+	}
+	annotations := AnnotateTSSDistance(query, genes)
+	if len(annotations) != len(expected)+1 {
+		t.Fatal("AnnotateTSSDistance 1 failed")
+	}
+	for i, annotation := range expected {
+		if annotations[i] != annotation {
+			t.Error("AnnotateTSSDistance 2 failed for", annotation.Region.Start, "got", annotations[i].Gene, annotations[i].Distance)
+		}
+	}
+	if annotations[len(expected)].Found {
+		t.Error("AnnotateTSSDistance 3 failed")
+	}
+}
+
+func TestMergeCapped(t *testing.T) {
+	bed := makeBed(
+		makeRegion("chr1", 0, 100),
+		makeRegion("chr1", 50, 150),
+		makeRegion("chr1", 120, 180),
+		makeRegion("chr1", 300, 350),
+	)
+	merged, err := MergeCapped(bed, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions := merged.RegionMap[utils.Intern("chr1")]
+	expected := []struct{ start, end int32 }{{0, 100}, {100, 180}, {300, 350}}
+	if len(regions) != len(expected) {
+		t.Fatal("MergeCapped 1 failed")
+	}
+	for i, region := range regions {
+		if region.Start != expected[i].start || region.End != expected[i].end {
+			t.Error("MergeCapped 2 failed")
+		}
+	}
+	if _, err := MergeCapped(bed, 0); err == nil {
+		t.Error("MergeCapped 3 failed")
+	}
+}
+
+func TestEqualWithin(t *testing.T) {
+	a := makeBed(makeRegion("chr1", 100, 200), makeRegion("chr1", 300, 400), makeRegion("chr2", 0, 50))
+	b := makeBed(makeRegion("chr1", 105, 195), makeRegion("chr1", 295, 405), makeRegion("chr2", 5, 45))
+	if !EqualWithin(a, b, 5) {
+		t.Error("EqualWithin tol failed")
+	}
+	if EqualWithin(a, b, 4) {
+		t.Error("EqualWithin tol-1 failed")
+	}
+	b = makeBed(makeRegion("chr1", 105, 195), makeRegion("chr1", 294, 405), makeRegion("chr3", 0, 50))
+	onlyA, onlyB := UnmatchedWithin(a, b, 5)
+	if len(onlyA) != 2 || onlyA[0].Start != 300 || *onlyA[1].Chrom != "chr2" {
+		t.Error("UnmatchedWithin a failed")
+	}
+	if len(onlyB) != 2 || onlyB[0].Start != 294 || *onlyB[1].Chrom != "chr3" {
+		t.Error("UnmatchedWithin b failed")
+	}
+}
+
+func TestRegionStreams(t *testing.T) {
+	a := makeBed(
+		makeRegion("chr1", 100, 200),
+		makeRegion("chr1", 150, 300),
+		makeRegion("chr1", 400, 500),
+		makeRegion("chr2", 0, 100),
+		makeRegion("chr3", 0, 100),
+	)
+	b := makeBed(
+		makeRegion("chr1", 120, 130),
+		makeRegion("chr1", 280, 450),
+		makeRegion("chr3", 0, 10),
+		makeRegion("chr3", 90, 200),
+	)
+	result := Collect(FilterStream(SubtractStream(MergeStream(Stream(a)), Stream(b)), func(region *Region) bool {
+		return region.End-region.Start >= 50
+	}))
+	expected := []Triple{{"chr1", 130, 280}, {"chr1", 450, 500}, {"chr2", 0, 100}, {"chr3", 10, 90}}
+	regions := allSortedRegions(result)
+	if len(regions) != len(expected) {
+		t.Fatal("region stream chain failed")
+	}
+	for i, region := range regions {
+		if *region.Chrom != expected[i].Chrom || region.Start != expected[i].Start || region.End != expected[i].End {
+			t.Error("region stream chain region failed")
+		}
+	}
+	s := IntersectStream(Stream(a), Stream(b))
+	if region := s.Next(); region == nil || region.Start != 120 || region.End != 130 {
+		t.Error("IntersectStream failed")
+	}
+}
+
+func BenchmarkStreamChain(b *testing.B) {
+	x, y := benchmarkBeds()
+	keep := func(region *Region) bool { return region.End-region.Start >= 200 }
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Collect(FilterStream(SubtractStream(MergeStream(Stream(x)), Stream(y)), keep))
+	}
+}
+
+func BenchmarkMaterializedChain(b *testing.B) {
+	x, y := benchmarkBeds()
+	keep := func(region *Region) bool { return region.End-region.Start >= 200 }
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		subtracted := Subtract(Merge(x), y)
+		result := NewBed()
+		for _, regions := range subtracted.RegionMap {
+			for _, region := range regions {
+				if keep(region) {
+					AddRegion(result, region)
+				}
+			}
+		}
+	}
+}
+
+func TestRegionIndex(t *testing.T) {
+	r1 := makeRegion("chr1", 100, 1000)
+	r2 := makeRegion("chr1", 200, 300)
+	r3 := makeRegion("chr1", 400, 500)
+	r4 := makeRegion("chr1", 2000, 2100)
+	index := NewRegionIndex(makeBed(r4, r3, r2, r1, makeRegion("chr2", 0, 10)))
+	chr1 := utils.Intern("chr1")
+	if result := index.OverlapQuery(chr1, 450, 600); len(result) != 2 || result[0] != r1 || result[1] != r3 {
+		t.Error("OverlapQuery 1 failed")
+	}
+	if result := index.OverlapQuery(chr1, 1000, 2000); len(result) != 0 {
+		t.Error("OverlapQuery 2 failed")
+	}
+	if !index.Overlaps(chr1, 2099, 2100) || index.Overlaps(chr1, 2100, 3000) {
+		t.Error("Overlaps failed")
+	}
+	if index.Overlaps(utils.Intern("chr3"), 0, 10) {
+		t.Error("Overlaps chromosome failed")
+	}
+	if region := index.NearestQuery(chr1, 450, 460, 0); region != r1 {
+		t.Error("NearestQuery overlap failed")
+	}
+	if region := index.NearestQuery(chr1, 1050, 1060, 100); region != r1 {
+		t.Error("NearestQuery left failed")
+	}
+	if region := index.NearestQuery(chr1, 1900, 1950, 100); region != r4 {
+		t.Error("NearestQuery right failed")
+	}
+	if region := index.NearestQuery(chr1, 1050, 1060, 10); region != nil {
+		t.Error("NearestQuery distance failed")
+	}
+	if region := index.NearestQuery(chr1, 0, 10, 90); region != r1 {
+		t.Error("NearestQuery first failed")
+	}
+	if region := index.NearestQuery(chr1, 2200, 2300, 100); region != r4 {
+		t.Error("NearestQuery last failed")
+	}
+	if region := index.NearestQuery(utils.Intern("chr3"), 0, 10, 100); region != nil {
+		t.Error("NearestQuery chromosome failed")
+	}
+}
+
+func TestBlockFields(t *testing.T) {
+	region, err := NewRegion(utils.Intern("chr1"), 1000, 1600, []string{"tx", "0", "+", "1000", "1600", "0", "2", "100,100", "0,500,"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes := region.OptionalFields[brBlockSizes].([]int32); len(sizes) != 2 || sizes[1] != 100 {
+		t.Error("BlockSizes failed")
+	}
+	if starts := region.OptionalFields[brBlockStarts].([]int32); len(starts) != 2 || starts[1] != 500 {
+		t.Error("BlockStarts failed")
+	}
+	if _, err := NewRegion(utils.Intern("chr1"), 1000, 1600, []string{"tx", "0", "+", "1000", "1600", "0", "3", "100,100,", "0,500,"}); err == nil {
+		t.Error("BlockCount validation failed")
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	a := makeBed(makeRegion("chr1", 0, 100), makeRegion("chr1", 100, 150), makeRegion("chr1", 300, 400))
+	b := makeBed(makeRegion("chr1", 50, 60), makeRegion("chr1", 120, 350), makeRegion("chr2", 0, 10))
+	merged := Merge(a)
+	if regions := merged.RegionMap[utils.Intern("chr1")]; len(regions) != 2 || regions[0].End != 150 {
+		t.Error("Merge adjacent failed")
+	}
+	intersected := Intersect(merged, b)
+	expected := []Triple{{"chr1", 50, 60}, {"chr1", 120, 150}, {"chr1", 300, 350}}
+	regions := allSortedRegions(intersected)
+	if len(regions) != len(expected) {
+		t.Fatal("Intersect failed")
+	}
+	for i, region := range regions {
+		if region.Start != expected[i].Start || region.End != expected[i].End {
+			t.Error("Intersect region failed")
+		}
+	}
+	subtracted := Subtract(merged, b)
+	expected = []Triple{{"chr1", 0, 50}, {"chr1", 60, 120}, {"chr1", 350, 400}}
+	regions = allSortedRegions(subtracted)
+	if len(regions) != len(expected) {
+		t.Fatal("Subtract failed")
+	}
+	for i, region := range regions {
+		if region.Start != expected[i].Start || region.End != expected[i].End {
+			t.Error("Subtract region failed")
+		}
+	}
+	if len(Subtract(b, NewBed()).RegionMap) != 2 {
+		t.Error("Subtract empty failed")
+	}
+}
+
+func TestHeaderChromOrder(t *testing.T) {
+	a := makeBed(makeRegion("chr1", 0, 100), makeRegion("chr2", 0, 100), makeRegion("chrUn", 0, 100))
+	b := makeBed(makeRegion("chr1", 50, 60), makeRegion("chr2", 10, 20), makeRegion("chr3", 0, 100))
+	header := sam.NewHeader()
+	header.SQ = append(header.SQ, utils.StringMap{"SN": "chr2", "LN": "1000"}, utils.StringMap{"SN": "chr1", "LN": "1000"}, utils.StringMap{"SN": "chr3", "LN": "1000"})
+	chroms, missing := HeaderChromOrder(a, header)
+	if len(chroms) != 2 || *chroms[0] != "chr2" || *chroms[1] != "chr1" {
+		t.Error("HeaderChromOrder failed")
+	}
+	if len(missing) != 1 || *missing[0] != "chrUn" {
+		t.Error("HeaderChromOrder missing failed")
+	}
+	s := IntersectStreamInOrder(StreamInOrder(a, chroms), StreamInOrder(b, chroms), chroms)
+	if region := s.Next(); region == nil || *region.Chrom != "chr2" || region.Start != 10 {
+		t.Error("IntersectStreamInOrder 1 failed")
+	}
+	if region := s.Next(); region == nil || *region.Chrom != "chr1" || region.Start != 50 {
+		t.Error("IntersectStreamInOrder 2 failed")
+	}
+	if s.Next() != nil {
+		t.Error("IntersectStreamInOrder 3 failed")
+	}
+}
+
+func TestOverlapQueryStrand(t *testing.T) {
+	plus := makeRegion("chr1", 100, 200, "p", "0", "+")
+	minus := makeRegion("chr1", 150, 250, "m", "10", "-")
+	index := NewRegionIndex(makeBed(plus, minus, makeRegion("chr1", 100, 300)))
+	chr1 := utils.Intern("chr1")
+	if result := index.OverlapQueryStrand(chr1, 160, 170, SR); len(result) != 1 || result[0] != minus {
+		t.Error("OverlapQueryStrand 1 failed")
+	}
+	if result := index.OverlapQueryStrand(chr1, 160, 170, SF); len(result) != 1 || result[0] != plus {
+		t.Error("OverlapQueryStrand 2 failed")
+	}
+	if score, ok := minus.Score(); !ok || score != 10 || minus.Name() != "m" || minus.Strand() != SR {
+		t.Error("Region accessors failed")
+	}
+	if _, ok := makeRegion("chr1", 0, 1).Score(); ok {
+		t.Error("Region Score failed")
+	}
+}
+
+func TestPad(t *testing.T) {
+	a := makeBed(
+		makeRegion("chr1", 10, 100, "r1", "0", "+", "10", "100", "0", "1", "90,", "0,"),
+		makeRegion("chr1", 900, 950),
+		makeRegion("chr2", 100, 200),
+	)
+	padded := Pad(a, 50, map[utils.Symbol]int32{utils.Intern("chr1"): 980})
+	regions := padded.RegionMap[utils.Intern("chr1")]
+	if regions[0].Start != 0 || regions[0].End != 150 || len(regions[0].OptionalFields) != 3 || regions[0].Name() != "r1" {
+		t.Error("Pad start failed")
+	}
+	if regions[1].Start != 850 || regions[1].End != 980 {
+		t.Error("Pad end failed")
+	}
+	if regions := padded.RegionMap[utils.Intern("chr2")]; regions[0].Start != 50 || regions[0].End != 250 {
+		t.Error("Pad unknown length failed")
+	}
+}
+
+func TestItemRgb(t *testing.T) {
+	red := makeRegion("chr1", 0, 100, "red", "0", "+", "0", "100", "255,0,0")
+	if red.OptionalFields[brItemRgb].(ItemRgb).RGB != (RGB{R: 255}) {
+		t.Error("ItemRgb parse failed")
+	}
+	black := makeRegion("chr1", 200, 300, "black", "0", "+", "200", "300", "0")
+	explicitBlack := makeRegion("chr1", 400, 500, "black", "0", "+", "400", "500", "0,0,0")
+	on := makeRegion("chr1", 600, 700, "on", "0", "+", "600", "700", "on")
+	if on.OptionalFields[brItemRgb].(ItemRgb).RGB != (RGB{}) {
+		t.Error("ItemRgb on parse failed")
+	}
+	var out bytes.Buffer
+	if err := Format(&out, makeBed(red, black, explicitBlack, on)); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "chr1\t0\t100\tred\t0\t+\t0\t100\t255,0,0\n"+
+		"chr1\t200\t300\tblack\t0\t+\t200\t300\t0\n"+
+		"chr1\t400\t500\tblack\t0\t+\t400\t500\t0,0,0\n"+
+		"chr1\t600\t700\ton\t0\t+\t600\t700\ton\n" {
+		t.Error("ItemRgb format failed", out.String())
+	}
+	if _, err := NewRegion(utils.Intern("chr1"), 0, 1, []string{"x", "0", "+", "0", "1", "256,0,0"}); err == nil {
+		t.Error("ItemRgb validation failed")
+	}
+}
+
+func TestComplement(t *testing.T) {
+	lengths := map[utils.Symbol]int32{utils.Intern("chr1"): 1000, utils.Intern("chr2"): 500}
+	a := makeBed(makeRegion("chr1", 0, 100), makeRegion("chr1", 50, 200), makeRegion("chr1", 900, 1200), makeRegion("chrUn", 0, 10))
+	regions := allSortedRegions(Complement(a, lengths))
+	expected := []Triple{{"chr1", 200, 900}, {"chr2", 0, 500}}
+	if len(regions) != len(expected) {
+		t.Fatal("Complement failed")
+	}
+	for i, region := range regions {
+		if *region.Chrom != expected[i].Chrom || region.Start != expected[i].Start || region.End != expected[i].End {
+			t.Error("Complement region failed")
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	builder := NewBuilder()
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func(i int32) {
+			defer wait.Done()
+			for j := int32(0); j < 100; j++ {
+				builder.AddRegion(makeRegion("chr1", 1000*j+i, 1000*j+i+1))
+			}
+		}(int32(i))
+	}
+	wait.Wait()
+	builder.AddBed(makeBed(makeRegion("chr2", 0, 10)))
+	frozen := builder.Freeze()
+	regions := frozen.Bed().RegionMap[utils.Intern("chr1")]
+	if len(regions) != 800 {
+		t.Fatal("Builder AddRegion failed")
+	}
+	for i := 1; i < len(regions); i++ {
+		if regions[i-1].Start > regions[i].Start {
+			t.Error("Builder Freeze failed")
+			break
+		}
+	}
+	if !frozen.Overlaps(utils.Intern("chr2"), 5, 6) || len(frozen.OverlapQuery(utils.Intern("chr1"), 2000, 3000)) != 8 {
+		t.Error("FrozenBed query failed")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Builder use after Freeze failed")
+		}
+	}()
+	builder.AddRegion(makeRegion("chr1", 0, 1))
+}
+
+func TestCollapse(t *testing.T) {
+	bed := makeBed(
+		makeRegion("chr1", 100, 200, "a", "0", "+"),
+		makeRegion("chr1", 100, 200, "a", "0", "+"),
+		makeRegion("chr1", 150, 300, "b", "0", "+"),
+		makeRegion("chr1", 300, 400, "c", "0", "-"),
+		makeRegion("chr2", 0, 10),
+		makeRegion("chr2", 5, 20),
+	)
+	collapsed, stats := Collapse(bed, true)
+	if stats.Regions != 6 || stats.Collapsed != 3 || stats.Duplicates != 1 || stats.Merged() != 3 {
+		t.Error("Collapse stats failed")
+	}
+	chr1 := collapsed.RegionMap[utils.Intern("chr1")]
+	if len(chr1) != 2 || chr1[0].Start != 100 || chr1[0].End != 300 ||
+		chr1[0].Name() != "a,b" || chr1[0].Strand() != SF ||
+		chr1[1].Start != 300 || chr1[1].Name() != "c" {
+		t.Error("Collapse chr1 failed")
+	}
+	chr2 := collapsed.RegionMap[utils.Intern("chr2")]
+	if len(chr2) != 1 || chr2[0].End != 20 || len(chr2[0].OptionalFields) != 0 {
+		t.Error("Collapse chr2 failed")
+	}
+	if collapsed, _ = Collapse(bed, false); collapsed.RegionMap[utils.Intern("chr1")][0].Name() != "." {
+		t.Error("Collapse without names failed")
+	}
+}
+
+func TestFilterByNameRegex(t *testing.T) {
+	brca1 := makeRegion("chr17", 100, 200, "BRCA1_exon1")
+	brca2 := makeRegion("chr13", 300, 400, "BRCA2_exon2")
+	tp53 := makeRegion("chr17", 500, 600, "TP53_exon1")
+	unnamed := makeRegion("chr17", 700, 800)
+	filtered, err := FilterByNameRegex(makeBed(brca1, brca2, tp53, unnamed), "^BRCA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := filtered.RegionMap[utils.Intern("chr17")]; len(regions) != 1 || regions[0] != brca1 {
+		t.Error("FilterByNameRegex 1 failed")
+	}
+	if regions := filtered.RegionMap[utils.Intern("chr13")]; len(regions) != 1 || regions[0] != brca2 {
+		t.Error("FilterByNameRegex 2 failed")
+	}
+	filtered, err = FilterByNameRegex(makeBed(unnamed), ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered.RegionMap) != 0 {
+		t.Error("FilterByNameRegex 3 failed")
+	}
+	if _, err := FilterByNameRegex(makeBed(brca1), "BRCA("); err == nil {
+		t.Error("FilterByNameRegex 4 failed")
+	}
+}
+
+func TestFromTriples(t *testing.T) {
+	bed, err := FromTriples([]Triple{
+		{Chrom: "chr1", Start: 500, End: 600},
+		{Chrom: "chr2", Start: 0, End: 10},
+		{Chrom: "chr1", Start: 100, End: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chr1 := bed.RegionMap[utils.Intern("chr1")]
+	if len(chr1) != 2 || chr1[0].Start != 100 || chr1[0].End != 100 || chr1[1].Start != 500 || chr1[1].End != 600 {
+		t.Error("FromTriples 1 failed")
+	}
+	if chr2 := bed.RegionMap[utils.Intern("chr2")]; len(chr2) != 1 || chr2[0].End != 10 || len(chr2[0].OptionalFields) != 0 {
+		t.Error("FromTriples 2 failed")
+	}
+	if _, err := FromTriples([]Triple{{Chrom: "chr1", Start: -1, End: 10}}); err == nil {
+		t.Error("FromTriples 3 failed")
+	}
+	if _, err := FromTriples([]Triple{{Chrom: "chr1", Start: 0, End: 10}, {Chrom: "chr1", Start: 20, End: 10}}); err == nil {
+		t.Error("FromTriples 4 failed")
+	}
+}
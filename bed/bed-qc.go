@@ -0,0 +1,438 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// ChromLengths returns the lengths of the reference sequences listed
+// in the @SQ lines of a SAM header, keyed by sequence name.
+func ChromLengths(header *sam.Header) (map[utils.Symbol]int32, error) {
+	lengths := make(map[utils.Symbol]int32, len(header.SQ))
+	for _, sq := range header.SQ {
+		ln, err := sam.SQLN(sq)
+		if err != nil {
+			return nil, fmt.Errorf("%v, for reference sequence %v", err, sq["SN"])
+		}
+		lengths[utils.Intern(sq["SN"])] = ln
+	}
+	return lengths, nil
+}
+
+// HeaderChromOrder returns the chromosomes of a bed in the order in
+// which they are listed in the @SQ lines of a SAM header, as needed
+// for processing regions together with coordinate-sorted reads, for
+// example with StreamInOrder. Chromosomes of the bed that are not
+// listed in the header are returned separately, in name order.
+func HeaderChromOrder(bed *Bed, header *sam.Header) (chroms, missing []utils.Symbol) {
+	listed := make(map[utils.Symbol]bool, len(header.SQ))
+	for _, sq := range header.SQ {
+		chrom := utils.Intern(sq["SN"])
+		listed[chrom] = true
+		if _, found := bed.RegionMap[chrom]; found {
+			chroms = append(chroms, chrom)
+		}
+	}
+	for _, chrom := range sortedChroms(bed) {
+		if !listed[chrom] {
+			missing = append(missing, chrom)
+		}
+	}
+	return chroms, missing
+}
+
+// A ChromTargetCoverage reports how much of a chromosome is covered
+// by the regions of a bed.
+type ChromTargetCoverage struct {
+	Chrom utils.Symbol
+	// The length of the chromosome according to the SAM header, or 0
+	// if it is not listed in the header.
+	Length int32
+	// The number of bases of the chromosome covered by regions,
+	// counting bases covered by overlapping regions only once.
+	TargetedBases int64
+	// TargetedBases / Length, or 0 if the chromosome is not listed in
+	// the header.
+	Fraction float64
+	// False if the bed has regions on this chromosome, but the
+	// chromosome is not listed in the header. This is an error.
+	InHeader bool
+}
+
+// ChromTargetReport reports for each chromosome listed in the SAM
+// header which fraction of it is covered by the regions of a bed, in
+// header order. Chromosomes of the bed that are not listed in the
+// header are reported after that, in name order, with InHeader set to
+// false. Bases of regions that lie beyond the end of a chromosome are
+// not counted.
+func ChromTargetReport(bed *Bed, header *sam.Header) (report []ChromTargetCoverage, err error) {
+	lengths, err := ChromLengths(header)
+	if err != nil {
+		return nil, err
+	}
+	merged := Merge(bed)
+	for _, sq := range header.SQ {
+		chrom := utils.Intern(sq["SN"])
+		length := lengths[chrom]
+		var targeted int64
+		for _, region := range merged.RegionMap[chrom] {
+			if region.Start >= length {
+				break
+			}
+			end := region.End
+			if end > length {
+				end = length
+			}
+			targeted += int64(end - region.Start)
+		}
+		var fraction float64
+		if length > 0 {
+			fraction = float64(targeted) / float64(length)
+		}
+		report = append(report, ChromTargetCoverage{
+			Chrom:         chrom,
+			Length:        length,
+			TargetedBases: targeted,
+			Fraction:      fraction,
+			InHeader:      true,
+		})
+	}
+	for _, chrom := range sortedChroms(merged) {
+		if _, found := lengths[chrom]; !found {
+			var targeted int64
+			for _, region := range merged.RegionMap[chrom] {
+				targeted += regionLength(region)
+			}
+			report = append(report, ChromTargetCoverage{Chrom: chrom, TargetedBases: targeted})
+		}
+	}
+	return report, nil
+}
+
+// WriteChromTargetReport writes a report created by ChromTargetReport
+// as a tab-separated table with a header line. Chromosomes that are
+// not listed in the SAM header are flagged as errors in the status
+// column.
+func WriteChromTargetReport(w io.Writer, report []ChromTargetCoverage) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprint(out, "chrom\tlength\ttargeted\tfraction\tstatus\n")
+	for _, entry := range report {
+		status := "ok"
+		if !entry.InHeader {
+			status = "ERROR: not in header"
+		}
+		fmt.Fprintf(out, "%v\t%v\t%v\t%.6f\t%v\n", *entry.Chrom, entry.Length, entry.TargetedBases, entry.Fraction, status)
+	}
+	return out.Flush()
+}
+
+// ParseBaseline parses a tab-separated file that maps region names
+// onto values, for example expected depths from a panel of normals.
+// Each line consists of a region name and a value, separated by a
+// tab. Any further columns are ignored, and empty lines and lines
+// starting with # are skipped.
+func ParseBaseline(filename string) (baseline map[string]float64, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	baseline = make(map[string]float64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		data := strings.Split(line, "\t")
+		if len(data) < 2 {
+			return nil, fmt.Errorf("invalid baseline line: %v", line)
+		}
+		value, err := strconv.ParseFloat(data[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid baseline value: %v", err)
+		}
+		baseline[data[0]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading baseline file: %v", err)
+	}
+	return baseline, nil
+}
+
+// A RegionRatio relates the observed depth of a region to its
+// expected depth.
+type RegionRatio struct {
+	Region             *Region
+	Observed, Expected float64
+	// log2(Observed / Expected)
+	Log2Ratio float64
+}
+
+// CoverageRatios computes the log2 ratio of observed to expected mean
+// depth for each named region of a bed, ordered by chromosome name
+// and start position. Both observed and expected depths are keyed by
+// region name. Regions for which the observed depth is missing are
+// skipped. Regions for which the expected depth is missing or not
+// positive are skipped with a warning. An observed depth of 0 results
+// in a ratio of negative infinity.
+func CoverageRatios(bed *Bed, observed, expected map[string]float64) (ratios []RegionRatio) {
+	for _, region := range allSortedRegions(bed) {
+		name := region.Name()
+		depth, found := observed[name]
+		if name == "" || !found {
+			continue
+		}
+		baseline, found := expected[name]
+		if !found || baseline <= 0 {
+			log.Println("Warning: No valid baseline for region", name, "- skipping it.")
+			continue
+		}
+		ratios = append(ratios, RegionRatio{
+			Region:    region,
+			Observed:  depth,
+			Expected:  baseline,
+			Log2Ratio: math.Log2(depth / baseline),
+		})
+	}
+	return ratios
+}
+
+// WriteCoverageRatios writes ratios computed by CoverageRatios as a
+// tab-separated table with a header line.
+func WriteCoverageRatios(w io.Writer, ratios []RegionRatio) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprint(out, "chrom\tstart\tend\tname\tobserved\texpected\tlog2ratio\n")
+	for _, ratio := range ratios {
+		region := ratio.Region
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%.4f\t%.4f\t%.4f\n", *region.Chrom, region.Start, region.End, region.Name(), ratio.Observed, ratio.Expected, ratio.Log2Ratio)
+	}
+	return out.Flush()
+}
+
+// An AnomalyReason describes why the coordinates of a region are
+// suspicious.
+type AnomalyReason int
+
+// Possible reasons for reporting an anomaly.
+const (
+	// The region starts after it ends.
+	NegativeLength AnomalyReason = iota
+	// The region starts where it ends.
+	ZeroLength
+	// The region starts before position 0.
+	NegativeStart
+	// The region ends beyond the end of its chromosome.
+	BeyondChromosomeEnd
+	// The chromosome of the region has no known length.
+	UnknownChromosome
+)
+
+func (reason AnomalyReason) String() string {
+	switch reason {
+	case NegativeLength:
+		return "start after end"
+	case ZeroLength:
+		return "zero length"
+	case NegativeStart:
+		return "negative start"
+	case BeyondChromosomeEnd:
+		return "end beyond chromosome end"
+	case UnknownChromosome:
+		return "unknown chromosome"
+	default:
+		return fmt.Sprintf("AnomalyReason(%d)", int(reason))
+	}
+}
+
+// An Anomaly reports a region with suspicious coordinates.
+type Anomaly struct {
+	Region  *Region
+	Reasons []AnomalyReason
+}
+
+// DetectAnomalies reports regions of a bed with suspicious
+// coordinates, which often result from shifted or missing columns in
+// malformed input, for review by the user. Unlike a strict
+// validation, this does not fail on the first problem, but lists all
+// reasons for suspicion per region. The chromosome checks are only
+// performed if lengths is not nil. Anomalies are ordered by
+// chromosome name and start position.
+func DetectAnomalies(bed *Bed, lengths map[utils.Symbol]int32) (anomalies []Anomaly) {
+	for _, region := range allSortedRegions(bed) {
+		if reasons := regionAnomalies(region, lengths); len(reasons) > 0 {
+			anomalies = append(anomalies, Anomaly{Region: region, Reasons: reasons})
+		}
+	}
+	return anomalies
+}
+
+// Returns the reasons why the coordinates of a region are suspicious,
+// as described for DetectAnomalies.
+func regionAnomalies(region *Region, lengths map[utils.Symbol]int32) (reasons []AnomalyReason) {
+	if region.Start > region.End {
+		reasons = append(reasons, NegativeLength)
+	} else if region.Start == region.End {
+		reasons = append(reasons, ZeroLength)
+	}
+	if region.Start < 0 {
+		reasons = append(reasons, NegativeStart)
+	}
+	if lengths != nil {
+		if length, found := lengths[region.Chrom]; !found {
+			reasons = append(reasons, UnknownChromosome)
+		} else if region.End > length {
+			reasons = append(reasons, BeyondChromosomeEnd)
+		}
+	}
+	return reasons
+}
+
+// Issue kinds reported by ValidateBedFile, in addition to the
+// AnomalyReasons.
+const (
+	// A line that cannot be parsed as a track or a region.
+	MalformedLine = "malformed line"
+	// A region that overlaps with a region on an earlier line.
+	OverlappingRegion = "overlapping region"
+)
+
+// A ValidationIssue reports a problem with a line of a BED file.
+type ValidationIssue struct {
+	// The 1-based line number.
+	Line int
+	// Either MalformedLine, OverlappingRegion, or the String() of an
+	// AnomalyReason.
+	Kind   string
+	Detail string
+}
+
+// A ValidationReport summarizes the result of ValidateBedFile.
+type ValidationReport struct {
+	Lines, Regions int
+	// Issues ordered by line number.
+	Issues []ValidationIssue
+}
+
+// ValidateBedFile checks a BED file line by line, and reports all
+// problems it finds instead of stopping at the first one: lines that
+// cannot be parsed, regions with suspicious coordinates as described
+// for DetectAnomalies, and regions that overlap with other regions.
+// The chromosome checks are only performed if lengths is not nil.
+// Empty lines, comment lines, and browser lines are skipped. Returns
+// an error only if the file cannot be read.
+func ValidateBedFile(filename string, lengths map[utils.Symbol]int32) (report *ValidationReport, err error) {
+	input, err := openInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := input.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	report = &ValidationReport{}
+	lineNumbers := make(map[*Region]int)
+	bed := NewBed()
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		report.Lines++
+		line := scanner.Text()
+		if isSkippedLine(line) || isTrackLine(line) {
+			continue
+		}
+		region, err := parseRegionLine(strings.Split(line, "\t"), StandardLayout)
+		if err != nil {
+			report.Issues = append(report.Issues, ValidationIssue{Line: report.Lines, Kind: MalformedLine, Detail: strings.TrimSpace(err.Error())})
+			continue
+		}
+		report.Regions++
+		for _, reason := range regionAnomalies(region, lengths) {
+			report.Issues = append(report.Issues, ValidationIssue{
+				Line:   report.Lines,
+				Kind:   reason.String(),
+				Detail: fmt.Sprintf("%v:%v-%v", *region.Chrom, region.Start, region.End),
+			})
+		}
+		lineNumbers[region] = report.Lines
+		AddRegion(bed, region)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading bed file: %v", err)
+	}
+	for _, chrom := range sortedChroms(bed) {
+		var previous *Region
+		for _, region := range sortedRegions(bed.RegionMap[chrom]) {
+			if previous != nil && region.Start < previous.End {
+				report.Issues = append(report.Issues, ValidationIssue{
+					Line:   lineNumbers[region],
+					Kind:   OverlappingRegion,
+					Detail: fmt.Sprintf("%v:%v-%v overlaps with line %v", *region.Chrom, region.Start, region.End, lineNumbers[previous]),
+				})
+			}
+			if previous == nil || region.End > previous.End {
+				previous = region
+			}
+		}
+	}
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		return report.Issues[i].Line < report.Issues[j].Line
+	})
+	return report, nil
+}
+
+// WriteValidationReport writes a report created by ValidateBedFile as
+// a tab-separated table of issues with a header line, followed by a
+// summary with one "# key<TAB>count" line each for the number of
+// lines, regions, and issues, and for the number of issues per kind.
+func WriteValidationReport(w io.Writer, report *ValidationReport) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprint(out, "line\tissue\tdetail\n")
+	counts := make(map[string]int)
+	for _, issue := range report.Issues {
+		fmt.Fprintf(out, "%v\t%v\t%v\n", issue.Line, issue.Kind, issue.Detail)
+		counts[issue.Kind]++
+	}
+	fmt.Fprintf(out, "# lines\t%v\n# regions\t%v\n# issues\t%v\n", report.Lines, report.Regions, len(report.Issues))
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(out, "# %v\t%v\n", kind, counts[kind])
+	}
+	return out.Flush()
+}
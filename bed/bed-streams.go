@@ -0,0 +1,316 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// A RegionStream produces regions one at a time, ordered by
+// chromosome name, in natural order, and start position. Streams can be chained, for
+// example to merge regions, then subtract other regions, and then
+// filter the result, without materializing intermediate Beds. A
+// consumer can stop reading from a stream at any time.
+type RegionStream interface {
+	// Next returns the next region of the stream, or nil if the
+	// stream is exhausted. Once exhausted, a stream keeps returning
+	// nil.
+	Next() *Region
+}
+
+type bedStream struct {
+	bed     *Bed
+	chroms  []utils.Symbol
+	regions []*Region
+}
+
+// Stream returns a RegionStream that produces the regions of a bed,
+// ordered by chromosome name and start position. The regions of each
+// chromosome are sorted when the stream reaches it, so the bed need
+// not be sorted. The bed must not be modified while the stream is in
+// use.
+func Stream(bed *Bed) RegionStream {
+	return &bedStream{bed: bed, chroms: sortedChroms(bed)}
+}
+
+// StreamInOrder returns a RegionStream that produces the regions of
+// the given chromosomes of a bed, in the given chromosome order, and
+// by start position within each chromosome. Regions on other
+// chromosomes are skipped. See HeaderChromOrder for obtaining the
+// chromosome order of a SAM header.
+func StreamInOrder(bed *Bed, chroms []utils.Symbol) RegionStream {
+	return &bedStream{bed: bed, chroms: chroms}
+}
+
+func (s *bedStream) Next() *Region {
+	for len(s.regions) == 0 {
+		if len(s.chroms) == 0 {
+			return nil
+		}
+		s.regions = sortedRegions(s.bed.RegionMap[s.chroms[0]])
+		s.chroms = s.chroms[1:]
+	}
+	region := s.regions[0]
+	s.regions = s.regions[1:]
+	return region
+}
+
+// Collect reads all remaining regions of a stream, and returns them
+// as a new, sorted Bed.
+func Collect(s RegionStream) *Bed {
+	result := NewBed()
+	for region := s.Next(); region != nil; region = s.Next() {
+		AddRegion(result, region)
+	}
+	sortRegions(result)
+	return result
+}
+
+type mergeStream struct {
+	in   RegionStream
+	next *Region
+	done bool
+}
+
+// MergeStream returns a RegionStream that combines overlapping and
+// adjacent regions of a sorted stream into single regions, as
+// described for Merge.
+func MergeStream(in RegionStream) RegionStream {
+	return &mergeStream{in: in}
+}
+
+func (s *mergeStream) Next() *Region {
+	if s.done {
+		return nil
+	}
+	region := s.next
+	if region == nil {
+		if region = s.in.Next(); region == nil {
+			s.done = true
+			return nil
+		}
+	}
+	merged := &Region{Chrom: region.Chrom, Start: region.Start, End: region.End}
+	strand := region.Strand()
+	for {
+		region = s.in.Next()
+		if region == nil || region.Chrom != merged.Chrom || region.Start > merged.End {
+			break
+		}
+		if region.End > merged.End {
+			merged.End = region.End
+		}
+		if region.Strand() != strand {
+			strand = nil
+		}
+	}
+	s.next = region
+	s.done = region == nil
+	if strand != nil {
+		merged.OptionalFields = []interface{}{".", 0, strand}
+	}
+	return merged
+}
+
+// Keeps track of the regions of a sorted stream that may overlap with
+// the regions of another sorted stream, which are visited in order.
+type overlapWindow struct {
+	in     RegionStream
+	next   *Region
+	chrom  utils.Symbol
+	active []*Region
+	// Maps chromosomes onto their position in the chromosome order,
+	// or nil if chromosomes are ordered by name.
+	ranks map[utils.Symbol]int
+}
+
+func newOverlapWindow(in RegionStream, chroms []utils.Symbol) *overlapWindow {
+	w := &overlapWindow{in: in, next: in.Next()}
+	if chroms != nil {
+		w.ranks = make(map[utils.Symbol]int, len(chroms))
+		for i, chrom := range chroms {
+			w.ranks[chrom] = i
+		}
+	}
+	return w
+}
+
+// Determines whether chrom1 comes before chrom2 in the chromosome
+// order.
+func (w *overlapWindow) before(chrom1, chrom2 utils.Symbol) bool {
+	if w.ranks == nil {
+		return chromLess(chrom1, chrom2)
+	}
+	return w.ranks[chrom1] < w.ranks[chrom2]
+}
+
+// Advances the window to the given region, and returns the regions
+// that overlap with it, sorted by start position. Regions passed to
+// successive calls must be sorted.
+func (w *overlapWindow) advance(region *Region) []*Region {
+	if w.chrom != region.Chrom {
+		w.chrom = region.Chrom
+		w.active = w.active[:0]
+		for w.next != nil && w.before(w.next.Chrom, region.Chrom) {
+			w.next = w.in.Next()
+		}
+	}
+	k := 0
+	for _, active := range w.active {
+		if active.End > region.Start {
+			w.active[k] = active
+			k++
+		}
+	}
+	w.active = w.active[:k]
+	for ; w.next != nil && w.next.Chrom == region.Chrom && w.next.Start < region.End; w.next = w.in.Next() {
+		if w.next.End > region.Start {
+			w.active = append(w.active, w.next)
+		}
+	}
+	return w.active
+}
+
+type intersectStream struct {
+	a       RegionStream
+	b       *overlapWindow
+	pending []*Region
+}
+
+// IntersectStream returns a RegionStream that produces the stretches
+// covered by both a region of a and a region of b, as described for
+// Intersect. Both input streams must be sorted. The result is only
+// guaranteed to be sorted if the regions of a do not overlap with
+// each other, for example because a is the result of MergeStream.
+func IntersectStream(a, b RegionStream) RegionStream {
+	return &intersectStream{a: a, b: newOverlapWindow(b, nil)}
+}
+
+// IntersectStreamInOrder is like IntersectStream, but for input
+// streams that are ordered by the given chromosome order instead of
+// chromosome name, such as the streams returned by StreamInOrder.
+// Both input streams must only contain regions on the given
+// chromosomes.
+func IntersectStreamInOrder(a, b RegionStream, chroms []utils.Symbol) RegionStream {
+	return &intersectStream{a: a, b: newOverlapWindow(b, chroms)}
+}
+
+func (s *intersectStream) Next() *Region {
+	for len(s.pending) == 0 {
+		aRegion := s.a.Next()
+		if aRegion == nil {
+			return nil
+		}
+		for _, bRegion := range s.b.advance(aRegion) {
+			if overlapLength(aRegion, bRegion) > 0 {
+				s.pending = append(s.pending, overlapRegion(aRegion, bRegion))
+			}
+		}
+	}
+	region := s.pending[0]
+	s.pending = s.pending[1:]
+	return region
+}
+
+type subtractStream struct {
+	a       RegionStream
+	b       *overlapWindow
+	pending []*Region
+}
+
+// SubtractStream returns a RegionStream that produces the stretches
+// of the regions of a that are not covered by any region of b,
+// similar to bedtools subtract. A region of a may result in several
+// regions, which share its optional fields. Both input streams must
+// be sorted. The result is only guaranteed to be sorted if the
+// regions of a do not overlap with each other.
+func SubtractStream(a, b RegionStream) RegionStream {
+	return &subtractStream{a: a, b: newOverlapWindow(b, nil)}
+}
+
+// SubtractStreamInOrder is like SubtractStream, but for input
+// streams that are ordered by the given chromosome order instead of
+// chromosome name, such as the streams returned by StreamInOrder.
+// Both input streams must only contain regions on the given
+// chromosomes.
+func SubtractStreamInOrder(a, b RegionStream, chroms []utils.Symbol) RegionStream {
+	return &subtractStream{a: a, b: newOverlapWindow(b, chroms)}
+}
+
+func (s *subtractStream) Next() *Region {
+	for len(s.pending) == 0 {
+		aRegion := s.a.Next()
+		if aRegion == nil {
+			return nil
+		}
+		pos := aRegion.Start
+		for _, bRegion := range s.b.advance(aRegion) {
+			if bRegion.Start > pos {
+				s.pending = append(s.pending, &Region{Chrom: aRegion.Chrom, Start: pos, End: bRegion.Start, OptionalFields: aRegion.OptionalFields})
+			}
+			if bRegion.End > pos {
+				pos = bRegion.End
+			}
+		}
+		if pos < aRegion.End {
+			s.pending = append(s.pending, &Region{Chrom: aRegion.Chrom, Start: pos, End: aRegion.End, OptionalFields: aRegion.OptionalFields})
+		}
+	}
+	region := s.pending[0]
+	s.pending = s.pending[1:]
+	return region
+}
+
+type filterStream struct {
+	in   RegionStream
+	keep func(*Region) bool
+}
+
+// FilterStream returns a RegionStream that only produces the regions
+// of a stream for which keep returns true.
+func FilterStream(in RegionStream, keep func(*Region) bool) RegionStream {
+	return &filterStream{in: in, keep: keep}
+}
+
+func (s *filterStream) Next() *Region {
+	for region := s.in.Next(); region != nil; region = s.in.Next() {
+		if s.keep(region) {
+			return region
+		}
+	}
+	return nil
+}
+
+// Subtract returns a new, sorted Bed with the stretches of the
+// regions of a that are not covered by any region of b. See
+// SubtractStream.
+func Subtract(a, b *Bed) *Bed {
+	return Collect(SubtractStream(Stream(a), Stream(b)))
+}
+
+// Complement returns a new, sorted Bed with the stretches of the
+// chromosomes listed in lengths that are not covered by any region of
+// the bed, for example to keep everything except blacklisted regions.
+// Chromosome lengths can be obtained from a SAM header with
+// ChromLengths, or from a chrom.sizes or .fai file with
+// ParseChromSizes. Regions on chromosomes that are not listed in
+// lengths are ignored. The resulting regions have no optional fields.
+func Complement(bed *Bed, lengths map[utils.Symbol]int32) *Bed {
+	return Subtract(GenomeBed(lengths), bed)
+}
@@ -19,9 +19,11 @@
 package bed
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/exascience/elprep/v4/utils"
 )
@@ -61,6 +63,33 @@ var (
 	SR = utils.Intern("-")
 )
 
+// Name returns the name of a region, or the empty string if the
+// region has no name.
+func (region *Region) Name() string {
+	if len(region.OptionalFields) > brName {
+		return region.OptionalFields[brName].(string)
+	}
+	return ""
+}
+
+// Score returns the score of a region. The second return value is
+// false if the region has no score.
+func (region *Region) Score() (int, bool) {
+	if len(region.OptionalFields) > brScore {
+		return region.OptionalFields[brScore].(int), true
+	}
+	return 0, false
+}
+
+// Strand returns the strand of a region, which is either SF or SR, or
+// nil if the region has no strand.
+func (region *Region) Strand() utils.Symbol {
+	if len(region.OptionalFields) > brStrand {
+		return region.OptionalFields[brStrand].(utils.Symbol)
+	}
+	return nil
+}
+
 // NewRegion allocates and initializes a new Region. Optional fields
 // are given in order. If a "later" field is entered, then the
 // "earlier" field was entered as well. See
@@ -91,6 +120,74 @@ const (
 	brBlockStarts
 )
 
+// An RGB value is the display color of a region, as given by the
+// itemRgb field of a BED file.
+type RGB struct {
+	R, G, B uint8
+}
+
+// String formats an RGB value as in a BED file: "R,G,B", or "0" for
+// black, which is the common notation for regions without a color.
+func (rgb RGB) String() string {
+	if rgb == (RGB{}) {
+		return "0"
+	}
+	return fmt.Sprintf("%v,%v,%v", rgb.R, rgb.G, rgb.B)
+}
+
+// An ItemRgb is the itemRgb field of a region. It keeps the form in
+// which the field was given, so that it is written back unchanged.
+type ItemRgb struct {
+	// The display color, which is black for "0" and "on".
+	RGB
+	text string
+}
+
+// String formats an ItemRgb as it was given in the BED file.
+func (item ItemRgb) String() string {
+	if item.text != "" {
+		return item.text
+	}
+	return item.RGB.String()
+}
+
+// Parses an itemRgb field, which is either "R,G,B", "0", or "on".
+func parseItemRgb(val string) (item ItemRgb, err error) {
+	item.text = val
+	if val == "0" || val == "on" {
+		return item, nil
+	}
+	entries := strings.Split(val, ",")
+	if len(entries) != 3 {
+		return item, fmt.Errorf("expected R,G,B, 0, or on, got %v", val)
+	}
+	var components [3]uint8
+	for i, entry := range entries {
+		n, err := strconv.ParseUint(entry, 10, 8)
+		if err != nil {
+			return item, err
+		}
+		components[i] = uint8(n)
+	}
+	item.RGB = RGB{R: components[0], G: components[1], B: components[2]}
+	return item, nil
+}
+
+// Parses a comma-separated list of integers, as used for the
+// BlockSizes and BlockStarts fields. A trailing comma is allowed.
+func parseInt32List(val string) ([]int32, error) {
+	entries := strings.Split(strings.TrimSuffix(val, ","), ",")
+	list := make([]int32, len(entries))
+	for i, entry := range entries {
+		n, err := strconv.ParseInt(entry, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = int32(n)
+	}
+	return list, nil
+}
+
 // Allocates a fresh SmallMap to initialize a Region's optional
 // fields.
 func initializeRegionFields(fields []string) ([]interface{}, error) {
@@ -123,11 +220,11 @@ func initializeRegionFields(fields []string) ([]interface{}, error) {
 			}
 			brFields[brThickEnd] = end
 		case brItemRgb:
-			if val == "on" {
-				brFields[brItemRgb] = true
-			} else {
-				brFields[brItemRgb] = false
+			item, err := parseItemRgb(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ItemRgb field: %v", err)
 			}
+			brFields[brItemRgb] = item
 		case brBlockCount:
 			count, err := strconv.Atoi(val)
 			if err != nil {
@@ -135,21 +232,32 @@ func initializeRegionFields(fields []string) ([]interface{}, error) {
 			}
 			brFields[brBlockCount] = count
 		case brBlockSizes:
-			sizes, err := strconv.Atoi(val)
+			sizes, err := parseInt32List(val)
 			if err != nil {
 				return nil, fmt.Errorf("invalid BlockSizes field: %v", err)
 			}
 			brFields[brBlockSizes] = sizes
 		case brBlockStarts:
-			start, err := strconv.Atoi(val)
+			starts, err := parseInt32List(val)
 			if err != nil {
 				return nil, fmt.Errorf("invalid BlockStarts field: %v", err)
 			}
-			brFields[brBlockStarts] = start
+			brFields[brBlockStarts] = starts
 		default:
 			return nil, fmt.Errorf("invalid optional field: %v out of 0-8", val)
 		}
 	}
+	if len(brFields) > brBlockSizes {
+		count := brFields[brBlockCount].(int)
+		if sizes := brFields[brBlockSizes].([]int32); len(sizes) != count {
+			return nil, fmt.Errorf("invalid BlockSizes field: %v sizes for BlockCount %v", len(sizes), count)
+		}
+		if len(brFields) > brBlockStarts {
+			if starts := brFields[brBlockStarts].([]int32); len(starts) != count {
+				return nil, fmt.Errorf("invalid BlockStarts field: %v starts for BlockCount %v", len(starts), count)
+			}
+		}
+	}
 	return brFields, nil
 }
 
@@ -160,6 +268,22 @@ func NewTrack(fields map[string]string) *Track {
 	}
 }
 
+// TrackRegionMap returns the regions of a track, mapped by chromosome
+// name and sorted by start position, in the same form as
+// Bed.RegionMap.
+func TrackRegionMap(track *Track) map[utils.Symbol][]*Region {
+	regionMap := make(map[utils.Symbol][]*Region)
+	for _, region := range track.Regions {
+		regionMap[region.Chrom] = append(regionMap[region.Chrom], region)
+	}
+	for _, regions := range regionMap {
+		sort.SliceStable(regions, func(i, j int) bool {
+			return regions[i].Start < regions[j].Start
+		})
+	}
+	return regionMap
+}
+
 // NewBed allocates and initializes an empty bed.
 func NewBed() *Bed {
 	return &Bed{
@@ -167,12 +291,89 @@ func NewBed() *Bed {
 	}
 }
 
-// AddRegion adds a region to the bed region map.
+// AddRegion adds a region to the bed region map. AddRegion is not
+// safe for concurrent use. Use a Builder to add regions from several
+// goroutines.
 func AddRegion(bed *Bed, region *Region) {
 	// append the region entry
 	bed.RegionMap[region.Chrom] = append(bed.RegionMap[region.Chrom], region)
 }
 
+// A Triple describes a region by chromosome name, start and end
+// position only.
+type Triple = struct {
+	Chrom      string
+	Start, End int32
+}
+
+// FromTriples creates a Bed from a slice of region triples. Returns
+// an error for the first triple with invalid coordinates. The regions
+// of the resulting Bed are sorted.
+func FromTriples(triples []Triple) (*Bed, error) {
+	bed := NewBed()
+	for i, triple := range triples {
+		if triple.Start < 0 {
+			return nil, fmt.Errorf("invalid bed region start in triple %v: %v", i, triple.Start)
+		}
+		if triple.End < triple.Start {
+			return nil, fmt.Errorf("invalid bed region end in triple %v: %v < %v", i, triple.End, triple.Start)
+		}
+		AddRegion(bed, &Region{
+			Chrom: utils.Intern(triple.Chrom),
+			Start: triple.Start,
+			End:   triple.End,
+		})
+	}
+	sortRegions(bed)
+	return bed, nil
+}
+
+// GenomeBed creates a Bed with one region per chromosome that spans
+// the whole chromosome, from 0 to its length, for example as input
+// for operations that need the whole genome as a region set.
+func GenomeBed(lengths map[utils.Symbol]int32) *Bed {
+	bed := NewBed()
+	for chrom, length := range lengths {
+		AddRegion(bed, &Region{Chrom: chrom, Start: 0, End: length})
+	}
+	return bed
+}
+
+// BoundingRegion returns the smallest region on the given chromosome
+// that contains all given 0-based positions. The positions need not
+// be sorted. The resulting region has no optional fields. Returns an
+// error if no positions are given.
+func BoundingRegion(chrom utils.Symbol, positions []int32) (*Region, error) {
+	if len(positions) == 0 {
+		return nil, errors.New("no positions for bounding region")
+	}
+	start, end := positions[0], positions[0]
+	for _, pos := range positions[1:] {
+		if pos < start {
+			start = pos
+		} else if pos > end {
+			end = pos
+		}
+	}
+	return &Region{Chrom: chrom, Start: start, End: end + 1}, nil
+}
+
+// InsertSorted inserts a region into the region map of a bed whose
+// regions are sorted, such that they remain sorted. A region is
+// inserted after any regions with the same start position. This takes
+// O(n) time per insertion for shifting the regions of the chromosome,
+// which is still cheaper than sorting them again after each addition.
+func (bed *Bed) InsertSorted(region *Region) {
+	regions := bed.RegionMap[region.Chrom]
+	i := sort.Search(len(regions), func(i int) bool {
+		return regions[i].Start > region.Start
+	})
+	regions = append(regions, nil)
+	copy(regions[i+1:], regions[i:])
+	regions[i] = region
+	bed.RegionMap[region.Chrom] = regions
+}
+
 // A function for sorting the bed regions.
 func sortRegions(bed *Bed) {
 	for _, regions := range bed.RegionMap {
@@ -181,3 +382,53 @@ func sortRegions(bed *Bed) {
 		})
 	}
 }
+
+// Returns the blocks (exons) of a region as absolute start and end
+// positions, in ascending order. A region without block information
+// consists of a single block.
+func (region *Region) blocks() (starts, ends []int32) {
+	if len(region.OptionalFields) <= brBlockStarts {
+		return []int32{region.Start}, []int32{region.End}
+	}
+	sizes := region.OptionalFields[brBlockSizes].([]int32)
+	relativeStarts := region.OptionalFields[brBlockStarts].([]int32)
+	for i, relativeStart := range relativeStarts {
+		if i >= len(sizes) {
+			break
+		}
+		start := region.Start + relativeStart
+		starts = append(starts, start)
+		ends = append(ends, start+sizes[i])
+	}
+	return starts, ends
+}
+
+// ProjectToTranscript maps a 0-based genomic position onto a 0-based
+// position in spliced transcript coordinates, given a (BED12)
+// transcript region with exon blocks. The transcript position is the
+// sum of the lengths of all exons that precede the position in
+// transcription direction, plus the offset within the exon
+// containing the position. Regions on the reverse strand are
+// transcribed from End to Start.
+//
+// The second return value is false if the position falls in an
+// intron or outside of the region.
+func ProjectToTranscript(region *Region, pos int32) (int32, bool) {
+	starts, ends := region.blocks()
+	var offset, total int32
+	found := false
+	for i, start := range starts {
+		if start <= pos && pos < ends[i] {
+			offset = total + pos - start
+			found = true
+		}
+		total += ends[i] - start
+	}
+	if !found {
+		return 0, false
+	}
+	if region.Strand() == SR {
+		return total - 1 - offset, true
+	}
+	return offset, true
+}
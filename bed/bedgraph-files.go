@@ -0,0 +1,137 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// A BedGraphEntry assigns a value to a range of positions.
+type BedGraphEntry struct {
+	Start, End int32
+	Value      float64
+}
+
+// ParseBedGraph parses a bedGraph file. See
+// https://genome.ucsc.edu/goldenPath/help/bedgraph.html
+//
+// Track, browser, and comment lines are skipped. The entries of each
+// chromosome are sorted by start position, and are expected not to
+// overlap.
+func ParseBedGraph(filename string) (track map[utils.Symbol][]BedGraphEntry, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	track = make(map[utils.Symbol][]BedGraphEntry)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		data := strings.Fields(line)
+		if len(data) < 4 {
+			return nil, fmt.Errorf("invalid bedGraph line: %v", line)
+		}
+		start, err := strconv.ParseInt(data[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bedGraph start: %v", err)
+		}
+		end, err := strconv.ParseInt(data[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bedGraph end: %v", err)
+		}
+		value, err := strconv.ParseFloat(data[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bedGraph value: %v", err)
+		}
+		chrom := utils.Intern(data[0])
+		track[chrom] = append(track[chrom], BedGraphEntry{Start: int32(start), End: int32(end), Value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading bedGraph file: %v", err)
+	}
+	for _, entries := range track {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Start < entries[j].Start
+		})
+	}
+	return track, nil
+}
+
+// MeanValue computes the mean value of a bedGraph track over the bases
+// of a region. Bases that are not covered by any entry of the track
+// count as 0.
+func MeanValue(track map[utils.Symbol][]BedGraphEntry, region *Region) float64 {
+	length := region.End - region.Start
+	if length <= 0 {
+		return 0
+	}
+	entries := track[region.Chrom]
+	var sum float64
+	for i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].End > region.Start
+	}); i < len(entries) && entries[i].Start < region.End; i++ {
+		start, end := entries[i].Start, entries[i].End
+		if start < region.Start {
+			start = region.Start
+		}
+		if end > region.End {
+			end = region.End
+		}
+		sum += float64(end-start) * entries[i].Value
+	}
+	return sum / float64(length)
+}
+
+// A ScoredRegion is a region together with a value computed for it.
+type ScoredRegion struct {
+	Region *Region
+	Score  float64
+}
+
+// FilterByMappability computes the mean mappability of each region of
+// a bed according to a mappability track, and returns a new, sorted
+// Bed with the regions whose mean mappability is at least threshold.
+// The regions that are dropped are returned together with their mean
+// mappability, ordered by chromosome name and start position.
+func FilterByMappability(bed *Bed, track map[utils.Symbol][]BedGraphEntry, threshold float64) (kept *Bed, dropped []ScoredRegion) {
+	kept = NewBed()
+	for _, region := range allSortedRegions(bed) {
+		if score := MeanValue(track, region); score >= threshold {
+			AddRegion(kept, region)
+		} else {
+			dropped = append(dropped, ScoredRegion{Region: region, Score: score})
+		}
+	}
+	return kept, dropped
+}
@@ -0,0 +1,333 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+/*
+A bigBed file is an indexed binary BED file, as described in
+https://genome.ucsc.edu/goldenPath/help/bigBed.html and in Kent et al.,
+BigWig and BigBed: enabling browsing of large distributed datasets,
+Bioinformatics 26(17), 2010. The parts relevant for reading regions
+are:
+
+  header, 64 bytes, at offset 0:
+    magic, version, zoomLevels, chromTreeOffset, dataOffset,
+    indexOffset, fieldCount, definedFieldCount, autoSqlOffset,
+    totalSummaryOffset, uncompressBufSize, extensionOffset
+  chromosome B+ tree at chromTreeOffset, mapping chromosome names
+    onto chromosome IDs
+  data blocks, possibly zlib-compressed, each consisting of records
+    with a chromosome ID, start, end, and a zero-terminated string
+    with the remaining tab-separated fields
+  R-tree at indexOffset, mapping genomic ranges onto data blocks
+
+All numbers are in the byte order indicated by the magic number.
+*/
+
+const (
+	bigBedMagic    = 0x8789F2EB
+	bptMagic       = 0x78CA8C91
+	cirTreeMagic   = 0x2468ACE0
+	bigBedHdrSize  = 64
+	bptHdrSize     = 32
+	cirTreeHdrSize = 48
+)
+
+type bigBedFile struct {
+	file              io.ReaderAt
+	order             binary.ByteOrder
+	chromTreeOffset   uint64
+	indexOffset       uint64
+	definedFieldCount int
+	uncompressBufSize uint32
+	chromNames        map[uint32]string
+	chromIDs          map[string]uint32
+}
+
+// Reads n bytes at the given offset.
+func (bb *bigBedFile) read(offset uint64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := bb.file.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func openBigBed(file io.ReaderAt) (*bigBedFile, error) {
+	bb := &bigBedFile{file: file, order: binary.LittleEndian}
+	header, err := bb.read(0, bigBedHdrSize)
+	if err != nil {
+		return nil, fmt.Errorf("not a bigBed file - %v", err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(header) == bigBedMagic:
+	case binary.BigEndian.Uint32(header) == bigBedMagic:
+		bb.order = binary.BigEndian
+	default:
+		return nil, errors.New("not a bigBed file - invalid magic number")
+	}
+	bb.chromTreeOffset = bb.order.Uint64(header[8:])
+	bb.indexOffset = bb.order.Uint64(header[24:])
+	bb.definedFieldCount = int(bb.order.Uint16(header[34:]))
+	bb.uncompressBufSize = bb.order.Uint32(header[52:])
+	if err := bb.readChromTree(); err != nil {
+		return nil, err
+	}
+	return bb, nil
+}
+
+// Reads the chromosome B+ tree.
+func (bb *bigBedFile) readChromTree() error {
+	header, err := bb.read(bb.chromTreeOffset, bptHdrSize)
+	if err != nil {
+		return err
+	}
+	if bb.order.Uint32(header) != bptMagic {
+		return errors.New("invalid bigBed chromosome tree")
+	}
+	keySize := int(bb.order.Uint32(header[8:]))
+	bb.chromNames = make(map[uint32]string)
+	bb.chromIDs = make(map[string]uint32)
+	var readNode func(offset uint64) error
+	readNode = func(offset uint64) error {
+		nodeHeader, err := bb.read(offset, 4)
+		if err != nil {
+			return err
+		}
+		isLeaf := nodeHeader[0] != 0
+		count := int(bb.order.Uint16(nodeHeader[2:]))
+		itemSize := keySize + 8
+		items, err := bb.read(offset+4, count*itemSize)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			item := items[i*itemSize : (i+1)*itemSize]
+			if isLeaf {
+				name := string(bytes.TrimRight(item[:keySize], "\x00"))
+				id := bb.order.Uint32(item[keySize:])
+				bb.chromNames[id] = name
+				bb.chromIDs[name] = id
+			} else if err := readNode(bb.order.Uint64(item[keySize:])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return readNode(bb.chromTreeOffset + bptHdrSize)
+}
+
+// A bigBedBlock is the location of a data block in a bigBed file.
+type bigBedBlock struct {
+	offset, size uint64
+}
+
+// Compares two (chromosome ID, position) pairs.
+func bigBedLess(chrom1, pos1, chrom2, pos2 uint32) bool {
+	return chrom1 < chrom2 || (chrom1 == chrom2 && pos1 < pos2)
+}
+
+// Returns the data blocks that may contain records that overlap with
+// the given range, or all data blocks if all is true.
+func (bb *bigBedFile) findBlocks(chrom, start, end uint32, all bool) (blocks []bigBedBlock, err error) {
+	header, err := bb.read(bb.indexOffset, cirTreeHdrSize)
+	if err != nil {
+		return nil, err
+	}
+	if bb.order.Uint32(header) != cirTreeMagic {
+		return nil, errors.New("invalid bigBed R-tree index")
+	}
+	var readNode func(offset uint64) error
+	readNode = func(offset uint64) error {
+		nodeHeader, err := bb.read(offset, 4)
+		if err != nil {
+			return err
+		}
+		isLeaf := nodeHeader[0] != 0
+		count := int(bb.order.Uint16(nodeHeader[2:]))
+		itemSize := 24
+		if isLeaf {
+			itemSize = 32
+		}
+		items, err := bb.read(offset+4, count*itemSize)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			item := items[i*itemSize : (i+1)*itemSize]
+			if !all {
+				startChrom, startBase := bb.order.Uint32(item[0:]), bb.order.Uint32(item[4:])
+				endChrom, endBase := bb.order.Uint32(item[8:]), bb.order.Uint32(item[12:])
+				if !bigBedLess(startChrom, startBase, chrom, end) || !bigBedLess(chrom, start, endChrom, endBase) {
+					continue
+				}
+			}
+			if isLeaf {
+				blocks = append(blocks, bigBedBlock{offset: bb.order.Uint64(item[16:]), size: bb.order.Uint64(item[24:])})
+			} else if err := readNode(bb.order.Uint64(item[16:])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := readNode(bb.indexOffset + cirTreeHdrSize); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// Reads the records of a data block, and adds the regions for those
+// that overlap with the given range, or all of them if all is true,
+// to the bed.
+func (bb *bigBedFile) readBlock(bed *Bed, block bigBedBlock, chrom, start, end uint32, all bool) error {
+	data, err := bb.read(block.offset, int(block.size))
+	if err != nil {
+		return err
+	}
+	if bb.uncompressBufSize > 0 {
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return err
+		}
+		if err := reader.Close(); err != nil {
+			return err
+		}
+	}
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return errors.New("truncated bigBed record")
+		}
+		recordChrom := bb.order.Uint32(data[0:])
+		recordStart := bb.order.Uint32(data[4:])
+		recordEnd := bb.order.Uint32(data[8:])
+		rest := bytes.IndexByte(data[12:], 0)
+		if rest < 0 {
+			return errors.New("truncated bigBed record")
+		}
+		fields := string(data[12 : 12+rest])
+		data = data[12+rest+1:]
+		if !all && (recordChrom != chrom || recordStart >= end || recordEnd <= start) {
+			continue
+		}
+		name, found := bb.chromNames[recordChrom]
+		if !found {
+			return fmt.Errorf("unknown chromosome ID %v in bigBed record", recordChrom)
+		}
+		var optionalFields []string
+		if fields != "" {
+			optionalFields = strings.Split(fields, "\t")
+		}
+		// Fields beyond the BED standard fields are not supported.
+		if n := bb.definedFieldCount - 3; n >= 0 && len(optionalFields) > n {
+			optionalFields = optionalFields[:n]
+		}
+		if len(optionalFields) > brBlockStarts+1 {
+			optionalFields = optionalFields[:brBlockStarts+1]
+		}
+		region, err := NewRegion(utils.Intern(name), int32(recordStart), int32(recordEnd), optionalFields)
+		if err != nil {
+			return fmt.Errorf("invalid bigBed region: %v", err)
+		}
+		AddRegion(bed, region)
+	}
+	return nil
+}
+
+func (bb *bigBedFile) load(chrom, start, end uint32, all bool) (*Bed, error) {
+	blocks, err := bb.findBlocks(chrom, start, end, all)
+	if err != nil {
+		return nil, err
+	}
+	bed := NewBed()
+	for _, block := range blocks {
+		if err := bb.readBlock(bed, block, chrom, start, end, all); err != nil {
+			return nil, err
+		}
+	}
+	sortRegions(bed)
+	return bed, nil
+}
+
+// ParseBigBed parses a bigBed file, the indexed binary version of BED
+// files. See https://genome.ucsc.edu/goldenPath/help/bigBed.html
+//
+// Only the standard BED fields are loaded. Additional fields defined
+// by the autoSql schema of the file are ignored. The regions of the
+// resulting Bed are sorted.
+func ParseBigBed(filename string) (b *Bed, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	bb, err := openBigBed(file)
+	if err != nil {
+		return nil, fmt.Errorf("%v, while reading %v", err, filename)
+	}
+	return bb.load(0, 0, 0, true)
+}
+
+// ParseBigBedRange parses only the regions of a bigBed file that
+// overlap with the 0-based, half-open range [start, end) on the given
+// chromosome, using the R-tree index of the file to read only the
+// relevant data blocks. Otherwise like ParseBigBed. Returns an empty
+// Bed if the chromosome does not occur in the file.
+func ParseBigBedRange(filename, chrom string, start, end int32) (b *Bed, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	bb, err := openBigBed(file)
+	if err != nil {
+		return nil, fmt.Errorf("%v, while reading %v", err, filename)
+	}
+	id, found := bb.chromIDs[chrom]
+	if !found || start >= end {
+		return NewBed(), nil
+	}
+	if start < 0 {
+		start = 0
+	}
+	return bb.load(id, uint32(start), uint32(end), false)
+}
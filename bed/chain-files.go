@@ -0,0 +1,348 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// An ungapped block of a chain, where size bases starting at tStart
+// in the old assembly align with size bases starting at qStart in the
+// new assembly. qStart is relative to the strand of the chain.
+type chainBlock struct {
+	tStart, qStart, size int32
+}
+
+// A chain as defined in UCSC chain files.
+type chain struct {
+	score        float64
+	tName, qName utils.Symbol
+	tStart, tEnd int32
+	qSize        int32
+	qReverse     bool
+	blocks       []chainBlock // sorted by tStart
+}
+
+// A Liftover maps regions from an old assembly to a new assembly,
+// using the chains of a UCSC chain file.
+type Liftover struct {
+	chains map[utils.Symbol]*chainIndex
+}
+
+type chainIndex struct {
+	chains []*chain // sorted by tStart
+	// The tStart and tEnd positions of the chains, for finding the
+	// chains that overlap with a region.
+	bounds chromIndex
+}
+
+// ParseChainFile parses a UCSC chain file, which may be compressed
+// with gzip, for lifting regions over from the target assembly of the
+// chains (the old assembly) to their query assembly (the new
+// assembly). The filename "/dev/stdin" refers to standard input.
+//
+// See https://genome.ucsc.edu/goldenPath/help/chain.html
+func ParseChainFile(filename string) (l *Liftover, err error) {
+	input, err := openInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := input.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	chains, err := parseChains(input)
+	if err != nil {
+		return nil, err
+	}
+	return newLiftover(chains), nil
+}
+
+func parseChainInt(s string) (int32, error) {
+	i, err := strconv.ParseInt(s, 10, 32)
+	return int32(i), err
+}
+
+func parseChains(input io.Reader) (chains []*chain, err error) {
+	scanner := bufio.NewScanner(input)
+	var current *chain
+	var tPos, qPos int32
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		data := strings.Fields(line)
+		if data[0] == "chain" {
+			if current != nil {
+				return nil, fmt.Errorf("incomplete chain before line %v", lineNumber)
+			}
+			if len(data) < 12 {
+				return nil, fmt.Errorf("invalid chain header on line %v: %v", lineNumber, line)
+			}
+			var ints [6]int32
+			for i, index := range []int{3, 5, 6, 8, 10, 11} {
+				if ints[i], err = parseChainInt(data[index]); err != nil {
+					return nil, fmt.Errorf("invalid chain header on line %v: %v", lineNumber, err)
+				}
+			}
+			score, err := strconv.ParseFloat(data[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid chain score on line %v: %v", lineNumber, err)
+			}
+			if data[4] != "+" {
+				return nil, fmt.Errorf("invalid target strand on line %v: %v", lineNumber, data[4])
+			}
+			if data[9] != "+" && data[9] != "-" {
+				return nil, fmt.Errorf("invalid query strand on line %v: %v", lineNumber, data[9])
+			}
+			current = &chain{
+				score:    score,
+				tName:    utils.Intern(data[2]),
+				tStart:   ints[1],
+				tEnd:     ints[2],
+				qName:    utils.Intern(data[7]),
+				qSize:    ints[3],
+				qReverse: data[9] == "-",
+			}
+			tPos, qPos = ints[1], ints[4]
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("alignment data outside of a chain on line %v", lineNumber)
+		}
+		if len(data) != 1 && len(data) != 3 {
+			return nil, fmt.Errorf("invalid alignment data on line %v: %v", lineNumber, line)
+		}
+		size, err := parseChainInt(data[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid block size on line %v: %v", lineNumber, err)
+		}
+		current.blocks = append(current.blocks, chainBlock{tStart: tPos, qStart: qPos, size: size})
+		tPos += size
+		qPos += size
+		if len(data) == 1 {
+			if tPos != current.tEnd {
+				return nil, fmt.Errorf("chain ending on line %v does not match its header", lineNumber)
+			}
+			chains = append(chains, current)
+			current = nil
+			continue
+		}
+		dt, err := parseChainInt(data[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gap size on line %v: %v", lineNumber, err)
+		}
+		dq, err := parseChainInt(data[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gap size on line %v: %v", lineNumber, err)
+		}
+		tPos += dt
+		qPos += dq
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading chain file: %v", err)
+	}
+	if current != nil {
+		return nil, fmt.Errorf("incomplete chain at end of chain file")
+	}
+	return chains, nil
+}
+
+func newLiftover(chains []*chain) *Liftover {
+	lift := &Liftover{chains: make(map[utils.Symbol]*chainIndex)}
+	for _, c := range chains {
+		index := lift.chains[c.tName]
+		if index == nil {
+			index = &chainIndex{}
+			lift.chains[c.tName] = index
+		}
+		index.chains = append(index.chains, c)
+	}
+	for _, index := range lift.chains {
+		sort.SliceStable(index.chains, func(i, j int) bool {
+			return index.chains[i].tStart < index.chains[j].tStart
+		})
+		index.bounds.starts = make([]int32, len(index.chains))
+		index.bounds.ends = make([]int32, len(index.chains))
+		for i, c := range index.chains {
+			index.bounds.starts[i] = c.tStart
+			index.bounds.ends[i] = c.tEnd
+		}
+		index.bounds.initMaxEnds()
+	}
+	return lift
+}
+
+// Maps the range [start, end) of the old assembly onto the new
+// assembly, and returns the range in the new assembly spanned by the
+// mapped bases, and the number of mapped bases.
+func (c *chain) mapRange(start, end int32) (qStart, qEnd, mapped int32) {
+	i := sort.Search(len(c.blocks), func(i int) bool {
+		return c.blocks[i].tStart+c.blocks[i].size > start
+	})
+	for ; i < len(c.blocks) && c.blocks[i].tStart < end; i++ {
+		block := c.blocks[i]
+		s, e := block.tStart, block.tStart+block.size
+		if s < start {
+			s = start
+		}
+		if e > end {
+			e = end
+		}
+		qs, qe := block.qStart+s-block.tStart, block.qStart+e-block.tStart
+		if c.qReverse {
+			qs, qe = c.qSize-qe, c.qSize-qs
+		}
+		if mapped == 0 || qs < qStart {
+			qStart = qs
+		}
+		if mapped == 0 || qe > qEnd {
+			qEnd = qe
+		}
+		mapped += e - s
+	}
+	return qStart, qEnd, mapped
+}
+
+// Kinds of LiftoverIssue.
+const (
+	// A region none of whose bases map onto the new assembly.
+	DeletedInNew = "deleted in new"
+	// A region only some of whose bases map onto the new assembly.
+	PartiallyDeletedInNew = "partially deleted in new"
+)
+
+// A LiftoverIssue reports a region that could not be mapped
+// completely onto the new assembly.
+type LiftoverIssue struct {
+	// The region in the old assembly.
+	Region *Region
+	// Either DeletedInNew or PartiallyDeletedInNew.
+	Kind string
+	// The fraction of the bases of the region that map onto the new
+	// assembly, using the best chain.
+	Fraction float64
+	// Whether the region is part of the result of Lift.
+	Lifted bool
+}
+
+// A LiftoverReport summarizes the result of Lift.
+type LiftoverReport struct {
+	Regions, Lifted int
+	// Issues ordered by chromosome name and start position of the
+	// regions in the old assembly.
+	Issues []LiftoverIssue
+}
+
+// Lift maps the regions of a bed from the old assembly of a Liftover
+// onto its new assembly. Each region is mapped using the chain that
+// maps most of its bases, and spans the range between the first and
+// the last mapped base in the new assembly, which may therefore
+// include bases that are inserted in the new assembly. The strand of
+// regions that map onto the reverse strand is flipped. Only the name,
+// score, and strand fields of the regions are kept.
+//
+// Regions of which less than minMatch (between 0 and 1) of the bases
+// map onto the new assembly are dropped. The report lists all regions
+// that could not be mapped completely, including those that are
+// dropped. The regions of the resulting Bed are sorted.
+func (lift *Liftover) Lift(bed *Bed, minMatch float64) (*Bed, *LiftoverReport) {
+	result := NewBed()
+	report := &LiftoverReport{}
+	for stream := Stream(bed); ; {
+		region := stream.Next()
+		if region == nil {
+			break
+		}
+		report.Regions++
+		var best *chain
+		var qStart, qEnd, mapped int32
+		if index := lift.chains[region.Chrom]; index != nil {
+			lo, hi := index.bounds.candidates(region.Start, region.End)
+			for _, c := range index.chains[lo:hi] {
+				if s, e, m := c.mapRange(region.Start, region.End); m > mapped ||
+					(m == mapped && m > 0 && c.score > best.score) {
+					best, qStart, qEnd, mapped = c, s, e, m
+				}
+			}
+		}
+		length := region.End - region.Start
+		fraction := 1.0
+		if length > 0 {
+			fraction = float64(mapped) / float64(length)
+		}
+		lifted := best != nil && fraction >= minMatch
+		if best == nil || mapped < length {
+			kind := PartiallyDeletedInNew
+			if best == nil {
+				kind, fraction = DeletedInNew, 0
+			}
+			report.Issues = append(report.Issues, LiftoverIssue{Region: region, Kind: kind, Fraction: fraction, Lifted: lifted})
+		}
+		if !lifted {
+			continue
+		}
+		report.Lifted++
+		fields := region.OptionalFields
+		if len(fields) > brThickStart {
+			fields = fields[:brThickStart]
+		}
+		if best.qReverse && len(fields) > brStrand {
+			fields = append([]interface{}(nil), fields...)
+			switch fields[brStrand] {
+			case SF:
+				fields[brStrand] = SR
+			case SR:
+				fields[brStrand] = SF
+			}
+		}
+		AddRegion(result, &Region{Chrom: best.qName, Start: qStart, End: qEnd, OptionalFields: fields})
+	}
+	sortRegions(result)
+	return result, report
+}
+
+// WriteLiftoverReport writes a LiftoverReport as a tab-delimited
+// table, with one line per issue, followed by summary lines that
+// start with #.
+func WriteLiftoverReport(w io.Writer, report *LiftoverReport) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprint(out, "chrom\tstart\tend\tname\tissue\tfraction\tlifted\n")
+	for _, issue := range report.Issues {
+		name := issue.Region.Name()
+		if name == "" {
+			name = "."
+		}
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\t%.4f\t%v\n", *issue.Region.Chrom, issue.Region.Start, issue.Region.End,
+			name, issue.Kind, issue.Fraction, issue.Lifted)
+	}
+	fmt.Fprintf(out, "# regions\t%v\n# lifted\t%v\n# unmapped\t%v\n", report.Regions, report.Lifted, report.Regions-report.Lifted)
+	return out.Flush()
+}
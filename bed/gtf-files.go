@@ -0,0 +1,291 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// GTFOptions controls how ParseGTF converts features into regions.
+type GTFOptions struct {
+	// The feature types (third column) to load, for example "exon" or
+	// "CDS". If empty, only exons are loaded.
+	FeatureTypes []string
+	// If true, the features of all transcripts of the same gene are
+	// combined, and overlapping or adjacent features are merged into
+	// single regions named after the gene. Otherwise, there is one
+	// region per feature, named after its transcript.
+	CollapseTranscripts bool
+}
+
+// Parses the attributes column of a GTF or GFF3 line. GTF attributes
+// have the form key "value"; and GFF3 attributes have the form
+// key=value;
+func parseGTFAttributes(column string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(column, ";") {
+		attribute = strings.TrimSpace(attribute)
+		if attribute == "" {
+			continue
+		}
+		var key, val string
+		if i := strings.IndexByte(attribute, '='); i >= 0 {
+			key, val = attribute[:i], attribute[i+1:]
+		} else if i := strings.IndexAny(attribute, " \t"); i >= 0 {
+			key, val = attribute[:i], strings.Trim(strings.TrimSpace(attribute[i+1:]), "\"")
+		} else {
+			continue
+		}
+		if _, found := attributes[key]; !found {
+			attributes[key] = val
+		}
+	}
+	return attributes
+}
+
+// A gtfFeature is a feature of a GTF or GFF3 file with 0-based,
+// half-open coordinates.
+type gtfFeature struct {
+	chrom      utils.Symbol
+	start, end int32
+	strand     utils.Symbol
+	attributes map[string]string
+}
+
+// Returns the first of possibly several comma-separated GFF3 parents.
+func gff3Parent(attributes map[string]string) string {
+	parent := attributes["Parent"]
+	if i := strings.IndexByte(parent, ','); i >= 0 {
+		return parent[:i]
+	}
+	return parent
+}
+
+// ParseGTF parses a GTF or GFF3 annotation file into a Bed, selecting
+// features by type as specified in the options. Compressed files and
+// standard input are handled as for ParseBed. Coordinates are converted
+// from the 1-based, closed intervals of GTF and GFF3 to the 0-based,
+// half-open intervals of BED. See
+// https://www.ensembl.org/info/website/upload/gff.html and
+// https://github.com/The-Sequence-Ontology/Specifications/blob/master/gff3.md
+//
+// Each region gets a name, a score of 0, and the strand of its
+// feature, if known. Genes are identified by the gene_id attribute in
+// GTF files, and by following the Parent attributes up to the
+// top-level feature in GFF3 files. Gene names are taken from the
+// gene_name or Name attribute where available. Comment and directive
+// lines are skipped, and the FASTA section of a GFF3 file ends the
+// parse. The regions of the resulting Bed are sorted.
+func ParseGTF(filename string, options GTFOptions) (b *Bed, err error) {
+	input, err := openInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := input.Close(); err == nil {
+			err = nerr
+		}
+	}()
+
+	featureTypes := options.FeatureTypes
+	if len(featureTypes) == 0 {
+		featureTypes = []string{"exon"}
+	}
+	selected := make(map[string]bool, len(featureTypes))
+	for _, featureType := range featureTypes {
+		selected[featureType] = true
+	}
+
+	var features []gtfFeature
+	// GFF3 hierarchy: maps IDs onto parent IDs and names.
+	parents := make(map[string]string)
+	names := make(map[string]string)
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			if strings.HasPrefix(line, "##FASTA") {
+				break
+			}
+			continue
+		}
+		data := strings.Split(line, "\t")
+		if len(data) < 9 {
+			return nil, fmt.Errorf("invalid GTF/GFF line: %v", line)
+		}
+		attributes := parseGTFAttributes(data[8])
+		if id := attributes["ID"]; id != "" {
+			if parent := gff3Parent(attributes); parent != "" {
+				parents[id] = parent
+			}
+			if name := attributes["Name"]; name != "" {
+				names[id] = name
+			}
+		}
+		if !selected[data[2]] {
+			continue
+		}
+		start, err := strconv.ParseInt(data[3], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GTF/GFF feature start: %v", err)
+		}
+		end, err := strconv.ParseInt(data[4], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GTF/GFF feature end: %v", err)
+		}
+		if start < 1 || end < start {
+			return nil, fmt.Errorf("invalid GTF/GFF feature coordinates: %v-%v", start, end)
+		}
+		var strand utils.Symbol
+		switch data[6] {
+		case "+":
+			strand = SF
+		case "-":
+			strand = SR
+		}
+		features = append(features, gtfFeature{
+			chrom:      utils.Intern(data[0]),
+			start:      int32(start - 1),
+			end:        int32(end),
+			strand:     strand,
+			attributes: attributes,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading GTF/GFF file: %v", err)
+	}
+
+	// Returns the gene ID of a feature, and the name to use for it.
+	gene := func(feature *gtfFeature) (id, name string) {
+		if id = feature.attributes["gene_id"]; id != "" {
+			if name = feature.attributes["gene_name"]; name != "" {
+				return id, name
+			}
+			return id, id
+		}
+		id = gff3Parent(feature.attributes)
+		for parent := parents[id]; parent != ""; parent = parents[id] {
+			id = parent
+		}
+		if name = names[id]; name != "" {
+			return id, name
+		}
+		return id, id
+	}
+	transcript := func(feature *gtfFeature) string {
+		if id := feature.attributes["transcript_id"]; id != "" {
+			return id
+		}
+		return gff3Parent(feature.attributes)
+	}
+	newRegion := func(chrom utils.Symbol, start, end int32, name string, strand utils.Symbol) *Region {
+		region := &Region{Chrom: chrom, Start: start, End: end, OptionalFields: []interface{}{name}}
+		if strand != nil {
+			region.OptionalFields = append(region.OptionalFields, 0, strand)
+		}
+		return region
+	}
+
+	bed := NewBed()
+	if !options.CollapseTranscripts {
+		for i := range features {
+			feature := &features[i]
+			AddRegion(bed, newRegion(feature.chrom, feature.start, feature.end, transcript(feature), feature.strand))
+		}
+		sortRegions(bed)
+		return bed, nil
+	}
+
+	type geneKey struct {
+		chrom  utils.Symbol
+		id     string
+		strand utils.Symbol
+	}
+	var keys []geneKey
+	geneNames := make(map[geneKey]string)
+	geneFeatures := make(map[geneKey][]*gtfFeature)
+	for i := range features {
+		feature := &features[i]
+		id, name := gene(feature)
+		key := geneKey{feature.chrom, id, feature.strand}
+		if _, found := geneFeatures[key]; !found {
+			keys = append(keys, key)
+			geneNames[key] = name
+		}
+		geneFeatures[key] = append(geneFeatures[key], feature)
+	}
+	for _, key := range keys {
+		gfs := geneFeatures[key]
+		sort.SliceStable(gfs, func(i, j int) bool {
+			return gfs[i].start < gfs[j].start
+		})
+		start, end := gfs[0].start, gfs[0].end
+		for _, feature := range gfs[1:] {
+			if feature.start <= end {
+				if feature.end > end {
+					end = feature.end
+				}
+				continue
+			}
+			AddRegion(bed, newRegion(key.chrom, start, end, geneNames[key], key.strand))
+			start, end = feature.start, feature.end
+		}
+		AddRegion(bed, newRegion(key.chrom, start, end, geneNames[key], key.strand))
+	}
+	sortRegions(bed)
+	return bed, nil
+}
+
+// Returns true if the filename has a GTF or GFF3 extension, possibly
+// followed by .gz.
+func isGTFFile(filename string) bool {
+	ext := filepath.Ext(filename)
+	if ext == ".gz" {
+		ext = filepath.Ext(strings.TrimSuffix(filename, ext))
+	}
+	switch ext {
+	case ".gtf", ".gff", ".gff3":
+		return true
+	default:
+		return false
+	}
+}
+
+// ParseRegions parses a file with target regions, which can be a BED
+// file, a bigBed file, or a GTF or GFF3 file, based on the extension
+// of the filename. GTF and GFF3 files are parsed with ParseGTF,
+// loading the exons of all transcripts collapsed per gene.
+func ParseRegions(filename string) (*Bed, error) {
+	if isGTFFile(filename) {
+		return ParseGTF(filename, GTFOptions{CollapseTranscripts: true})
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".bb", ".bigbed":
+		return ParseBigBed(filename)
+	}
+	return ParseBed(filename)
+}
@@ -0,0 +1,139 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package bed
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// ParseIntervalList parses a Picard/GATK interval_list file, which
+// consists of a SAM header with a sequence dictionary, followed by
+// one interval per line with the columns sequence name, start, end,
+// strand, and name. See
+// https://gatk.broadinstitute.org/hc/en-us/articles/360035531852
+//
+// Intervals are converted from 1-based, closed coordinates to the
+// 0-based, half-open coordinates of BED. Each region gets the name of
+// its interval, a score of 0, and its strand. Returns an error if an
+// interval lies on a sequence that is not listed in the sequence
+// dictionary, or beyond the end of its sequence. The sequence
+// dictionary is returned as well, for example for validating it with
+// CompareSequenceDictionaries. The regions of the resulting Bed are
+// sorted.
+func ParseIntervalList(filename string) (b *Bed, header *sam.Header, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	reader := bufio.NewReader(file)
+	header, err = sam.ParseSamHeader(reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v, while reading header of interval list %v", err, filename)
+	}
+	lengths, err := ChromLengths(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	bed := NewBed()
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		data := strings.Split(line, "\t")
+		if len(data) < 5 {
+			return nil, nil, fmt.Errorf("invalid interval list line: %v", line)
+		}
+		chrom := utils.Intern(data[0])
+		length, found := lengths[chrom]
+		if !found {
+			return nil, nil, fmt.Errorf("sequence %v of interval list line not in sequence dictionary: %v", data[0], line)
+		}
+		start, err := strconv.ParseInt(data[1], 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid interval list start: %v", err)
+		}
+		end, err := strconv.ParseInt(data[2], 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid interval list end: %v", err)
+		}
+		if start < 1 || end < start-1 || end > int64(length) {
+			return nil, nil, fmt.Errorf("invalid interval list coordinates: %v", line)
+		}
+		var strand utils.Symbol
+		switch data[3] {
+		case "+":
+			strand = SF
+		case "-":
+			strand = SR
+		default:
+			return nil, nil, fmt.Errorf("invalid interval list strand: %v", data[3])
+		}
+		AddRegion(bed, &Region{
+			Chrom:          chrom,
+			Start:          int32(start - 1),
+			End:            int32(end),
+			OptionalFields: []interface{}{data[4], 0, strand},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error while reading interval list: %v", err)
+	}
+	sortRegions(bed)
+	return bed, header, nil
+}
+
+// CompareSequenceDictionaries checks that each sequence listed in the
+// @SQ lines of dict is also listed in header, with the same length
+// and, if both specify one, the same MD5 checksum. The header may
+// list additional sequences, and the order of the sequences is not
+// checked. Returns an error describing the first mismatch.
+func CompareSequenceDictionaries(dict, header *sam.Header) error {
+	sequences := make(map[string]utils.StringMap, len(header.SQ))
+	for _, sq := range header.SQ {
+		sequences[sq["SN"]] = sq
+	}
+	for _, sq := range dict.SQ {
+		name := sq["SN"]
+		other, found := sequences[name]
+		if !found {
+			return fmt.Errorf("sequence %v not listed in the SAM header", name)
+		}
+		if sq["LN"] != other["LN"] {
+			return fmt.Errorf("sequence %v has length %v, but length %v in the SAM header", name, sq["LN"], other["LN"])
+		}
+		if md5, otherMD5 := sq["M5"], other["M5"]; md5 != "" && otherMD5 != "" && !strings.EqualFold(md5, otherMD5) {
+			return fmt.Errorf("sequence %v has MD5 checksum %v, but %v in the SAM header", name, md5, otherMD5)
+		}
+	}
+	return nil
+}
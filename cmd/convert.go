@@ -121,7 +121,7 @@ func FastaToElfasta() error {
 
 	if len(os.Args) < 4 {
 		fmt.Fprintln(os.Stderr, "Incorrect number of parameters.")
-		fmt.Fprintln(os.Stderr, FastaToElfastaHelp)
+		fmt.Fprint(os.Stderr, FastaToElfastaHelp)
 		os.Exit(1)
 	}
 
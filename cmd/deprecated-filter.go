@@ -252,7 +252,7 @@ func DeprecatedFilter() error {
 	log.Println("Executing command:\n", cmdString)
 	if markDuplicates || (sortingOrder == sam.Coordinate) || (sortingOrder == sam.Queryname) ||
 		((replaceRefSeqDictFilter != nil) && (sortingOrder == sam.Keep)) {
-		return runBestPracticesPipelineIntermediateSam(filenames[0], filenames[1], sortingOrder, filters1, filters2, nil, false, timed, profile)
+		return runBestPracticesPipelineIntermediateSam(filenames[0], filenames[1], nil, nil, sam.DefaultFormat, sam.NoIndex, 0, noOutputSplit, sam.DontCheckSortingOrder, nil, sortingOrder, filters1, filters2, nil, false, timed, profile)
 	}
-	return runBestPracticesPipeline(filenames[0], filenames[1], sortingOrder, filters1, timed, profile)
+	return runBestPracticesPipeline(filenames[0], filenames[1], nil, nil, sam.DefaultFormat, sam.NoIndex, 0, noOutputSplit, sam.DontCheckSortingOrder, nil, sortingOrder, filters1, timed, profile)
 }
@@ -0,0 +1,343 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package cmd
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/exascience/elprep/v4/fastq"
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// Bam2fqHelp is the help string for this command.
+const Bam2fqHelp = "\nbam2fq parameters:\n" +
+	"elprep bam2fq sam-file fastq-file\n" +
+	"[--fastq2 file]\n" +
+	"[--singletons file]\n" +
+	"[--original-qualities]\n" +
+	BGZFHelp +
+	"[--timed]\n" +
+	"[--log-path path]\n"
+
+// Bam2fq implements the elprep bam2fq command.
+func Bam2fq() error {
+	var (
+		fastq2, singletons       string
+		originalQualities, timed bool
+		profile, logPath         string
+	)
+
+	var flags flag.FlagSet
+	var bgzf bgzfFlags
+
+	flags.StringVar(&fastq2, "fastq2", "", "write the last segments of paired reads to a separate file")
+	flags.StringVar(&singletons, "singletons", "", "write unpaired reads and reads without mates to a separate file")
+	flags.BoolVar(&originalQualities, "original-qualities", false, "restore the base qualities from the OQ field")
+	bgzf.define(&flags)
+	flags.BoolVar(&timed, "timed", false, "measure the runtime")
+	flags.StringVar(&profile, "profile", "", "write a runtime profile to the specified file(s)")
+	flags.StringVar(&logPath, "log-path", "", "write log files to the specified directory")
+
+	parseFlags(flags, 4, Bam2fqHelp)
+
+	input := getFilename(os.Args[2], Bam2fqHelp)
+	output := getFilename(os.Args[3], Bam2fqHelp)
+
+	setLogOutput(logPath)
+
+	// sanity checks
+
+	var sanityChecksFailed bool
+
+	if !sam.IsHtsgetURL(input) && !checkExist("", input) {
+		sanityChecksFailed = true
+	}
+	if !checkCreate("", output) {
+		sanityChecksFailed = true
+	}
+	if fastq2 != "" && !checkCreate("--fastq2", fastq2) {
+		sanityChecksFailed = true
+	}
+	if singletons != "" && !checkCreate("--singletons", singletons) {
+		sanityChecksFailed = true
+	}
+	if profile != "" && !checkCreate("--profile", profile) {
+		sanityChecksFailed = true
+	}
+	if !bgzf.apply() {
+		sanityChecksFailed = true
+	}
+
+	if sanityChecksFailed {
+		fmt.Fprint(os.Stderr, Bam2fqHelp)
+		os.Exit(1)
+	}
+
+	// building output command line
+
+	var command bytes.Buffer
+	fmt.Fprint(&command, os.Args[0], " bam2fq ", input, " ", output)
+	if fastq2 != "" {
+		fmt.Fprint(&command, " --fastq2 ", fastq2)
+	}
+	if singletons != "" {
+		fmt.Fprint(&command, " --singletons ", singletons)
+	}
+	if originalQualities {
+		fmt.Fprint(&command, " --original-qualities")
+	}
+	for _, arg := range bgzf.args() {
+		fmt.Fprint(&command, " ", arg)
+	}
+	if timed {
+		fmt.Fprint(&command, " --timed")
+	}
+	if profile != "" {
+		fmt.Fprint(&command, " --profile ", profile)
+	}
+	if logPath != "" {
+		fmt.Fprint(&command, " --log-path ", logPath)
+	}
+
+	// executing command
+
+	log.Println("Executing command:\n", command.String())
+
+	return timedRun(timed, profile, "Converting alignments to FASTQ.", 1, func() error {
+		return runBam2fq(input, output, fastq2, singletons, originalQualities)
+	})
+}
+
+func runBam2fq(fileIn, fileOut, fileOut2, fileSingletons string, originalQualities bool) (err error) {
+	input, err := openInput(fileIn, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := input.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	it, err := input.Iterator()
+	if err != nil {
+		return err
+	}
+	var writers []*fastq.Writer
+	defer func() {
+		for _, w := range writers {
+			if nerr := w.Close(); err == nil {
+				err = nerr
+			}
+		}
+	}()
+	create := func(name string) (*fastq.Writer, error) {
+		w, err := fastq.Create(name)
+		if err == nil {
+			writers = append(writers, w)
+		}
+		return w, err
+	}
+	out1, err := create(fileOut)
+	if err != nil {
+		return err
+	}
+	out2, singletons := out1, out1
+	if fileOut2 != "" {
+		if out2, err = create(fileOut2); err != nil {
+			return err
+		}
+		singletons = nil
+	}
+	if fileSingletons != "" {
+		if singletons, err = create(fileSingletons); err != nil {
+			return err
+		}
+	}
+	return fastq.FromAlignments(it, out1, out2, singletons, originalQualities)
+}
+
+// Fq2bamHelp is the help string for this command.
+const Fq2bamHelp = "\nfq2bam parameters:\n" +
+	"elprep fq2bam fastq-file sam-output-file\n" +
+	"[--fastq2 file]\n" +
+	"[--read-group read-group-string]\n" +
+	"[--umi-from-read-name]\n" +
+	"[--output-format [sam | sam.gz | bam | uncompressed-bam]]\n" +
+	BGZFHelp +
+	"[--timed]\n" +
+	"[--log-path path]\n"
+
+// Fq2bam implements the elprep fq2bam command.
+func Fq2bam() error {
+	var (
+		fastq2, readGroup, outputFormatString string
+		umiFromReadName, timed                bool
+		profile, logPath                      string
+	)
+
+	var flags flag.FlagSet
+	var bgzf bgzfFlags
+
+	flags.StringVar(&fastq2, "fastq2", "", "read the last segments of paired reads from a separate file")
+	flags.StringVar(&readGroup, "read-group", "", "add a read group to the header and the alignments")
+	flags.BoolVar(&umiFromReadName, "umi-from-read-name", false, "store the unique molecular identifiers from the read names in RX fields")
+	flags.StringVar(&outputFormatString, "output-format", "", "format of the output file, one of sam, sam.gz, bam, or uncompressed-bam (default determined by the file extension)")
+	bgzf.define(&flags)
+	flags.BoolVar(&timed, "timed", false, "measure the runtime")
+	flags.StringVar(&profile, "profile", "", "write a runtime profile to the specified file(s)")
+	flags.StringVar(&logPath, "log-path", "", "write log files to the specified directory")
+
+	parseFlags(flags, 4, Fq2bamHelp)
+
+	input := getFilename(os.Args[2], Fq2bamHelp)
+	output := getFilename(os.Args[3], Fq2bamHelp)
+
+	setLogOutput(logPath)
+
+	// sanity checks
+
+	var sanityChecksFailed bool
+
+	if !checkExist("", input) {
+		sanityChecksFailed = true
+	}
+	if fastq2 != "" && !checkExist("--fastq2", fastq2) {
+		sanityChecksFailed = true
+	}
+	if !checkCreate("", output) {
+		sanityChecksFailed = true
+	}
+	if profile != "" && !checkCreate("--profile", profile) {
+		sanityChecksFailed = true
+	}
+
+	var readGroupRecord utils.StringMap
+	if readGroup != "" {
+		record, err := sam.ParseHeaderLineFromString(readGroup)
+		if err != nil {
+			log.Println("Error: Invalid --read-group: ", err)
+			sanityChecksFailed = true
+		} else if record["ID"] == "" {
+			log.Println("Error: Missing ID in --read-group ", readGroup)
+			sanityChecksFailed = true
+		}
+		readGroupRecord = record
+	}
+
+	outputFormat, err := sam.ParseOutputFormat(outputFormatString)
+	if err != nil {
+		log.Println("Error: Invalid output-format: ", outputFormatString)
+		sanityChecksFailed = true
+	}
+
+	if !bgzf.apply() {
+		sanityChecksFailed = true
+	}
+
+	if sanityChecksFailed {
+		fmt.Fprint(os.Stderr, Fq2bamHelp)
+		os.Exit(1)
+	}
+
+	// building output command line
+
+	var command bytes.Buffer
+	fmt.Fprint(&command, os.Args[0], " fq2bam ", input, " ", output)
+	if fastq2 != "" {
+		fmt.Fprint(&command, " --fastq2 ", fastq2)
+	}
+	if readGroup != "" {
+		fmt.Fprint(&command, " --read-group \"", readGroup, "\"")
+	}
+	if umiFromReadName {
+		fmt.Fprint(&command, " --umi-from-read-name")
+	}
+	if outputFormatString != "" {
+		fmt.Fprint(&command, " --output-format ", outputFormatString)
+	}
+	for _, arg := range bgzf.args() {
+		fmt.Fprint(&command, " ", arg)
+	}
+	if timed {
+		fmt.Fprint(&command, " --timed")
+	}
+	if profile != "" {
+		fmt.Fprint(&command, " --profile ", profile)
+	}
+	if logPath != "" {
+		fmt.Fprint(&command, " --log-path ", logPath)
+	}
+
+	// executing command
+
+	log.Println("Executing command:\n", command.String())
+
+	return timedRun(timed, profile, "Converting FASTQ to unaligned alignments.", 1, func() error {
+		return runFq2bam(input, fastq2, output, outputFormat, readGroupRecord, umiFromReadName)
+	})
+}
+
+func runFq2bam(fileIn, fileIn2, fileOut string, outputFormat sam.OutputFormat, readGroup utils.StringMap, umiFromReadName bool) (err error) {
+	in1, err := fastq.Open(fileIn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := in1.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	var in2 *fastq.Reader
+	if fileIn2 != "" {
+		if in2, err = fastq.Open(fileIn2); err != nil {
+			return err
+		}
+		defer func() {
+			if nerr := in2.Close(); err == nil {
+				err = nerr
+			}
+		}()
+	}
+	output, err := sam.CreateFormat(fileOut, outputFormat)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := output.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	hdr := sam.NewHeader()
+	hdr.SetHDSO(sam.Unsorted)
+	hdr.SetHDGO(sam.Query)
+	var readGroupID string
+	if readGroup != nil {
+		readGroupID = readGroup["ID"]
+		hdr.RG = append(hdr.RG, readGroup)
+	}
+	if err := output.FormatHeader(hdr); err != nil {
+		return err
+	}
+	return fastq.ToAlignments(in1, in2, output, readGroupID, umiFromReadName)
+}
@@ -22,7 +22,9 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -38,18 +40,16 @@ import (
 
 // Run the best practices pipeline. Version that uses an intermediate
 // slice so that sorting and mark-duplicates are supported.
-func runBestPracticesPipelineIntermediateSam(fileIn, fileOut string, sortingOrder sam.SortingOrder, filters, filters2 []sam.Filter, opticalDuplicateFilter func(reads *sam.Sam) error, deterministic, timed bool, profile string) error {
+func runBestPracticesPipelineIntermediateSam(fileIn, fileOut string, loci []sam.Locus, aliases sam.ContigAliases, outputFormat sam.OutputFormat, indexFormat sam.IndexFormat, offsetMapBinSize int32, split outputSplit, sortingOrderCheck sam.SortingOrderCheck, groupFilters []sam.GroupFilter, sortingOrder sam.SortingOrder, filters, filters2 []sam.Filter, opticalDuplicateFilter func(reads *sam.Sam) error, deterministic, timed bool, profile string) error {
 	filteredReads := sam.NewSam()
 	phase := int64(1)
 	err := timedRun(timed, profile, "Reading SAM into memory and applying filters.", phase, func() (err error) {
-		pathname, err := filepath.Abs(fileIn)
-		if err != nil {
-			return err
-		}
-		input, err := sam.Open(pathname)
+		input, err := openInput(fileIn, loci, aliases)
 		if err != nil {
 			return err
 		}
+		input.CheckSortingOrder(sortingOrderCheck)
+		input.SetGroupFilters(groupFilters)
 		defer func() {
 			nerr := input.Close()
 			if err == nil {
@@ -82,7 +82,7 @@ func runBestPracticesPipelineIntermediateSam(fileIn, fileOut string, sortingOrde
 		if err != nil {
 			return err
 		}
-		output, err := sam.Create(pathname)
+		output, err := createOutput(pathname, outputFormat, indexFormat, offsetMapBinSize, split)
 		if err != nil {
 			return err
 		}
@@ -99,19 +99,17 @@ func runBestPracticesPipelineIntermediateSam(fileIn, fileOut string, sortingOrde
 	})
 }
 
-func runBestPracticesPipelineIntermediateSamWithBQSR(fileIn, fileOut string, sortingOrder sam.SortingOrder, filters1, filters2 []sam.Filter, opticalDuplicateFilter func(reads *sam.Sam) error, baseRecalibrator *filters.BaseRecalibrator, quantizeLevels int, sqqList []uint8, recalFile string, deterministic, timed bool, profile string) error {
+func runBestPracticesPipelineIntermediateSamWithBQSR(fileIn, fileOut string, loci []sam.Locus, aliases sam.ContigAliases, outputFormat sam.OutputFormat, indexFormat sam.IndexFormat, offsetMapBinSize int32, split outputSplit, sortingOrderCheck sam.SortingOrderCheck, groupFilters []sam.GroupFilter, sortingOrder sam.SortingOrder, filters1, filters2 []sam.Filter, opticalDuplicateFilter func(reads *sam.Sam) error, baseRecalibrator *filters.BaseRecalibrator, quantizeLevels int, sqqList []uint8, recalFile string, deterministic, timed bool, profile string) error {
 	// Input and first filters and sorting
 	filteredReads := sam.NewSam()
 	phase := int64(1)
 	err := timedRun(timed, profile, "Reading SAM into memory and applying filters.", phase, func() (err error) {
-		pathname, err := filepath.Abs(fileIn)
-		if err != nil {
-			return err
-		}
-		input, err := sam.Open(pathname)
+		input, err := openInput(fileIn, loci, aliases)
 		if err != nil {
 			return err
 		}
+		input.CheckSortingOrder(sortingOrderCheck)
+		input.SetGroupFilters(groupFilters)
 		defer func() {
 			nerr := input.Close()
 			if err == nil {
@@ -189,7 +187,7 @@ func runBestPracticesPipelineIntermediateSamWithBQSR(fileIn, fileOut string, sor
 		if err != nil {
 			return err
 		}
-		output, err := sam.Create(pathname)
+		output, err := createOutput(pathname, outputFormat, indexFormat, offsetMapBinSize, split)
 		if err != nil {
 			return err
 		}
@@ -203,7 +201,7 @@ func runBestPracticesPipelineIntermediateSamWithBQSR(fileIn, fileOut string, sor
 	})
 }
 
-func runBestPracticesPipelineIntermediateSamWithBQSRApplyOnly(input, output string, sortingOrder sam.SortingOrder, filters []sam.Filter, baseRecalibratorTables filters.BaseRecalibratorTables, recalFile string, timed bool, profile string) error {
+func runBestPracticesPipelineIntermediateSamWithBQSRApplyOnly(input, output string, loci []sam.Locus, aliases sam.ContigAliases, outputFormat sam.OutputFormat, indexFormat sam.IndexFormat, offsetMapBinSize int32, split outputSplit, sortingOrderCheck sam.SortingOrderCheck, groupFilters []sam.GroupFilter, sortingOrder sam.SortingOrder, filters []sam.Filter, baseRecalibratorTables filters.BaseRecalibratorTables, recalFile string, timed bool, profile string) error {
 	// Finalize BQSR tables + log recal file
 	err := timedRun(timed, profile, "Finalize BQSR tables", 1, func() error {
 		baseRecalibratorTables.FinalizeBQSRTables()
@@ -221,21 +219,19 @@ func runBestPracticesPipelineIntermediateSamWithBQSRApplyOnly(input, output stri
 		return err
 	}
 	return timedRun(timed, profile, "Running pipeline.", 2, func() (err error) {
-		pathname, err := filepath.Abs(input)
-		if err != nil {
-			return err
-		}
-		input, err := sam.Open(pathname)
+		input, err := openInput(input, loci, aliases)
 		if err != nil {
 			return err
 		}
+		input.CheckSortingOrder(sortingOrderCheck)
+		input.SetGroupFilters(groupFilters)
 		defer func() {
 			nerr := input.Close()
 			if err == nil {
 				err = nerr
 			}
 		}()
-		pathname, err = filepath.Abs(output)
+		pathname, err := filepath.Abs(output)
 		if err != nil {
 			return err
 		}
@@ -243,7 +239,7 @@ func runBestPracticesPipelineIntermediateSamWithBQSRApplyOnly(input, output stri
 		if err != nil {
 			return err
 		}
-		output, err := sam.Create(pathname)
+		output, err := createOutput(pathname, outputFormat, indexFormat, offsetMapBinSize, split)
 		if err != nil {
 			return err
 		}
@@ -257,19 +253,17 @@ func runBestPracticesPipelineIntermediateSamWithBQSRApplyOnly(input, output stri
 	})
 }
 
-func runBestPracticesPipelineIntermediateSamWithBQSRCalculateTablesOnly(fileIn, fileOut string, sortingOrder sam.SortingOrder, filters1, filters2 []sam.Filter, opticalDuplicateFilter func(reads *sam.Sam) error, baseRecalibrator *filters.BaseRecalibrator, tableFile string, timed bool, profile string) error {
+func runBestPracticesPipelineIntermediateSamWithBQSRCalculateTablesOnly(fileIn, fileOut string, loci []sam.Locus, aliases sam.ContigAliases, outputFormat sam.OutputFormat, indexFormat sam.IndexFormat, offsetMapBinSize int32, split outputSplit, sortingOrderCheck sam.SortingOrderCheck, groupFilters []sam.GroupFilter, sortingOrder sam.SortingOrder, filters1, filters2 []sam.Filter, opticalDuplicateFilter func(reads *sam.Sam) error, baseRecalibrator *filters.BaseRecalibrator, tableFile string, timed bool, profile string) error {
 	// Input and first filters and sorting
 	filteredReads := sam.NewSam()
 	phase := int64(1)
 	err := timedRun(timed, profile, "Reading SAM into memory and applying filters.", phase, func() (err error) {
-		pathname, err := filepath.Abs(fileIn)
-		if err != nil {
-			return err
-		}
-		input, err := sam.Open(pathname)
+		input, err := openInput(fileIn, loci, aliases)
 		if err != nil {
 			return err
 		}
+		input.CheckSortingOrder(sortingOrderCheck)
+		input.SetGroupFilters(groupFilters)
 		defer func() {
 			nerr := input.Close()
 			if err == nil {
@@ -331,7 +325,7 @@ func runBestPracticesPipelineIntermediateSamWithBQSRCalculateTablesOnly(fileIn,
 		if err != nil {
 			return err
 		}
-		output, err := sam.Create(pathname)
+		output, err := createOutput(pathname, outputFormat, indexFormat, offsetMapBinSize, split)
 		if err != nil {
 			return err
 		}
@@ -351,23 +345,21 @@ func runBestPracticesPipelineIntermediateSamWithBQSRCalculateTablesOnly(fileIn,
 // Run the best practices pipeline. Version that doesn't use an
 // intermediate slice when neither sorting nor mark-duplicates are
 // needed.
-func runBestPracticesPipeline(fileIn, fileOut string, sortingOrder sam.SortingOrder, filters []sam.Filter, timed bool, profile string) error {
+func runBestPracticesPipeline(fileIn, fileOut string, loci []sam.Locus, aliases sam.ContigAliases, outputFormat sam.OutputFormat, indexFormat sam.IndexFormat, offsetMapBinSize int32, split outputSplit, sortingOrderCheck sam.SortingOrderCheck, groupFilters []sam.GroupFilter, sortingOrder sam.SortingOrder, filters []sam.Filter, timed bool, profile string) error {
 	return timedRun(timed, profile, "Running pipeline.", 1, func() (err error) {
-		pathname, err := filepath.Abs(fileIn)
-		if err != nil {
-			return err
-		}
-		input, err := sam.Open(pathname)
+		input, err := openInput(fileIn, loci, aliases)
 		if err != nil {
 			return err
 		}
+		input.CheckSortingOrder(sortingOrderCheck)
+		input.SetGroupFilters(groupFilters)
 		defer func() {
 			nerr := input.Close()
 			if err == nil {
 				err = nerr
 			}
 		}()
-		pathname, err = filepath.Abs(fileOut)
+		pathname, err := filepath.Abs(fileOut)
 		if err != nil {
 			return err
 		}
@@ -375,7 +367,7 @@ func runBestPracticesPipeline(fileIn, fileOut string, sortingOrder sam.SortingOr
 		if err != nil {
 			return err
 		}
-		output, err := sam.Create(pathname)
+		output, err := createOutput(pathname, outputFormat, indexFormat, offsetMapBinSize, split)
 		if err != nil {
 			return err
 		}
@@ -389,30 +381,248 @@ func runBestPracticesPipeline(fileIn, fileOut string, sortingOrder sam.SortingOr
 	})
 }
 
+// Parses the target regions for --filter-non-overlapping-reads and
+// --filter-non-overlapping-fragments, and pads them by the given
+// number of bases. For an interval list, the padded regions are
+// clamped to the sequence lengths of its dictionary, and a filter is
+// returned as well that checks the dictionary against the SAM header
+// of the input.
+func parseTargetRegions(filename string, padding int) (*bed.Bed, sam.Filter, error) {
+	if strings.HasSuffix(filename, ".interval_list") {
+		regions, dict, err := bed.ParseIntervalList(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		if padding > 0 {
+			lengths, err := bed.ChromLengths(dict)
+			if err != nil {
+				return nil, nil, err
+			}
+			regions = bed.Pad(regions, int32(padding), lengths)
+		}
+		return regions, filters.CheckSequenceDictionary(dict), nil
+	}
+	regions, err := bed.ParseRegions(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if padding > 0 {
+		regions = bed.Pad(regions, int32(padding), nil)
+	}
+	return regions, nil, nil
+}
+
+// Writes the counts of --region-counts to the given file.
+func writeRegionCounts(filename string, counts []*filters.RegionCounts) (err error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	return filters.WriteRegionCounts(file, counts)
+}
+
+// Parses the loci for --regions, which are either given as a
+// comma-separated list in samtools notation, or as a file with target
+// regions as accepted by parseTargetRegions. For interval_list files,
+// it also returns the filter that checks the sequence dictionary.
+func parseLoci(regions string) ([]sam.Locus, sam.Filter, error) {
+	if _, err := os.Stat(regions); err == nil {
+		parsedBed, checkDict, err := parseTargetRegions(regions, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		var loci []sam.Locus
+		for chrom, chromRegions := range parsedBed.RegionMap {
+			for _, region := range chromRegions {
+				loci = append(loci, sam.Locus{RNAME: *chrom, Start: region.Start, End: region.End})
+			}
+		}
+		if len(loci) == 0 {
+			return nil, nil, fmt.Errorf("no regions in %v", regions)
+		}
+		return loci, checkDict, nil
+	}
+	var loci []sam.Locus
+	for _, region := range strings.Split(regions, ",") {
+		locus, err := sam.ParseLocus(strings.TrimSpace(region))
+		if err != nil {
+			return nil, nil, err
+		}
+		loci = append(loci, locus)
+	}
+	return loci, nil, nil
+}
+
+// Parses the thresholds for --mask-low-quality-bases, which are given
+// as a comma-separated list of base qualities that are optionally
+// prefixed by a read group ID and a colon. A threshold without read
+// group ID is used for all other read groups. If qualityCap is not
+// negative, it must be below all thresholds that enable masking.
+func parseBaseQualityThresholds(thresholds string, qualityCap int) (defaultThreshold byte, readGroupThresholds map[string]byte, err error) {
+	readGroupThresholds = make(map[string]byte)
+	for _, entry := range strings.Split(thresholds, ",") {
+		entry = strings.TrimSpace(entry)
+		readGroup, quality := "", entry
+		if index := strings.LastIndexByte(entry, ':'); index >= 0 {
+			readGroup, quality = entry[:index], entry[index+1:]
+		}
+		threshold, err := strconv.ParseUint(quality, 10, 8)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid base quality threshold %v in --mask-low-quality-bases: %v", entry, err)
+		}
+		if threshold > 93 {
+			return 0, nil, fmt.Errorf("invalid base quality threshold %v in --mask-low-quality-bases, must be at most 93", entry)
+		}
+		if threshold > 0 && qualityCap >= int(threshold) {
+			return 0, nil, fmt.Errorf("--mask-quality-cap %v must be below base quality threshold %v in --mask-low-quality-bases", qualityCap, entry)
+		}
+		if readGroup == "" {
+			defaultThreshold = byte(threshold)
+		} else {
+			readGroupThresholds[readGroup] = byte(threshold)
+		}
+	}
+	return defaultThreshold, readGroupThresholds, nil
+}
+
+// Parses the argument of --reassign-mapping-quality, which is of the
+// form from:to, where from and to are mapping qualities.
+func parseMappingQualityReassignment(reassignment string) (from, to byte, err error) {
+	colon := strings.IndexByte(reassignment, ':')
+	if colon < 0 {
+		return 0, 0, fmt.Errorf("invalid --reassign-mapping-quality %v, must be of the form from:to", reassignment)
+	}
+	f, err := strconv.ParseUint(strings.TrimSpace(reassignment[:colon]), 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid --reassign-mapping-quality %v: %v", reassignment, err)
+	}
+	t, err := strconv.ParseUint(strings.TrimSpace(reassignment[colon+1:]), 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid --reassign-mapping-quality %v: %v", reassignment, err)
+	}
+	return byte(f), byte(t), nil
+}
+
+// Parses the argument of --filter-read-length, which is of the form
+// min:max, where either min or max can be omitted. A missing maximum
+// is returned as -1.
+func parseReadLengthRange(lengthRange string) (minLength, maxLength int, err error) {
+	colon := strings.IndexByte(lengthRange, ':')
+	if colon < 0 {
+		return 0, 0, fmt.Errorf("invalid --filter-read-length %v, must be of the form min:max", lengthRange)
+	}
+	maxLength = -1
+	if s := strings.TrimSpace(lengthRange[:colon]); s != "" {
+		if minLength, err = strconv.Atoi(s); err != nil || minLength < 0 {
+			return 0, 0, fmt.Errorf("invalid minimum in --filter-read-length %v", lengthRange)
+		}
+	}
+	if s := strings.TrimSpace(lengthRange[colon+1:]); s != "" {
+		if maxLength, err = strconv.Atoi(s); err != nil || maxLength < minLength {
+			return 0, 0, fmt.Errorf("invalid maximum in --filter-read-length %v", lengthRange)
+		}
+	}
+	return minLength, maxLength, nil
+}
+
+// Parses the read groups for --keep-read-groups and
+// --exclude-read-groups, which are either given as a comma-separated
+// list, or as a file with one read group per line.
+func parseReadGroupList(readGroups string) ([]string, error) {
+	entries := strings.Split(readGroups, ",")
+	if _, err := os.Stat(readGroups); err == nil {
+		contents, err := ioutil.ReadFile(readGroups)
+		if err != nil {
+			return nil, err
+		}
+		entries = strings.Split(string(contents), "\n")
+	}
+	var values []string
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			values = append(values, entry)
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no read groups in %v", readGroups)
+	}
+	return values, nil
+}
+
 // FilterHelp is the help string for this command.
 const FilterHelp = "\nfilter parameters:\n" +
-	"elprep filter sam-file sam-output-file\n" +
+	"elprep filter (sam-file | /path/to/input/) sam-output-file\n" +
+	"[--regions list-or-bed-file]\n" +
+	"[--contig-aliases file]\n" +
 	"[--replace-reference-sequences sam-file]\n" +
 	"[--filter-unmapped-reads]\n" +
 	"[--filter-unmapped-reads-strict]\n" +
+	"[--filter-secondary-alignments]\n" +
+	"[--keep-only-secondary]\n" +
+	"[--filter-supplementary-alignments]\n" +
+	"[--strip-sa-tags]\n" +
+	"[--reassign-mapping-quality from:to]\n" +
+	"[--cap-mapping-quality mapping-quality]\n" +
+	"[--floor-mapping-quality mapping-quality]\n" +
 	"[--filter-mapping-quality mapping-quality]\n" +
+	"[--filter-read-length min:max]\n" +
+	"[--read-length-type [query | aligned]]\n" +
 	"[--filter-non-exact-mapping-reads]\n" +
 	"[--filter-non-exact-mapping-reads-strict]\n" +
 	"[--filter-non-overlapping-reads bed-file]\n" +
+	"[--filter-non-overlapping-fragments bed-file]\n" +
+	"[--target-padding nr-of-bases]\n" +
+	"[--keep-read-groups list-or-file]\n" +
+	"[--exclude-read-groups list-or-file]\n" +
 	"[--replace-read-group read-group-string]\n" +
+	"[--add-comment comment]\n" +
+	"[--no-pg]\n" +
+	"[--pg-id id]\n" +
+	"[--pg-name name]\n" +
+	"[--pg-description description]\n" +
+	"[--pg-command-line command-line]\n" +
 	"[--mark-duplicates]\n" +
 	"[--mark-optical-duplicates file]\n" +
 	"[--remove-duplicates]\n" +
+	"[--region-counts bed-file]\n" +
+	"[--region-counts-output file]\n" +
+	"[--region-counts-min-mapping-quality mapping-quality]\n" +
+	"[--region-counts-skip-duplicates]\n" +
+	"[--region-counts-nearest-distance nr]\n" +
+	"[--mask-low-quality-bases [read-group:]quality[,...]]\n" +
+	"[--mask-quality-cap quality]\n" +
+	"[--clip-mode [hard | soft]]\n" +
+	"[--keep-clipped-bases]\n" +
+	"[--trim-clipped-bases]\n" +
+	"[--trim-min-length nr-of-bases]\n" +
 	"[--remove-optional-fields [all | list]]\n" +
 	"[--keep-optional-fields [none | list]]\n" +
 	"[--sorting-order [keep | unknown | unsorted | queryname | coordinate]]\n" +
+	"[--queryname-collation [lexicographical | natural]]\n" +
+	"[--output-format [sam | sam.gz | bam | uncompressed-bam]]\n" +
+	"[--write-index [bai | csi]]\n" +
+	"[--write-offset-map bin-size]\n" +
+	"[--output-per-read-group]\n" +
+	"[--output-per-contig]\n" +
+	"[--check-sorting-order [warn | strict]]\n" +
+	"[--validation-stringency [strict | lenient | none]]\n" +
 	"[--clean-sam]\n" +
+	"[--fix-mate-information]\n" +
+	"[--clip-overlapping-mates]\n" +
+	"[--anonymize-read-names]\n" +
+	"[--read-name-map file]\n" +
 	"[--bqsr recal-file]\n" +
 	"[--bqsr-reference elfasta]\n" +
 	"[--quantize-levels nr]\n" +
 	"[--sqq list]\n" +
 	"[--known-sites list]\n" +
 	"[--nr-of-threads nr]\n" +
+	BGZFHelp +
 	"[--timed]\n" +
 	"[--log-path path]\n"
 
@@ -424,21 +634,56 @@ const FilterExtendedHelp = FilterHelp +
 	"[--recal-file file]\n"
 
 // Filter implements the elprep filter command.
-func Filter() error {
+func Filter() (err error) {
 	var (
+		regions                                                  string
+		contigAliases                                            string
 		replaceReferenceSequences                                string
 		filterUnmappedReads, filterUnmappedReadsStrict           bool
+		filterSecondaryAlignments, keepOnlySecondary             bool
+		filterSupplementaryAlignments, stripSATags               bool
+		reassignMappingQuality                                   string
+		capMappingQuality, floorMappingQuality                   int
 		filterMappingQuality                                     int
+		filterReadLength, readLengthType                         string
+		targetPadding                                            int
 		filterNonExactMappingReads                               bool
 		filterNonExactMappingReadsStrict                         bool
 		filterNonOverlappingReads                                string
+		filterNonOverlappingFragments                            string
+		keepReadGroups, excludeReadGroups                        string
 		replaceReadGroup                                         string
+		addComments                                              stringList
+		noPG                                                     bool
+		pgID, pgName, pgDescription, pgCommandLine               string
 		markDuplicates, markDuplicatesDet, removeDuplicates      bool
+		regionCounts, regionCountsOutput                         string
+		regionCountsMinMappingQuality                            int
+		regionCountsNearestDistance                              int
+		regionCountsSkipDuplicates                               bool
+		maskLowQualityBases                                      string
+		maskQualityCap                                           int
+		clipMode                                                 string
+		keepClippedBases                                         bool
+		trimClippedBases                                         bool
+		trimMinLength                                            int
 		markOpticalDuplicates, markOpticalDuplicatesIntermediate string
 		removeOptionalFields                                     string
 		keepOptionalFields                                       string
 		sortingOrderString                                       string
+		querynameCollation                                       string
+		outputFormatString                                       string
+		writeIndex                                               string
+		writeOffsetMap                                           int
+		outputPerReadGroup                                       bool
+		outputPerContig                                          bool
+		checkSortingOrder                                        string
+		validationStringency                                     string
 		cleanSam                                                 bool
+		fixMateInformation                                       bool
+		clipOverlappingMates                                     bool
+		anonymizeReadNames                                       bool
+		readNameMap                                              string
 		bqsr                                                     string
 		referenceElFasta                                         string
 		bqsrTablesOnly                                           string
@@ -456,24 +701,70 @@ func Filter() error {
 	)
 
 	var flags flag.FlagSet
+	var bgzf bgzfFlags
 
+	flags.StringVar(&regions, "regions", "", "only read the alignments of an indexed BAM file that overlap with the given regions (comma-separated list or bed file)")
+	flags.StringVar(&regions, "L", "", "short for --regions")
+	flags.StringVar(&contigAliases, "contig-aliases", "", "table of alternative reference sequence names for --regions and --filter-non-overlapping-reads/fragments")
 	flags.StringVar(&replaceReferenceSequences, "replace-reference-sequences", "", "replace the existing header by a new one")
 	flags.BoolVar(&filterUnmappedReads, "filter-unmapped-reads", false, "remove all unmapped alignments")
 	flags.BoolVar(&filterUnmappedReadsStrict, "filter-unmapped-reads-strict", false, "remove all unmapped alignments, taking also POS and RNAME into account")
+	flags.BoolVar(&filterSecondaryAlignments, "filter-secondary-alignments", false, "remove all secondary alignments")
+	flags.BoolVar(&keepOnlySecondary, "keep-only-secondary", false, "remove all but the secondary alignments")
+	flags.BoolVar(&filterSupplementaryAlignments, "filter-supplementary-alignments", false, "remove all supplementary alignments")
+	flags.BoolVar(&stripSATags, "strip-sa-tags", false, "remove the SA optional field from the alignments that remain after --filter-supplementary-alignments")
+	flags.StringVar(&reassignMappingQuality, "reassign-mapping-quality", "", "replace the mapping quality from by the mapping quality to")
+	flags.IntVar(&capMappingQuality, "cap-mapping-quality", -1, "lower mapping qualities above the given mapping quality to that mapping quality")
+	flags.IntVar(&floorMappingQuality, "floor-mapping-quality", -1, "raise mapping qualities of mapped reads below the given mapping quality to that mapping quality")
 	flags.IntVar(&filterMappingQuality, "filter-mapping-quality", 0, "output only reads that equal or exceed given mapping quality")
+	flags.StringVar(&filterReadLength, "filter-read-length", "", "output only reads with a length in the given range")
+	flags.StringVar(&readLengthType, "read-length-type", "", "the length used by --filter-read-length (query or aligned)")
 	flags.BoolVar(&filterNonExactMappingReads, "filter-non-exact-mapping-reads", false, "output only exact mapping reads (soft-clipping allowed) based on cigar string (only M,S allowed)")
 	flags.BoolVar(&filterNonExactMappingReadsStrict, "filter-non-exact-mapping-reads-strict", false, "output only exact mapping reads (soft-clipping allowed) based on optional fields X0=1, X1=0, XM=0, XO=0, XG=0")
-	flags.StringVar(&filterNonOverlappingReads, "filter-non-overlapping-reads", "", "output only reads that overlap with the given regions (bed format)")
+	flags.StringVar(&filterNonOverlappingReads, "filter-non-overlapping-reads", "", "output only reads that overlap with the given regions (bed, gtf, gff3, or interval_list format)")
+	flags.StringVar(&filterNonOverlappingFragments, "filter-non-overlapping-fragments", "", "output only reads whose fragments overlap with the given regions (bed, gtf, gff3, or interval_list format)")
+	flags.IntVar(&targetPadding, "target-padding", 0, "extend the regions of --filter-non-overlapping-reads or --filter-non-overlapping-fragments by the given number of bases on each side")
+	flags.StringVar(&keepReadGroups, "keep-read-groups", "", "keep only the reads of the given read groups (IDs, SM, or LB values)")
+	flags.StringVar(&excludeReadGroups, "exclude-read-groups", "", "remove the reads of the given read groups (IDs, SM, or LB values)")
 	flags.StringVar(&replaceReadGroup, "replace-read-group", "", "add or replace alignment read groups")
+	flags.Var(&addComments, "add-comment", "add a @CO line to the header (can be given more than once)")
+	flags.BoolVar(&noPG, "no-pg", false, "do not add a @PG line for elprep to the header")
+	flags.StringVar(&pgID, "pg-id", "", "ID of the @PG line for elprep (default \""+ProgramName+" "+ProgramVersion+"\")")
+	flags.StringVar(&pgName, "pg-name", "", "PN of the @PG line for elprep (default \""+ProgramName+"\")")
+	flags.StringVar(&pgDescription, "pg-description", "", "DS of the @PG line for elprep (default \""+ProgramURL+"\")")
+	flags.StringVar(&pgCommandLine, "pg-command-line", "", "CL of the @PG line for elprep (default the elprep command line)")
 	flags.BoolVar(&markDuplicates, "mark-duplicates", false, "mark duplicates")
 	flags.StringVar(&markOpticalDuplicates, "mark-optical-duplicates", "", "mark optical duplicates")
 	flags.StringVar(&markOpticalDuplicatesIntermediate, "mark-optical-duplicates-intermediate", "", "mark optical duplicates intermediate file (only for split files)")
 	flags.BoolVar(&markDuplicatesDet, "mark-duplicates-deterministic", false, "mark duplicates deterministically")
 	flags.BoolVar(&removeDuplicates, "remove-duplicates", false, "remove duplicates")
+	flags.StringVar(&regionCounts, "region-counts", "", "count the reads and fragments that overlap with the given regions (bed, gtf, gff3, or interval_list format)")
+	flags.StringVar(&regionCountsOutput, "region-counts-output", "", "write the counts of --region-counts to the given file")
+	flags.IntVar(&regionCountsMinMappingQuality, "region-counts-min-mapping-quality", 0, "count only reads that equal or exceed the given mapping quality for --region-counts")
+	flags.BoolVar(&regionCountsSkipDuplicates, "region-counts-skip-duplicates", false, "do not count reads that are marked as duplicates for --region-counts")
+	flags.IntVar(&regionCountsNearestDistance, "region-counts-nearest-distance", 0, "count reads that overlap with no region for the nearest region at most the given number of bases away for --region-counts (off by default)")
+	flags.StringVar(&maskLowQualityBases, "mask-low-quality-bases", "", "replace bases with a base quality below the given threshold by N, optionally per read group")
+	flags.IntVar(&maskQualityCap, "mask-quality-cap", -1, "cap the base quality of low quality bases instead of replacing them by N")
+	flags.StringVar(&clipMode, "clip-mode", "", "convert soft clips to hard clips (hard), or restore soft clips from hard clips (soft)")
+	flags.BoolVar(&keepClippedBases, "keep-clipped-bases", false, "keep the bases and base qualities removed by --clip-mode hard in the hb and hq optional fields, so that --clip-mode soft can restore them")
+	flags.BoolVar(&trimClippedBases, "trim-clipped-bases", false, "remove the clipped bases from the reads, and the clips from the CIGAR strings")
+	flags.IntVar(&trimMinLength, "trim-min-length", 0, "remove reads with fewer bases remaining after --trim-clipped-bases")
 	flags.StringVar(&removeOptionalFields, "remove-optional-fields", "", "remove the given optional fields")
 	flags.StringVar(&keepOptionalFields, "keep-optional-fields", "", "remove all except for the given optional fields")
 	flags.StringVar(&sortingOrderString, "sorting-order", string(sam.Keep), "determine output order of alignments, one of keep, unknown, unsorted, queryname, or coordinate")
+	flags.StringVar(&querynameCollation, "queryname-collation", "", "compare query names when sorting by queryname, one of lexicographical (as Picard) or natural (as samtools)")
+	flags.StringVar(&outputFormatString, "output-format", "", "format of the output file, one of sam, sam.gz, bam, or uncompressed-bam (default determined by the file extension)")
+	flags.StringVar(&writeIndex, "write-index", "", "write a .bai or .csi index along with a coordinate-sorted BAM output file")
+	flags.IntVar(&writeOffsetMap, "write-offset-map", 0, "write a map from bins of the given size to virtual offsets along with a coordinate-sorted BAM output file")
+	flags.BoolVar(&outputPerReadGroup, "output-per-read-group", false, "write the alignments of each read group to a separate output file")
+	flags.BoolVar(&outputPerContig, "output-per-contig", false, "write the alignments of each reference sequence to a separate coordinate-sorted output file")
+	flags.StringVar(&checkSortingOrder, "check-sorting-order", "", "check the order of the input alignments against the sorting order in the input header, one of warn or strict")
+	flags.StringVar(&validationStringency, "validation-stringency", "", "check the alignments for invalid fields, one of strict, lenient, or none")
 	flags.BoolVar(&cleanSam, "clean-sam", false, "clean the sam file")
+	flags.BoolVar(&anonymizeReadNames, "anonymize-read-names", false, "replace the read names by short deterministic identifiers")
+	flags.StringVar(&readNameMap, "read-name-map", "", "write the original read names replaced by --anonymize-read-names to the given file")
+	flags.BoolVar(&fixMateInformation, "fix-mate-information", false, "make the mate information of paired reads consistent (requires input sorted by queryname or grouped by query)")
+	flags.BoolVar(&clipOverlappingMates, "clip-overlapping-mates", false, "soft-clip the overlapping parts of properly paired reads (requires input sorted by queryname or grouped by query)")
 	flags.StringVar(&bqsr, "bqsr", "", "base quality score recalibration")
 	flags.StringVar(&bqsrTablesOnly, "bqsr-tables-only", "", "base quality score recalibration table calculation (only with split/merge)")
 	flags.StringVar(&bqsrApplyFromTables, "bqsr-apply", "", "base quality score recalibration application (only with split/merge)")
@@ -484,6 +775,7 @@ func Filter() error {
 	flags.StringVar(&recalFile, "recal-file", "", "log file for recalibration tables (only with --bqsr-apply)")
 	flags.BoolVar(&deterministic, "deterministic", false, "run elprep deterministically")
 	flags.IntVar(&nrOfThreads, "nr-of-threads", 0, "number of worker threads")
+	bgzf.define(&flags)
 	flags.BoolVar(&timed, "timed", false, "measure the runtime")
 	flags.StringVar(&profile, "profile", "", "write a runtime profile to the specified file(s)")
 	flags.StringVar(&logPath, "log-path", "", "write log files to the specified directory")
@@ -500,19 +792,65 @@ func Filter() error {
 
 	var sanityChecksFailed bool
 
-	if !checkExist("", input) {
+	if !sam.IsHtsgetURL(input) && !checkExist("", input) {
 		sanityChecksFailed = true
 	}
 	if !checkCreate("", output) {
 		sanityChecksFailed = true
 	}
 
+	if regions != "" {
+		if files, err := sam.InputFiles(input); err == nil {
+			for _, file := range files {
+				if filepath.Ext(file) != sam.BamExt && !sam.IsHtsgetURL(file) {
+					sanityChecksFailed = true
+					log.Println("Error: --regions requires BAM files with a .bai or .csi index, or an htsget URL, as input.")
+					break
+				}
+			}
+		}
+	}
+	if contigAliases != "" && !checkExist("--contig-aliases", contigAliases) {
+		sanityChecksFailed = true
+	}
 	if replaceReferenceSequences != "" && !checkExist("--replace-reference-sequences", replaceReferenceSequences) {
 		sanityChecksFailed = true
 	}
 	if filterNonOverlappingReads != "" && !checkExist("--filter-non-overlapping-reads", filterNonOverlappingReads) {
 		sanityChecksFailed = true
 	}
+	if filterNonOverlappingFragments != "" && !checkExist("--filter-non-overlapping-fragments", filterNonOverlappingFragments) {
+		sanityChecksFailed = true
+	}
+	if filterNonOverlappingReads != "" && filterNonOverlappingFragments != "" {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --filter-non-overlapping-reads and --filter-non-overlapping-fragments in the same command.")
+	}
+	if targetPadding < 0 {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid target-padding: ", targetPadding)
+	} else if targetPadding > 0 && filterNonOverlappingReads == "" && filterNonOverlappingFragments == "" {
+		sanityChecksFailed = true
+		log.Println("Error: --target-padding requires --filter-non-overlapping-reads or --filter-non-overlapping-fragments.")
+	}
+	if regionCounts != "" && !checkExist("--region-counts", regionCounts) {
+		sanityChecksFailed = true
+	}
+	if regionCounts != "" && !checkCreate("--region-counts-output", regionCountsOutput) {
+		sanityChecksFailed = true
+	}
+	if regionCounts == "" && (regionCountsOutput != "" || regionCountsMinMappingQuality != 0 || regionCountsSkipDuplicates || regionCountsNearestDistance != 0) {
+		sanityChecksFailed = true
+		log.Println("Error: --region-counts-output, --region-counts-min-mapping-quality, --region-counts-skip-duplicates, and --region-counts-nearest-distance require --region-counts.")
+	}
+	if regionCountsMinMappingQuality < 0 || regionCountsMinMappingQuality > math.MaxUint8 {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid region-counts-min-mapping-quality: ", regionCountsMinMappingQuality)
+	}
+	if regionCountsNearestDistance < 0 || regionCountsNearestDistance > math.MaxInt32 {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid region-counts-nearest-distance: ", regionCountsNearestDistance)
+	}
 	if markOpticalDuplicates != "" && !checkCreate("--mark-optical-duplicates", markOpticalDuplicates) {
 		sanityChecksFailed = true
 	}
@@ -560,15 +898,127 @@ func Filter() error {
 		log.Println("Error: Invalid sorting-order: ", sortingOrder)
 	}
 
+	switch sam.QuerynameCollation(querynameCollation) {
+	case "":
+	case sam.Lexicographical, sam.Natural:
+		if sortingOrder != sam.Queryname {
+			sanityChecksFailed = true
+			log.Println("Error: --queryname-collation requires --sorting-order queryname.")
+		}
+	default:
+		sanityChecksFailed = true
+		log.Println("Error: Invalid queryname-collation: ", querynameCollation)
+	}
+
+	outputFormat, err := sam.ParseOutputFormat(outputFormatString)
+	if err != nil {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid output-format: ", outputFormatString)
+	}
+
+	indexFormat, err := sam.ParseIndexFormat(writeIndex)
+	if err != nil {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid write-index: ", writeIndex)
+	} else if indexFormat != sam.NoIndex {
+		if resolved := sam.ResolveOutputFormat(output, outputFormat); (resolved != sam.BamFormat && resolved != sam.UncompressedBamFormat) || output == "/dev/stdout" {
+			sanityChecksFailed = true
+			log.Println("Error: --write-index requires a BAM file as output.")
+		}
+		if sortingOrder != sam.Coordinate && sortingOrder != sam.Keep {
+			sanityChecksFailed = true
+			log.Println("Error: --write-index requires --sorting-order coordinate, or keep for coordinate-sorted input.")
+		}
+	}
+
+	if writeOffsetMap < 0 || writeOffsetMap > math.MaxInt32 {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid write-offset-map: ", writeOffsetMap)
+	} else if writeOffsetMap > 0 {
+		if resolved := sam.ResolveOutputFormat(output, outputFormat); (resolved != sam.BamFormat && resolved != sam.UncompressedBamFormat) || output == "/dev/stdout" {
+			sanityChecksFailed = true
+			log.Println("Error: --write-offset-map requires a BAM file as output.")
+		}
+		if sortingOrder != sam.Coordinate && sortingOrder != sam.Keep {
+			sanityChecksFailed = true
+			log.Println("Error: --write-offset-map requires --sorting-order coordinate, or keep for coordinate-sorted input.")
+		}
+		if outputPerReadGroup || outputPerContig {
+			sanityChecksFailed = true
+			log.Println("Error: Cannot use --write-offset-map with --output-per-read-group or --output-per-contig.")
+		}
+	}
+	offsetMapBinSize := int32(writeOffsetMap)
+
+	split := noOutputSplit
+	if outputPerReadGroup {
+		split = splitPerReadGroup
+		if output == "/dev/stdout" {
+			sanityChecksFailed = true
+			log.Println("Error: --output-per-read-group cannot write to /dev/stdout.")
+		}
+	}
+	if outputPerContig {
+		split = splitPerContig
+		if output == "/dev/stdout" {
+			sanityChecksFailed = true
+			log.Println("Error: --output-per-contig cannot write to /dev/stdout.")
+		}
+		if outputPerReadGroup {
+			sanityChecksFailed = true
+			log.Println("Error: Cannot use --output-per-read-group and --output-per-contig in the same command.")
+		}
+		if sortingOrder != sam.Coordinate && sortingOrder != sam.Keep {
+			sanityChecksFailed = true
+			log.Println("Error: --output-per-contig requires --sorting-order coordinate, or keep for coordinate-sorted input.")
+		}
+	}
+
+	sortingOrderCheck, err := sam.ParseSortingOrderCheck(checkSortingOrder)
+	if err != nil {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid check-sorting-order: ", checkSortingOrder)
+	}
+
+	stringency, err := sam.ParseValidationStringency(validationStringency)
+	if err != nil {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid validation-stringency: ", validationStringency)
+	}
+
 	if (replaceReferenceSequences != "") && (sortingOrder == sam.Keep) {
 		log.Println("Warning: Requesting to keep the order of the input file while replacing the reference sequence dictionary may force an additional sorting phase to ensure the original sorting order is respected.")
 	}
 
+	for _, comment := range addComments {
+		if strings.ContainsRune(comment, '\n') {
+			sanityChecksFailed = true
+			log.Println("Error: Invalid newline in --add-comment.")
+		}
+	}
+
+	if noPG && (pgID != "" || pgName != "" || pgDescription != "" || pgCommandLine != "") {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --no-pg and --pg-id, --pg-name, --pg-description, or --pg-command-line in the same filter command.")
+	}
+
+	for _, value := range []string{pgID, pgName, pgDescription, pgCommandLine} {
+		if strings.ContainsAny(value, "\t\n") {
+			sanityChecksFailed = true
+			log.Println("Error: Invalid tab or newline in --pg-id, --pg-name, --pg-description, or --pg-command-line.")
+			break
+		}
+	}
+
 	if keepOptionalFields != "" && removeOptionalFields != "" {
 		sanityChecksFailed = true
 		log.Println("Error: Cannot use --keep-optional-fields and --remove-optional-fields in the same filter command.")
 	}
 
+	if !bgzf.apply() {
+		sanityChecksFailed = true
+	}
+
 	if nrOfThreads < 0 {
 		sanityChecksFailed = true
 		log.Println("Error: Invalid nr-of-threads: ", nrOfThreads)
@@ -589,6 +1039,104 @@ func Filter() error {
 		log.Println("Error: Cannot use --mark-optical-duplicates-intermediate without also using --mark-duplicates.")
 	}
 
+	if filterSecondaryAlignments && keepOnlySecondary {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --filter-secondary-alignments and --keep-only-secondary in the same filter command.")
+	}
+
+	if stripSATags && !filterSupplementaryAlignments {
+		sanityChecksFailed = true
+		log.Println("Error: --strip-sa-tags can only be used together with --filter-supplementary-alignments.")
+	}
+
+	if maskQualityCap >= 0 && maskLowQualityBases == "" {
+		sanityChecksFailed = true
+		log.Println("Error: --mask-quality-cap can only be used together with --mask-low-quality-bases.")
+	}
+
+	if maskQualityCap > 93 {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid mask-quality-cap: ", maskQualityCap)
+	}
+
+	switch clipMode {
+	case "", "hard", "soft":
+	default:
+		sanityChecksFailed = true
+		log.Println("Error: Invalid clip-mode: ", clipMode)
+	}
+
+	if keepClippedBases && clipMode != "hard" {
+		sanityChecksFailed = true
+		log.Println("Error: --keep-clipped-bases can only be used together with --clip-mode hard.")
+	}
+
+	if trimMinLength < 0 {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid trim-min-length: ", trimMinLength)
+	}
+
+	if trimMinLength > 0 && !trimClippedBases {
+		sanityChecksFailed = true
+		log.Println("Error: --trim-min-length can only be used together with --trim-clipped-bases.")
+	}
+
+	if capMappingQuality > 254 {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid cap-mapping-quality: ", capMappingQuality)
+	}
+
+	if floorMappingQuality > 254 {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid floor-mapping-quality: ", floorMappingQuality)
+	}
+
+	if capMappingQuality >= 0 && floorMappingQuality > capMappingQuality {
+		sanityChecksFailed = true
+		log.Println("Error: --floor-mapping-quality cannot be higher than --cap-mapping-quality.")
+	}
+
+	switch readLengthType {
+	case "", "query", "aligned":
+	default:
+		sanityChecksFailed = true
+		log.Println("Error: Invalid read-length-type: ", readLengthType)
+	}
+
+	if readLengthType != "" && filterReadLength == "" {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --read-length-type without also using --filter-read-length.")
+	}
+
+	if keepReadGroups != "" && excludeReadGroups != "" {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --keep-read-groups and --exclude-read-groups in the same filter command.")
+	}
+
+	if readNameMap != "" && !anonymizeReadNames {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --read-name-map without also using --anonymize-read-names.")
+	}
+
+	if readNameMap != "" && !checkCreate("--read-name-map", readNameMap) {
+		sanityChecksFailed = true
+	}
+
+	if anonymizeReadNames && (markOpticalDuplicates != "" || markOpticalDuplicatesIntermediate != "") {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --anonymize-read-names and --mark-optical-duplicates in the same filter command, since optical duplicates are detected using the read names.")
+	}
+
+	if fixMateInformation && (markOpticalDuplicates != "" || markOpticalDuplicatesIntermediate != "") {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --fix-mate-information and --mark-optical-duplicates in the same filter command.")
+	}
+
+	if clipOverlappingMates && (markOpticalDuplicates != "" || markOpticalDuplicatesIntermediate != "") {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --clip-overlapping-mates and --mark-optical-duplicates in the same filter command.")
+	}
+
 	if deterministic && (bqsrTablesOnly != "" || bqsrApplyFromTables != "") {
 		sanityChecksFailed = true
 		log.Println("Error: deterministic option is not yet supported for --bqsr-tables-only or --bqsr-apply")
@@ -616,6 +1164,30 @@ func Filter() error {
 
 	var filters1, filters2 []sam.Filter
 
+	var aliases sam.ContigAliases
+
+	if contigAliases != "" {
+		var err error
+		if aliases, err = sam.ParseContigAliases(contigAliases); err != nil {
+			return err
+		}
+		fmt.Fprint(&command, " --contig-aliases ", contigAliases)
+	}
+
+	var loci []sam.Locus
+
+	if regions != "" {
+		var checkDict sam.Filter
+		var err error
+		if loci, checkDict, err = parseLoci(regions); err != nil {
+			return err
+		}
+		if checkDict != nil {
+			filters1 = append(filters1, checkDict)
+		}
+		fmt.Fprint(&command, " --regions ", regions)
+	}
+
 	if filterUnmappedReadsStrict {
 		filters1 = append(filters1, filters.RemoveUnmappedReadsStrict)
 		fmt.Fprint(&command, " --filter-unmapped-reads-strict")
@@ -624,12 +1196,59 @@ func Filter() error {
 		fmt.Fprint(&command, " --filter-unmapped-reads")
 	}
 
+	if filterSecondaryAlignments {
+		filters1 = append(filters1, filters.RemoveSecondaryAlignments)
+		fmt.Fprint(&command, " --filter-secondary-alignments")
+	} else if keepOnlySecondary {
+		filters1 = append(filters1, filters.KeepOnlySecondaryAlignments)
+		fmt.Fprint(&command, " --keep-only-secondary")
+	}
+
+	if filterSupplementaryAlignments {
+		filters1 = append(filters1, filters.RemoveSupplementaryAlignments(stripSATags))
+		fmt.Fprint(&command, " --filter-supplementary-alignments")
+		if stripSATags {
+			fmt.Fprint(&command, " --strip-sa-tags")
+		}
+	}
+
+	if reassignMappingQuality != "" {
+		from, to, err := parseMappingQualityReassignment(reassignMappingQuality)
+		if err != nil {
+			return err
+		}
+		filters1 = append(filters1, filters.ReassignMappingQuality(from, to))
+		fmt.Fprint(&command, " --reassign-mapping-quality ", reassignMappingQuality)
+	}
+
+	if capMappingQuality >= 0 {
+		filters1 = append(filters1, filters.CapMappingQuality(byte(capMappingQuality)))
+		fmt.Fprint(&command, " --cap-mapping-quality ", capMappingQuality)
+	}
+
+	if floorMappingQuality >= 0 {
+		filters1 = append(filters1, filters.FloorMappingQuality(byte(floorMappingQuality)))
+		fmt.Fprint(&command, " --floor-mapping-quality ", floorMappingQuality)
+	}
+
 	if filterMappingQuality > 0 {
 		filterMappingQualityFilter := filters.RemoveMappingQualityLessThan(filterMappingQuality)
 		filters1 = append(filters1, filterMappingQualityFilter)
 		fmt.Fprint(&command, " --filter-mapping-quality ", filterMappingQuality)
 	}
 
+	if filterReadLength != "" {
+		minLength, maxLength, err := parseReadLengthRange(filterReadLength)
+		if err != nil {
+			return err
+		}
+		filters1 = append(filters1, filters.RemoveReadsOutsideLengthRange(minLength, maxLength, readLengthType == "aligned"))
+		fmt.Fprint(&command, " --filter-read-length ", filterReadLength)
+		if readLengthType != "" {
+			fmt.Fprint(&command, " --read-length-type ", readLengthType)
+		}
+	}
+
 	if filterNonExactMappingReads {
 		filters1 = append(filters1, filters.RemoveNonExactMappingReads)
 		fmt.Fprint(&command, " --filter-non-exact-mapping-reads")
@@ -641,15 +1260,35 @@ func Filter() error {
 	}
 
 	if filterNonOverlappingReads != "" {
-		parsedBed, err := bed.ParseBed(filterNonOverlappingReads)
+		parsedBed, checkDict, err := parseTargetRegions(filterNonOverlappingReads, targetPadding)
 		if err != nil {
 			return err
 		}
-		filterNonOverlappingReadsFilter := filters.RemoveNonOverlappingReads(parsedBed)
+		if checkDict != nil {
+			filters1 = append(filters1, checkDict)
+		}
+		filterNonOverlappingReadsFilter := filters.RemoveNonOverlappingReadsWithAliases(parsedBed, aliases)
 		filters1 = append(filters1, filterNonOverlappingReadsFilter)
 		fmt.Fprint(&command, " --filter-non-overlapping-reads ", filterNonOverlappingReads)
 	}
 
+	if filterNonOverlappingFragments != "" {
+		parsedBed, checkDict, err := parseTargetRegions(filterNonOverlappingFragments, targetPadding)
+		if err != nil {
+			return err
+		}
+		if checkDict != nil {
+			filters1 = append(filters1, checkDict)
+		}
+		filterNonOverlappingFragmentsFilter := filters.RemoveNonOverlappingFragmentsWithAliases(parsedBed, aliases)
+		filters1 = append(filters1, filterNonOverlappingFragmentsFilter)
+		fmt.Fprint(&command, " --filter-non-overlapping-fragments ", filterNonOverlappingFragments)
+	}
+
+	if targetPadding > 0 {
+		fmt.Fprint(&command, " --target-padding ", targetPadding)
+	}
+
 	if renameChromosomes {
 		filters1 = append(filters1, filters.RenameChromosomes)
 		fmt.Fprint(&command, " --rename-chromosomes")
@@ -660,6 +1299,38 @@ func Filter() error {
 		fmt.Fprint(&command, " --clean-sam")
 	}
 
+	if anonymizeReadNames {
+		var nameMap *filters.ReadNameMap
+		if readNameMap != "" {
+			nameMap, err = filters.CreateReadNameMap(readNameMap)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if nerr := nameMap.Close(); err == nil {
+					err = nerr
+				}
+			}()
+		}
+		filters1 = append(filters1, filters.AnonymizeReadNames(nameMap))
+		fmt.Fprint(&command, " --anonymize-read-names")
+		if readNameMap != "" {
+			fmt.Fprint(&command, " --read-name-map ", readNameMap)
+		}
+	}
+
+	var groupFilters []sam.GroupFilter
+
+	if fixMateInformation {
+		groupFilters = append(groupFilters, filters.FixMateInformation)
+		fmt.Fprint(&command, " --fix-mate-information")
+	}
+
+	if clipOverlappingMates {
+		groupFilters = append(groupFilters, filters.ClipOverlappingMates)
+		fmt.Fprint(&command, " --clip-overlapping-mates")
+	}
+
 	if replaceReferenceSequences != "" {
 		replaceReferenceSequencesFilter, err := filters.ReplaceReferenceSequenceDictionaryFromSamFile(replaceReferenceSequences)
 		if err != nil {
@@ -669,15 +1340,59 @@ func Filter() error {
 		fmt.Fprint(&command, " --replace-reference-sequences ", replaceReferenceSequences)
 	}
 
+	if keepReadGroups != "" {
+		values, err := parseReadGroupList(keepReadGroups)
+		if err != nil {
+			return err
+		}
+		filters1 = append(filters1, filters.SelectReadGroups(values, false))
+		fmt.Fprint(&command, " --keep-read-groups \"", keepReadGroups, "\"")
+	} else if excludeReadGroups != "" {
+		values, err := parseReadGroupList(excludeReadGroups)
+		if err != nil {
+			return err
+		}
+		filters1 = append(filters1, filters.SelectReadGroups(values, true))
+		fmt.Fprint(&command, " --exclude-read-groups \"", excludeReadGroups, "\"")
+	}
+
 	if replaceReadGroup != "" {
 		record, err := sam.ParseHeaderLineFromString(replaceReadGroup)
 		if err != nil {
 			return err
 		}
+		if record["ID"] == "" {
+			return fmt.Errorf("missing ID in --replace-read-group %v", replaceReadGroup)
+		}
 		filters1 = append(filters1, filters.AddOrReplaceReadGroup(record))
 		fmt.Fprint(&command, " --replace-read-group ", replaceReadGroup)
 	}
 
+	for _, comment := range addComments {
+		filters1 = append(filters1, filters.AddComment(comment))
+		fmt.Fprint(&command, " --add-comment \"", comment, "\"")
+	}
+
+	if noPG {
+		fmt.Fprint(&command, " --no-pg")
+	}
+
+	if pgID != "" {
+		fmt.Fprint(&command, " --pg-id \"", pgID, "\"")
+	}
+
+	if pgName != "" {
+		fmt.Fprint(&command, " --pg-name \"", pgName, "\"")
+	}
+
+	if pgDescription != "" {
+		fmt.Fprint(&command, " --pg-description \"", pgDescription, "\"")
+	}
+
+	if pgCommandLine != "" {
+		fmt.Fprint(&command, " --pg-command-line \"", pgCommandLine, "\"")
+	}
+
 	if (replaceReferenceSequences != "") || markDuplicates ||
 		(sortingOrder == sam.Coordinate) || (sortingOrder == sam.Queryname) {
 		filters1 = append(filters1, filters.AddREFID)
@@ -725,11 +1440,76 @@ func Filter() error {
 
 	filters1 = append(filters1, filters.RemoveOptionalReads)
 
+	if regionCounts != "" {
+		parsedBed, checkDict, err := parseTargetRegions(regionCounts, 0)
+		if err != nil {
+			return err
+		}
+		if checkDict != nil {
+			filters1 = append(filters1, checkDict)
+		}
+		countFilter, counts := filters.CountRegionReads(parsedBed, byte(regionCountsMinMappingQuality), regionCountsSkipDuplicates, int32(regionCountsNearestDistance))
+		filters2 = append(filters2, countFilter)
+		defer func() {
+			if err == nil {
+				err = writeRegionCounts(regionCountsOutput, counts)
+			}
+		}()
+		fmt.Fprint(&command, " --region-counts ", regionCounts, " --region-counts-output ", regionCountsOutput)
+		if regionCountsMinMappingQuality > 0 {
+			fmt.Fprint(&command, " --region-counts-min-mapping-quality ", regionCountsMinMappingQuality)
+		}
+		if regionCountsSkipDuplicates {
+			fmt.Fprint(&command, " --region-counts-skip-duplicates")
+		}
+		if regionCountsNearestDistance > 0 {
+			fmt.Fprint(&command, " --region-counts-nearest-distance ", regionCountsNearestDistance)
+		}
+	}
+
 	if removeDuplicates {
 		filters2 = append(filters2, filters.RemoveDuplicateReads)
 		fmt.Fprint(&command, " --remove-duplicates")
 	}
 
+	var maskLowQualityBasesFilter sam.Filter
+
+	if maskLowQualityBases != "" {
+		defaultThreshold, readGroupThresholds, err := parseBaseQualityThresholds(maskLowQualityBases, maskQualityCap)
+		if err != nil {
+			return err
+		}
+		maskLowQualityBasesFilter = filters.MaskLowQualityBases(defaultThreshold, readGroupThresholds, maskQualityCap)
+		if bqsrApplyFromTables == "" {
+			// with --bqsr-apply, the filter is added after applying BQSR
+			filters2 = append(filters2, maskLowQualityBasesFilter)
+		}
+		fmt.Fprint(&command, " --mask-low-quality-bases \"", maskLowQualityBases, "\"")
+		if maskQualityCap >= 0 {
+			fmt.Fprint(&command, " --mask-quality-cap ", maskQualityCap)
+		}
+	}
+
+	switch clipMode {
+	case "hard":
+		filters2 = append(filters2, filters.ConvertSoftClipsToHardClips(keepClippedBases))
+		fmt.Fprint(&command, " --clip-mode hard")
+		if keepClippedBases {
+			fmt.Fprint(&command, " --keep-clipped-bases")
+		}
+	case "soft":
+		filters2 = append(filters2, filters.RestoreSoftClips)
+		fmt.Fprint(&command, " --clip-mode soft")
+	}
+
+	if trimClippedBases {
+		filters2 = append(filters2, filters.TrimClippedBases(trimMinLength))
+		fmt.Fprint(&command, " --trim-clipped-bases")
+		if trimMinLength > 0 {
+			fmt.Fprint(&command, " --trim-min-length ", trimMinLength)
+		}
+	}
+
 	if bqsr != "" {
 		// filters created later
 		fmt.Fprint(&command, " --bqsr ", bqsr)
@@ -805,6 +1585,39 @@ func Filter() error {
 
 	fmt.Fprint(&command, " --sorting-order ", sortingOrder)
 
+	if querynameCollation != "" {
+		filters1 = append(filters1, filters.SetQuerynameCollation(sam.QuerynameCollation(querynameCollation)))
+		fmt.Fprint(&command, " --queryname-collation ", querynameCollation)
+	}
+
+	if outputFormatString != "" {
+		fmt.Fprint(&command, " --output-format ", outputFormatString)
+	}
+
+	if writeIndex != "" {
+		fmt.Fprint(&command, " --write-index ", writeIndex)
+	}
+
+	if writeOffsetMap > 0 {
+		fmt.Fprint(&command, " --write-offset-map ", writeOffsetMap)
+	}
+
+	if outputPerReadGroup {
+		fmt.Fprint(&command, " --output-per-read-group")
+	}
+
+	if outputPerContig {
+		fmt.Fprint(&command, " --output-per-contig")
+	}
+
+	if checkSortingOrder != "" {
+		fmt.Fprint(&command, " --check-sorting-order ", checkSortingOrder)
+	}
+
+	if validationStringency != "" {
+		fmt.Fprint(&command, " --validation-stringency ", validationStringency)
+	}
+
 	if deterministic {
 		fmt.Fprint(&command, " --deterministic")
 	}
@@ -820,6 +1633,10 @@ func Filter() error {
 		fmt.Fprint(&command, " --nr-of-threads ", nrOfThreads)
 	}
 
+	for _, arg := range bgzf.args() {
+		fmt.Fprint(&command, " ", arg)
+	}
+
 	if timed {
 		fmt.Fprint(&command, " --timed")
 	}
@@ -834,13 +1651,39 @@ func Filter() error {
 
 	commandString := command.String()
 
-	filters1 = append([]sam.Filter{filters.AddPGLine(utils.StringMap{
-		"ID": ProgramName + " " + ProgramVersion,
-		"PN": ProgramName,
-		"VN": ProgramVersion,
-		"DS": ProgramURL,
-		"CL": commandString,
-	})}, filters1...)
+	if !noPG {
+		pg := utils.StringMap{
+			"ID": ProgramName + " " + ProgramVersion,
+			"PN": ProgramName,
+			"VN": ProgramVersion,
+			"DS": ProgramURL,
+			"CL": commandString,
+		}
+		if pgID != "" {
+			pg["ID"] = pgID
+		}
+		if pgName != "" {
+			pg["PN"] = pgName
+		}
+		if pgDescription != "" {
+			pg["DS"] = pgDescription
+		}
+		if pgCommandLine != "" {
+			pg["CL"] = pgCommandLine
+		}
+		filters1 = append([]sam.Filter{filters.AddPGLine(pg)}, filters1...)
+	}
+
+	var report sam.ValidationReport
+	validation := filters.ValidateAlignments(stringency, &report)
+	if validation != nil {
+		filters1 = append([]sam.Filter{validation}, filters1...)
+		defer func() {
+			var lines strings.Builder
+			_ = report.Write(&lines)
+			log.Print("Validation report:\n", lines.String())
+		}()
+	}
 
 	// executing command
 
@@ -852,12 +1695,12 @@ func Filter() error {
 			return err
 		}
 		baseRecalibrator := filters.NewBaseRecalibrator(knownSitesList, referenceElFasta)
-		return runBestPracticesPipelineIntermediateSamWithBQSR(input, output, sortingOrder, filters1, filters2, opticalDuplicatesFilter, baseRecalibrator, quantizeLevels, sqqList, recalFile, deterministic, timed, profile)
+		return runBestPracticesPipelineIntermediateSamWithBQSR(input, output, loci, aliases, outputFormat, indexFormat, offsetMapBinSize, split, sortingOrderCheck, groupFilters, sortingOrder, filters1, filters2, opticalDuplicatesFilter, baseRecalibrator, quantizeLevels, sqqList, recalFile, deterministic, timed, profile)
 	}
 
 	if bqsrTablesOnly != "" {
 		baseRecalibrator := filters.NewBaseRecalibrator(knownSitesList, referenceElFasta)
-		return runBestPracticesPipelineIntermediateSamWithBQSRCalculateTablesOnly(input, output, sortingOrder, filters1, filters2, opticalDuplicatesFilter, baseRecalibrator, bqsrTablesOnly, timed, profile)
+		return runBestPracticesPipelineIntermediateSamWithBQSRCalculateTablesOnly(input, output, loci, aliases, outputFormat, indexFormat, offsetMapBinSize, split, sortingOrderCheck, groupFilters, sortingOrder, filters1, filters2, opticalDuplicatesFilter, baseRecalibrator, bqsrTablesOnly, timed, profile)
 	}
 
 	if bqsrApplyFromTables != "" {
@@ -869,14 +1712,18 @@ func Filter() error {
 		if err != nil {
 			return err
 		}
+		filters2 = append([]sam.Filter{validation}, filters2...)
 		filters2 = append(filters2, baseRecalibratorTables.ApplyBQSR(quantizeLevels, sqqList))
-		return runBestPracticesPipelineIntermediateSamWithBQSRApplyOnly(input, output, sortingOrder, filters2, baseRecalibratorTables, recalFile, timed, profile)
+		if maskLowQualityBasesFilter != nil {
+			filters2 = append(filters2, maskLowQualityBasesFilter)
+		}
+		return runBestPracticesPipelineIntermediateSamWithBQSRApplyOnly(input, output, loci, aliases, outputFormat, indexFormat, offsetMapBinSize, split, sortingOrderCheck, groupFilters, sortingOrder, filters2, baseRecalibratorTables, recalFile, timed, profile)
 	}
 
 	if markDuplicates ||
 		(sortingOrder == sam.Coordinate) || (sortingOrder == sam.Queryname) ||
-		((replaceReferenceSequences != "") && (sortingOrder == sam.Keep)) {
-		return runBestPracticesPipelineIntermediateSam(input, output, sortingOrder, filters1, filters2, opticalDuplicatesFilter, deterministic, timed, profile)
+		((replaceReferenceSequences != "" || anonymizeReadNames) && (sortingOrder == sam.Keep)) {
+		return runBestPracticesPipelineIntermediateSam(input, output, loci, aliases, outputFormat, indexFormat, offsetMapBinSize, split, sortingOrderCheck, groupFilters, sortingOrder, filters1, filters2, opticalDuplicatesFilter, deterministic, timed, profile)
 	}
-	return runBestPracticesPipeline(input, output, sortingOrder, append(filters1, filters2...), timed, profile)
+	return runBestPracticesPipeline(input, output, loci, aliases, outputFormat, indexFormat, offsetMapBinSize, split, sortingOrderCheck, groupFilters, sortingOrder, append(filters1, filters2...), timed, profile)
 }
@@ -0,0 +1,67 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBaseQualityThresholds(t *testing.T) {
+	defaultThreshold, readGroupThresholds, err := parseBaseQualityThresholds("10, rg1:20,lane:1:0", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaultThreshold != 10 || !reflect.DeepEqual(readGroupThresholds, map[string]byte{"rg1": 20, "lane:1": 0}) {
+		t.Error("parseBaseQualityThresholds failed", defaultThreshold, readGroupThresholds)
+	}
+	if _, _, err := parseBaseQualityThresholds("10,rg1:20,lane:1:0", 5); err != nil {
+		t.Error("parseBaseQualityThresholds with quality cap failed", err)
+	}
+	for _, invalid := range []struct {
+		thresholds string
+		qualityCap int
+	}{
+		{"abc", -1},
+		{"rg1:", -1},
+		{"94", -1},
+		{"-1", -1},
+		{"10", 10},
+		{"20,rg1:10", 15},
+	} {
+		if _, _, err := parseBaseQualityThresholds(invalid.thresholds, invalid.qualityCap); err == nil {
+			t.Error("parseBaseQualityThresholds accepted", invalid.thresholds, invalid.qualityCap)
+		}
+	}
+}
+
+func TestParseMappingQualityReassignment(t *testing.T) {
+	from, to, err := parseMappingQualityReassignment("255: 60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 255 || to != 60 {
+		t.Error("parseMappingQualityReassignment failed", from, to)
+	}
+	for _, invalid := range []string{"", "60", "256:60", "60:-1", "a:60", "60:"} {
+		if _, _, err := parseMappingQualityReassignment(invalid); err == nil {
+			t.Error("parseMappingQualityReassignment accepted", invalid)
+		}
+	}
+}
@@ -37,6 +37,7 @@ const MergeHelp = "\nmerge parameters:\n" +
 	"elprep merge /path/to/input sam-output-file\n" +
 	"[--single-end]\n" +
 	"[--nr-of-threads n]\n" +
+	BGZFHelp +
 	"[--timed]\n" +
 	"[--log-path path]\n" +
 	"[--contig-group-size nr]\n"
@@ -51,10 +52,12 @@ func Merge() error {
 	)
 
 	var flags flag.FlagSet
+	var bgzf bgzfFlags
 
 	flags.IntVar(&contigGroupSize, "contig-group-size", 0, "maximum sum of reference sequence lengths for creating groups of reference sequences")
 	flags.BoolVar(&singleEnd, "single-end", false, "when splitting single-end data")
 	flags.IntVar(&nrOfThreads, "nr-of-threads", 0, "number of worker threads")
+	bgzf.define(&flags)
 	flags.BoolVar(&timed, "timed", false, "measure the runtime")
 	flags.StringVar(&profile, "profile", "", "write a runtime profile to the specified file(s)")
 	flags.StringVar(&logPath, "log-path", "", "write log files to the specified directory")
@@ -94,6 +97,10 @@ func Merge() error {
 		sanityChecksFailed = true
 	}
 
+	if !bgzf.apply() {
+		sanityChecksFailed = true
+	}
+
 	if nrOfThreads < 0 {
 		sanityChecksFailed = true
 		log.Println("Error: Invalid nr-of-threads: ", nrOfThreads)
@@ -126,8 +133,8 @@ func Merge() error {
 	}
 
 	var inputExtension string
-	switch ext := filepath.Ext(filesToMerge[0]); ext {
-	case sam.SamExt, sam.BamExt:
+	switch ext := sam.FileExt(filesToMerge[0]); ext {
+	case sam.SamExt, sam.SamGzExt, sam.BamExt:
 		inputExtension = ext[1:]
 	default:
 		inputExtension = "sam"
@@ -144,6 +151,9 @@ func Merge() error {
 		runtime.GOMAXPROCS(nrOfThreads)
 		fmt.Fprint(&command, " --nr-of-threads ", nrOfThreads)
 	}
+	for _, arg := range bgzf.args() {
+		fmt.Fprint(&command, " ", arg)
+	}
 	if timed {
 		fmt.Fprint(&command, " --timed ")
 	}
@@ -40,32 +40,62 @@ import (
 
 // SfmHelp is the help string for this command.
 const SfmHelp = "\nsfm parameters:\n" +
-	"elprep sfm sam-file sam-output-file\n" +
+	"elprep sfm (sam-file | /path/to/input/) sam-output-file\n" +
 	"[--replace-reference-sequences sam-file]\n" +
 	"[--filter-unmapped-reads]\n" +
 	"[--filter-unmapped-reads-strict]\n" +
+	"[--filter-secondary-alignments]\n" +
+	"[--keep-only-secondary]\n" +
+	"[--filter-supplementary-alignments]\n" +
+	"[--strip-sa-tags]\n" +
+	"[--reassign-mapping-quality from:to]\n" +
+	"[--cap-mapping-quality mapping-quality]\n" +
+	"[--floor-mapping-quality mapping-quality]\n" +
 	"[--filter-mapping-quality mapping-quality]\n" +
+	"[--filter-read-length min:max]\n" +
+	"[--read-length-type [query | aligned]]\n" +
 	"[--filter-non-exact-mapping-reads]\n" +
 	"[--filter-non-exact-mapping-reads-strict]\n" +
 	"[--filter-non-overlapping-reads bed-file]\n" +
+	"[--filter-non-overlapping-fragments bed-file]\n" +
+	"[--contig-aliases file]\n" +
+	"[--target-padding nr-of-bases]\n" +
+	"[--keep-read-groups list-or-file]\n" +
+	"[--exclude-read-groups list-or-file]\n" +
 	"[--replace-read-group read-group-string]\n" +
+	"[--add-comment comment]\n" +
+	"[--no-pg]\n" +
+	"[--pg-id id]\n" +
+	"[--pg-name name]\n" +
+	"[--pg-description description]\n" +
+	"[--pg-command-line command-line]\n" +
 	"[--mark-duplicates]\n" +
 	"[--mark-optical-duplicates file]\n" +
 	"[--remove-duplicates]\n" +
+	"[--mask-low-quality-bases [read-group:]quality[,...]]\n" +
+	"[--mask-quality-cap quality]\n" +
+	"[--clip-mode [hard | soft]]\n" +
+	"[--keep-clipped-bases]\n" +
+	"[--trim-clipped-bases]\n" +
+	"[--trim-min-length nr-of-bases]\n" +
 	"[--remove-optional-fields [all | list]]\n" +
 	"[--keep-optional-fields [none | list]]\n" +
 	"[--sorting-order [keep | unknown | unsorted | queryname | coordinate]]\n" +
+	"[--output-per-read-group]\n" +
+	"[--output-per-contig]\n" +
 	"[--clean-sam]\n" +
+	"[--validation-stringency [strict | lenient | none]]\n" +
 	"[--bqsr]\n" +
 	"[--bqsr-reference elfasta]\n" +
 	"[--quantize-levels nr]\n" +
 	"[--sqq list]\n" +
 	"[--known-sites list]\n" +
 	"[--nr-of-threads nr]\n" +
+	BGZFHelp +
 	"[--timed]\n" +
 	"[--log-path path]\n" +
 	"[--intermediate-files-output-prefix name]\n" +
-	"[--intermediate-files-output-type [sam | bam]]\n" +
+	"[--intermediate-files-output-type [sam | sam.gz | bam]]\n" +
 	"[--single-end]\n" +
 	"[--contig-group-size nr]\n"
 
@@ -75,28 +105,58 @@ const CombinedSfmFilterHelp = "filter/sfm parameters:\n" +
 	"[--replace-reference-sequences sam-file]\n" +
 	"[--filter-unmapped-reads]\n" +
 	"[--filter-unmapped-reads-strict]\n" +
+	"[--filter-secondary-alignments]\n" +
+	"[--keep-only-secondary]\n" +
+	"[--filter-supplementary-alignments]\n" +
+	"[--strip-sa-tags]\n" +
+	"[--reassign-mapping-quality from:to]\n" +
+	"[--cap-mapping-quality mapping-quality]\n" +
+	"[--floor-mapping-quality mapping-quality]\n" +
 	"[--filter-mapping-quality mapping-quality]\n" +
+	"[--filter-read-length min:max]\n" +
+	"[--read-length-type [query | aligned]]\n" +
 	"[--filter-non-exact-mapping-reads]\n" +
 	"[--filter-non-exact-mapping-reads-strict]\n" +
 	"[--filter-non-overlapping-reads bed-file]\n" +
+	"[--filter-non-overlapping-fragments bed-file]\n" +
+	"[--contig-aliases file]\n" +
+	"[--target-padding nr-of-bases]\n" +
+	"[--keep-read-groups list-or-file]\n" +
+	"[--exclude-read-groups list-or-file]\n" +
 	"[--replace-read-group read-group-string]\n" +
+	"[--add-comment comment]\n" +
+	"[--no-pg]\n" +
+	"[--pg-id id]\n" +
+	"[--pg-name name]\n" +
+	"[--pg-description description]\n" +
+	"[--pg-command-line command-line]\n" +
 	"[--mark-duplicates]\n" +
 	"[--mark-optical-duplicates file]\n" +
 	"[--remove-duplicates]\n" +
+	"[--mask-low-quality-bases [read-group:]quality[,...]]\n" +
+	"[--mask-quality-cap quality]\n" +
+	"[--clip-mode [hard | soft]]\n" +
+	"[--keep-clipped-bases]\n" +
+	"[--trim-clipped-bases]\n" +
+	"[--trim-min-length nr-of-bases]\n" +
 	"[--remove-optional-fields [all | list]]\n" +
 	"[--keep-optional-fields [none | list]]\n" +
 	"[--sorting-order [keep | unknown | unsorted | queryname | coordinate]]\n" +
+	"[--output-per-read-group]\n" +
+	"[--output-per-contig]\n" +
 	"[--clean-sam]\n" +
+	"[--validation-stringency [strict | lenient | none]]\n" +
 	"[--bqsr recal-file]\n" +
 	"[--bqsr-reference elfasta]\n" +
 	"[--quantize-levels nr]\n" +
 	"[--sqq list]\n" +
 	"[--known-sites list]\n" +
 	"[--nr-of-threads nr]\n" +
+	BGZFHelp +
 	"[--timed]\n" +
 	"[--log-path path]\n" +
 	"[--intermediate-files-output-prefix name] (sfm only)\n" +
-	"[--intermediate-files-output-type [sam | bam]] (sfm only)\n" +
+	"[--intermediate-files-output-type [sam | sam.gz | bam]] (sfm only)\n" +
 	"[--single-end] (sfm only)\n" +
 	"[--contig-group-size nr] (sfm only)\n"
 
@@ -105,17 +165,38 @@ func Sfm() error {
 	var (
 		replaceReferenceSequences                           string
 		filterUnmappedReads, filterUnmappedReadsStrict      bool
+		filterSecondaryAlignments, keepOnlySecondary        bool
+		filterSupplementaryAlignments, stripSATags          bool
+		reassignMappingQuality                              string
+		capMappingQuality, floorMappingQuality              int
 		filterMappingQuality                                int
+		filterReadLength, readLengthType                    string
+		targetPadding                                       int
 		filterNonExactMappingReads                          bool
 		filterNonExactMappingReadsStrict                    bool
 		filterNonOverlappingReads                           string
+		filterNonOverlappingFragments                       string
+		contigAliases                                       string
+		keepReadGroups, excludeReadGroups                   string
 		replaceReadGroup                                    string
+		addComments                                         stringList
+		noPG                                                bool
+		pgID, pgName, pgDescription, pgCommandLine          string
 		markDuplicates, markDuplicatesDet, removeDuplicates bool
+		maskLowQualityBases                                 string
+		maskQualityCap                                      int
+		clipMode                                            string
+		keepClippedBases                                    bool
+		trimClippedBases                                    bool
+		trimMinLength                                       int
 		markOpticalDuplicates                               string
 		removeOptionalFields                                string
 		keepOptionalFields                                  string
 		sortingOrderString                                  string
+		outputPerReadGroup                                  bool
+		outputPerContig                                     bool
 		cleanSam                                            bool
+		validationStringency                                string
 		bqsr                                                string
 		referenceElFasta                                    string
 		quantizeLevels                                      int
@@ -133,24 +214,54 @@ func Sfm() error {
 	)
 
 	var flags flag.FlagSet
+	var bgzf bgzfFlags
 
 	// filter flags
 	flags.StringVar(&replaceReferenceSequences, "replace-reference-sequences", "", "replace the existing header by a new one")
 	flags.BoolVar(&filterUnmappedReads, "filter-unmapped-reads", false, "remove all unmapped alignments")
 	flags.BoolVar(&filterUnmappedReadsStrict, "filter-unmapped-reads-strict", false, "remove all unmapped alignments, taking also POS and RNAME into account")
+	flags.BoolVar(&filterSecondaryAlignments, "filter-secondary-alignments", false, "remove all secondary alignments")
+	flags.BoolVar(&keepOnlySecondary, "keep-only-secondary", false, "remove all but the secondary alignments")
+	flags.BoolVar(&filterSupplementaryAlignments, "filter-supplementary-alignments", false, "remove all supplementary alignments")
+	flags.BoolVar(&stripSATags, "strip-sa-tags", false, "remove the SA optional field from the alignments that remain after --filter-supplementary-alignments")
+	flags.StringVar(&reassignMappingQuality, "reassign-mapping-quality", "", "replace the mapping quality from by the mapping quality to")
+	flags.IntVar(&capMappingQuality, "cap-mapping-quality", -1, "lower mapping qualities above the given mapping quality to that mapping quality")
+	flags.IntVar(&floorMappingQuality, "floor-mapping-quality", -1, "raise mapping qualities of mapped reads below the given mapping quality to that mapping quality")
 	flags.IntVar(&filterMappingQuality, "filter-mapping-quality", 0, "output only reads that equal or exceed given mapping quality")
+	flags.StringVar(&filterReadLength, "filter-read-length", "", "output only reads with a length in the given range")
+	flags.StringVar(&readLengthType, "read-length-type", "", "the length used by --filter-read-length (query or aligned)")
 	flags.BoolVar(&filterNonExactMappingReads, "filter-non-exact-mapping-reads", false, "output only exact mapping reads (soft-clipping allowed) based on cigar string (only M,S allowed)")
 	flags.BoolVar(&filterNonExactMappingReadsStrict, "filter-non-exact-mapping-reads-strict", false, "output only exact mapping reads (soft-clipping allowed) based on optional fields X0=1, X1=0, XM=0, XO=0, XG=0")
-	flags.StringVar(&filterNonOverlappingReads, "filter-non-overlapping-reads", "", "output only reads that overlap with the given regions (bed format)")
+	flags.StringVar(&filterNonOverlappingReads, "filter-non-overlapping-reads", "", "output only reads that overlap with the given regions (bed, gtf, gff3, or interval_list format)")
+	flags.StringVar(&filterNonOverlappingFragments, "filter-non-overlapping-fragments", "", "output only reads whose fragments overlap with the given regions (bed, gtf, gff3, or interval_list format)")
+	flags.StringVar(&contigAliases, "contig-aliases", "", "table of alternative reference sequence names for --filter-non-overlapping-reads/fragments")
+	flags.IntVar(&targetPadding, "target-padding", 0, "extend the regions of --filter-non-overlapping-reads or --filter-non-overlapping-fragments by the given number of bases on each side")
+	flags.StringVar(&keepReadGroups, "keep-read-groups", "", "keep only the reads of the given read groups (IDs, SM, or LB values)")
+	flags.StringVar(&excludeReadGroups, "exclude-read-groups", "", "remove the reads of the given read groups (IDs, SM, or LB values)")
 	flags.StringVar(&replaceReadGroup, "replace-read-group", "", "add or replace alignment read groups")
+	flags.Var(&addComments, "add-comment", "add a @CO line to the header (can be given more than once)")
+	flags.BoolVar(&noPG, "no-pg", false, "do not add a @PG line for elprep to the header")
+	flags.StringVar(&pgID, "pg-id", "", "ID of the @PG line for elprep (default \""+ProgramName+" "+ProgramVersion+"\")")
+	flags.StringVar(&pgName, "pg-name", "", "PN of the @PG line for elprep (default \""+ProgramName+"\")")
+	flags.StringVar(&pgDescription, "pg-description", "", "DS of the @PG line for elprep (default \""+ProgramURL+"\")")
+	flags.StringVar(&pgCommandLine, "pg-command-line", "", "CL of the @PG line for elprep (default the elprep command line)")
 	flags.BoolVar(&markDuplicates, "mark-duplicates", false, "mark duplicates")
 	flags.BoolVar(&markDuplicatesDet, "mark-duplicates-deterministic", false, "mark duplicates deterministically")
 	flags.BoolVar(&removeDuplicates, "remove-duplicates", false, "remove duplicates")
+	flags.StringVar(&maskLowQualityBases, "mask-low-quality-bases", "", "replace bases with a base quality below the given threshold by N, optionally per read group")
+	flags.IntVar(&maskQualityCap, "mask-quality-cap", -1, "cap the base quality of low quality bases instead of replacing them by N")
+	flags.StringVar(&clipMode, "clip-mode", "", "convert soft clips to hard clips (hard), or restore soft clips from hard clips (soft)")
+	flags.BoolVar(&keepClippedBases, "keep-clipped-bases", false, "keep the bases and base qualities removed by --clip-mode hard in the hb and hq optional fields, so that --clip-mode soft can restore them")
+	flags.BoolVar(&trimClippedBases, "trim-clipped-bases", false, "remove the clipped bases from the reads, and the clips from the CIGAR strings")
+	flags.IntVar(&trimMinLength, "trim-min-length", 0, "remove reads with fewer bases remaining after --trim-clipped-bases")
 	flags.StringVar(&markOpticalDuplicates, "mark-optical-duplicates", "", "mark optical duplicates")
 	flags.StringVar(&removeOptionalFields, "remove-optional-fields", "", "remove the given optional fields")
 	flags.StringVar(&keepOptionalFields, "keep-optional-fields", "", "remove all except for the given optional fields")
 	flags.StringVar(&sortingOrderString, "sorting-order", string(sam.Keep), "determine output order of alignments, one of keep, unknown, unsorted, queryname, or coordinate")
+	flags.BoolVar(&outputPerReadGroup, "output-per-read-group", false, "write the alignments of each read group to a separate output file")
+	flags.BoolVar(&outputPerContig, "output-per-contig", false, "write the alignments of each reference sequence to a separate coordinate-sorted output file")
 	flags.BoolVar(&cleanSam, "clean-sam", false, "clean the sam file")
+	flags.StringVar(&validationStringency, "validation-stringency", "", "check the alignments for invalid fields, one of strict, lenient, or none")
 	flags.StringVar(&bqsr, "bqsr", "", "base quality score recalibration")
 	flags.StringVar(&referenceElFasta, "bqsr-reference", "", "reference used for base quality score recalibration (elfasta format)")
 	flags.IntVar(&quantizeLevels, "quantize-levels", 0, "number of levels to be used for quantizing recalibrated base qualities (only with --bqsr)")
@@ -158,6 +269,7 @@ func Sfm() error {
 	flags.StringVar(&knownSites, "known-sites", "", "list of vcf files containing known sites for base recalibration (only with --bqsr)")
 	flags.BoolVar(&deterministic, "deterministic", false, "run elprep deterministically (currently not supported in sfm mode)")
 	flags.IntVar(&nrOfThreads, "nr-of-threads", 0, "number of worker threads")
+	bgzf.define(&flags)
 	flags.BoolVar(&timed, "timed", false, "measure the runtime")
 	flags.StringVar(&profile, "profile", "", "write a runtime profile to the specified file(s)")
 	flags.StringVar(&logPath, "log-path", "", "write log files to the specified directory")
@@ -179,7 +291,7 @@ func Sfm() error {
 
 	var sanityChecksFailed bool
 
-	if !checkExist("", input) {
+	if !sam.IsHtsgetURL(input) && !checkExist("", input) {
 		sanityChecksFailed = true
 	}
 	if !checkCreate("", output) {
@@ -192,6 +304,27 @@ func Sfm() error {
 	if filterNonOverlappingReads != "" && !checkExist("--filter-non-overlapping-reads", filterNonOverlappingReads) {
 		sanityChecksFailed = true
 	}
+	if filterNonOverlappingFragments != "" && !checkExist("--filter-non-overlapping-fragments", filterNonOverlappingFragments) {
+		sanityChecksFailed = true
+	}
+	if contigAliases != "" && !checkExist("--contig-aliases", contigAliases) {
+		sanityChecksFailed = true
+	}
+	if _, err := sam.ParseValidationStringency(validationStringency); err != nil {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid validation-stringency: ", validationStringency)
+	}
+	if filterNonOverlappingReads != "" && filterNonOverlappingFragments != "" {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --filter-non-overlapping-reads and --filter-non-overlapping-fragments in the same command.")
+	}
+	if targetPadding < 0 {
+		sanityChecksFailed = true
+		log.Println("Error: Invalid target-padding: ", targetPadding)
+	} else if targetPadding > 0 && filterNonOverlappingReads == "" && filterNonOverlappingFragments == "" {
+		sanityChecksFailed = true
+		log.Println("Error: --target-padding requires --filter-non-overlapping-reads or --filter-non-overlapping-fragments.")
+	}
 	if markOpticalDuplicates != "" && !checkCreate("--mark-optical-duplicates", markOpticalDuplicates) {
 		sanityChecksFailed = true
 	}
@@ -233,11 +366,35 @@ func Sfm() error {
 		log.Println("Warning: Requesting to keep the order of the input file while replacing the reference sequence dictionary may force an additional sorting phase to ensure the original sorting order is respected.")
 	}
 
+	if outputPerReadGroup && output == "/dev/stdout" {
+		sanityChecksFailed = true
+		log.Println("Error: --output-per-read-group cannot write to /dev/stdout.")
+	}
+
+	if outputPerContig {
+		if output == "/dev/stdout" {
+			sanityChecksFailed = true
+			log.Println("Error: --output-per-contig cannot write to /dev/stdout.")
+		}
+		if outputPerReadGroup {
+			sanityChecksFailed = true
+			log.Println("Error: Cannot use --output-per-read-group and --output-per-contig in the same command.")
+		}
+		if sortingOrder != sam.Coordinate && sortingOrder != sam.Keep {
+			sanityChecksFailed = true
+			log.Println("Error: --output-per-contig requires --sorting-order coordinate, or keep for coordinate-sorted input.")
+		}
+	}
+
 	if keepOptionalFields != "" && removeOptionalFields != "" {
 		sanityChecksFailed = true
 		log.Println("Error: Cannot use --keep-optional-fields and --remove-optional-fields in the same filter command.")
 	}
 
+	if !bgzf.apply() {
+		sanityChecksFailed = true
+	}
+
 	if nrOfThreads < 0 {
 		sanityChecksFailed = true
 		log.Println("Error: Invalid nr-of-threads: ", nrOfThreads)
@@ -257,6 +414,11 @@ func Sfm() error {
 		log.Println("Error: Cannot use --mark-optical-duplicates without also using --mark-duplicates.")
 	}
 
+	if readLengthType != "" && filterReadLength == "" {
+		sanityChecksFailed = true
+		log.Println("Error: Cannot use --read-length-type without also using --filter-read-length.")
+	}
+
 	if sanityChecksFailed {
 		fmt.Fprint(os.Stderr, SfmHelp)
 		os.Exit(1)
@@ -276,11 +438,54 @@ func Sfm() error {
 		filterArgs = append(filterArgs, "--filter-unmapped-reads")
 	}
 
+	if filterSecondaryAlignments {
+		fmt.Fprint(&command, " --filter-secondary-alignments")
+		filterArgs = append(filterArgs, "--filter-secondary-alignments")
+	}
+
+	if keepOnlySecondary {
+		fmt.Fprint(&command, " --keep-only-secondary")
+		filterArgs = append(filterArgs, "--keep-only-secondary")
+	}
+
+	if filterSupplementaryAlignments {
+		fmt.Fprint(&command, " --filter-supplementary-alignments")
+		filterArgs = append(filterArgs, "--filter-supplementary-alignments")
+		if stripSATags {
+			fmt.Fprint(&command, " --strip-sa-tags")
+			filterArgs = append(filterArgs, "--strip-sa-tags")
+		}
+	}
+
+	if reassignMappingQuality != "" {
+		fmt.Fprint(&command, " --reassign-mapping-quality ", reassignMappingQuality)
+		filterArgs = append(filterArgs, "--reassign-mapping-quality", reassignMappingQuality)
+	}
+
+	if capMappingQuality >= 0 {
+		fmt.Fprint(&command, " --cap-mapping-quality ", capMappingQuality)
+		filterArgs = append(filterArgs, "--cap-mapping-quality", strconv.Itoa(capMappingQuality))
+	}
+
+	if floorMappingQuality >= 0 {
+		fmt.Fprint(&command, " --floor-mapping-quality ", floorMappingQuality)
+		filterArgs = append(filterArgs, "--floor-mapping-quality", strconv.Itoa(floorMappingQuality))
+	}
+
 	if filterMappingQuality > 0 {
 		fmt.Fprint(&command, " --filter-mapping-quality ", filterMappingQuality)
 		filterArgs = append(filterArgs, "--filter-mapping-quality", strconv.Itoa(filterMappingQuality))
 	}
 
+	if filterReadLength != "" {
+		fmt.Fprint(&command, " --filter-read-length ", filterReadLength)
+		filterArgs = append(filterArgs, "--filter-read-length", filterReadLength)
+		if readLengthType != "" {
+			fmt.Fprint(&command, " --read-length-type ", readLengthType)
+			filterArgs = append(filterArgs, "--read-length-type", readLengthType)
+		}
+	}
+
 	if filterNonExactMappingReads {
 		fmt.Fprint(&command, " --filter-non-exact-mapping-reads")
 		filterArgs = append(filterArgs, "--filter-non-exact-mapping-reads")
@@ -296,6 +501,21 @@ func Sfm() error {
 		filterArgs = append(filterArgs, "--filter-non-overlapping-reads", filterNonOverlappingReads)
 	}
 
+	if filterNonOverlappingFragments != "" {
+		fmt.Fprint(&command, " --filter-non-overlapping-fragments ", filterNonOverlappingFragments)
+		filterArgs = append(filterArgs, "--filter-non-overlapping-fragments", filterNonOverlappingFragments)
+	}
+
+	if contigAliases != "" {
+		fmt.Fprint(&command, " --contig-aliases ", contigAliases)
+		filterArgs = append(filterArgs, "--contig-aliases", contigAliases)
+	}
+
+	if targetPadding > 0 {
+		fmt.Fprint(&command, " --target-padding ", targetPadding)
+		filterArgs = append(filterArgs, "--target-padding", strconv.Itoa(targetPadding))
+	}
+
 	if renameChromosomes {
 		fmt.Fprint(&command, " --rename-chromosomes")
 		filterArgs = append(filterArgs, "--rename-chromosomes")
@@ -306,16 +526,61 @@ func Sfm() error {
 		filterArgs = append(filterArgs, "--clean-sam")
 	}
 
+	if validationStringency != "" {
+		fmt.Fprint(&command, " --validation-stringency ", validationStringency)
+		filterArgs = append(filterArgs, "--validation-stringency", validationStringency)
+	}
+
 	if replaceReferenceSequences != "" {
 		fmt.Fprint(&command, " --replace-reference-sequences ", replaceReferenceSequences)
 		filterArgs = append(filterArgs, "--replace-reference-sequences", replaceReferenceSequences)
 	}
 
+	if keepReadGroups != "" {
+		fmt.Fprint(&command, " --keep-read-groups \"", keepReadGroups, "\"")
+		filterArgs = append(filterArgs, "--keep-read-groups", keepReadGroups)
+	}
+
+	if excludeReadGroups != "" {
+		fmt.Fprint(&command, " --exclude-read-groups \"", excludeReadGroups, "\"")
+		filterArgs = append(filterArgs, "--exclude-read-groups", excludeReadGroups)
+	}
+
 	if replaceReadGroup != "" {
 		fmt.Fprint(&command, " --replace-read-group ", replaceReadGroup)
 		filterArgs = append(filterArgs, "--replace-read-group", replaceReadGroup)
 	}
 
+	for _, comment := range addComments {
+		fmt.Fprint(&command, " --add-comment \"", comment, "\"")
+		filterArgs = append(filterArgs, "--add-comment", comment)
+	}
+
+	if noPG {
+		fmt.Fprint(&command, " --no-pg")
+		filterArgs = append(filterArgs, "--no-pg")
+	}
+
+	if pgID != "" {
+		fmt.Fprint(&command, " --pg-id \"", pgID, "\"")
+		filterArgs = append(filterArgs, "--pg-id", pgID)
+	}
+
+	if pgName != "" {
+		fmt.Fprint(&command, " --pg-name \"", pgName, "\"")
+		filterArgs = append(filterArgs, "--pg-name", pgName)
+	}
+
+	if pgDescription != "" {
+		fmt.Fprint(&command, " --pg-description \"", pgDescription, "\"")
+		filterArgs = append(filterArgs, "--pg-description", pgDescription)
+	}
+
+	if pgCommandLine != "" {
+		fmt.Fprint(&command, " --pg-command-line \"", pgCommandLine, "\"")
+		filterArgs = append(filterArgs, "--pg-command-line", pgCommandLine)
+	}
+
 	if markDuplicates {
 		fmt.Fprint(&command, " --mark-duplicates")
 		filterArgs = append(filterArgs, "--mark-duplicates")
@@ -330,6 +595,33 @@ func Sfm() error {
 		filterArgs = append(filterArgs, "--remove-duplicates")
 	}
 
+	if maskLowQualityBases != "" {
+		fmt.Fprint(&command, " --mask-low-quality-bases \"", maskLowQualityBases, "\"")
+		filterArgs = append(filterArgs, "--mask-low-quality-bases", maskLowQualityBases)
+		if maskQualityCap >= 0 {
+			fmt.Fprint(&command, " --mask-quality-cap ", maskQualityCap)
+			filterArgs = append(filterArgs, "--mask-quality-cap", strconv.Itoa(maskQualityCap))
+		}
+	}
+
+	if clipMode != "" {
+		fmt.Fprint(&command, " --clip-mode ", clipMode)
+		filterArgs = append(filterArgs, "--clip-mode", clipMode)
+		if keepClippedBases {
+			fmt.Fprint(&command, " --keep-clipped-bases")
+			filterArgs = append(filterArgs, "--keep-clipped-bases")
+		}
+	}
+
+	if trimClippedBases {
+		fmt.Fprint(&command, " --trim-clipped-bases")
+		filterArgs = append(filterArgs, "--trim-clipped-bases")
+		if trimMinLength > 0 {
+			fmt.Fprint(&command, " --trim-min-length ", trimMinLength)
+			filterArgs = append(filterArgs, "--trim-min-length", strconv.Itoa(trimMinLength))
+		}
+	}
+
 	if bqsr != "" {
 		fmt.Fprint(&command, " --bqsr ", bqsr)
 		fmt.Fprint(&command, " --bqsr-reference ", referenceElFasta)
@@ -368,6 +660,16 @@ func Sfm() error {
 	fmt.Fprint(&command, " --sorting-order ", sortingOrder)
 	filterArgs = append(filterArgs, "--sorting-order", sortingOrderString)
 
+	if outputPerReadGroup {
+		fmt.Fprint(&command, " --output-per-read-group")
+		filterArgs2 = append(filterArgs2, "--output-per-read-group")
+	}
+
+	if outputPerContig {
+		fmt.Fprint(&command, " --output-per-contig")
+		filterArgs2 = append(filterArgs2, "--output-per-contig")
+	}
+
 	if nrOfThreads > 0 {
 		runtime.GOMAXPROCS(nrOfThreads)
 		fmt.Fprint(&command, " --nr-of-threads ", nrOfThreads)
@@ -376,6 +678,14 @@ func Sfm() error {
 		mergeArgs = append(mergeArgs, "--nr-of-threads", strconv.Itoa(nrOfThreads))
 	}
 
+	if args := bgzf.args(); len(args) > 0 {
+		fmt.Fprint(&command, " ", strings.Join(args, " "))
+		filterArgs = append(filterArgs, args...)
+		filterArgs2 = append(filterArgs2, args...)
+		splitArgs = append(splitArgs, args...)
+		mergeArgs = append(mergeArgs, args...)
+	}
+
 	if timed {
 		fmt.Fprint(&command, " --timed")
 		filterArgs = append(filterArgs, "--timed")
@@ -400,7 +710,7 @@ func Sfm() error {
 		mergeArgs = append(mergeArgs, "--log-path", logPath)
 	}
 
-	ext := filepath.Ext(input)
+	ext := sam.FileExt(input)
 	if outputPrefix == "" {
 		base := filepath.Base(input)
 		outputPrefix = base[:len(base)-len(ext)]
@@ -409,7 +719,12 @@ func Sfm() error {
 	splitArgs = append(splitArgs, "--output-prefix", outputPrefix)
 
 	if outputType == "" {
-		outputType = ext[1:]
+		switch ext {
+		case sam.SamExt, sam.SamGzExt, sam.BamExt:
+			outputType = ext[1:]
+		default:
+			outputType = "sam"
+		}
 	}
 	fmt.Fprint(&command, " --intermediate-files-output-type ", outputType)
 	splitArgs = append(splitArgs, "--output-type", outputType)
@@ -574,7 +889,7 @@ func Sfm() error {
 	}
 	log.Println("Merging...")
 	// merge
-	if bqsr != "" {
+	if bqsr != "" || outputPerReadGroup || outputPerContig {
 		mergeOpt := []string{"merge", mergeDir, "/dev/stdout"}
 		mergeArgs = append(mergeOpt, mergeArgs...)
 		mergeCmd := exec.Command(os.Args[0], mergeArgs...)
@@ -583,24 +898,27 @@ func Sfm() error {
 			return err
 		}
 		mergeCmd.Stderr = os.Stderr
-		// phase 2: apply bqsr
+		// phase 2: apply bqsr and/or split the output
 		log.Println("Filtering...")
 		filterOpt2 := []string{"filter", "/dev/stdin", output}
 		filterArgs2 = append(filterOpt2, filterArgs2...)
-		tabsDir, err := filepath.Abs("elprep-tabs-" + timeStamp)
-		if err != nil {
-			return err
+		var tabsDir string
+		if bqsr != "" {
+			tabsDir, err = filepath.Abs("elprep-tabs-" + timeStamp)
+			if err != nil {
+				return err
+			}
+			tabsDir = tabsDir + string(filepath.Separator)
+			filterArgs2 = append(filterArgs2, "--bqsr-apply", tabsDir, "--recal-file", bqsr)
 		}
-		tabsDir = tabsDir + string(filepath.Separator)
-		filterArgs2 = append(filterArgs2, "--bqsr-apply", tabsDir, "--recal-file", bqsr)
-		applyBqsrCommand := exec.Command(os.Args[0], filterArgs2...)
-		applyBqsrCommand.Stdin = outPipe
-		applyBqsrCommand.Stderr = os.Stderr
+		filterCommand := exec.Command(os.Args[0], filterArgs2...)
+		filterCommand.Stdin = outPipe
+		filterCommand.Stderr = os.Stderr
 		err = mergeCmd.Start()
 		if err != nil {
 			return err
 		}
-		err = applyBqsrCommand.Start()
+		err = filterCommand.Start()
 		if err != nil {
 			return err
 		}
@@ -608,13 +926,15 @@ func Sfm() error {
 		if err != nil {
 			return err
 		}
-		err = applyBqsrCommand.Wait()
+		err = filterCommand.Wait()
 		if err != nil {
 			return err
 		}
-		err = os.RemoveAll(tabsDir)
-		if err != nil {
-			return err
+		if tabsDir != "" {
+			err = os.RemoveAll(tabsDir)
+			if err != nil {
+				return err
+			}
 		}
 	} else {
 		mergeOpt := []string{"merge", mergeDir, output}
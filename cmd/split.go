@@ -27,36 +27,44 @@ import (
 	"path/filepath"
 	"runtime"
 
+	"github.com/exascience/elprep/v4/bed"
 	"github.com/exascience/elprep/v4/sam"
 )
 
 // SplitHelp is the help string for this command.
 const SplitHelp = "\nsplit parameters:\n" +
-	"elprep split (sam-file | /path/to/input/) /path/to/output/\n" +
+	"elprep split (sam-file | /path/to/input/ | bed-file) /path/to/output/\n" +
 	"[--output-prefix name]\n" +
-	"[--output-type [sam | bam]]\n" +
+	"[--output-type [sam | sam.gz | bam]]\n" +
 	"[--single-end]\n" +
 	"[--nr-of-threads nr]\n" +
+	BGZFHelp +
 	"[--timed]\n" +
 	"[--log-path path]\n" +
-	"[--contig-group-size nr]\n"
+	"[--contig-group-size nr]\n" +
+	"[--nr-of-shards nr | --shard-size nr] (bed-file only)\n"
 
 // Split implements the elprep split command.
 func Split() error {
 	var (
-		contigGroupSize                            int
+		contigGroupSize, nrOfShards                int
+		shardSize                                  int64
 		outputPrefix, outputType, profile, logPath string
 		nrOfThreads                                int
 		singleEnd, timed                           bool
 	)
 
 	var flags flag.FlagSet
+	var bgzf bgzfFlags
 
 	flags.IntVar(&contigGroupSize, "contig-group-size", 0, "maximum sum of reference sequence lengths for creating groups of reference sequences")
+	flags.IntVar(&nrOfShards, "nr-of-shards", 0, "number of shards for splitting a bed file")
+	flags.Int64Var(&shardSize, "shard-size", 0, "maximum number of bases per shard for splitting a bed file")
 	flags.StringVar(&outputPrefix, "output-prefix", "", "prefix for the output files")
 	flags.StringVar(&outputType, "output-type", "", "format of the output files")
 	flags.BoolVar(&singleEnd, "single-end", false, "when splitting single-end data")
 	flags.IntVar(&nrOfThreads, "nr-of-threads", 0, "number of worker threads")
+	bgzf.define(&flags)
 	flags.BoolVar(&timed, "timed", false, "measure the runtime")
 	flags.StringVar(&profile, "profile", "", "write a runtime profile to the specified file(s)")
 	flags.StringVar(&logPath, "log-path", "", "write log files to the specified directory")
@@ -66,14 +74,15 @@ func Split() error {
 	input := getFilename(os.Args[2], SplitHelp)
 	output := getFilename(os.Args[3], SplitHelp)
 
-	ext := filepath.Ext(input)
+	ext := sam.FileExt(input)
+	splitBed := ext == ".bed"
 	if outputPrefix == "" {
 		base := filepath.Base(input)
 		outputPrefix = base[:len(base)-len(ext)]
 	}
 	if outputType == "" {
 		switch ext {
-		case sam.SamExt, sam.BamExt:
+		case sam.SamExt, sam.SamGzExt, sam.BamExt:
 			outputType = ext[1:]
 		default:
 			outputType = "sam"
@@ -86,7 +95,7 @@ func Split() error {
 
 	var sanityChecksFailed bool
 
-	if !checkExist("", input) {
+	if !sam.IsHtsgetURL(input) && !checkExist("", input) {
 		sanityChecksFailed = true
 	}
 
@@ -99,11 +108,33 @@ func Split() error {
 		sanityChecksFailed = true
 	}
 
+	if !bgzf.apply() {
+		sanityChecksFailed = true
+	}
+
 	if nrOfThreads < 0 {
 		sanityChecksFailed = true
 		log.Println("Error: Invalid nr-of-threads: ", nrOfThreads)
 	}
 
+	if splitBed {
+		if (nrOfShards > 0) == (shardSize > 0) {
+			sanityChecksFailed = true
+			log.Println("Error: Splitting a bed file requires either --nr-of-shards or --shard-size.")
+		}
+		if nrOfShards < 0 {
+			sanityChecksFailed = true
+			log.Println("Error: Invalid nr-of-shards: ", nrOfShards)
+		}
+		if shardSize < 0 {
+			sanityChecksFailed = true
+			log.Println("Error: Invalid shard-size: ", shardSize)
+		}
+	} else if nrOfShards != 0 || shardSize != 0 {
+		sanityChecksFailed = true
+		log.Println("Error: --nr-of-shards and --shard-size can only be used when splitting a bed file.")
+	}
+
 	if sanityChecksFailed {
 		fmt.Fprint(os.Stderr, SplitHelp)
 		os.Exit(1)
@@ -114,7 +145,15 @@ func Split() error {
 	var command bytes.Buffer
 	fmt.Fprint(&command, os.Args[0], " split ", input, " ", output)
 	fmt.Fprint(&command, " --output-prefix ", outputPrefix)
-	fmt.Fprint(&command, " --output-type ", outputType)
+	if !splitBed {
+		fmt.Fprint(&command, " --output-type ", outputType)
+	}
+	if nrOfShards > 0 {
+		fmt.Fprint(&command, " --nr-of-shards ", nrOfShards)
+	}
+	if shardSize > 0 {
+		fmt.Fprint(&command, " --shard-size ", shardSize)
+	}
 	if singleEnd {
 		fmt.Fprint(&command, " --single-end ")
 	}
@@ -122,6 +161,9 @@ func Split() error {
 		runtime.GOMAXPROCS(nrOfThreads)
 		fmt.Fprint(&command, " --nr-of-threads ", nrOfThreads)
 	}
+	for _, arg := range bgzf.args() {
+		fmt.Fprint(&command, " ", arg)
+	}
 	if timed {
 		fmt.Fprint(&command, " --timed ")
 	}
@@ -133,9 +175,12 @@ func Split() error {
 
 	log.Println("Executing command:\n", command.String())
 
-	fullInput, err := filepath.Abs(input)
-	if err != nil {
-		return err
+	fullInput := input
+	if !sam.IsHtsgetURL(input) {
+		var err error
+		if fullInput, err = filepath.Abs(input); err != nil {
+			return err
+		}
 	}
 
 	fullOutput, err := filepath.Abs(output)
@@ -148,6 +193,22 @@ func Split() error {
 		return err
 	}
 
+	if splitBed {
+		err := timedRun(timed, profile, "Splitting bed file.", 1, func() (err error) {
+			regions, err := bed.ParseBed(fullInput)
+			if err != nil {
+				return err
+			}
+			var shards []*bed.Bed
+			if nrOfShards > 0 {
+				shards = bed.SplitByBases(regions, nrOfShards)
+			} else {
+				shards = bed.SplitBySize(regions, shardSize)
+			}
+			return bed.WriteShards(shards, fullOutput, outputPrefix)
+		})
+		return err
+	}
 	if singleEnd {
 		err := timedRun(timed, profile, "Splitting single-end files.", 1, func() (err error) {
 			return sam.SplitSingleEndFilePerChromosome(fullInput, fullOutput, outputPrefix, outputType, contigGroupSize)
@@ -31,6 +31,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/exascience/elprep/v4/sam"
 )
 
 const (
@@ -153,6 +155,138 @@ func checkCreate(parameter, filename string) bool {
 	return true
 }
 
+// stringList is a flag.Value for flags that can be given more than
+// once.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// openInput opens an input argument, which is either a single file, a
+// directory, merging the alignments of several files with
+// sam.OpenMergedRegions, or an htsget URL.
+func openInput(input string, loci []sam.Locus, aliases sam.ContigAliases) (*sam.InputFile, error) {
+	if !sam.IsHtsgetURL(input) {
+		var err error
+		if input, err = filepath.Abs(input); err != nil {
+			return nil, err
+		}
+	}
+	files, err := sam.InputFiles(input)
+	if err != nil {
+		return nil, err
+	}
+	return sam.OpenMergedRegions(files, loci, aliases)
+}
+
+// A pipelineOutput is a sam.PipelineOutput that needs to be closed
+// after the pipeline has run.
+type pipelineOutput interface {
+	sam.PipelineOutput
+	Close() error
+}
+
+// An outputSplit determines whether the output of a filter pipeline
+// is written to a single file, or split into several files.
+type outputSplit int
+
+const (
+	noOutputSplit outputSplit = iota
+	splitPerReadGroup
+	splitPerContig
+)
+
+// createOutput creates the output for a filter pipeline, which is
+// either a single file, one file per read group, or one file per
+// reference sequence. If offsetMapBinSize is positive, an offset map
+// is written next to a single output file.
+func createOutput(output string, format sam.OutputFormat, index sam.IndexFormat, offsetMapBinSize int32, split outputSplit) (pipelineOutput, error) {
+	switch split {
+	case splitPerReadGroup:
+		return sam.CreatePerReadGroup(output, format, index)
+	case splitPerContig:
+		return sam.CreatePerContig(output, format, index)
+	default:
+		file, err := sam.CreateIndexed(output, format, index)
+		if err != nil {
+			return nil, err
+		}
+		if offsetMapBinSize > 0 {
+			if err := file.AddOffsetMap(output+sam.OffsetMapExt, offsetMapBinSize); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+		}
+		return file, nil
+	}
+}
+
+// BGZFHelp is the help string for the bgzf flags shared by several
+// commands.
+const BGZFHelp = "[--bgzf-threads nr]\n" +
+	"[--bgzf-queue-depth nr]\n" +
+	"[--bgzf-block-size nr]\n" +
+	"[--bgzf-compression-level nr]\n"
+
+// bgzfFlags are the command line flags for tuning the parallel
+// compression and decompression of BAM files, independently from
+// --nr-of-threads.
+type bgzfFlags struct {
+	threads, queueDepth, blockSize, compressionLevel int
+}
+
+func (f *bgzfFlags) define(flags *flag.FlagSet) {
+	flags.IntVar(&f.threads, "bgzf-threads", 0, "number of threads for compressing and decompressing BAM files (default: nr-of-threads)")
+	flags.IntVar(&f.queueDepth, "bgzf-queue-depth", 0, "number of BGZF blocks queued between file I/O and the bgzf threads")
+	flags.IntVar(&f.blockSize, "bgzf-block-size", 0, "uncompressed size of the BGZF blocks of BAM output files, at most 65280")
+	flags.IntVar(&f.compressionLevel, "bgzf-compression-level", -1, "compression level of BAM output files, from 0 (none) to 9 (smallest) (default: 6)")
+}
+
+// Checks the flags, and sets the BGZF options of the sam package.
+func (f *bgzfFlags) apply() bool {
+	options := sam.BGZFOptions{
+		Workers:    f.threads,
+		QueueDepth: f.queueDepth,
+		BlockSize:  f.blockSize,
+	}
+	switch {
+	case f.compressionLevel >= 0:
+		options.CompressionLevel = &f.compressionLevel
+	case f.compressionLevel < -1:
+		log.Println("Error: Invalid --bgzf-compression-level, must be between 0 and 9.")
+		return false
+	}
+	if err := sam.SetBGZFOptions(options); err != nil {
+		log.Println("Error: ", err)
+		return false
+	}
+	return true
+}
+
+// Returns the flags that are set, for logging the command line and
+// for passing them on to other commands.
+func (f *bgzfFlags) args() (args []string) {
+	if f.threads > 0 {
+		args = append(args, "--bgzf-threads", strconv.Itoa(f.threads))
+	}
+	if f.queueDepth > 0 {
+		args = append(args, "--bgzf-queue-depth", strconv.Itoa(f.queueDepth))
+	}
+	if f.blockSize > 0 {
+		args = append(args, "--bgzf-block-size", strconv.Itoa(f.blockSize))
+	}
+	if f.compressionLevel >= 0 {
+		args = append(args, "--bgzf-compression-level", strconv.Itoa(f.compressionLevel))
+	}
+	return args
+}
+
 func checkBQSROptions(bqsr, bqsrTablesOnly bool, elFasta string, quantizationLevel int, sqq string, knownSites, bqsrRecalFile, recalFile string) bool {
 	if bqsr {
 		if bqsrRecalFile == "" {
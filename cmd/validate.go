@@ -0,0 +1,105 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package cmd
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// BedValidateHelp is the help string for this command.
+const BedValidateHelp = "bed-validate parameters:\n" +
+	"elprep bed-validate bed-file\n" +
+	"[--sequence-dictionary sam-or-dict-file]\n" +
+	"[--chrom-sizes chrom-sizes-file]\n" +
+	"[--log-path path]\n"
+
+// Reads the reference sequence lengths from the header of a SAM file
+// or a Picard .dict file.
+func parseSequenceDictionary(filename string) (lengths map[utils.Symbol]int32, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	header, err := sam.ParseSamHeader(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("%v, while reading sequence dictionary %v", err, filename)
+	}
+	return bed.ChromLengths(header)
+}
+
+// BedValidate implements the elprep bed-validate command.
+func BedValidate() error {
+
+	var sequenceDictionary, chromSizes, logPath string
+
+	var flags flag.FlagSet
+
+	flags.StringVar(&sequenceDictionary, "sequence-dictionary", "", "check chromosomes and coordinates against the @SQ lines of a SAM or .dict file")
+	flags.StringVar(&chromSizes, "chrom-sizes", "", "check chromosomes and coordinates against a chrom.sizes file")
+	flags.StringVar(&logPath, "log-path", "", "write log files to the specified directory")
+
+	parseFlags(flags, 3, BedValidateHelp)
+
+	input := getFilename(os.Args[2], BedValidateHelp)
+
+	setLogOutput(logPath)
+
+	if sequenceDictionary != "" && chromSizes != "" {
+		log.Println("Error: Cannot use --sequence-dictionary and --chrom-sizes in the same command.")
+		fmt.Fprint(os.Stderr, BedValidateHelp)
+		os.Exit(1)
+	}
+
+	var lengths map[utils.Symbol]int32
+	var err error
+	switch {
+	case sequenceDictionary != "":
+		lengths, err = parseSequenceDictionary(sequenceDictionary)
+	case chromSizes != "":
+		lengths, err = bed.ParseChromSizes(chromSizes)
+	}
+	if err != nil {
+		return err
+	}
+
+	report, err := bed.ValidateBedFile(input, lengths)
+	if err != nil {
+		return err
+	}
+	if err := bed.WriteValidationReport(os.Stdout, report); err != nil {
+		return err
+	}
+	if len(report.Issues) > 0 {
+		return fmt.Errorf("%v issues found in %v", len(report.Issues), input)
+	}
+	return nil
+}
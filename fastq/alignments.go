@@ -0,0 +1,279 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package fastq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+	"github.com/exascience/elprep/v4/utils/nibbles"
+)
+
+var (
+	complement = [256]byte{}
+	oq         = utils.Intern("OQ")
+	rx         = utils.Intern("RX")
+)
+
+func init() {
+	for i := range complement {
+		complement[i] = 'N'
+	}
+	for _, pair := range []string{"AT", "CG", "MK", "RY", "WW", "SS", "VB", "HD", "NN", "=="} {
+		complement[pair[0]], complement[pair[1]] = pair[1], pair[0]
+	}
+}
+
+// The quality that is used for bases without a quality score, as in
+// samtools fastq.
+const missingQual = 1 + 33
+
+// FromAlignment converts an alignment to a FASTQ record with the
+// sequence and qualities as they were read by the sequencer: Reads
+// that are mapped to the reverse strand are reverse-complemented. If
+// originalQualities is true, the qualities are taken from the OQ
+// field when present, to undo base quality score recalibration.
+func FromAlignment(aln *sam.Alignment, originalQualities bool) *Record {
+	n := aln.SEQ.Len()
+	record := &Record{
+		Name: aln.QNAME,
+		Seq:  make([]byte, n),
+		Qual: make([]byte, n),
+	}
+	for i := 0; i < n; i++ {
+		record.Seq[i] = aln.SEQ.Base(i)
+	}
+	qualDone := false
+	if originalQualities {
+		if s, found := aln.TagString(oq); found && len(s) == n {
+			copy(record.Qual, s)
+			qualDone = true
+		}
+	}
+	if !qualDone {
+		for i := 0; i < n; i++ {
+			if i < len(aln.QUAL) && aln.QUAL[i] != 0xff {
+				record.Qual[i] = aln.QUAL[i] + 33
+			} else {
+				record.Qual[i] = missingQual
+			}
+		}
+	}
+	if aln.IsReversed() {
+		for i, j := 0, n-1; i <= j; i, j = i+1, j-1 {
+			record.Seq[i], record.Seq[j] = complement[record.Seq[j]], complement[record.Seq[i]]
+			record.Qual[i], record.Qual[j] = record.Qual[j], record.Qual[i]
+		}
+	}
+	return record
+}
+
+// FromAlignments converts the alignments of the given iterator to
+// FASTQ records. Secondary and supplementary alignments are skipped,
+// so that each read is written exactly once. The first and last
+// segments of a template are written to out1 and out2 respectively,
+// once both are found, so the input does not need to be sorted or
+// grouped by query name, but input that is grouped by query name
+// needs much less memory. Reads that are not paired, or whose mates
+// are missing from the input, are written to singletons, or dropped
+// if singletons is nil. out1, out2, and singletons may be the same
+// Writer, for example for interleaved output.
+func FromAlignments(it *sam.AlignmentIterator, out1, out2, singletons *Writer, originalQualities bool) error {
+	pending := make(map[string]*sam.Alignment)
+	for {
+		aln, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if aln.IsSecondary() || aln.IsSupplementary() {
+			continue
+		}
+		if !aln.IsMultiple() || aln.IsFirst() == aln.IsLast() {
+			if singletons != nil {
+				if err := singletons.Write(FromAlignment(aln, originalQualities)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		mate, found := pending[aln.QNAME]
+		if !found {
+			pending[aln.QNAME] = aln
+			continue
+		}
+		delete(pending, aln.QNAME)
+		if mate.IsFirst() == aln.IsFirst() {
+			// two first or two last segments: keep the
+			// latest, as with missing mates
+			pending[aln.QNAME] = aln
+			if singletons != nil {
+				if err := singletons.Write(FromAlignment(mate, originalQualities)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if aln.IsFirst() {
+			aln, mate = mate, aln
+		}
+		if err := out1.Write(FromAlignment(mate, originalQualities)); err != nil {
+			return err
+		}
+		if err := out2.Write(FromAlignment(aln, originalQualities)); err != nil {
+			return err
+		}
+	}
+	if singletons == nil {
+		return nil
+	}
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := singletons.Write(FromAlignment(pending[name], originalQualities)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToAlignment converts a FASTQ record to an unmapped alignment with
+// the given FLAG. A /1 or /2 suffix of the read name is removed.
+func ToAlignment(record *Record, flag uint16) (*sam.Alignment, error) {
+	n := len(record.Seq)
+	aln := &sam.Alignment{
+		QNAME: readName(record.Name),
+		RNAME: "*",
+		FLAG:  flag | sam.Unmapped,
+		RNEXT: "*",
+		SEQ:   sam.Sequence(nibbles.Make(n)),
+		QUAL:  make([]byte, n),
+	}
+	for i, base := range record.Seq {
+		if base >= 'a' && base <= 'z' {
+			base -= 'a' - 'A'
+		}
+		aln.SEQ.SetBase(i, base)
+		if record.Qual[i] < 33 {
+			return nil, fmt.Errorf("invalid base quality in FASTQ record %v", record.Name)
+		}
+		aln.QUAL[i] = record.Qual[i] - 33
+	}
+	return aln, nil
+}
+
+// Returns the read name without a /1 or /2 suffix.
+func readName(name string) string {
+	if strings.HasSuffix(name, "/1") || strings.HasSuffix(name, "/2") {
+		return name[:len(name)-2]
+	}
+	return name
+}
+
+// UMIFromReadName returns the unique molecular identifier of a read
+// name in the format written by Illumina's bcl2fastq and BCL Convert,
+// where it is the eighth field of the read name, separated by colons.
+// The two identifiers of dual UMIs are separated by a hyphen, as
+// recommended for the RX field.
+func UMIFromReadName(name string) (string, bool) {
+	fields := strings.Split(readName(name), ":")
+	if len(fields) != 8 || fields[7] == "" {
+		return "", false
+	}
+	return strings.Replace(fields[7], "+", "-", -1), true
+}
+
+// ToAlignments converts the FASTQ records of in1, and of in2 if it is
+// not nil, to unmapped alignments, and writes them to output, after
+// the header. If in2 is not nil, the records of in1 and in2 must be
+// the first and last segments of paired reads, in the same order, and
+// the two alignments of a pair are written next to each other. If
+// readGroup is not empty, the alignments get an RG field with that
+// value. If umiFromReadName is true, the alignments get an RX field
+// with the unique molecular identifier from the read name, see
+// UMIFromReadName.
+func ToAlignments(in1, in2 *Reader, output *sam.OutputFile, readGroup string, umiFromReadName bool) error {
+	var buf []byte
+	write := func(record *Record, flag uint16) error {
+		aln, err := ToAlignment(record, flag)
+		if err != nil {
+			return err
+		}
+		if readGroup != "" {
+			aln.SetRG(readGroup)
+		}
+		if umiFromReadName {
+			umi, ok := UMIFromReadName(record.Name)
+			if !ok {
+				return fmt.Errorf("missing unique molecular identifier in read name %v", record.Name)
+			}
+			aln.TAGS.Set(rx, umi)
+		}
+		if buf, err = output.FormatAlignment(aln, buf[:0]); err != nil {
+			return err
+		}
+		_, err = output.Write(buf)
+		return err
+	}
+	for {
+		record1, err := in1.Read()
+		if in2 == nil {
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := write(record1, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		record2, err2 := in2.Read()
+		if err == io.EOF && err2 == io.EOF {
+			return nil
+		}
+		if err == io.EOF || err2 == io.EOF {
+			return errors.New("paired FASTQ files have different numbers of records")
+		}
+		if err != nil {
+			return err
+		}
+		if err2 != nil {
+			return err2
+		}
+		if readName(record1.Name) != readName(record2.Name) {
+			return fmt.Errorf("read names %v and %v of paired FASTQ records differ", record1.Name, record2.Name)
+		}
+		if err := write(record1, sam.Multiple|sam.NextUnmapped|sam.First); err != nil {
+			return err
+		}
+		if err := write(record2, sam.Multiple|sam.NextUnmapped|sam.Last); err != nil {
+			return err
+		}
+	}
+}
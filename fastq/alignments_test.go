@@ -0,0 +1,152 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package fastq
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/exascience/elprep/v4/sam"
+)
+
+func readFile(t *testing.T, name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		if _, err := f.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFromAlignments(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "test.sam")
+	if err := ioutil.WriteFile(input, []byte("@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:1000\n"+
+		"r1\t99\tchr1\t10\t60\t4M\t=\t50\t44\tACGT\tABCD\n"+
+		"r2\t0\tchr1\t20\t60\t3M\t*\t0\t0\tAAC\tIII\tOQ:Z:###\n"+
+		"r1\t147\tchr1\t50\t60\t4M\t=\t10\t-44\tAACG\tEFGH\tOQ:Z:#$%&\n"+
+		"r1\t2195\tchr1\t70\t60\t4M\t=\t10\t-44\tAACG\tEFGH\n"+
+		"r3\t65\tchr1\t80\t60\t2M\t=\t10\t-44\tAC\tEF\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	convert := func(originalQualities bool) (contents []string) {
+		f, err := sam.Open(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		it, err := f.Iterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{filepath.Join(dir, "1.fq"), filepath.Join(dir, "2.fq.gz"), filepath.Join(dir, "s.fq")}
+		var writers []*Writer
+		for _, name := range names {
+			w, err := Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writers = append(writers, w)
+		}
+		if err := FromAlignments(it, writers[0], writers[1], writers[2], originalQualities); err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range writers {
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			contents = append(contents, readFile(t, names[i]))
+		}
+		return contents
+	}
+	contents := convert(false)
+	if contents[0] != "@r1\nACGT\n+\nABCD\n" ||
+		contents[1] != "@r1\nCGTT\n+\nHGFE\n" ||
+		contents[2] != "@r2\nAAC\n+\nIII\n@r3\nAC\n+\nEF\n" {
+		t.Error("FromAlignments failed", contents)
+	}
+	contents = convert(true)
+	if contents[1] != "@r1\nCGTT\n+\n&%$#\n" || contents[2] != "@r2\nAAC\n+\n###\n@r3\nAC\n+\nEF\n" {
+		t.Error("FromAlignments original qualities failed", contents)
+	}
+}
+
+func TestToAlignments(t *testing.T) {
+	dir := t.TempDir()
+	name1, name2 := filepath.Join(dir, "test_1.fq"), filepath.Join(dir, "test_2.fq")
+	if err := ioutil.WriteFile(name1, []byte("@M1:1:FC:1:1:10:20:ACGT+TTGA/1 1:N:0:ATCACG\nACGTn\n+\nIIIII\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name2, []byte("@M1:1:FC:1:1:10:20:ACGT+TTGA/2 2:N:0:ATCACG\r\nTTTT\r\n+\r\nJJJJ\r\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	in1, err := Open(name1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in2, err := Open(name2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "test.sam")
+	output, err := sam.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := output.FormatHeader(sam.NewHeader()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ToAlignments(in1, in2, output, "rg1", true); err != nil {
+		t.Fatal(err)
+	}
+	_ = in1.Close()
+	_ = in2.Close()
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if contents := readFile(t, name); contents != "M1:1:FC:1:1:10:20:ACGT+TTGA\t77\t*\t0\t0\t*\t*\t0\t0\tACGTN\tIIIII\tRG:Z:rg1\tRX:Z:ACGT-TTGA\n"+
+		"M1:1:FC:1:1:10:20:ACGT+TTGA\t141\t*\t0\t0\t*\t*\t0\t0\tTTTT\tJJJJ\tRG:Z:rg1\tRX:Z:ACGT-TTGA\n" {
+		t.Error("ToAlignments failed", contents)
+	}
+	if _, ok := UMIFromReadName("r1"); ok {
+		t.Error("UMIFromReadName failed")
+	}
+}
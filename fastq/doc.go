@@ -0,0 +1,3 @@
+// Package fastq is a library for reading and writing FASTQ files, and
+// for converting between FASTQ records and SAM alignments.
+package fastq
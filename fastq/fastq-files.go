@@ -0,0 +1,228 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package fastq
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/exascience/elprep/v4/sam"
+)
+
+// A Record is a FASTQ record. The qualities are ASCII characters, as
+// in the FASTQ format.
+type Record struct {
+	Name    string
+	Comment string
+	Seq     []byte
+	Qual    []byte
+}
+
+// A Reader reads FASTQ records from a file.
+type Reader struct {
+	file io.Closer
+	gz   *gzip.Reader
+	buf  *bufio.Reader
+	line int
+}
+
+// Open opens a FASTQ file for input. Files compressed with gzip or
+// BGZF are detected by looking at their first bytes, and decompressed
+// on the fly. If the name is "/dev/stdin", then the input is read
+// from os.Stdin.
+func Open(name string) (*Reader, error) {
+	var file *os.File
+	if name == "/dev/stdin" {
+		file = os.Stdin
+	} else {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+	}
+	r := &Reader{file: file, buf: bufio.NewReader(file)}
+	if magic, _ := r.buf.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r.buf)
+		if err != nil {
+			if file != os.Stdin {
+				_ = file.Close()
+			}
+			return nil, fmt.Errorf("%v, while opening FASTQ file %v", err, name)
+		}
+		r.gz = gz
+		r.buf = bufio.NewReader(gz)
+	}
+	return r, nil
+}
+
+// Returns the next line without its line terminator, or io.EOF.
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.buf.ReadBytes('\n')
+	if err == io.EOF {
+		if len(line) == 0 {
+			return nil, io.EOF
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	r.line++
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// Read returns the next FASTQ record. It returns nil and io.EOF after
+// the last record.
+func (r *Reader) Read() (*Record, error) {
+	var header []byte
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) > 0 {
+			header = line
+			break
+		}
+	}
+	if header[0] != '@' {
+		return nil, fmt.Errorf("missing @ at the start of FASTQ record in line %v", r.line)
+	}
+	record := &Record{}
+	if i := bytes.IndexAny(header, " \t"); i >= 0 {
+		record.Name, record.Comment = string(header[1:i]), string(header[i+1:])
+	} else {
+		record.Name = string(header[1:])
+	}
+	seq, err := r.readLine()
+	if err != nil {
+		return nil, r.truncated(err)
+	}
+	separator, err := r.readLine()
+	if err != nil {
+		return nil, r.truncated(err)
+	}
+	if len(separator) == 0 || separator[0] != '+' {
+		return nil, fmt.Errorf("missing + separator in FASTQ record in line %v", r.line)
+	}
+	qual, err := r.readLine()
+	if err != nil {
+		return nil, r.truncated(err)
+	}
+	if len(qual) != len(seq) {
+		return nil, fmt.Errorf("sequence and quality lengths differ in FASTQ record in line %v", r.line)
+	}
+	record.Seq, record.Qual = seq, qual
+	return record, nil
+}
+
+func (r *Reader) truncated(err error) error {
+	if err == io.EOF {
+		return errors.New("truncated FASTQ record at the end of the file")
+	}
+	return err
+}
+
+// Close closes the file.
+func (r *Reader) Close() (err error) {
+	if r.gz != nil {
+		err = r.gz.Close()
+	}
+	if r.file != os.Stdin {
+		if nerr := r.file.Close(); err == nil {
+			err = nerr
+		}
+	}
+	return err
+}
+
+// A Writer writes FASTQ records to a file.
+type Writer struct {
+	file io.WriteCloser
+	bgzf *sam.BGZFWriter
+	buf  *bufio.Writer
+}
+
+// Create creates a FASTQ file for output. If the name ends in ".gz",
+// the file is compressed with BGZF. If the name is "/dev/stdout",
+// then the output is written to os.Stdout.
+func Create(name string) (*Writer, error) {
+	var file io.WriteCloser
+	if name == "/dev/stdout" {
+		file = os.Stdout
+	} else {
+		f, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+	}
+	w := &Writer{file: file}
+	if strings.HasSuffix(name, ".gz") {
+		bgzf, err := sam.NewBGZFWriterWithOptions(file, sam.CurrentBGZFOptions())
+		if err != nil {
+			if file != os.Stdout {
+				_ = file.Close()
+			}
+			return nil, err
+		}
+		w.bgzf = bgzf
+		w.buf = bufio.NewWriter(bgzf)
+	} else {
+		w.buf = bufio.NewWriter(file)
+	}
+	return w, nil
+}
+
+// Write writes a FASTQ record.
+func (w *Writer) Write(record *Record) error {
+	_ = w.buf.WriteByte('@')
+	_, _ = w.buf.WriteString(record.Name)
+	if record.Comment != "" {
+		_ = w.buf.WriteByte(' ')
+		_, _ = w.buf.WriteString(record.Comment)
+	}
+	_ = w.buf.WriteByte('\n')
+	_, _ = w.buf.Write(record.Seq)
+	_, _ = w.buf.WriteString("\n+\n")
+	_, _ = w.buf.Write(record.Qual)
+	return w.buf.WriteByte('\n')
+}
+
+// Close flushes the output and closes the file.
+func (w *Writer) Close() (err error) {
+	err = w.buf.Flush()
+	if w.bgzf != nil {
+		if nerr := w.bgzf.Close(); err == nil {
+			err = nerr
+		}
+	}
+	if w.file != os.Stdout {
+		if nerr := w.file.Close(); err == nil {
+			err = nerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"github.com/exascience/elprep/v4/sam"
+)
+
+// MaskLowQualityBases returns a filter that masks all bases with a
+// base quality below a threshold.
+//
+// The threshold for an alignment is looked up in readGroupThresholds
+// by the alignment's read group, and defaults to defaultThreshold. A
+// threshold of 0 disables masking.
+//
+// If qualityCap is negative, masked bases are replaced by N in the
+// segment sequence. Otherwise, the base qualities of masked bases are
+// capped at qualityCap, and the bases themselves are left unchanged.
+func MaskLowQualityBases(defaultThreshold byte, readGroupThresholds map[string]byte, qualityCap int) sam.Filter {
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		return func(aln *sam.Alignment) bool {
+			threshold := defaultThreshold
+			if len(readGroupThresholds) > 0 {
+				if rg, ok := aln.RG().(string); ok {
+					if rgThreshold, found := readGroupThresholds[rg]; found {
+						threshold = rgThreshold
+					}
+				}
+			}
+			if threshold == 0 || len(aln.QUAL) == 0 || aln.QUAL[0] == 0xff || len(aln.QUAL) != aln.SEQ.Len() {
+				return true
+			}
+			if qualityCap < 0 {
+				for i, qual := range aln.QUAL {
+					if qual < threshold {
+						aln.SEQ.SetBase(i, 'N')
+					}
+				}
+			} else {
+				maxQual := byte(qualityCap)
+				for i, qual := range aln.QUAL {
+					if qual < threshold && qual > maxQual {
+						aln.QUAL[i] = maxQual
+					}
+				}
+			}
+			return true
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils/nibbles"
+)
+
+func TestMaskLowQualityBases(t *testing.T) {
+	newAlignment := func(rg string) *sam.Alignment {
+		aln := &sam.Alignment{QNAME: "r1", SEQ: sam.Sequence(nibbles.Make(4)), QUAL: []byte{30, 10, 25, 2}}
+		for i, base := range []byte("ACGT") {
+			aln.SEQ.SetBase(i, base)
+		}
+		aln.SetRG(rg)
+		return aln
+	}
+	bases := func(aln *sam.Alignment) string {
+		var result []byte
+		for i := 0; i < aln.SEQ.Len(); i++ {
+			result = append(result, aln.SEQ.Base(i))
+		}
+		return string(result)
+	}
+	filter := MaskLowQualityBases(20, map[string]byte{"rg2": 28, "rg3": 0}, -1)(sam.NewHeader())
+	aln := newAlignment("rg1")
+	filter(aln)
+	if bases(aln) != "ANGN" {
+		t.Error("MaskLowQualityBases failed", bases(aln))
+	}
+	aln = newAlignment("rg2")
+	filter(aln)
+	if bases(aln) != "ANNN" {
+		t.Error("MaskLowQualityBases with read group threshold failed", bases(aln))
+	}
+	aln = newAlignment("rg3")
+	filter(aln)
+	if bases(aln) != "ACGT" {
+		t.Error("MaskLowQualityBases with disabled read group failed", bases(aln))
+	}
+	filter = MaskLowQualityBases(20, nil, 5)(sam.NewHeader())
+	aln = newAlignment("rg1")
+	filter(aln)
+	if bases(aln) != "ACGT" || string(aln.QUAL) != string([]byte{30, 5, 25, 2}) {
+		t.Error("MaskLowQualityBases with quality cap failed", bases(aln), aln.QUAL)
+	}
+}
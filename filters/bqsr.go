@@ -278,8 +278,7 @@ func cigarContainsN(cigarVec []sam.CigarOperation) bool {
 }
 
 func recalibrateAln(hdr *sam.Header, aln *sam.Alignment) bool {
-	_, found := aln.TAGS.Get(sr)
-	if found {
+	if aln.HasTag(sr) {
 		return false
 	}
 	if aln.MAPQ > 0 && aln.MAPQ < 255 &&
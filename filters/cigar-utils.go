@@ -39,6 +39,33 @@ func end(aln *sam.Alignment, cigars []sam.CigarOperation) int32 {
 	return aln.POS + length - 1
 }
 
+// Returns the reference blocks covered by the aligned bases of a read
+// as 0-based, half-open start and end positions, in ascending order.
+// Blocks are separated by skipped regions (N), such as introns.
+// Deletions do not separate blocks.
+func alignedBlocks(aln *sam.Alignment) (starts, ends []int32) {
+	pos := aln.POS - 1
+	blockStart := pos
+	for _, op := range aln.CIGAR {
+		switch op.Operation {
+		case 'M', 'D', '=', 'X':
+			pos += op.Length
+		case 'N':
+			if pos > blockStart {
+				starts = append(starts, blockStart)
+				ends = append(ends, pos)
+			}
+			pos += op.Length
+			blockStart = pos
+		}
+	}
+	if pos > blockStart {
+		starts = append(starts, blockStart)
+		ends = append(ends, pos)
+	}
+	return starts, ends
+}
+
 var (
 	operatorConsumesReadBases      = map[byte]bool{'M': true, 'I': true, 'S': true, '=': true, 'X': true}
 	operatorConsumesReferenceBases = map[byte]bool{'M': true, 'D': true, 'N': true, '=': true, 'X': true}
@@ -0,0 +1,54 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestReadOverlapsRegion(t *testing.T) {
+	cigar, err := sam.ScanCigarString("2S50M1000N10M5D40M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Exons at [99,149) and [1149,1204), intron at [149,1149).
+	aln := &sam.Alignment{RNAME: "chr1", POS: 100, CIGAR: cigar}
+	starts, ends := alignedBlocks(aln)
+	if len(starts) != 2 || starts[0] != 99 || ends[0] != 149 || starts[1] != 1149 || ends[1] != 1204 {
+		t.Error("alignedBlocks failed")
+	}
+	regions := bed.NewBed()
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 500, End: 600})
+	if ReadOverlapsRegion(aln, bed.NewRegionIndex(regions)) {
+		t.Error("ReadOverlapsRegion intron failed")
+	}
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 1203, End: 1300})
+	index := bed.NewRegionIndex(regions)
+	if !ReadOverlapsRegion(aln, index) {
+		t.Error("ReadOverlapsRegion exon failed")
+	}
+	aln.RNAME = "chr2"
+	if ReadOverlapsRegion(aln, index) {
+		t.Error("ReadOverlapsRegion chromosome failed")
+	}
+}
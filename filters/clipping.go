@@ -0,0 +1,257 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"log"
+	"strings"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+	"github.com/exascience/elprep/v4/utils/nibbles"
+)
+
+// Symbols for the optional fields that store the bases and base
+// qualities of soft clips that are converted to hard clips. The tags
+// contain lowercase letters, which the SAM specification reserves for
+// local use, so that they do not clash with the tags of aligners,
+// such as the ZS tag of HISAT2 and BWA.
+//
+// ClippedBases (hb) contains the clipped bases at the start and at the
+// end of the segment sequence, separated by a comma.
+// ClippedQualities (hq) contains the base qualities of the clipped
+// bases at the start, followed by the base qualities of the clipped
+// bases at the end, encoded as in the OQ optional field. hq is
+// omitted when the alignment has no base qualities.
+var (
+	ClippedBases     = utils.Intern("hb")
+	ClippedQualities = utils.Intern("hq")
+)
+
+// Returns the lengths of the leading and trailing hard and soft clips
+// of a CIGAR string.
+func clips(cigar []sam.CigarOperation) (leftHard, leftSoft, rightSoft, rightHard int32) {
+	i, j := 0, len(cigar)-1
+	if i <= j && cigar[i].Operation == 'H' {
+		leftHard = cigar[i].Length
+		i++
+	}
+	if i <= j && cigar[j].Operation == 'H' {
+		rightHard = cigar[j].Length
+		j--
+	}
+	if i <= j && cigar[i].Operation == 'S' {
+		leftSoft = cigar[i].Length
+		i++
+	}
+	if i <= j && cigar[j].Operation == 'S' {
+		rightSoft = cigar[j].Length
+	}
+	return
+}
+
+// Returns a CIGAR string with the given leading and trailing hard and
+// soft clips, and the operations of the given CIGAR string in between
+// its own leading and trailing clips.
+func reclip(cigar []sam.CigarOperation, leftHard, leftSoft, rightSoft, rightHard int32) []sam.CigarOperation {
+	i, j := 0, len(cigar)
+	for i < j && (cigar[i].Operation == 'H' || cigar[i].Operation == 'S') {
+		i++
+	}
+	for i < j && (cigar[j-1].Operation == 'H' || cigar[j-1].Operation == 'S') {
+		j--
+	}
+	newCigar := make([]sam.CigarOperation, 0, j-i+4)
+	if leftHard > 0 {
+		newCigar = append(newCigar, sam.CigarOperation{Length: leftHard, Operation: 'H'})
+	}
+	if leftSoft > 0 {
+		newCigar = append(newCigar, sam.CigarOperation{Length: leftSoft, Operation: 'S'})
+	}
+	newCigar = append(newCigar, cigar[i:j]...)
+	if rightSoft > 0 {
+		newCigar = append(newCigar, sam.CigarOperation{Length: rightSoft, Operation: 'S'})
+	}
+	if rightHard > 0 {
+		newCigar = append(newCigar, sam.CigarOperation{Length: rightHard, Operation: 'H'})
+	}
+	return newCigar
+}
+
+func sequenceString(seq sam.Sequence, low, high int) string {
+	var b strings.Builder
+	b.Grow(high - low)
+	for i := low; i < high; i++ {
+		b.WriteByte(seq.Base(i))
+	}
+	return b.String()
+}
+
+// ConvertSoftClipsToHardClips returns a filter that converts the
+// soft clips of each alignment to hard clips, removing the clipped
+// bases and base qualities from SEQ and QUAL. If keepClippedBases is
+// true, the clipped bases and base qualities are stored in the hb and
+// hq optional fields, so that RestoreSoftClips can restore them later.
+// Alignments that already have an hb or hq optional field are then
+// left unchanged, so that existing fields are never overwritten.
+func ConvertSoftClipsToHardClips(keepClippedBases bool) sam.Filter {
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		return func(aln *sam.Alignment) bool {
+			leftHard, leftSoft, rightSoft, rightHard := clips(aln.CIGAR)
+			if leftSoft == 0 && rightSoft == 0 {
+				return true
+			}
+			seqLen := aln.SEQ.Len()
+			if seqLen > 0 {
+				if int(leftSoft+rightSoft) > seqLen {
+					return true
+				}
+				low, high := int(leftSoft), seqLen-int(rightSoft)
+				hasQual := len(aln.QUAL) == seqLen && aln.QUAL[0] != 0xff
+				if keepClippedBases {
+					if aln.HasTag(ClippedBases) || aln.HasTag(ClippedQualities) {
+						return true
+					}
+					if err := aln.SetTag(ClippedBases, sequenceString(aln.SEQ, 0, low)+","+sequenceString(aln.SEQ, high, seqLen)); err != nil {
+						log.Fatal(err)
+					}
+					if hasQual {
+						clippedQual := make([]byte, 0, low+seqLen-high)
+						for _, q := range aln.QUAL[:low] {
+							clippedQual = append(clippedQual, q+33)
+						}
+						for _, q := range aln.QUAL[high:] {
+							clippedQual = append(clippedQual, q+33)
+						}
+						if err := aln.SetTag(ClippedQualities, string(clippedQual)); err != nil {
+							log.Fatal(err)
+						}
+					}
+				}
+				seq := nibbles.Make(high - low)
+				seq.Copy(nibbles.Nibbles(aln.SEQ).Slice(low, high))
+				aln.SEQ = sam.Sequence(seq)
+				if len(aln.QUAL) == seqLen {
+					aln.QUAL = append([]byte(nil), aln.QUAL[low:high]...)
+				}
+			}
+			aln.CIGAR = reclip(aln.CIGAR, leftHard+leftSoft, 0, 0, rightSoft+rightHard)
+			return true
+		}
+	}
+}
+
+// RestoreSoftClips returns a filter that converts hard clips back to
+// soft clips, using the bases and base qualities stored in the hb and
+// hq optional fields by ConvertSoftClipsToHardClips. Alignments
+// without an hb optional field, or for which the stored bases do not
+// match the CIGAR string, are left unchanged.
+func RestoreSoftClips(_ *sam.Header) sam.AlignmentFilter {
+	return func(aln *sam.Alignment) bool {
+		clipped, ok := aln.TagString(ClippedBases)
+		if !ok {
+			return true
+		}
+		comma := strings.IndexByte(clipped, ',')
+		if comma < 0 {
+			return true
+		}
+		left, right := clipped[:comma], clipped[comma+1:]
+		leftHard, leftSoft, rightSoft, rightHard := clips(aln.CIGAR)
+		if leftSoft != 0 || rightSoft != 0 || int(leftHard) < len(left) || int(rightHard) < len(right) {
+			return true
+		}
+		seqLen := aln.SEQ.Len()
+		if seqLen == 0 {
+			return true
+		}
+		clippedQual, hasQual := aln.TagString(ClippedQualities)
+		if hasQual {
+			if len(clippedQual) != len(left)+len(right) || len(aln.QUAL) != seqLen || aln.QUAL[0] == 0xff {
+				return true
+			}
+		} else if len(aln.QUAL) == seqLen && aln.QUAL[0] != 0xff {
+			return true
+		}
+		newLen := len(left) + seqLen + len(right)
+		seq := sam.Sequence(nibbles.Make(newLen))
+		for i := 0; i < len(left); i++ {
+			seq.SetBase(i, left[i])
+		}
+		nibbles.Nibbles(seq).Slice(len(left), len(left)+seqLen).Copy(nibbles.Nibbles(aln.SEQ))
+		for i := 0; i < len(right); i++ {
+			seq.SetBase(len(left)+seqLen+i, right[i])
+		}
+		aln.SEQ = seq
+		if hasQual {
+			qual := make([]byte, newLen)
+			for i := 0; i < len(left); i++ {
+				qual[i] = clippedQual[i] - 33
+			}
+			copy(qual[len(left):], aln.QUAL)
+			for i := len(left); i < len(clippedQual); i++ {
+				qual[seqLen+i] = clippedQual[i] - 33
+			}
+			aln.QUAL = qual
+		} else if len(aln.QUAL) == seqLen {
+			// missing QUAL, as in BAM files
+			aln.QUAL = make([]byte, newLen)
+			for i := range aln.QUAL {
+				aln.QUAL[i] = 0xff
+			}
+		}
+		aln.CIGAR = reclip(aln.CIGAR, leftHard-int32(len(left)), int32(len(left)), int32(len(right)), rightHard-int32(len(right)))
+		aln.DeleteTag(ClippedBases)
+		if hasQual {
+			aln.DeleteTag(ClippedQualities)
+		}
+		return true
+	}
+}
+
+// TrimClippedBases returns a filter that removes the soft-clipped
+// bases and base qualities at the start and end of each alignment
+// from SEQ and QUAL, and removes the soft and hard clips from the
+// CIGAR string. If minLength is positive, the filter also removes
+// alignments with fewer than minLength remaining bases.
+func TrimClippedBases(minLength int) sam.Filter {
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		return func(aln *sam.Alignment) bool {
+			leftHard, leftSoft, rightSoft, rightHard := clips(aln.CIGAR)
+			seqLen := aln.SEQ.Len()
+			if leftSoft+rightSoft > 0 && seqLen > 0 {
+				if int(leftSoft+rightSoft) > seqLen {
+					return true
+				}
+				low, high := int(leftSoft), seqLen-int(rightSoft)
+				seq := nibbles.Make(high - low)
+				seq.Copy(nibbles.Nibbles(aln.SEQ).Slice(low, high))
+				aln.SEQ = sam.Sequence(seq)
+				if len(aln.QUAL) == seqLen {
+					aln.QUAL = append([]byte(nil), aln.QUAL[low:high]...)
+				}
+				seqLen = high - low
+			}
+			if leftHard+leftSoft+rightSoft+rightHard > 0 {
+				aln.CIGAR = reclip(aln.CIGAR, 0, 0, 0, 0)
+			}
+			return minLength <= 0 || seqLen >= minLength
+		}
+	}
+}
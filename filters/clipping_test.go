@@ -0,0 +1,113 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+	"github.com/exascience/elprep/v4/utils/nibbles"
+)
+
+func TestClipping(t *testing.T) {
+	cigar, err := sam.ScanCigarString("2H3S4M1I2M2S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := sam.Sequence(nibbles.Make(12))
+	for i, base := range []byte("AACCCCGTTTGG") {
+		seq.SetBase(i, base)
+	}
+	aln := &sam.Alignment{QNAME: "r1", CIGAR: cigar, SEQ: seq, QUAL: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}}
+	bases := func() string { return sequenceString(aln.SEQ, 0, aln.SEQ.Len()) }
+	ConvertSoftClipsToHardClips(true)(sam.NewHeader())(aln)
+	if cigarString(aln.CIGAR) != "5H4M1I2M2H" || bases() != "CCCGTTT" || string(aln.QUAL) != string([]byte{4, 5, 6, 7, 8, 9, 10}) {
+		t.Error("ConvertSoftClipsToHardClips failed", cigarString(aln.CIGAR), bases(), aln.QUAL)
+	}
+	if hb, _ := aln.TagString(ClippedBases); hb != "AAC,GG" {
+		t.Error("ConvertSoftClipsToHardClips hb failed", hb)
+	}
+	RestoreSoftClips(sam.NewHeader())(aln)
+	if cigarString(aln.CIGAR) != "2H3S4M1I2M2S" || bases() != "AACCCCGTTTGG" || string(aln.QUAL) != string([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}) {
+		t.Error("RestoreSoftClips failed", cigarString(aln.CIGAR), bases(), aln.QUAL)
+	}
+	if aln.HasTag(ClippedBases) || aln.HasTag(ClippedQualities) {
+		t.Error("RestoreSoftClips did not remove hb and hq")
+	}
+	ConvertSoftClipsToHardClips(false)(sam.NewHeader())(aln)
+	RestoreSoftClips(sam.NewHeader())(aln)
+	if cigarString(aln.CIGAR) != "5H4M1I2M2H" || bases() != "CCCGTTT" || aln.HasTag(ClippedBases) {
+		t.Error("ConvertSoftClipsToHardClips without clipped bases failed", cigarString(aln.CIGAR), bases())
+	}
+}
+
+func TestClippingExistingTags(t *testing.T) {
+	cigar, err := sam.ScanCigarString("3S4M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := sam.Sequence(nibbles.Make(7))
+	for i, base := range []byte("AACCCCG") {
+		seq.SetBase(i, base)
+	}
+	zs := utils.Intern("ZS")
+	aln := &sam.Alignment{QNAME: "r1", CIGAR: cigar, SEQ: seq, QUAL: []byte{1, 2, 3, 4, 5, 6, 7}}
+	// HISAT2 and BWA emit ZS, which must not be mistaken for stored bases.
+	if err := aln.SetTag(zs, 5); err != nil {
+		t.Fatal(err)
+	}
+	RestoreSoftClips(sam.NewHeader())(aln)
+	ConvertSoftClipsToHardClips(true)(sam.NewHeader())(aln)
+	if value, ok := aln.TagInt(zs); !ok || value != 5 || cigarString(aln.CIGAR) != "3H4M" {
+		t.Error("ConvertSoftClipsToHardClips with ZS failed", cigarString(aln.CIGAR))
+	}
+	aln.CIGAR = cigar
+	aln.SEQ = seq
+	aln.QUAL = []byte{1, 2, 3, 4, 5, 6, 7}
+	aln.DeleteTag(ClippedQualities)
+	if err := aln.SetTag(ClippedBases, 1); err != nil {
+		t.Fatal(err)
+	}
+	ConvertSoftClipsToHardClips(true)(sam.NewHeader())(aln)
+	if value, ok := aln.TagInt(ClippedBases); !ok || value != 1 || cigarString(aln.CIGAR) != "3S4M" {
+		t.Error("ConvertSoftClipsToHardClips with existing hb failed", cigarString(aln.CIGAR))
+	}
+}
+
+func TestTrimClippedBases(t *testing.T) {
+	cigar, err := sam.ScanCigarString("2H3S4M1I2M2S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := sam.Sequence(nibbles.Make(12))
+	for i, base := range []byte("AACCCCGTTTGG") {
+		seq.SetBase(i, base)
+	}
+	aln := &sam.Alignment{QNAME: "r1", CIGAR: cigar, SEQ: seq, QUAL: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}}
+	if !TrimClippedBases(7)(sam.NewHeader())(aln) {
+		t.Error("TrimClippedBases removed alignment")
+	}
+	if cigarString(aln.CIGAR) != "4M1I2M" || sequenceString(aln.SEQ, 0, aln.SEQ.Len()) != "CCCGTTT" || string(aln.QUAL) != string([]byte{4, 5, 6, 7, 8, 9, 10}) {
+		t.Error("TrimClippedBases failed", cigarString(aln.CIGAR), sequenceString(aln.SEQ, 0, aln.SEQ.Len()), aln.QUAL)
+	}
+	if TrimClippedBases(8)(sam.NewHeader())(aln) {
+		t.Error("TrimClippedBases with minimum length failed")
+	}
+}
@@ -0,0 +1,149 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"strconv"
+
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// MC is the symbol for the optional field with the CIGAR string of
+// the mate.
+var MC = utils.Intern("MC")
+
+// Formats a CIGAR string for the MC optional field.
+func cigarString(cigar []sam.CigarOperation) string {
+	if len(cigar) == 0 {
+		return "*"
+	}
+	var b []byte
+	for _, op := range cigar {
+		b = strconv.AppendInt(b, int64(op.Length), 10)
+		b = append(b, op.Operation)
+	}
+	return string(b)
+}
+
+// Sets the mate information of an alignment from the primary
+// alignment of its mate, except for TLEN.
+func setMateInformation(aln, mate *sam.Alignment) {
+	switch {
+	case mate.RNAME == "*":
+		aln.RNEXT = "*"
+	case mate.RNAME == aln.RNAME:
+		aln.RNEXT = "="
+	default:
+		aln.RNEXT = mate.RNAME
+	}
+	aln.PNEXT = mate.POS
+	if mate.IsUnmapped() {
+		aln.FLAG |= sam.NextUnmapped
+		aln.DeleteTag(MC)
+	} else {
+		aln.FLAG &^= sam.NextUnmapped
+		_ = aln.SetTag(MC, cigarString(mate.CIGAR))
+	}
+	if mate.IsReversed() {
+		aln.FLAG |= sam.NextReversed
+	} else {
+		aln.FLAG &^= sam.NextReversed
+	}
+}
+
+// Returns the primary alignments of the first and last segment of a
+// read pair, or nil if the query group does not contain exactly one
+// of each.
+func primaryMates(group []*sam.Alignment) (first, last *sam.Alignment) {
+	for _, aln := range group {
+		if !aln.IsMultiple() || aln.IsSecondary() || aln.IsSupplementary() {
+			continue
+		}
+		if aln.IsFirst() && !aln.IsLast() {
+			if first != nil {
+				return nil, nil
+			}
+			first = aln
+		} else if aln.IsLast() && !aln.IsFirst() {
+			if last != nil {
+				return nil, nil
+			}
+			last = aln
+		}
+	}
+	if first == nil || last == nil {
+		return nil, nil
+	}
+	return first, last
+}
+
+// Sets the mate information of all alignments of a read pair from the
+// primary alignments of their mates, and TLEN of the primary
+// alignments.
+func setPairInformation(group []*sam.Alignment, first, last *sam.Alignment) {
+	for _, aln := range group {
+		if !aln.IsMultiple() {
+			continue
+		}
+		if aln.IsFirst() && !aln.IsLast() {
+			setMateInformation(aln, last)
+		} else if aln.IsLast() && !aln.IsFirst() {
+			setMateInformation(aln, first)
+		}
+	}
+	if first.IsUnmapped() || last.IsUnmapped() || first.RNAME != last.RNAME {
+		first.TLEN, last.TLEN = 0, 0
+		return
+	}
+	left, right := first, last
+	if right.POS < left.POS {
+		left, right = right, left
+	}
+	rightmost := end(left, left.CIGAR)
+	if e := end(right, right.CIGAR); e > rightmost {
+		rightmost = e
+	}
+	left.TLEN = rightmost - left.POS + 1
+	right.TLEN = -left.TLEN
+}
+
+// FixMateInformation is a filter for making the mate information of
+// paired reads consistent with the primary alignments of their mates:
+// RNEXT, PNEXT, the mate unmapped and mate reverse strand flags, the
+// MC optional field, and TLEN for the primary alignments. An unmapped
+// read whose mate is mapped is placed at the position of its mate.
+//
+// FixMateInformation only looks at the alignments of each query
+// template, so it requires input that is sorted by queryname or
+// grouped by query (GO:query), but does not sort it.
+func FixMateInformation(_ *sam.Header) sam.QueryGroupFilter {
+	return func(group []*sam.Alignment) {
+		first, last := primaryMates(group)
+		if first == nil {
+			return
+		}
+		if first.IsUnmapped() && !last.IsUnmapped() {
+			first.RNAME, first.POS = last.RNAME, last.POS
+		} else if last.IsUnmapped() && !first.IsUnmapped() {
+			last.RNAME, last.POS = first.RNAME, first.POS
+		}
+		setPairInformation(group, first, last)
+	}
+}
@@ -0,0 +1,51 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/sam"
+)
+
+func TestFixMateInformation(t *testing.T) {
+	cigar, err := sam.ScanCigarString("10M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &sam.Alignment{QNAME: "r", FLAG: sam.Multiple | sam.First, RNAME: "chr1", POS: 100, CIGAR: cigar, RNEXT: "*"}
+	last := &sam.Alignment{QNAME: "r", FLAG: sam.Multiple | sam.Last | sam.Reversed, RNAME: "chr1", POS: 150, CIGAR: cigar, RNEXT: "*"}
+	FixMateInformation(nil)([]*sam.Alignment{first, last})
+	if first.RNEXT != "=" || first.PNEXT != 150 || !first.IsNextReversed() || first.TLEN != 60 {
+		t.Error("FixMateInformation failed", first)
+	}
+	if last.RNEXT != "=" || last.PNEXT != 100 || last.IsNextReversed() || last.TLEN != -60 {
+		t.Error("FixMateInformation failed", last)
+	}
+	if mc, _ := first.TagString(MC); mc != "10M" {
+		t.Error("FixMateInformation MC failed", mc)
+	}
+
+	unmapped := &sam.Alignment{QNAME: "u", FLAG: sam.Multiple | sam.Last | sam.Unmapped, RNAME: "*"}
+	mapped := &sam.Alignment{QNAME: "u", FLAG: sam.Multiple | sam.First, RNAME: "chr2", POS: 7, CIGAR: cigar, TLEN: 5}
+	FixMateInformation(nil)([]*sam.Alignment{unmapped, mapped})
+	if unmapped.RNAME != "chr2" || unmapped.POS != 7 || !mapped.IsNextUnmapped() || mapped.TLEN != 0 || mapped.RNEXT != "=" {
+		t.Error("FixMateInformation unmapped mate failed", unmapped, mapped)
+	}
+}
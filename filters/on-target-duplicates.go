@@ -0,0 +1,69 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"sync/atomic"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+)
+
+// DuplicateCounts counts the reads that overlap with target regions,
+// and how many of them are marked as duplicates.
+type DuplicateCounts struct {
+	Duplicates, Total int64
+}
+
+// Rate returns Duplicates / Total, or 0 if there are no reads.
+func (counts *DuplicateCounts) Rate() float64 {
+	if counts.Total == 0 {
+		return 0
+	}
+	return float64(counts.Duplicates) / float64(counts.Total)
+}
+
+// OnTargetDuplicateRate returns a filter for counting the reads that
+// overlap with the regions of a bed, and how many of them are marked
+// as duplicates. For capture libraries, this on-target duplicate rate
+// is more relevant than the genome-wide duplicate rate. Unmapped,
+// secondary, and supplementary reads are not counted. The filter does
+// not remove any reads.
+//
+// The counts are returned as well, and are complete once all reads
+// have been filtered. The filter relies on the duplicate flag, and
+// must therefore be applied after duplicates are marked.
+func OnTargetDuplicateRate(regions *bed.Bed) (sam.Filter, *DuplicateCounts) {
+	ivals := flattenedIntervals(regions)
+	counts := &DuplicateCounts{}
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		return func(aln *sam.Alignment) bool {
+			if aln.IsUnmapped() || aln.IsSecondary() || aln.IsSupplementary() {
+				return true
+			}
+			if readOverlaps(ivals, aln) {
+				atomic.AddInt64(&counts.Total, 1)
+				if aln.IsDuplicate() {
+					atomic.AddInt64(&counts.Duplicates, 1)
+				}
+			}
+			return true
+		}
+	}, counts
+}
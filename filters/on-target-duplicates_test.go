@@ -0,0 +1,60 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestOnTargetDuplicateRate(t *testing.T) {
+	regions := bed.NewBed()
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 100, End: 200})
+	filter, counts := OnTargetDuplicateRate(regions)
+	if counts.Rate() != 0 {
+		t.Error("OnTargetDuplicateRate without reads failed")
+	}
+	cigar, err := sam.ScanCigarString("50M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alns := []*sam.Alignment{
+		{RNAME: "chr1", POS: 101, CIGAR: cigar},
+		{RNAME: "chr1", POS: 121, CIGAR: cigar},
+		{RNAME: "chr1", POS: 171, CIGAR: cigar, FLAG: sam.Duplicate},
+		{RNAME: "chr1", POS: 121, CIGAR: cigar, FLAG: sam.Duplicate},
+		{RNAME: "chr1", POS: 121, CIGAR: cigar, FLAG: sam.Duplicate | sam.Secondary},
+		{RNAME: "chr1", POS: 121, CIGAR: cigar, FLAG: sam.Duplicate | sam.Supplementary},
+		{RNAME: "chr1", POS: 121, CIGAR: cigar, FLAG: sam.Duplicate | sam.Unmapped},
+		{RNAME: "chr1", POS: 301, CIGAR: cigar, FLAG: sam.Duplicate},
+		{RNAME: "chr2", POS: 121, CIGAR: cigar},
+	}
+	alnFilter := filter(sam.NewHeader())
+	for _, aln := range alns {
+		if !alnFilter(aln) {
+			t.Error("OnTargetDuplicateRate removed a read")
+		}
+	}
+	if counts.Total != 4 || counts.Duplicates != 2 || counts.Rate() != 0.5 {
+		t.Error("OnTargetDuplicateRate failed", counts.Total, counts.Duplicates)
+	}
+}
@@ -0,0 +1,181 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// MD and NM are the symbols for the optional fields that describe the
+// differences between an alignment and the reference.
+var (
+	MD = utils.Intern("MD")
+	NM = utils.Intern("NM")
+)
+
+// Removes the optional fields of an alignment that no longer match
+// its CIGAR string after clipping. They cannot be recomputed without
+// the reference.
+func deleteReferenceTags(aln *sam.Alignment) {
+	aln.DeleteTag(MD)
+	aln.DeleteTag(NM)
+}
+
+// Soft-clips the aligned bases of a CIGAR string that starts at the
+// given reference position and that are aligned to reference
+// positions before boundary. Returns the new CIGAR string and
+// position, or false if no aligned bases would remain.
+func softClipStartByReference(cigar []sam.CigarOperation, pos, boundary int32) ([]sam.CigarOperation, int32, bool) {
+	var hard, soft int32
+	i := 0
+	for ; i < len(cigar) && cigar[i].Operation == 'H'; i++ {
+		hard += cigar[i].Length
+	}
+	for ; i < len(cigar) && cigar[i].Operation == 'S'; i++ {
+		soft += cigar[i].Length
+	}
+	var rest []sam.CigarOperation
+	for ; i < len(cigar) && pos < boundary; i++ {
+		op := cigar[i]
+		if cigarConsumesReferenceBases[op.Operation] == 1 {
+			n := op.Length
+			if pos+n > boundary {
+				n = boundary - pos
+			}
+			pos += n
+			soft += cigarConsumesReadBases[op.Operation] * n
+			if n < op.Length {
+				rest = append(rest, sam.CigarOperation{Length: op.Length - n, Operation: op.Operation})
+				i++
+				break
+			}
+		} else {
+			soft += cigarConsumesReadBases[op.Operation] * op.Length
+		}
+	}
+	rest = append(rest, cigar[i:]...)
+	// an alignment cannot start with a deletion, skip, or insertion
+	for len(rest) > 0 {
+		if op := rest[0]; op.Operation == 'D' || op.Operation == 'N' {
+			pos += op.Length
+		} else if op.Operation == 'I' {
+			soft += op.Length
+		} else {
+			break
+		}
+		rest = rest[1:]
+	}
+	aligned := false
+	for _, op := range rest {
+		if cigarConsumesReferenceBases[op.Operation] == 1 && cigarConsumesReadBases[op.Operation] == 1 {
+			aligned = true
+			break
+		}
+	}
+	if !aligned {
+		return nil, 0, false
+	}
+	newCigar := make([]sam.CigarOperation, 0, len(rest)+2)
+	if hard > 0 {
+		newCigar = append(newCigar, sam.CigarOperation{Length: hard, Operation: 'H'})
+	}
+	if soft > 0 {
+		newCigar = append(newCigar, sam.CigarOperation{Length: soft, Operation: 'S'})
+	}
+	return append(newCigar, rest...), pos, true
+}
+
+func reverseCigar(cigar []sam.CigarOperation) []sam.CigarOperation {
+	reversed := make([]sam.CigarOperation, len(cigar))
+	for i, op := range cigar {
+		reversed[len(cigar)-1-i] = op
+	}
+	return reversed
+}
+
+// Soft-clips the aligned bases of an alignment that are aligned to
+// reference positions after boundary. Returns the new CIGAR string,
+// or false if no aligned bases would remain.
+func softClipEndByReference(aln *sam.Alignment, boundary int32) ([]sam.CigarOperation, bool) {
+	// clip the start of the reversed CIGAR string, with negated reference positions
+	reversed, _, ok := softClipStartByReference(reverseCigar(aln.CIGAR), -end(aln, aln.CIGAR), -boundary)
+	if !ok {
+		return nil, false
+	}
+	return reverseCigar(reversed), true
+}
+
+// ClipOverlappingMates is a filter for soft-clipping the overlapping
+// parts of properly paired reads, so that each base of the template
+// is covered by only one of the two reads, similar to bamUtil
+// clipOverlap and fgbio ClipBam.
+//
+// The filter only considers the primary alignments of read pairs
+// that are mapped in proper pairs to opposite strands of the same
+// reference sequence. For such a read pair, the start of the read
+// that starts later is clipped up to the end of the other read. If
+// the read that starts later is completely contained in the other
+// read, the end of the other read is clipped instead. The mate
+// information of all alignments of the read pair is updated
+// accordingly. The MD and NM optional fields of a clipped read are
+// removed.
+//
+// ClipOverlappingMates only looks at the alignments of each query
+// template, so it requires input that is sorted by queryname or
+// grouped by query (GO:query), but does not sort it.
+func ClipOverlappingMates(_ *sam.Header) sam.QueryGroupFilter {
+	return func(group []*sam.Alignment) {
+		first, last := primaryMates(group)
+		if first == nil ||
+			!first.IsProper() || !last.IsProper() ||
+			first.IsUnmapped() || last.IsUnmapped() ||
+			first.RNAME != last.RNAME ||
+			first.IsReversed() == last.IsReversed() {
+			return
+		}
+		left, right := first, last
+		if right.POS < left.POS || (right.POS == left.POS && left.IsReversed()) {
+			left, right = right, left
+		}
+		leftEnd := end(left, left.CIGAR)
+		if right.POS > leftEnd {
+			return
+		}
+		if end(right, right.CIGAR) > leftEnd {
+			cigar, pos, ok := softClipStartByReference(right.CIGAR, right.POS, leftEnd+1)
+			if !ok {
+				return
+			}
+			right.CIGAR, right.POS = cigar, pos
+			deleteReferenceTags(right)
+		} else {
+			if right.POS == left.POS {
+				return
+			}
+			cigar, ok := softClipEndByReference(left, right.POS-1)
+			if !ok {
+				return
+			}
+			left.CIGAR = cigar
+			deleteReferenceTags(left)
+		}
+		setPairInformation(group, first, last)
+	}
+}
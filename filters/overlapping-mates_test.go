@@ -0,0 +1,81 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/sam"
+)
+
+func TestClipOverlappingMates(t *testing.T) {
+	newPair := func(pos1 int32, cigar1 string, pos2 int32, cigar2 string) []*sam.Alignment {
+		c1, err := sam.ScanCigarString(cigar1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := sam.ScanCigarString(cigar2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*sam.Alignment{
+			{QNAME: "r1", FLAG: sam.Multiple | sam.Proper | sam.First | sam.NextReversed, RNAME: "chr1", POS: pos1, CIGAR: c1, RNEXT: "=", PNEXT: pos2},
+			{QNAME: "r1", FLAG: sam.Multiple | sam.Proper | sam.Last | sam.Reversed, RNAME: "chr1", POS: pos2, CIGAR: c2, RNEXT: "=", PNEXT: pos1},
+		}
+	}
+	filter := ClipOverlappingMates(sam.NewHeader())
+
+	group := newPair(100, "10M", 105, "10M")
+	for _, aln := range group {
+		if err := aln.SetTag(MD, "10"); err != nil {
+			t.Fatal(err)
+		}
+		if err := aln.SetTag(NM, int32(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filter(group)
+	if !group[0].HasTag(MD) || !group[0].HasTag(NM) || group[1].HasTag(MD) || group[1].HasTag(NM) {
+		t.Error("ClipOverlappingMates MD and NM failed")
+	}
+	if cigarString(group[0].CIGAR) != "10M" || cigarString(group[1].CIGAR) != "5S5M" || group[1].POS != 110 {
+		t.Error("ClipOverlappingMates failed", cigarString(group[1].CIGAR), group[1].POS)
+	}
+	if mc, _ := group[0].TagString(MC); group[0].PNEXT != 110 || mc != "5S5M" || group[0].TLEN != 15 || group[1].TLEN != -15 {
+		t.Error("ClipOverlappingMates mate information failed", group[0].PNEXT, mc, group[0].TLEN, group[1].TLEN)
+	}
+
+	group = newPair(100, "20M", 105, "5M")
+	filter(group)
+	if cigarString(group[0].CIGAR) != "5M15S" || cigarString(group[1].CIGAR) != "5M" || group[0].TLEN != 10 {
+		t.Error("ClipOverlappingMates with contained mate failed", cigarString(group[0].CIGAR), group[0].TLEN)
+	}
+
+	group = newPair(100, "5M", 102, "3M2D5M")
+	filter(group)
+	if cigarString(group[1].CIGAR) != "3S5M" || group[1].POS != 107 {
+		t.Error("ClipOverlappingMates with deletion failed", cigarString(group[1].CIGAR), group[1].POS)
+	}
+
+	group = newPair(100, "10M", 110, "10M")
+	filter(group)
+	if cigarString(group[1].CIGAR) != "10M" || group[1].POS != 110 {
+		t.Error("ClipOverlappingMates clipped non-overlapping mates")
+	}
+}
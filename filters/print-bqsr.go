@@ -32,6 +32,16 @@ import (
 
 const quantizationLevel = 16
 
+// GATK table format lines. These are variables rather than constants
+// to indicate that their formatting directives are printed literally.
+var (
+	quantizationTableFormat = "#:GATKTable:3:94:\045d:\045d:\045d:;"
+	recalTable0Format       = "#:GATKTable:6:1:\045s:\045s:\045.4f:\045.4f:\045d:\045.2f:;"
+	recalTable1Format       = "#:GATKTable:6:36:\045s:\045d:\045s:\045.4f:\045d:\045.2f:;"
+	recalTable2Format       = "#:GATKTable:8:7756:\045s:\045d:\045s:\045s:\045s:\045.4f:\045d:\045.2f:;"
+	argumentsTableFormat    = "#:GATKTable:2:17:\045s:\045s:;"
+)
+
 func (recal *BaseRecalibratorTables) fprintln(w io.Writer, a ...interface{}) {
 	if recal.err != nil {
 		return
@@ -63,7 +73,7 @@ const (
 func (recal *BaseRecalibratorTables) printQuantizationTable(file io.Writer) {
 	observations, scores := initializeQuantizedQualityScores(recal.QualityScores, quantizationLevel)
 
-	recal.fprintln(file, "#:GATKTable:3:94:\045d:\045d:\045d:;")
+	recal.fprintln(file, quantizationTableFormat)
 	recal.fprintln(file, "#:GATKTable:Quantized:Quality quantization map")
 
 	maxLenQualityScore := len(qualityScoreString)
@@ -92,7 +102,7 @@ func (recal *BaseRecalibratorTables) printQuantizationTable(file io.Writer) {
 func (recal *BaseRecalibratorTables) printCombinedBQSRTable(file io.Writer) {
 	table := initializeCombinedBQSRTable(recal.QualityScores)
 
-	recal.fprintln(file, "#:GATKTable:6:1:\045s:\045s:\045.4f:\045.4f:\045d:\045.2f:;")
+	recal.fprintln(file, recalTable0Format)
 	recal.fprintln(file, "#:GATKTable:RecalTable0:")
 
 	maxLenReadGroup := len(readGroupString)
@@ -136,7 +146,7 @@ func (recal *BaseRecalibratorTables) printCombinedBQSRTable(file io.Writer) {
 }
 
 func (recal *BaseRecalibratorTables) printBQSRTable(file io.Writer) {
-	recal.fprintln(file, "#:GATKTable:6:36:\045s:\045d:\045s:\045.4f:\045d:\045.2f:;")
+	recal.fprintln(file, recalTable1Format)
 	recal.fprintln(file, "#:GATKTable:RecalTable1:")
 
 	maxLenReadGroup := len(readGroupString)
@@ -195,7 +205,7 @@ type covariateBqsrTableKey struct {
 }
 
 func (recal *BaseRecalibratorTables) printOtherCovariateTable(file io.Writer) {
-	recal.fprintln(file, "#:GATKTable:8:7756:\045s:\045d:\045s:\045s:\045s:\045.4f:\045d:\045.2f:;")
+	recal.fprintln(file, recalTable2Format)
 	recal.fprintln(file, "#:GATKTable:RecalTable2:")
 
 	maxLenReadGroup := len(readGroupString)
@@ -291,7 +301,7 @@ func (recal *BaseRecalibratorTables) PrintBQSRTables(name string) error {
 		}
 	}()
 	recal.fprintln(file, "#:GATKReport.v1.1:5")
-	recal.fprintln(file, "#:GATKTable:2:17:\045s:\045s:;")
+	recal.fprintln(file, argumentsTableFormat)
 	recal.fprintln(file, "#:GATKTable:Arguments:Recalibration argument collection values used in this run")
 	recal.fprintln(file, "Argument                    Value                                                                   ")
 	recal.fprintln(file, "binary_tag_name             null                                                                    ")
@@ -0,0 +1,110 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/exascience/elprep/v4/sam"
+)
+
+// AnonymizeReadName returns a short identifier for a read name. The
+// identifier only depends on the read name, so the alignments of a
+// read pair, and the same read in different files, receive the same
+// identifier.
+func AnonymizeReadName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	// 80 bits make collisions unlikely even for billions of reads.
+	return base32.StdEncoding.EncodeToString(sum[:10])
+}
+
+// A ReadNameMap is a file that records the original read names
+// replaced by AnonymizeReadNames, with one line per query template
+// that contains the new and the original read name, separated by a
+// TAB.
+type ReadNameMap struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	err    error
+}
+
+// CreateReadNameMap creates a ReadNameMap with the given file name.
+func CreateReadNameMap(name string) (*ReadNameMap, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadNameMap{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (m *ReadNameMap) add(newName, oldName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.writer, "%v\t%v\n", newName, oldName)
+	}
+}
+
+// Close flushes and closes the ReadNameMap, and returns the first
+// error that occurred while writing it.
+func (m *ReadNameMap) Close() error {
+	err := m.err
+	if nerr := m.writer.Flush(); err == nil {
+		err = nerr
+	}
+	if nerr := m.file.Close(); err == nil {
+		err = nerr
+	}
+	return err
+}
+
+// AnonymizeReadNames returns a filter for replacing the read names of
+// all alignments with the identifiers computed by AnonymizeReadName.
+// This shrinks the output, and removes the instrument and run
+// information that read names often contain. If readNameMap is not
+// nil, the original read names are recorded in it for the primary
+// alignment of each unpaired or first read.
+//
+// Since the new read names are not in the same order as the original
+// ones, a queryname sorting order in the header is replaced by
+// grouping by query (GO:query).
+func AnonymizeReadNames(readNameMap *ReadNameMap) sam.Filter {
+	return func(header *sam.Header) sam.AlignmentFilter {
+		if header.HDSO() == sam.Queryname {
+			header.SetHDSO(sam.Unknown)
+			header.SetHDGO(sam.Query)
+		}
+		return func(aln *sam.Alignment) bool {
+			name := AnonymizeReadName(aln.QNAME)
+			if readNameMap != nil &&
+				!aln.IsSecondary() && !aln.IsSupplementary() &&
+				(!aln.IsMultiple() || aln.IsFirst()) {
+				readNameMap.add(name, aln.QNAME)
+			}
+			aln.QNAME = name
+			return true
+		}
+	}
+}
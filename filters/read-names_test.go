@@ -0,0 +1,67 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/exascience/elprep/v4/sam"
+)
+
+func TestAnonymizeReadNames(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "names.tsv")
+	readNameMap, err := CreateReadNameMap(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := sam.NewHeader()
+	header.SetHDSO(sam.Queryname)
+	filter := AnonymizeReadNames(readNameMap)(header)
+	alns := []*sam.Alignment{
+		{QNAME: "M1:1:FC:1:1101:100:200", FLAG: sam.Multiple | sam.First},
+		{QNAME: "M1:1:FC:1:1101:100:200", FLAG: sam.Multiple | sam.Last},
+		{QNAME: "M1:1:FC:1:1101:100:200", FLAG: sam.Multiple | sam.First | sam.Supplementary},
+		{QNAME: "M1:1:FC:1:1101:300:400"},
+	}
+	for _, aln := range alns {
+		filter(aln)
+	}
+	if err := readNameMap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(alns[0].QNAME) != 16 || alns[0].QNAME != alns[1].QNAME || alns[0].QNAME != alns[2].QNAME || alns[0].QNAME == alns[3].QNAME {
+		t.Error("AnonymizeReadNames failed", alns[0].QNAME, alns[1].QNAME, alns[2].QNAME, alns[3].QNAME)
+	}
+	if alns[3].QNAME != AnonymizeReadName("M1:1:FC:1:1101:300:400") {
+		t.Error("AnonymizeReadName not deterministic")
+	}
+	if header.HDSO() != sam.Unknown || header.HDGO() != sam.Query {
+		t.Error("AnonymizeReadNames header failed", header.HD)
+	}
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := alns[0].QNAME + "\tM1:1:FC:1:1101:100:200\n" + alns[3].QNAME + "\tM1:1:FC:1:1101:300:400\n"
+	if string(contents) != expected {
+		t.Error("ReadNameMap failed", string(contents))
+	}
+}
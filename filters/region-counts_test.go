@@ -0,0 +1,93 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestCountRegionReads(t *testing.T) {
+	regions := bed.NewBed()
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 100, End: 200})
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 300, End: 400})
+	filter, counts := CountRegionReads(regions, 10, true, 0)
+	cigar, err := sam.ScanCigarString("50M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A proper pair with mates at [90,140) and [410,460) spans both regions.
+	first := &sam.Alignment{RNAME: "chr1", POS: 91, MAPQ: 60, CIGAR: cigar, RNEXT: "=", PNEXT: 411, TLEN: 370,
+		FLAG: sam.Multiple | sam.Proper | sam.First}
+	last := &sam.Alignment{RNAME: "chr1", POS: 411, MAPQ: 60, CIGAR: cigar, RNEXT: "=", PNEXT: 91, TLEN: -370,
+		FLAG: sam.Multiple | sam.Proper | sam.Last}
+	single := &sam.Alignment{RNAME: "chr1", POS: 351, MAPQ: 60, CIGAR: cigar}
+	lowMAPQ := &sam.Alignment{RNAME: "chr1", POS: 351, MAPQ: 5, CIGAR: cigar}
+	duplicate := &sam.Alignment{RNAME: "chr1", POS: 351, MAPQ: 60, CIGAR: cigar, FLAG: sam.Duplicate}
+	alnFilter := filter(nil)
+	for _, aln := range []*sam.Alignment{first, last, single, lowMAPQ, duplicate} {
+		if !alnFilter(aln) {
+			t.Error("CountRegionReads removed a read")
+		}
+	}
+	if len(counts) != 2 ||
+		counts[0].Reads != 1 || counts[0].Fragments != 1 ||
+		counts[1].Reads != 1 || counts[1].Fragments != 2 {
+		t.Error("CountRegionReads failed")
+	}
+	var out bytes.Buffer
+	if err := WriteRegionCounts(&out, counts); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "chrom\tstart\tend\tname\treads\tfragments\nchr1\t100\t200\t.\t1\t1\nchr1\t300\t400\t.\t1\t2\n" {
+		t.Error("WriteRegionCounts failed")
+	}
+}
+
+func TestCountRegionReadsNearest(t *testing.T) {
+	regions := bed.NewBed()
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 100, End: 200})
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 300, End: 400})
+	cigar, err := sam.ScanCigarString("50M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// [205,255) is 5 bases after the first region, and 45 bases before the second one.
+	near := &sam.Alignment{RNAME: "chr1", POS: 206, MAPQ: 60, CIGAR: cigar}
+	// [500,550) is 100 bases after the second region.
+	far := &sam.Alignment{RNAME: "chr1", POS: 501, MAPQ: 60, CIGAR: cigar}
+	for _, maxDistance := range []int32{0, 10} {
+		filter, counts := CountRegionReads(regions, 0, false, maxDistance)
+		alnFilter := filter(nil)
+		alnFilter(near)
+		alnFilter(far)
+		var expected int64
+		if maxDistance > 0 {
+			expected = 1
+		}
+		if counts[0].Reads != expected || counts[0].Fragments != expected ||
+			counts[1].Reads != 0 || counts[1].Fragments != 0 {
+			t.Error("CountRegionReads nearest failed", maxDistance)
+		}
+	}
+}
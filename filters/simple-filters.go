@@ -19,9 +19,8 @@
 package filters
 
 import (
+	"log"
 	"math"
-	"math/rand"
-	"strconv"
 
 	"github.com/exascience/elprep/v4/bed"
 	"github.com/exascience/elprep/v4/intervals"
@@ -93,6 +92,44 @@ func RemoveUnmappedReadsStrict(_ *sam.Header) sam.AlignmentFilter {
 	}
 }
 
+// RemoveSecondaryAlignments is a filter for removing secondary
+// alignments, based on FLAG.
+func RemoveSecondaryAlignments(_ *sam.Header) sam.AlignmentFilter {
+	return func(aln *sam.Alignment) bool { return (aln.FLAG & sam.Secondary) == 0 }
+}
+
+// KeepOnlySecondaryAlignments is a filter for removing all but the
+// secondary alignments, based on FLAG.
+func KeepOnlySecondaryAlignments(_ *sam.Header) sam.AlignmentFilter {
+	return func(aln *sam.Alignment) bool { return (aln.FLAG & sam.Secondary) != 0 }
+}
+
+// SA is the symbol for the optional field that lists the other parts
+// of a chimeric alignment.
+var SA = utils.Intern("SA")
+
+// RemoveSupplementaryAlignments returns a filter for removing
+// supplementary alignments, based on FLAG. If stripSATags is true,
+// the filter also removes the SA optional field from the remaining
+// alignments, since it would otherwise refer to alignments that are
+// no longer present.
+func RemoveSupplementaryAlignments(stripSATags bool) sam.Filter {
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		if stripSATags {
+			return func(aln *sam.Alignment) bool {
+				if (aln.FLAG & sam.Supplementary) != 0 {
+					return false
+				}
+				if aln.HasTag(SA) {
+					aln.DeleteTag(SA)
+				}
+				return true
+			}
+		}
+		return func(aln *sam.Alignment) bool { return (aln.FLAG & sam.Supplementary) == 0 }
+	}
+}
+
 var nonExactMappingOperator = map[byte]bool{'I': true, 'D': true, 'N': true, 'H': true, 'P': true, 'X': true, '=': true}
 
 // RemoveNonExactMappingReads is a filter that removes all reads that
@@ -125,19 +162,19 @@ var (
 // XM=0 (no mismatch), XO=0 (no gap opening), XG=0 (no gap extension).
 func RemoveNonExactMappingReadsStrict(header *sam.Header) sam.AlignmentFilter {
 	return func(aln *sam.Alignment) bool {
-		if x0, ok := aln.TAGS.Get(X0); !ok || x0.(int64) != 1 {
+		if x0, ok := aln.TagInt(X0); !ok || x0 != 1 {
 			return false
 		}
-		if x1, ok := aln.TAGS.Get(X1); !ok || x1.(int64) != 0 {
+		if x1, ok := aln.TagInt(X1); !ok || x1 != 0 {
 			return false
 		}
-		if xm, ok := aln.TAGS.Get(XM); !ok || xm.(int64) != 0 {
+		if xm, ok := aln.TagInt(XM); !ok || xm != 0 {
 			return false
 		}
-		if xo, ok := aln.TAGS.Get(XO); !ok || xo.(int64) != 0 {
+		if xo, ok := aln.TagInt(XO); !ok || xo != 0 {
 			return false
 		}
-		if xg, ok := aln.TAGS.Get(XG); !ok || xg.(int64) != 0 {
+		if xg, ok := aln.TagInt(XG); !ok || xg != 0 {
 			return false
 		}
 		return true
@@ -157,11 +194,57 @@ var sr = utils.Intern("sr")
 func RemoveOptionalReads(header *sam.Header) sam.AlignmentFilter {
 	if _, found := header.UserRecords["@sr"]; found {
 		delete(header.UserRecords, "@sr")
-		return func(aln *sam.Alignment) bool { _, found := aln.TAGS.Get(sr); return !found }
+		return func(aln *sam.Alignment) bool { return !aln.HasTag(sr) }
 	}
 	return nil
 }
 
+// SelectReadGroups returns a filter for keeping only the alignments
+// of the given read groups, or, if exclude is true, for removing the
+// alignments of the given read groups. A read group is selected if
+// its ID, SM, or LB value is one of the given values. The @RG lines
+// of the removed read groups are also removed from the Header.
+// Alignments without an RG optional field are removed when keeping
+// read groups, and kept when excluding read groups.
+func SelectReadGroups(values []string, exclude bool) sam.Filter {
+	return func(header *sam.Header) sam.AlignmentFilter {
+		// the given values may also be IDs of read groups without @RG line
+		selected := make(map[string]bool, len(values))
+		for _, value := range values {
+			if value != "" {
+				selected[value] = true
+			}
+		}
+		isSelected := func(rg utils.StringMap, field string) bool {
+			value, found := rg[field]
+			return found && selected[value]
+		}
+		var readGroups, selectedReadGroups []utils.StringMap
+		for _, rg := range header.RG {
+			if isSelected(rg, "ID") || isSelected(rg, "SM") || isSelected(rg, "LB") {
+				selectedReadGroups = append(selectedReadGroups, rg)
+				if exclude {
+					continue
+				}
+			} else if !exclude {
+				continue
+			}
+			readGroups = append(readGroups, rg)
+		}
+		for _, rg := range selectedReadGroups {
+			selected[rg["ID"]] = true
+		}
+		header.RG = readGroups
+		return func(aln *sam.Alignment) bool {
+			rg, ok := aln.RG().(string)
+			if !ok {
+				return exclude
+			}
+			return selected[rg] != exclude
+		}
+	}
+}
+
 // AddOrReplaceReadGroup returns a filter for adding or replacing the
 // read group both in the Header and in each Alignment.
 func AddOrReplaceReadGroup(readGroup utils.StringMap) sam.Filter {
@@ -172,24 +255,40 @@ func AddOrReplaceReadGroup(readGroup utils.StringMap) sam.Filter {
 	}
 }
 
-// AddPGLine returns a filter for adding a @PG tag to a Header, and
-// ensuring that it is the first one in the chain.
+// AddPGLine returns a filter for adding a @PG tag to a Header. If
+// the ID is already used by another @PG line, a numeric suffix is
+// added to make it unique. Unless the @PG tag has an explicit PP, it
+// is chained after the last program of the first chain in the Header.
 func AddPGLine(newPG utils.StringMap) sam.Filter {
 	return func(header *sam.Header) sam.AlignmentFilter {
-		id := newPG["ID"]
-		for utils.Find(header.PG, func(entry utils.StringMap) bool { return entry["ID"] == id }) >= 0 {
-			id += " "
-			id += strconv.FormatInt(rand.Int63n(0x10000), 16)
-		}
-		newPG["ID"] = id
-		for _, PG := range header.PG {
-			nextID := PG["ID"]
-			if pos := utils.Find(header.PG, func(entry utils.StringMap) bool { return entry["PP"] == nextID }); pos < 0 {
-				newPG["PP"] = nextID
-				break
-			}
+		record := make(utils.StringMap, len(newPG))
+		for key, value := range newPG {
+			record[key] = value
+		}
+		record["ID"] = header.UniquePGID(record["ID"])
+		if err := header.AddPG(record); err != nil {
+			log.Fatal(err)
+		}
+		return nil
+	}
+}
+
+// SetQuerynameCollation returns a filter for recording the collation
+// of query template names in a Header, so that sorting by queryname
+// uses it.
+func SetQuerynameCollation(collation sam.QuerynameCollation) sam.Filter {
+	return func(header *sam.Header) sam.AlignmentFilter {
+		header.SetHDQuerynameCollation(collation)
+		return nil
+	}
+}
+
+// AddComment returns a filter for adding a @CO line to a Header.
+func AddComment(comment string) sam.Filter {
+	return func(header *sam.Header) sam.AlignmentFilter {
+		if err := header.AddCO(comment); err != nil {
+			log.Fatal(err)
 		}
-		header.PG = append(header.PG, newPG)
 		return nil
 	}
 }
@@ -245,6 +344,7 @@ func RemoveOptionalFields(tags []string) sam.Filter {
 	}
 	return func(header *sam.Header) sam.AlignmentFilter {
 		return func(aln *sam.Alignment) bool {
+			aln.DecodeTags()
 			aln.TAGS, _ = aln.TAGS.DeleteIf(func(key utils.Symbol, val interface{}) bool {
 				for _, tag := range optionals {
 					if tag == key {
@@ -264,7 +364,7 @@ func KeepOptionalFields(tags []string) sam.Filter {
 	if len(tags) == 0 {
 		return func(header *sam.Header) sam.AlignmentFilter {
 			return func(aln *sam.Alignment) bool {
-				aln.TAGS = nil
+				aln.DeleteAllTags()
 				return true
 			}
 		}
@@ -276,6 +376,7 @@ func KeepOptionalFields(tags []string) sam.Filter {
 	}
 	return func(header *sam.Header) sam.AlignmentFilter {
 		return func(aln *sam.Alignment) bool {
+			aln.DecodeTags()
 			aln.TAGS, _ = aln.TAGS.DeleteIf(func(key utils.Symbol, val interface{}) bool {
 				for _, tag := range optionals {
 					if tag == key {
@@ -307,24 +408,148 @@ func CleanSam(header *sam.Header) sam.AlignmentFilter {
 	}
 }
 
-// RemoveNonOverlappingReads returns a filter for removing all reads
-// that do not overlap with a set of regions specified by a bed file.
-func RemoveNonOverlappingReads(bed *bed.Bed) sam.Filter {
+// Returns the flattened intervals of a bed, per chromosome.
+func flattenedIntervals(bed *bed.Bed) map[string][]intervals.Interval {
 	ivals := intervals.FromBed(bed)
 	for chrom, ival := range ivals {
 		intervals.ParallelSortByStart(ival)
 		ivals[chrom] = intervals.ParallelFlatten(ival)
 	}
+	return ivals
+}
+
+// Renames the chromosomes of the given intervals to the names of the
+// reference sequences of the header, as determined by
+// sam.Header.ContigNames. The intervals of chromosomes that refer to
+// the same reference sequence are combined.
+func resolveContigs(ivals map[string][]intervals.Interval, header *sam.Header, aliases sam.ContigAliases) map[string][]intervals.Interval {
+	names := header.ContigNames(aliases)
+	resolved := make(map[string][]intervals.Interval, len(ivals))
+	combined := make(map[string]bool)
+	for chrom, ival := range ivals {
+		if sn, found := names[chrom]; found {
+			chrom = sn
+		}
+		if _, found := resolved[chrom]; found {
+			combined[chrom] = true
+		}
+		resolved[chrom] = append(resolved[chrom], ival...)
+	}
+	for chrom := range combined {
+		ival := resolved[chrom]
+		intervals.ParallelSortByStart(ival)
+		resolved[chrom] = intervals.ParallelFlatten(ival)
+	}
+	return resolved
+}
+
+// Determines whether a single read overlaps with any of the given
+// intervals.
+func readOverlaps(ivals map[string][]intervals.Interval, aln *sam.Alignment) bool {
+	alnStart := aln.POS
+	alnEnd := aln.POS
+	if !aln.IsUnmapped() {
+		if readLengthFromCigar(aln.CIGAR) > 0 {
+			alnEnd = end(aln, aln.CIGAR)
+		}
+	}
+	return intervals.Overlap(ivals[aln.RNAME], alnStart, alnEnd)
+}
+
+// CheckSequenceDictionary returns a filter that checks that the
+// sequences of a sequence dictionary, for example of an interval
+// list, match the reference sequences of the SAM header, using
+// bed.CompareSequenceDictionaries. Exits the program with an error
+// message if they do not match. The filter does not modify the
+// header, nor remove any reads.
+func CheckSequenceDictionary(dict *sam.Header) sam.Filter {
+	return func(header *sam.Header) sam.AlignmentFilter {
+		if err := bed.CompareSequenceDictionaries(dict, header); err != nil {
+			log.Fatal("Sequence dictionary mismatch: ", err)
+		}
+		return nil
+	}
+}
+
+// ReadOverlapsRegion determines whether the aligned bases of a mapped
+// read overlap with any of the regions of a bed, as indexed by
+// bed.NewRegionIndex. Unlike the overlap checks of
+// RemoveNonOverlappingReads, which use the span of the read from its
+// first to its last aligned base, only the reference blocks between
+// skipped regions (N) of the CIGAR string are considered. A spliced
+// read is therefore not considered to overlap with a region that only
+// lies within one of its introns, which is more precise for RNA-seq
+// data. Unmapped reads never overlap.
+func ReadOverlapsRegion(aln *sam.Alignment, regions *bed.RegionIndex) bool {
+	if aln.IsUnmapped() {
+		return false
+	}
+	chrom := utils.Intern(aln.RNAME)
+	starts, ends := alignedBlocks(aln)
+	for i, start := range starts {
+		if regions.Overlaps(chrom, start, ends[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveNonOverlappingReads returns a filter for removing all reads
+// that do not overlap with a set of regions specified by a bed file.
+func RemoveNonOverlappingReads(bed *bed.Bed) sam.Filter {
+	return RemoveNonOverlappingReadsWithAliases(bed, nil)
+}
+
+// RemoveNonOverlappingReadsWithAliases is like
+// RemoveNonOverlappingReads, except that the chromosomes of the
+// regions may also be given by the alternative names of the reference
+// sequences, as determined by sam.Header.ContigNames with the given
+// aliases.
+func RemoveNonOverlappingReadsWithAliases(bed *bed.Bed, aliases sam.ContigAliases) sam.Filter {
+	ivals := flattenedIntervals(bed)
+	return func(header *sam.Header) sam.AlignmentFilter {
+		ivals := resolveContigs(ivals, header, aliases)
+		return func(aln *sam.Alignment) bool {
+			return readOverlaps(ivals, aln)
+		}
+	}
+}
+
+// RemoveNonOverlappingFragments returns a filter for removing all
+// reads whose fragments do not overlap with a set of regions
+// specified by a bed file. For read pairs where both mates map as a
+// proper pair on the same chromosome, the fragment spans from the
+// leftmost mate start to the rightmost mate end, as determined by
+// POS, PNEXT, and TLEN. Both mates of such a pair are therefore
+// either kept or removed together, even if only one of them, or
+// only the insert between them, overlaps with a region. Single-end
+// reads and other pairs are treated as in RemoveNonOverlappingReads.
+func RemoveNonOverlappingFragments(bed *bed.Bed) sam.Filter {
+	return RemoveNonOverlappingFragmentsWithAliases(bed, nil)
+}
+
+// RemoveNonOverlappingFragmentsWithAliases is like
+// RemoveNonOverlappingFragments, except that the chromosomes of the
+// regions are resolved as in RemoveNonOverlappingReadsWithAliases.
+func RemoveNonOverlappingFragmentsWithAliases(bed *bed.Bed, aliases sam.ContigAliases) sam.Filter {
+	ivals := flattenedIntervals(bed)
 	return func(header *sam.Header) sam.AlignmentFilter {
+		ivals := resolveContigs(ivals, header, aliases)
 		return func(aln *sam.Alignment) bool {
-			alnStart := aln.POS
-			alnEnd := aln.POS
-			if !aln.IsUnmapped() {
-				if readLengthFromCigar(aln.CIGAR) > 0 {
-					alnEnd = end(aln, aln.CIGAR)
+			if aln.IsMultiple() && aln.IsProper() &&
+				!aln.IsUnmapped() && !aln.IsNextUnmapped() &&
+				(aln.RNEXT == "=" || aln.RNEXT == aln.RNAME) && aln.TLEN != 0 {
+				fragmentStart := aln.POS
+				if aln.PNEXT < fragmentStart {
+					fragmentStart = aln.PNEXT
 				}
+				fragmentLength := aln.TLEN
+				if fragmentLength < 0 {
+					fragmentLength = -fragmentLength
+				}
+				return intervals.Overlap(ivals[aln.RNAME], fragmentStart, fragmentStart+fragmentLength-1)
 			}
-			return intervals.Overlap(ivals[aln.RNAME], alnStart, alnEnd)
+			return readOverlaps(ivals, aln)
 		}
 	}
 }
@@ -347,3 +572,114 @@ func RemoveMappingQualityLessThan(mq int) sam.Filter {
 		return func(aln *sam.Alignment) bool { return aln.MAPQ >= mapq }
 	}
 }
+
+// Returns the number of bases of a read that are aligned to the
+// reference, not counting clipped or inserted bases.
+func alignedLength(aln *sam.Alignment) int {
+	var length int32
+	for _, op := range aln.CIGAR {
+		length += cigarConsumesReadBases[op.Operation] * cigarConsumesReferenceBases[op.Operation] * op.Length
+	}
+	return int(length)
+}
+
+// RemoveReadsOutsideLengthRange returns a filter for removing reads
+// with a length below minLength or above maxLength. A negative
+// maxLength means there is no maximum. If aligned is true, the length
+// of a read is the number of its bases that are aligned to the
+// reference. Otherwise, it is the length of its segment sequence, or
+// the length derived from its CIGAR string if the segment sequence is
+// not stored.
+func RemoveReadsOutsideLengthRange(minLength, maxLength int, aligned bool) sam.Filter {
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		return func(aln *sam.Alignment) bool {
+			var length int
+			switch {
+			case aligned:
+				length = alignedLength(aln)
+			case aln.HasSeq():
+				length = aln.SEQ.Len()
+			default:
+				length = int(readLengthFromCigar(aln.CIGAR))
+			}
+			return length >= minLength && (maxLength < 0 || length <= maxLength)
+		}
+	}
+}
+
+// ReassignMappingQuality returns a filter that replaces the mapping
+// quality from by the mapping quality to, like the
+// ReassignOneMappingQuality read filter of GATK. For example, it can
+// replace the mapping quality 255 that STAR uses for uniquely mapped
+// reads by 60.
+func ReassignMappingQuality(from, to byte) sam.Filter {
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		return func(aln *sam.Alignment) bool {
+			if aln.MAPQ == from {
+				aln.MAPQ = to
+			}
+			return true
+		}
+	}
+}
+
+// CapMappingQuality returns a filter that lowers mapping qualities
+// above maxMAPQ to maxMAPQ. The mapping quality 255, which means that
+// the mapping quality is not available, is left unchanged.
+func CapMappingQuality(maxMAPQ byte) sam.Filter {
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		return func(aln *sam.Alignment) bool {
+			if aln.MAPQ > maxMAPQ && aln.MAPQ != 255 {
+				aln.MAPQ = maxMAPQ
+			}
+			return true
+		}
+	}
+}
+
+// FloorMappingQuality returns a filter that raises the mapping
+// qualities of mapped reads below minMAPQ to minMAPQ.
+func FloorMappingQuality(minMAPQ byte) sam.Filter {
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		return func(aln *sam.Alignment) bool {
+			if aln.MAPQ < minMAPQ && !aln.IsUnmapped() {
+				aln.MAPQ = minMAPQ
+			}
+			return true
+		}
+	}
+}
+
+// ValidateAlignments returns a filter that checks the alignments with
+// a sam.Validator. With sam.StrictValidation, it exits the program
+// with an error message at the first invalid alignment. With
+// sam.LenientValidation, it repairs invalid alignments where
+// possible, removes the others, and counts the problems in the given
+// report.
+func ValidateAlignments(stringency sam.ValidationStringency, report *sam.ValidationReport) sam.Filter {
+	if stringency == sam.NoValidation {
+		return nil
+	}
+	return func(header *sam.Header) sam.AlignmentFilter {
+		validator := sam.NewValidator(header)
+		return func(aln *sam.Alignment) bool {
+			errs := validator.Validate(aln)
+			if len(errs) == 0 {
+				return true
+			}
+			if stringency == sam.StrictValidation {
+				log.Fatal("Invalid alignment: ", errs[0])
+			}
+			for _, err := range errs {
+				if !sam.Repair(aln, err.Issue) {
+					report.Count(err.Issue, false)
+					return false
+				}
+			}
+			for _, err := range errs {
+				report.Count(err.Issue, true)
+			}
+			return true
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestSecondaryAlignments(t *testing.T) {
+	primary := &sam.Alignment{QNAME: "r1", FLAG: sam.Multiple | sam.First}
+	secondary := &sam.Alignment{QNAME: "r1", FLAG: sam.Multiple | sam.First | sam.Secondary}
+	supplementary := &sam.Alignment{QNAME: "r1", FLAG: sam.Multiple | sam.First | sam.Supplementary}
+	header := sam.NewHeader()
+	remove := RemoveSecondaryAlignments(header)
+	if !remove(primary) || remove(secondary) || !remove(supplementary) {
+		t.Error("RemoveSecondaryAlignments failed")
+	}
+	keep := KeepOnlySecondaryAlignments(header)
+	if keep(primary) || !keep(secondary) || keep(supplementary) {
+		t.Error("KeepOnlySecondaryAlignments failed")
+	}
+}
+
+func TestRemoveSupplementaryAlignments(t *testing.T) {
+	primary := &sam.Alignment{QNAME: "r1", FLAG: sam.Multiple | sam.First}
+	if err := primary.SetTag(SA, "chr2,100,+,50M50S,60,0;"); err != nil {
+		t.Fatal(err)
+	}
+	supplementary := &sam.Alignment{QNAME: "r1", FLAG: sam.Multiple | sam.First | sam.Supplementary}
+	filter := RemoveSupplementaryAlignments(false)(sam.NewHeader())
+	if !filter(primary) || filter(supplementary) {
+		t.Error("RemoveSupplementaryAlignments failed")
+	}
+	if !primary.HasTag(SA) {
+		t.Error("RemoveSupplementaryAlignments removed SA tag")
+	}
+	filter = RemoveSupplementaryAlignments(true)(sam.NewHeader())
+	if !filter(primary) || filter(supplementary) {
+		t.Error("RemoveSupplementaryAlignments with stripped SA tags failed")
+	}
+	if primary.HasTag(SA) {
+		t.Error("RemoveSupplementaryAlignments did not remove SA tag")
+	}
+}
+
+func TestRemoveNonOverlappingFragments(t *testing.T) {
+	regions := bed.NewBed()
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 200, End: 300})
+	header := sam.NewHeader()
+	header.SQ = []utils.StringMap{{"SN": "chr1", "LN": "1000"}}
+	cigar, err := sam.ScanCigarString("50M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPair := func(flag uint16) []*sam.Alignment {
+		return []*sam.Alignment{
+			{QNAME: "r1", FLAG: flag | sam.First | sam.NextReversed, RNAME: "chr1", POS: 100, CIGAR: cigar, RNEXT: "=", PNEXT: 351, TLEN: 301},
+			{QNAME: "r1", FLAG: flag | sam.Last | sam.Reversed, RNAME: "chr1", POS: 351, CIGAR: cigar, RNEXT: "=", PNEXT: 100, TLEN: -301},
+		}
+	}
+	reads := RemoveNonOverlappingReads(regions)(header)
+	fragments := RemoveNonOverlappingFragments(regions)(header)
+	for _, aln := range newPair(sam.Multiple | sam.Proper) {
+		if reads(aln) {
+			t.Error("RemoveNonOverlappingReads with insert overlap failed", aln.POS)
+		}
+		if !fragments(aln) {
+			t.Error("RemoveNonOverlappingFragments with insert overlap failed", aln.POS)
+		}
+	}
+	for _, aln := range newPair(sam.Multiple) {
+		if fragments(aln) {
+			t.Error("RemoveNonOverlappingFragments with improper pair failed", aln.POS)
+		}
+	}
+}
+
+func TestNonOverlappingContigAliases(t *testing.T) {
+	regions := bed.NewBed()
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("1"), Start: 200, End: 300})
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("NC_000001.11"), Start: 250, End: 400})
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 600, End: 700})
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("2"), Start: 100, End: 200})
+	header := sam.NewHeader()
+	header.SQ = []utils.StringMap{{"SN": "chr1", "LN": "1000", "AN": "1,NC_000001.11"}, {"SN": "chr2", "LN": "1000"}}
+	aliases := sam.ContigAliases{{"chr2", "2"}}
+	cigar, err := sam.ScanCigarString("50M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlapping := []*sam.Alignment{
+		{QNAME: "r1", RNAME: "chr1", POS: 221, CIGAR: cigar},
+		{QNAME: "r2", RNAME: "chr1", POS: 351, CIGAR: cigar},
+		{QNAME: "r3", RNAME: "chr1", POS: 651, CIGAR: cigar},
+		{QNAME: "r4", RNAME: "chr2", POS: 121, CIGAR: cigar},
+	}
+	nonOverlapping := []*sam.Alignment{
+		{QNAME: "r5", RNAME: "chr1", POS: 451, CIGAR: cigar},
+		{QNAME: "r6", RNAME: "chr2", POS: 251, CIGAR: cigar},
+	}
+	for _, filter := range []sam.Filter{RemoveNonOverlappingReadsWithAliases(regions, aliases), RemoveNonOverlappingFragmentsWithAliases(regions, aliases)} {
+		alnFilter := filter(header)
+		for _, aln := range overlapping {
+			if !alnFilter(aln) {
+				t.Error("Non-overlapping filter with contig aliases removed", aln.QNAME)
+			}
+		}
+		for _, aln := range nonOverlapping {
+			if alnFilter(aln) {
+				t.Error("Non-overlapping filter with contig aliases kept", aln.QNAME)
+			}
+		}
+	}
+	if RemoveNonOverlappingReads(regions)(header)(overlapping[3]) {
+		t.Error("RemoveNonOverlappingReads without contig aliases failed")
+	}
+	first := &sam.Alignment{QNAME: "r7", FLAG: sam.Multiple | sam.Proper | sam.First | sam.NextReversed,
+		RNAME: "chr1", POS: 101, CIGAR: cigar, RNEXT: "=", PNEXT: 451, TLEN: 400}
+	if RemoveNonOverlappingReadsWithAliases(regions, aliases)(header)(first) || !RemoveNonOverlappingFragmentsWithAliases(regions, aliases)(header)(first) {
+		t.Error("RemoveNonOverlappingFragmentsWithAliases failed")
+	}
+}
+
+func TestMappingQualityReassignment(t *testing.T) {
+	header := sam.NewHeader()
+	reassign := ReassignMappingQuality(255, 60)(header)
+	capMQ := CapMappingQuality(50)(header)
+	floorMQ := FloorMappingQuality(10)(header)
+	alns := []*sam.Alignment{{MAPQ: 255}, {MAPQ: 55}, {MAPQ: 3}, {MAPQ: 0, FLAG: sam.Unmapped}}
+	for _, aln := range alns {
+		reassign(aln)
+		capMQ(aln)
+		floorMQ(aln)
+	}
+	if alns[0].MAPQ != 50 || alns[1].MAPQ != 50 || alns[2].MAPQ != 10 || alns[3].MAPQ != 0 {
+		t.Error("mapping quality reassignment failed", alns[0].MAPQ, alns[1].MAPQ, alns[2].MAPQ, alns[3].MAPQ)
+	}
+	aln := &sam.Alignment{MAPQ: 255}
+	capMQ(aln)
+	if aln.MAPQ != 255 {
+		t.Error("CapMappingQuality changed unavailable mapping quality")
+	}
+}
+
+func TestRemoveReadsOutsideLengthRange(t *testing.T) {
+	cigar, err := sam.ScanCigarString("5S20M2I10M3H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aln := &sam.Alignment{CIGAR: cigar}
+	header := sam.NewHeader()
+	if !RemoveReadsOutsideLengthRange(37, 37, false)(header)(aln) || RemoveReadsOutsideLengthRange(38, -1, false)(header)(aln) {
+		t.Error("RemoveReadsOutsideLengthRange with query length failed")
+	}
+	if !RemoveReadsOutsideLengthRange(30, 30, true)(header)(aln) || RemoveReadsOutsideLengthRange(0, 29, true)(header)(aln) {
+		t.Error("RemoveReadsOutsideLengthRange with aligned length failed")
+	}
+
+	name := filepath.Join(t.TempDir(), "test.sam")
+	samData := "@HD\tVN:1.6\n@SQ\tSN:chr1\tLN:1000\n" +
+		"r1\t0\tchr1\t100\t60\t5S20M\t*\t0\t0\t*\t*\n" +
+		"r2\t0\tchr1\t100\t60\t1M\t*\t0\t0\tN\t#\n"
+	if err := ioutil.WriteFile(name, []byte(samData), 0666); err != nil {
+		t.Fatal(err)
+	}
+	input, err := sam.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := input.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	it, err := input.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSeq, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !RemoveReadsOutsideLengthRange(25, 25, false)(it.Header())(noSeq) {
+		t.Error("RemoveReadsOutsideLengthRange with missing SEQ failed")
+	}
+	singleBase, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !RemoveReadsOutsideLengthRange(1, 1, false)(it.Header())(singleBase) {
+		t.Error("RemoveReadsOutsideLengthRange with single base SEQ failed")
+	}
+}
+
+func TestSelectReadGroups(t *testing.T) {
+	newHeader := func() *sam.Header {
+		header := sam.NewHeader()
+		header.RG = []utils.StringMap{
+			{"ID": "rg1", "SM": "sample1", "LB": "lib1"},
+			{"ID": "rg2", "SM": "sample2", "LB": "lib2"},
+			{"ID": "rg3", "SM": "sample1", "LB": "lib3"},
+		}
+		return header
+	}
+	newAlignment := func(rg string) *sam.Alignment {
+		aln := &sam.Alignment{QNAME: "r1"}
+		if rg != "" {
+			aln.SetRG(rg)
+		}
+		return aln
+	}
+	header := newHeader()
+	filter := SelectReadGroups([]string{"sample1"}, false)(header)
+	if len(header.RG) != 2 || header.RG[0]["ID"] != "rg1" || header.RG[1]["ID"] != "rg3" {
+		t.Error("SelectReadGroups header failed", header.RG)
+	}
+	if !filter(newAlignment("rg1")) || filter(newAlignment("rg2")) || !filter(newAlignment("rg3")) || filter(newAlignment("")) {
+		t.Error("SelectReadGroups failed")
+	}
+	header = newHeader()
+	filter = SelectReadGroups([]string{"rg2", "lib3"}, true)(header)
+	if len(header.RG) != 1 || header.RG[0]["ID"] != "rg1" {
+		t.Error("SelectReadGroups with exclude header failed", header.RG)
+	}
+	if !filter(newAlignment("rg1")) || filter(newAlignment("rg2")) || filter(newAlignment("rg3")) || !filter(newAlignment("")) {
+		t.Error("SelectReadGroups with exclude failed")
+	}
+	header = newHeader()
+	header.RG = append(header.RG, utils.StringMap{"ID": "rg4"})
+	filter = SelectReadGroups([]string{"rg2", ""}, false)(header)
+	if len(header.RG) != 1 || header.RG[0]["ID"] != "rg2" {
+		t.Error("SelectReadGroups with empty value header failed", header.RG)
+	}
+	if filter(newAlignment("rg4")) || !filter(newAlignment("rg2")) {
+		t.Error("SelectReadGroups with empty value failed")
+	}
+}
@@ -0,0 +1,83 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"fmt"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+)
+
+// SliceByRegions copies the alignments of a coordinate-sorted, indexed
+// BAM file that overlap with the regions of a bed to an output file.
+// Only the parts of the input that the index refers to for the regions
+// are read, which is much faster than a full scan when the regions
+// cover a small part of the genome, as for targeted sequencing panels.
+// Overlapping and adjacent regions are merged first, and each
+// alignment is written only once, even if it overlaps with several
+// regions. The format of the output is determined by its filename
+// extension, as for sam.Create.
+//
+// Returns an error if the bed has no regions, if the input is not a
+// BAM file with a BAI or CSI index, or if it is not sorted by
+// coordinate.
+func SliceByRegions(input string, regions *bed.Bed, output string) (err error) {
+	var loci []sam.Locus
+	for stream := bed.Stream(bed.Merge(regions)); ; {
+		region := stream.Next()
+		if region == nil {
+			break
+		}
+		loci = append(loci, sam.Locus{RNAME: *region.Chrom, Start: region.Start, End: region.End})
+	}
+	if len(loci) == 0 {
+		return fmt.Errorf("no regions for slicing %v", input)
+	}
+	if sam.IsHtsgetURL(input) {
+		return fmt.Errorf("%v is not a local BAM file, and cannot be sliced by regions", input)
+	}
+	in, err := sam.OpenRegions(input, loci)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := in.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	header, err := in.ParseHeader()
+	if err != nil {
+		return err
+	}
+	if header.HDSO() != sam.Coordinate {
+		return fmt.Errorf("%v is not sorted by coordinate, and cannot be sliced by regions", input)
+	}
+	in.CheckSortingOrder(sam.EnforceSortingOrder)
+	out, err := sam.Create(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := out.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	return in.RunPipeline(out, nil, sam.Keep)
+}
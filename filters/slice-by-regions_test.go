@@ -0,0 +1,116 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// Writes the alignments to a SAM file, and converts it to a BAM file
+// with a BAI index. The alignments must be in coordinate order, but
+// the header may claim a different sorting order.
+func writeIndexedBam(t *testing.T, dir string, sortingOrder sam.SortingOrder, lines []string) string {
+	samName := filepath.Join(dir, "test.sam")
+	header := "@HD\tVN:1.6\tSO:" + string(sortingOrder) + "\n@SQ\tSN:chr1\tLN:100000\n@SQ\tSN:chr2\tLN:100000\n"
+	if err := ioutil.WriteFile(samName, []byte(header+strings.Join(lines, "\n")+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	in, err := sam.Open(samName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	bamName := filepath.Join(dir, "test.bam")
+	out, err := sam.CreateIndexed(bamName, sam.DefaultFormat, sam.BAIIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := in.RunPipeline(out, nil, sam.Keep); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bamName
+}
+
+// Returns the read names in a SAM file.
+func readNames(t *testing.T, name string) (qnames []string) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line != "" && !strings.HasPrefix(line, "@") {
+			qnames = append(qnames, strings.SplitN(line, "\t", 2)[0])
+		}
+	}
+	return qnames
+}
+
+func TestSliceByRegions(t *testing.T) {
+	lines := []string{
+		"r1\t0\tchr1\t101\t60\t50M\t*\t0\t0\t*\t*",
+		"r2\t0\tchr1\t1001\t60\t50M\t*\t0\t0\t*\t*",
+		"r3\t0\tchr1\t1091\t60\t50M\t*\t0\t0\t*\t*",
+		"r4\t0\tchr1\t5001\t60\t50M\t*\t0\t0\t*\t*",
+		"r5\t0\tchr2\t1001\t60\t50M\t*\t0\t0\t*\t*",
+		"u1\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*",
+	}
+	dir := t.TempDir()
+	input := writeIndexedBam(t, dir, sam.Coordinate, lines)
+	regions := bed.NewBed()
+	// r2 overlaps with both regions, which are adjacent, and r3 with the second one.
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 1000, End: 1040})
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 1040, End: 1100})
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr2"), Start: 0, End: 1000})
+	output := filepath.Join(dir, "slice.sam")
+	if err := SliceByRegions(input, regions, output); err != nil {
+		t.Fatal(err)
+	}
+	if qnames := readNames(t, output); len(qnames) != 2 || qnames[0] != "r2" || qnames[1] != "r3" {
+		t.Error("SliceByRegions failed", qnames)
+	}
+	if err := SliceByRegions(input, bed.NewBed(), output); err == nil {
+		t.Error("SliceByRegions without regions failed")
+	}
+	if err := SliceByRegions(filepath.Join(dir, "test.sam"), regions, output); err == nil {
+		t.Error("SliceByRegions of a SAM file failed")
+	}
+	if err := os.Remove(input + ".bai"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SliceByRegions(input, regions, output); err == nil {
+		t.Error("SliceByRegions without an index failed")
+	}
+	unsorted := writeIndexedBam(t, t.TempDir(), sam.Unsorted, lines)
+	if err := SliceByRegions(unsorted, regions, output); err == nil {
+		t.Error("SliceByRegions of an unsorted file failed")
+	}
+}
@@ -0,0 +1,96 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"sync/atomic"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// RegionStrandCounts counts the reads on the forward and reverse
+// strand that overlap with a region.
+type RegionStrandCounts struct {
+	Region           *bed.Region
+	Forward, Reverse int64
+}
+
+// Bias returns |Forward - Reverse| / (Forward + Reverse), which is 0
+// if reads are evenly distributed over both strands, and 1 if all
+// reads are on the same strand. Returns 0 if there are no reads.
+func (counts *RegionStrandCounts) Bias() float64 {
+	total := counts.Forward + counts.Reverse
+	if total == 0 {
+		return 0
+	}
+	diff := counts.Forward - counts.Reverse
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) / float64(total)
+}
+
+// StrandBias returns a filter for counting, per region of a bed, the
+// reads on the forward and reverse strand that overlap with the
+// region. Unmapped, secondary, supplementary, and duplicate reads are
+// not counted, nor are reads with a mapping quality below minMAPQ. A
+// read that overlaps with several regions is counted for each of
+// them. The filter does not remove any reads.
+//
+// The counts are returned as well, ordered by chromosome name and
+// start position, and are complete once all reads have been
+// filtered. To take duplicate marking into account, the filter must
+// be applied after duplicates are marked.
+func StrandBias(regions *bed.Bed, minMAPQ byte) (sam.Filter, []*RegionStrandCounts) {
+	var all []*RegionStrandCounts
+	countMap := make(map[*bed.Region]*RegionStrandCounts)
+	for stream := bed.Stream(regions); ; {
+		region := stream.Next()
+		if region == nil {
+			break
+		}
+		counts := &RegionStrandCounts{Region: region}
+		all = append(all, counts)
+		countMap[region] = counts
+	}
+	index := bed.NewRegionIndex(regions)
+	return func(_ *sam.Header) sam.AlignmentFilter {
+		return func(aln *sam.Alignment) bool {
+			if aln.IsUnmapped() || aln.IsSecondary() || aln.IsSupplementary() || aln.IsDuplicate() || aln.MAPQ < minMAPQ {
+				return true
+			}
+			start := aln.POS - 1
+			stop := start + 1
+			if readLengthFromCigar(aln.CIGAR) > 0 {
+				stop = end(aln, aln.CIGAR)
+			}
+			reversed := aln.IsReversed()
+			for _, region := range index.OverlapQuery(utils.Intern(aln.RNAME), start, stop) {
+				if reversed {
+					atomic.AddInt64(&countMap[region].Reverse, 1)
+				} else {
+					atomic.AddInt64(&countMap[region].Forward, 1)
+				}
+			}
+			return true
+		}
+	}, all
+}
@@ -0,0 +1,65 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package filters
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/bed"
+	"github.com/exascience/elprep/v4/sam"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestStrandBias(t *testing.T) {
+	regions := bed.NewBed()
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 300, End: 400})
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr1"), Start: 100, End: 200})
+	bed.AddRegion(regions, &bed.Region{Chrom: utils.Intern("chr2"), Start: 0, End: 100})
+	filter, counts := StrandBias(regions, 10)
+	cigar, err := sam.ScanCigarString("50M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alns := []*sam.Alignment{
+		{RNAME: "chr1", POS: 171, MAPQ: 60, CIGAR: cigar},
+		{RNAME: "chr1", POS: 381, MAPQ: 60, CIGAR: cigar},
+		{RNAME: "chr1", POS: 291, MAPQ: 60, CIGAR: cigar, FLAG: sam.Reversed},
+		{RNAME: "chr1", POS: 351, MAPQ: 60, CIGAR: cigar, FLAG: sam.Reversed},
+		{RNAME: "chr1", POS: 351, MAPQ: 5, CIGAR: cigar},
+		{RNAME: "chr1", POS: 351, MAPQ: 60, CIGAR: cigar, FLAG: sam.Duplicate},
+		{RNAME: "chr1", POS: 351, MAPQ: 60, CIGAR: cigar, FLAG: sam.Secondary},
+		{RNAME: "chr1", POS: 351, MAPQ: 60, CIGAR: cigar, FLAG: sam.Unmapped},
+		{RNAME: "chr3", POS: 1, MAPQ: 60, CIGAR: cigar},
+	}
+	alnFilter := filter(nil)
+	for _, aln := range alns {
+		if !alnFilter(aln) {
+			t.Error("StrandBias removed a read")
+		}
+	}
+	if len(counts) != 3 ||
+		counts[0].Region.Start != 100 || counts[0].Forward != 1 || counts[0].Reverse != 0 ||
+		counts[1].Region.Start != 300 || counts[1].Forward != 1 || counts[1].Reverse != 2 ||
+		counts[2].Forward != 0 || counts[2].Reverse != 0 {
+		t.Fatal("StrandBias failed")
+	}
+	if counts[0].Bias() != 1 || counts[1].Bias() != 1.0/3 || counts[2].Bias() != 0 {
+		t.Error("StrandBias Bias failed")
+	}
+}
@@ -1,8 +1,15 @@
 module github.com/exascience/elprep/v4
 
+go 1.27.1
+
 require (
 	github.com/exascience/pargo v1.0.0
 	golang.org/x/sys v0.0.0-20181011152604-fa43e7bc11ba
+)
+
+require (
+	golang.org/x/exp v0.0.0-20180321215751-8460e604b9de // indirect
+	golang.org/x/tools v0.0.0-20180525024113-a5b4c53f6e8b // indirect
 	gonum.org/v1/gonum v0.0.0-20181017130424-4c3d8206805c // indirect
 	gonum.org/v1/netlib v0.0.0-20181018051557-57e1e4db57a7 // indirect
 )
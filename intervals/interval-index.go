@@ -0,0 +1,259 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package intervals
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// IndexMagic is the magic byte sequence that every interval index
+// file starts with.
+var IndexMagic = []byte{0x31, 0x1D, 0xE7, 0x1D} // 311DE71D => ELINDEX
+
+// IndexVersion is the version of the interval index file format
+// written by WriteIndex.
+const IndexVersion = 1
+
+/*
+The interval index file format consists of:
+
+  magic      4 bytes
+  version    uint32
+  nContigs   uint32
+  nContigs contig entries:
+    nameLen  uint32
+    name     nameLen bytes
+    offset   uint64, file offset of the first interval entry
+    count    uint64, number of interval entries
+  interval entries, each consisting of three int32 values:
+    start, end, and the maximum end of this and all previous entries
+    of the same contig
+
+All numbers are little endian. The interval entries of a contig are
+sorted by start position, and the maximum end positions allow queries
+to determine where overlapping intervals can occur without examining
+earlier entries.
+*/
+
+const indexEntrySize = 12
+
+// WriteIndex stores intervals in an elPrep-defined interval index
+// file that can be memory-mapped with OpenIndexMmap.
+func WriteIndex(intervals map[string][]Interval, filename string) (err error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	contigs := make([]string, 0, len(intervals))
+	for contig := range intervals {
+		contigs = append(contigs, contig)
+	}
+	sort.Strings(contigs)
+	offset := uint64(len(IndexMagic) + 8)
+	for _, contig := range contigs {
+		offset += uint64(4 + len(contig) + 16)
+	}
+	out := bufio.NewWriter(file)
+	var buf [indexEntrySize]byte
+	if _, err = out.Write(IndexMagic); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(buf[0:], IndexVersion)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(contigs)))
+	if _, err = out.Write(buf[:8]); err != nil {
+		return err
+	}
+	for _, contig := range contigs {
+		binary.LittleEndian.PutUint32(buf[:], uint32(len(contig)))
+		if _, err = out.Write(buf[:4]); err != nil {
+			return err
+		}
+		if _, err = out.WriteString(contig); err != nil {
+			return err
+		}
+		count := uint64(len(intervals[contig]))
+		binary.LittleEndian.PutUint64(buf[:], offset)
+		if _, err = out.Write(buf[:8]); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(buf[:], count)
+		if _, err = out.Write(buf[:8]); err != nil {
+			return err
+		}
+		offset += count * indexEntrySize
+	}
+	for _, contig := range contigs {
+		ivals := append([]Interval(nil), intervals[contig]...)
+		SortByStart(ivals)
+		var maxEnd int32
+		for i, interval := range ivals {
+			if i == 0 || interval.End > maxEnd {
+				maxEnd = interval.End
+			}
+			binary.LittleEndian.PutUint32(buf[0:], uint32(interval.Start))
+			binary.LittleEndian.PutUint32(buf[4:], uint32(interval.End))
+			binary.LittleEndian.PutUint32(buf[8:], uint32(maxEnd))
+			if _, err = out.Write(buf[:]); err != nil {
+				return err
+			}
+		}
+	}
+	return out.Flush()
+}
+
+// MappedIndex represents the contents of a memory-mapped interval
+// index file. Queries are answered directly from the mapped file
+// contents.
+type MappedIndex struct {
+	contigs map[string][]byte
+	data    []byte
+	file    *os.File
+}
+
+// OpenIndexMmap opens and memory-maps an interval index file, and
+// validates its structure.
+func OpenIndexMmap(filename string) (*MappedIndex, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	size := int(stat.Size())
+	if size < len(IndexMagic)+8 {
+		_ = file.Close()
+		return nil, fmt.Errorf("%v is not an interval index file - file too short", filename)
+	}
+	data, err := unix.Mmap(int(file.Fd()), 0, size, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	fail := func(format string, args ...interface{}) (*MappedIndex, error) {
+		_ = unix.Munmap(data)
+		_ = file.Close()
+		return nil, fmt.Errorf(format, args...)
+	}
+	for i, b := range IndexMagic {
+		if data[i] != b {
+			return fail("%v is not an interval index file - invalid magic byte sequence", filename)
+		}
+	}
+	index := len(IndexMagic)
+	if version := binary.LittleEndian.Uint32(data[index:]); version != IndexVersion {
+		return fail("unsupported interval index file version %v in %v", version, filename)
+	}
+	nContigs := int(binary.LittleEndian.Uint32(data[index+4:]))
+	index += 8
+	contigs := make(map[string][]byte, nContigs)
+	for i := 0; i < nContigs; i++ {
+		if index+4 > size {
+			return fail("truncated contig table in interval index file %v", filename)
+		}
+		nameLen := int(binary.LittleEndian.Uint32(data[index:]))
+		index += 4
+		if index+nameLen+16 > size {
+			return fail("truncated contig table in interval index file %v", filename)
+		}
+		contig := string(data[index : index+nameLen])
+		index += nameLen
+		offset := binary.LittleEndian.Uint64(data[index:])
+		count := binary.LittleEndian.Uint64(data[index+8:])
+		index += 16
+		if offset > uint64(size) || count > (uint64(size)-offset)/indexEntrySize {
+			return fail("invalid entries for contig %v in interval index file %v", contig, filename)
+		}
+		contigs[contig] = data[offset : offset+count*indexEntrySize]
+	}
+	return &MappedIndex{contigs: contigs, data: data, file: file}, nil
+}
+
+// Close closes a memory-mapped interval index file.
+func (index *MappedIndex) Close() (err error) {
+	err = unix.Munmap(index.data)
+	index.data = nil
+	if nerr := index.file.Close(); err == nil {
+		err = nerr
+	}
+	index.file = nil
+	index.contigs = nil
+	return err
+}
+
+func indexEntry(entries []byte, i int) (start, end, maxEnd int32) {
+	entry := entries[i*indexEntrySize : (i+1)*indexEntrySize]
+	return int32(binary.LittleEndian.Uint32(entry[0:])),
+		int32(binary.LittleEndian.Uint32(entry[4:])),
+		int32(binary.LittleEndian.Uint32(entry[8:]))
+}
+
+// Returns the range of entries that may overlap with the given
+// start/end range.
+func indexCandidates(entries []byte, start, end int32) (lo, hi int) {
+	n := len(entries) / indexEntrySize
+	hi = sort.Search(n, func(i int) bool {
+		intervalStart, _, _ := indexEntry(entries, i)
+		return intervalStart >= end
+	})
+	lo = sort.Search(hi, func(i int) bool {
+		_, _, maxEnd := indexEntry(entries, i)
+		return maxEnd > start
+	})
+	return lo, hi
+}
+
+// Overlap determines whether the given start/end range on the given
+// contig overlaps with any of the indexed intervals.
+func (index *MappedIndex) Overlap(contig string, start, end int32) bool {
+	entries := index.contigs[contig]
+	lo, hi := indexCandidates(entries, start, end)
+	for i := lo; i < hi; i++ {
+		if _, intervalEnd, _ := indexEntry(entries, i); intervalEnd > start {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect returns all indexed intervals on the given contig that
+// overlap with the given start/end range, sorted by Start.
+func (index *MappedIndex) Intersect(contig string, start, end int32) (result []Interval) {
+	entries := index.contigs[contig]
+	lo, hi := indexCandidates(entries, start, end)
+	for i := lo; i < hi; i++ {
+		if intervalStart, intervalEnd, _ := indexEntry(entries, i); intervalEnd > start {
+			result = append(result, Interval{Start: intervalStart, End: intervalEnd})
+		}
+	}
+	return result
+}
@@ -19,7 +19,10 @@
 package intervals
 
 import (
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -211,3 +214,45 @@ func TestIntersect(t *testing.T) {
 		t.Error("Intersect 11 failed")
 	}
 }
+
+func TestMappedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elprep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.elindex")
+	err = WriteIndex(map[string][]Interval{
+		"chr1": {{50, 60}, {0, 100}, {200, 300}, {210, 220}},
+		"chr2": {},
+	}, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := OpenIndexMmap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if !index.Overlap("chr1", 70, 80) {
+		t.Error("MappedIndex Overlap 1 failed")
+	}
+	if index.Overlap("chr1", 100, 200) {
+		t.Error("MappedIndex Overlap 2 failed")
+	}
+	if index.Overlap("chr2", 0, 1000) || index.Overlap("chr3", 0, 1000) {
+		t.Error("MappedIndex Overlap 3 failed")
+	}
+	if !intervalsEqual(index.Intersect("chr1", 55, 215), []Interval{{0, 100}, {50, 60}, {200, 300}, {210, 220}}) {
+		t.Error("MappedIndex Intersect 1 failed")
+	}
+	if !intervalsEqual(index.Intersect("chr1", 60, 205), []Interval{{0, 100}, {200, 300}}) {
+		t.Error("MappedIndex Intersect 2 failed")
+	}
+	if err := ioutil.WriteFile(filename, []byte("not an index file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenIndexMmap(filename); err == nil {
+		t.Error("OpenIndexMmap validation failed")
+	}
+}
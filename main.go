@@ -34,21 +34,27 @@ import (
 )
 
 func printHelp() {
-	fmt.Fprintln(os.Stderr, "Available commands: filter, sfm, vcf-to-elsites, bed-to-elsites, fasta-to-elfasta")
+	fmt.Fprintln(os.Stderr, "Available commands: filter, sfm, bam2fq, fq2bam, vcf-to-elsites, bed-to-elsites, bed-validate, fasta-to-elfasta")
 	fmt.Fprint(os.Stderr, "\n", cmd.CombinedSfmFilterHelp)
+	fmt.Fprint(os.Stderr, "\n", cmd.Bam2fqHelp)
+	fmt.Fprint(os.Stderr, "\n", cmd.Fq2bamHelp)
 	fmt.Fprint(os.Stderr, "\n", cmd.VcfToElsitesHelp)
 	fmt.Fprint(os.Stderr, "\n", cmd.BedToElsitesHelp)
+	fmt.Fprint(os.Stderr, "\n", cmd.BedValidateHelp)
 	fmt.Fprint(os.Stderr, "\n", cmd.FastaToElfastaHelp)
 }
 
 func prinExtendedHelp() {
-	fmt.Fprintln(os.Stderr, "Available commands: filter, split, merge, sfm, vcf-to-elsites, bed-to-elsites, fasta-to-elfasta")
+	fmt.Fprintln(os.Stderr, "Available commands: filter, split, merge, sfm, bam2fq, fq2bam, vcf-to-elsites, bed-to-elsites, bed-validate, fasta-to-elfasta")
 	fmt.Fprint(os.Stderr, "\n", cmd.FilterExtendedHelp)
 	fmt.Fprint(os.Stderr, "\n", cmd.SplitHelp)
 	fmt.Fprint(os.Stderr, "\n", cmd.MergeHelp)
 	fmt.Fprint(os.Stderr, "\n", cmd.SfmHelp)
+	fmt.Fprint(os.Stderr, "\n", cmd.Bam2fqHelp)
+	fmt.Fprint(os.Stderr, "\n", cmd.Fq2bamHelp)
 	fmt.Fprint(os.Stderr, "\n", cmd.VcfToElsitesHelp)
 	fmt.Fprint(os.Stderr, "\n", cmd.BedToElsitesHelp)
+	fmt.Fprint(os.Stderr, "\n", cmd.BedValidateHelp)
 	fmt.Fprint(os.Stderr, "\n", cmd.FastaToElfastaHelp)
 }
 
@@ -56,7 +62,7 @@ func main() {
 	fmt.Fprintln(os.Stderr, cmd.ProgramMessage)
 	if len(os.Args) < 2 {
 		log.Println("Incorrect number of parameters.")
-		fmt.Fprintln(os.Stderr, cmd.HelpMessage)
+		fmt.Fprint(os.Stderr, cmd.HelpMessage)
 		printHelp()
 		os.Exit(1)
 	}
@@ -69,10 +75,16 @@ func main() {
 		err = cmd.Split()
 	case "merge":
 		err = cmd.Merge()
+	case "bam2fq":
+		err = cmd.Bam2fq()
+	case "fq2bam":
+		err = cmd.Fq2bam()
 	case "vcf-to-elsites":
 		err = cmd.VcfToElsites()
 	case "bed-to-elsites":
 		err = cmd.BedToElsites()
+	case "bed-validate":
+		err = cmd.BedValidate()
 	case "fasta-to-elfasta":
 		err = cmd.FastaToElfasta()
 	case "sfm":
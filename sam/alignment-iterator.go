@@ -0,0 +1,189 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// An AlignmentIterator reads the alignments of an InputFile one at a
+// time, for programs that do not need a full filter pipeline. An
+// AlignmentIterator is not safe for concurrent use.
+type AlignmentIterator struct {
+	input      *InputFile
+	header     *Header
+	bam        bool
+	references []BAMReference
+	batch      [][]byte
+	err        error
+}
+
+// The number of records an AlignmentIterator fetches at once.
+const iteratorBatchSize = 256
+
+// Iterator parses the header of the input file, and returns an
+// AlignmentIterator over its alignments.
+func (f *InputFile) Iterator() (*AlignmentIterator, error) {
+	header, err := f.ParseHeader()
+	if err != nil {
+		return nil, err
+	}
+	it := &AlignmentIterator{input: f, header: header}
+	it.bam, it.references = f.bamReferences()
+	return it, nil
+}
+
+// Determines whether the raw records of the input file are BAM
+// records, and if so, returns the references of the BAM file.
+func (f *InputFile) bamReferences() (bool, []BAMReference) {
+	switch reader := f.reader.(type) {
+	case *bamReader:
+		return true, reader.references
+	case *regionBamReader:
+		return true, reader.references
+	}
+	return false, nil
+}
+
+// Header returns the header of the input file.
+func (it *AlignmentIterator) Header() *Header {
+	return it.header
+}
+
+// NextRecord returns the next alignment as a Record, whose fields are
+// only decoded when they are accessed. It returns nil and io.EOF
+// after the last alignment.
+func (it *AlignmentIterator) NextRecord() (*Record, error) {
+	for len(it.batch) == 0 {
+		if it.err != nil {
+			return nil, it.err
+		}
+		if it.input.Fetch(iteratorBatchSize) == 0 {
+			if it.err = it.input.Err(); it.err == nil {
+				it.err = io.EOF
+			}
+			continue
+		}
+		it.batch = it.input.Data().([][]byte)
+	}
+	record := &Record{data: it.batch[0], it: it}
+	it.batch[0] = nil
+	it.batch = it.batch[1:]
+	return record, nil
+}
+
+// Next returns the next alignment. It returns nil and io.EOF after
+// the last alignment.
+func (it *AlignmentIterator) Next() (*Alignment, error) {
+	record, err := it.NextRecord()
+	if err != nil {
+		return nil, err
+	}
+	return record.Alignment()
+}
+
+// A Record is an alignment as read from a SAM or BAM file, which is
+// only decoded on demand.
+type Record struct {
+	data []byte
+	it   *AlignmentIterator
+}
+
+// Bytes returns the raw record: a line without its line terminator
+// for SAM files, or the binary alignment record without its
+// block_size field for BAM files.
+func (record *Record) Bytes() []byte {
+	return record.data
+}
+
+// Alignment decodes all fields of the record.
+func (record *Record) Alignment() (*Alignment, error) {
+	return record.it.input.ParseAlignment(record.data)
+}
+
+// Returns the field of a SAM line with the given index.
+func (record *Record) samField(index int) ([]byte, error) {
+	data := record.data
+	for ; index > 0; index-- {
+		i := bytes.IndexByte(data, '\t')
+		if i < 0 {
+			return nil, errors.New("missing tabulator in SAM alignment line")
+		}
+		data = data[i+1:]
+	}
+	if i := bytes.IndexByte(data, '\t'); i >= 0 {
+		return data[:i], nil
+	}
+	return data, nil
+}
+
+// QNAME decodes the query template name of the record.
+func (record *Record) QNAME() (string, error) {
+	if record.it.bam {
+		return string(record.data[readNameIndex : readNameIndex+int(record.data[lReadNameIndex])-1]), nil
+	}
+	field, err := record.samField(0)
+	return string(field), err
+}
+
+// FLAG decodes the bitwise flag of the record.
+func (record *Record) FLAG() (uint16, error) {
+	if record.it.bam {
+		return binary.LittleEndian.Uint16(record.data[flagIndex : flagIndex+2]), nil
+	}
+	field, err := record.samField(1)
+	if err != nil {
+		return 0, err
+	}
+	flag, err := strconv.ParseUint(string(field), 10, 16)
+	return uint16(flag), err
+}
+
+// RNAME decodes the reference sequence name of the record.
+func (record *Record) RNAME() (string, error) {
+	if record.it.bam {
+		refID := int32(binary.LittleEndian.Uint32(record.data[refIDIndex : refIDIndex+4]))
+		if refID < 0 {
+			return star, nil
+		}
+		if int(refID) >= len(record.it.references) {
+			return "", errors.New("invalid reference sequence index in BAM alignment record")
+		}
+		return record.it.references[refID].Name, nil
+	}
+	field, err := record.samField(2)
+	return string(field), err
+}
+
+// POS decodes the 1-based leftmost mapping position of the record.
+func (record *Record) POS() (int32, error) {
+	if record.it.bam {
+		return int32(binary.LittleEndian.Uint32(record.data[posIndex:posIndex+4])) + 1, nil
+	}
+	field, err := record.samField(3)
+	if err != nil {
+		return 0, err
+	}
+	pos, err := strconv.ParseInt(string(field), 10, 32)
+	return int32(pos), err
+}
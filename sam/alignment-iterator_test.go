@@ -0,0 +1,95 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func iterateFile(t *testing.T, name string) (qnames []string) {
+	input, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := input.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	it, err := input.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(it.Header().SQ) != 2 {
+		t.Error("Iterator header failed")
+	}
+	for {
+		record, err := it.NextRecord()
+		if err == io.EOF {
+			return qnames
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		qname, err := record.QNAME()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rname, _ := record.RNAME()
+		pos, _ := record.POS()
+		flag, _ := record.FLAG()
+		aln, err := record.Alignment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if qname != aln.QNAME || rname != aln.RNAME || pos != aln.POS || flag != aln.FLAG {
+			t.Error("Record lazy decoding failed", qname, rname, pos, flag)
+		}
+		qnames = append(qnames, qname)
+	}
+}
+
+func TestAlignmentIterator(t *testing.T) {
+	dir := t.TempDir()
+	samName := filepath.Join(dir, "test.sam")
+	samData := "@SQ\tSN:chr1\tLN:100000\n@SQ\tSN:chr2\tLN:100000\n"
+	for _, line := range indexedBamLines[:3] {
+		samData += line + "\n"
+	}
+	samData += "u1\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*\n"
+	if err := ioutil.WriteFile(samName, []byte(samData), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if qnames := iterateFile(t, samName); !equalNames(qnames, "r1", "r2", "r3", "u1") {
+		t.Error("AlignmentIterator SAM failed", qnames)
+	}
+	bamName := filepath.Join(dir, "test.bam")
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, indexedBamLines[0])
+	}
+	if err := writeBamWithIndex(t, bamName, NoIndex, append(lines, "u1\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*")); err != nil {
+		t.Fatal(err)
+	}
+	if qnames := iterateFile(t, bamName); len(qnames) != 1001 || qnames[0] != "r1" || qnames[1000] != "u1" {
+		t.Error("AlignmentIterator BAM failed", len(qnames))
+	}
+}
@@ -0,0 +1,241 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// The accessors in this file give typed access to the optional fields
+// of an alignment, stored in TAGS. Filters should prefer these
+// accessors over type assertions on the values stored in TAGS, which
+// represent the following SAM types: byte (A), int64 (i), float32 (f),
+// string (Z), ByteArray (H), []int8 (B:c), []uint8 (B:C), []int16
+// (B:s), []uint16 (B:S), []int32 (B:i), []uint32 (B:I), and []float32
+// (B:f). In BAM files, integers are stored using the smallest of the
+// types c, C, s, S, i, or I that can represent them.
+
+// DecodeTags decodes the optional fields of an alignment read from a
+// BAM file into TAGS, if this has not happened yet. The optional
+// fields of BAM alignments are kept in BAM encoding until they are
+// changed, so that they can be copied verbatim to BAM output.
+func (aln *Alignment) DecodeTags() {
+	if aln.rawTags != nil {
+		aln.TAGS = append(aln.TAGS, parseBamTags(aln.rawTags)...)
+		aln.rawTags = nil
+	}
+}
+
+// Returns the value of an optional field, decoding only this optional
+// field if the optional fields are not decoded yet.
+func (aln *Alignment) getTag(tag utils.Symbol) (interface{}, bool) {
+	if aln.rawTags != nil {
+		return findBamTag(aln.rawTags, tag)
+	}
+	return aln.TAGS.Get(tag)
+}
+
+// HasTag reports whether there is an optional field with the given
+// tag.
+func (aln *Alignment) HasTag(tag utils.Symbol) bool {
+	_, ok := aln.getTag(tag)
+	return ok
+}
+
+// TagType returns the SAM type code of the value of the given optional
+// field, for example "i" for an integer or "B:s" for an array of
+// int16. It returns false if there is no such optional field.
+func (aln *Alignment) TagType(tag utils.Symbol) (string, bool) {
+	value, ok := aln.getTag(tag)
+	if !ok {
+		return "", false
+	}
+	return tagTypeCode(value), true
+}
+
+func tagTypeCode(value interface{}) string {
+	switch value.(type) {
+	case byte:
+		return "A"
+	case int64:
+		return "i"
+	case float32:
+		return "f"
+	case string:
+		return "Z"
+	case ByteArray:
+		return "H"
+	case []int8:
+		return "B:c"
+	case []uint8:
+		return "B:C"
+	case []int16:
+		return "B:s"
+	case []uint16:
+		return "B:S"
+	case []int32:
+		return "B:i"
+	case []uint32:
+		return "B:I"
+	case []float32:
+		return "B:f"
+	default:
+		return ""
+	}
+}
+
+// TagChar returns the value of an optional field of type A. It returns
+// false if there is no such optional field, or if it has a different
+// type.
+func (aln *Alignment) TagChar(tag utils.Symbol) (byte, bool) {
+	value, ok := aln.getTag(tag)
+	if !ok {
+		return 0, false
+	}
+	char, ok := value.(byte)
+	return char, ok
+}
+
+// TagInt returns the value of an optional field of type i. It returns
+// false if there is no such optional field, or if it has a different
+// type.
+func (aln *Alignment) TagInt(tag utils.Symbol) (int64, bool) {
+	value, ok := aln.getTag(tag)
+	if !ok {
+		return 0, false
+	}
+	i, ok := value.(int64)
+	return i, ok
+}
+
+// TagFloat returns the value of an optional field of type f. It
+// returns false if there is no such optional field, or if it has a
+// different type.
+func (aln *Alignment) TagFloat(tag utils.Symbol) (float32, bool) {
+	value, ok := aln.getTag(tag)
+	if !ok {
+		return 0, false
+	}
+	f, ok := value.(float32)
+	return f, ok
+}
+
+// TagString returns the value of an optional field of type Z. It
+// returns false if there is no such optional field, or if it has a
+// different type.
+func (aln *Alignment) TagString(tag utils.Symbol) (string, bool) {
+	value, ok := aln.getTag(tag)
+	if !ok {
+		return "", false
+	}
+	s, ok := value.(string)
+	return s, ok
+}
+
+// TagByteArray returns the value of an optional field of type H. It
+// returns false if there is no such optional field, or if it has a
+// different type.
+func (aln *Alignment) TagByteArray(tag utils.Symbol) (ByteArray, bool) {
+	value, ok := aln.getTag(tag)
+	if !ok {
+		return nil, false
+	}
+	b, ok := value.(ByteArray)
+	return b, ok
+}
+
+// SetTag sets the value of an optional field, adding the field if it
+// does not exist yet. The tag must consist of a letter followed by a
+// letter or digit.
+//
+// The value can be of any of the types listed at the top of this
+// file. For convenience, values of type int, int8, int16, int32,
+// uint, uint16, uint32, and uint64 are stored as int64, and values of
+// type float64 as float32. Note that byte values are stored as
+// characters (type A), not as integers. SetTag returns an error for
+// integers that cannot be stored in a BAM file, and for values of
+// other types.
+func (aln *Alignment) SetTag(tag utils.Symbol, value interface{}) error {
+	if tag == nil || !isValidTag(*tag) {
+		return fmt.Errorf("invalid optional field tag %v", tag)
+	}
+	var v interface{}
+	switch val := value.(type) {
+	case byte, int64, float32, string, ByteArray, []int8, []uint8, []int16, []uint16, []int32, []uint32, []float32:
+		v = val
+	case int:
+		v = int64(val)
+	case int8:
+		v = int64(val)
+	case int16:
+		v = int64(val)
+	case int32:
+		v = int64(val)
+	case uint:
+		if uint64(val) > math.MaxUint32 {
+			return fmt.Errorf("integer value too large in optional field %v: %v", *tag, val)
+		}
+		v = int64(val)
+	case uint16:
+		v = int64(val)
+	case uint32:
+		v = int64(val)
+	case uint64:
+		if val > math.MaxUint32 {
+			return fmt.Errorf("integer value too large in optional field %v: %v", *tag, val)
+		}
+		v = int64(val)
+	case float64:
+		v = float32(val)
+	default:
+		return fmt.Errorf("unsupported type %T for optional field %v", value, *tag)
+	}
+	if i, ok := v.(int64); ok && (i < math.MinInt32 || i > math.MaxUint32) {
+		return fmt.Errorf("integer value out of range in optional field %v: %v", *tag, i)
+	}
+	aln.DecodeTags()
+	aln.TAGS.Set(tag, v)
+	return nil
+}
+
+// DeleteTag removes an optional field. It returns false if there was
+// no such optional field.
+func (aln *Alignment) DeleteTag(tag utils.Symbol) bool {
+	aln.DecodeTags()
+	var ok bool
+	aln.TAGS, ok = aln.TAGS.Delete(tag)
+	return ok
+}
+
+// DeleteAllTags removes all optional fields.
+func (aln *Alignment) DeleteAllTags() {
+	aln.TAGS = nil
+	aln.rawTags = nil
+}
+
+func isValidTag(tag string) bool {
+	if len(tag) != 2 {
+		return false
+	}
+	isLetter := func(c byte) bool { return ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') }
+	return isLetter(tag[0]) && (isLetter(tag[1]) || ('0' <= tag[1] && tag[1] <= '9'))
+}
@@ -0,0 +1,128 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestAlignmentTags(t *testing.T) {
+	aln, err := (*samReader)(nil).ParseAlignment([]byte("r1\t0\tchr1\t100\t60\t4M\t*\t0\t0\tACGT\tIIII\tNM:i:1\tXF:f:0.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm, xf, xa, xh, xs, xb := utils.Intern("NM"), utils.Intern("XF"), utils.Intern("XA"), utils.Intern("XH"), utils.Intern("XS"), utils.Intern("XB")
+	if err := aln.SetTag(xa, byte('x')); err != nil {
+		t.Error(err)
+	}
+	if err := aln.SetTag(xh, ByteArray{0x1a, 0xe3}); err != nil {
+		t.Error(err)
+	}
+	if err := aln.SetTag(xs, "text"); err != nil {
+		t.Error(err)
+	}
+	if err := aln.SetTag(xb, []int16{-1, 2}); err != nil {
+		t.Error(err)
+	}
+	if err := aln.SetTag(nm, int32(-70000)); err != nil {
+		t.Error(err)
+	}
+	if err := aln.SetTag(utils.Intern("X"), 1); err == nil {
+		t.Error("SetTag with invalid tag failed")
+	}
+	if err := aln.SetTag(utils.Intern("XI"), uint64(1)<<32); err == nil {
+		t.Error("SetTag with large integer failed")
+	}
+	if err := aln.SetTag(utils.Intern("XI"), []int{1}); err == nil {
+		t.Error("SetTag with invalid type failed")
+	}
+	record, err := formatBamAlignment(aln, nil, map[string]uint32{"chr1": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseBamAlignment(record[4:], []BAMReference{{Name: "chr1", Length: 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := parsed.TagInt(nm); !ok || v != -70000 {
+		t.Error("TagInt failed", v)
+	}
+	if v, ok := parsed.TagFloat(xf); !ok || v != 0.5 {
+		t.Error("TagFloat failed", v)
+	}
+	if v, ok := parsed.TagChar(xa); !ok || v != 'x' {
+		t.Error("TagChar failed", v)
+	}
+	if v, ok := parsed.TagByteArray(xh); !ok || string(v) != "\x1a\xe3" {
+		t.Error("TagByteArray failed", v)
+	}
+	if v, ok := parsed.TagString(xs); !ok || v != "text" {
+		t.Error("TagString failed", v)
+	}
+	if v, ok := parsed.TagType(xb); !ok || v != "B:s" {
+		t.Error("TagType failed", v)
+	}
+	if _, ok := parsed.TagString(nm); ok {
+		t.Error("TagString with wrong type failed")
+	}
+	if !parsed.DeleteTag(nm) || parsed.DeleteTag(nm) {
+		t.Error("DeleteTag failed")
+	}
+	if _, ok := parsed.TagInt(nm); ok {
+		t.Error("DeleteTag failed")
+	}
+}
+
+func TestNumericArrayTags(t *testing.T) {
+	line := "r1\t0\tchr1\t100\t60\t4M\t*\t0\t0\tACGT\tIIII\tMM:Z:C+m,0;\tML:B:C,204,10\tXc:B:c,-128,127\tXs:B:s,-3\tXS:B:S,65535\tXi:B:i,-2147483648,5\tXI:B:I,4294967295\tXf:B:f,0.25,-1e+10\tXe:B:C"
+	aln, err := (*samReader)(nil).ParseAlignment([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []string{"Z", "B:C", "B:c", "B:s", "B:S", "B:i", "B:I", "B:f", "B:C"}
+	for i, entry := range aln.TAGS {
+		if code := tagTypeCode(entry.Value); code != types[i] {
+			t.Error("numeric array type failed", *entry.Key, code)
+		}
+	}
+	formatted, err := formatSamAlignment(aln, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != line+"\n" {
+		t.Error("SAM numeric array round trip failed", string(formatted))
+	}
+	record, err := formatBamAlignment(aln, nil, map[string]uint32{"chr1": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseBamAlignment(record[4:], []BAMReference{{Name: "chr1", Length: 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatted, err = formatSamAlignment(parsed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != line+"\n" {
+		t.Error("BAM numeric array round trip failed", string(formatted))
+	}
+}
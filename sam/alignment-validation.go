@@ -0,0 +1,287 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// ValidationStringency determines how invalid alignments are handled.
+type ValidationStringency int
+
+// Possible values for ValidationStringency.
+const (
+	// NoValidation does not check the alignments.
+	NoValidation ValidationStringency = iota
+	// LenientValidation repairs invalid alignments where possible,
+	// removes the others, and counts them in a ValidationReport.
+	LenientValidation
+	// StrictValidation rejects the first invalid alignment.
+	StrictValidation
+)
+
+// ParseValidationStringency parses the name of a
+// ValidationStringency, which is one of "strict", "lenient", or
+// "none". The empty string is parsed as NoValidation.
+func ParseValidationStringency(s string) (ValidationStringency, error) {
+	switch s {
+	case "", "none":
+		return NoValidation, nil
+	case "lenient":
+		return LenientValidation, nil
+	case "strict":
+		return StrictValidation, nil
+	default:
+		return NoValidation, fmt.Errorf("unknown validation stringency %v", s)
+	}
+}
+
+// A ValidationIssue is a kind of problem with an alignment.
+type ValidationIssue int
+
+// Possible values for ValidationIssue.
+const (
+	// InvalidFlag is a FLAG with undefined bits, or with bits for
+	// paired reads in an unpaired read. It is repaired by clearing
+	// these bits.
+	InvalidFlag ValidationIssue = iota
+	// InvalidPosition is a POS or PNEXT outside of the reference
+	// sequence, a reference sequence that is not in the header, or a
+	// mapped read without a position. It cannot be repaired.
+	InvalidPosition
+	// CigarSeqMismatch is a CIGAR string whose query length differs
+	// from the length of SEQ. It cannot be repaired.
+	CigarSeqMismatch
+	// InvalidQuality is a QUAL with a different length than SEQ, or
+	// with base qualities above 93. It is repaired by removing QUAL,
+	// or by lowering the base qualities to 93.
+	InvalidQuality
+
+	nofValidationIssues
+)
+
+var validationIssueNames = [nofValidationIssues]string{
+	"invalid FLAG",
+	"position out of range",
+	"CIGAR and SEQ lengths differ",
+	"invalid QUAL",
+}
+
+func (issue ValidationIssue) String() string {
+	return validationIssueNames[issue]
+}
+
+// An AlignmentError describes a problem with an alignment.
+type AlignmentError struct {
+	Issue  ValidationIssue
+	QNAME  string
+	RNAME  string
+	POS    int32
+	Detail string
+}
+
+func (err *AlignmentError) Error() string {
+	return fmt.Sprintf("%v in alignment %v at %v:%v: %v", err.Issue, err.QNAME, err.RNAME, err.POS, err.Detail)
+}
+
+// The highest base quality that can be represented in SAM files.
+const maxQual = 93
+
+const (
+	undefinedFlags = 0xffff &^ 0xfff
+	pairedFlags    = Proper | NextUnmapped | NextReversed | First | Last
+)
+
+// A Validator checks alignments against the reference sequence
+// lengths in a header.
+type Validator struct {
+	lengths map[string]int32
+}
+
+// NewValidator returns a Validator for the alignments of a file with
+// the given header.
+func NewValidator(hdr *Header) *Validator {
+	lengths := make(map[string]int32)
+	for _, sq := range hdr.SQ {
+		if ln, err := SQLN(sq); err == nil {
+			lengths[sq["SN"]] = ln
+		}
+	}
+	return &Validator{lengths: lengths}
+}
+
+// Returns whether the alignment has a base quality string. A missing
+// QUAL is represented by 0xff bytes in BAM files, and by a single '*'
+// in SAM files.
+func hasQual(aln *Alignment) bool {
+	return len(aln.QUAL) > 0 && aln.QUAL[0] != 0xff && !(len(aln.QUAL) == 1 && aln.QUAL[0] == '*'-33)
+}
+
+// HasSeq returns whether the alignment has a segment sequence. A
+// missing SEQ is read as a single N from SAM files.
+func (aln *Alignment) HasSeq() bool {
+	l := aln.SEQ.Len()
+	return l > 0 && !(l == 1 && aln.SEQ.Base(0) == 'N' && !hasQual(aln))
+}
+
+// Validate returns the problems of an alignment, or nil if the
+// alignment is valid.
+func (v *Validator) Validate(aln *Alignment) (errs []*AlignmentError) {
+	report := func(issue ValidationIssue, format string, args ...interface{}) {
+		errs = append(errs, &AlignmentError{
+			Issue:  issue,
+			QNAME:  aln.QNAME,
+			RNAME:  aln.RNAME,
+			POS:    aln.POS,
+			Detail: fmt.Sprintf(format, args...),
+		})
+	}
+	if aln.FLAG&undefinedFlags != 0 {
+		report(InvalidFlag, "undefined bits set in FLAG %v", aln.FLAG)
+	} else if !aln.IsMultiple() && aln.FLAG&pairedFlags != 0 {
+		report(InvalidFlag, "bits for paired reads set in FLAG %v of an unpaired read", aln.FLAG)
+	}
+	v.validatePosition(aln, report)
+	if aln.HasSeq() && len(aln.CIGAR) > 0 {
+		var length int32
+		for _, op := range aln.CIGAR {
+			length += cigarConsumesReadBases[op.Operation] * op.Length
+		}
+		if int(length) != aln.SEQ.Len() {
+			report(CigarSeqMismatch, "CIGAR query length %v, SEQ length %v", length, aln.SEQ.Len())
+		}
+	}
+	if hasQual(aln) {
+		if aln.HasSeq() && len(aln.QUAL) != aln.SEQ.Len() {
+			report(InvalidQuality, "QUAL length %v, SEQ length %v", len(aln.QUAL), aln.SEQ.Len())
+		} else {
+			for _, q := range aln.QUAL {
+				if q > maxQual {
+					report(InvalidQuality, "base quality %v above %v", q, maxQual)
+					break
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func (v *Validator) validatePosition(aln *Alignment, report func(ValidationIssue, string, ...interface{})) {
+	if aln.POS < 0 || aln.PNEXT < 0 {
+		report(InvalidPosition, "negative POS or PNEXT")
+		return
+	}
+	if aln.RNAME == "*" {
+		if !aln.IsUnmapped() {
+			report(InvalidPosition, "mapped read without RNAME")
+		}
+	} else if ln, found := v.lengths[aln.RNAME]; !found {
+		report(InvalidPosition, "RNAME not in the header")
+		return
+	} else if aln.POS > ln {
+		report(InvalidPosition, "POS beyond reference sequence length %v", ln)
+	} else if aln.POS == 0 && !aln.IsUnmapped() {
+		report(InvalidPosition, "mapped read without POS")
+	}
+	rnext := aln.RNEXT
+	if rnext == "=" {
+		rnext = aln.RNAME
+	}
+	if rnext != "*" {
+		if ln, found := v.lengths[rnext]; !found {
+			report(InvalidPosition, "RNEXT not in the header")
+		} else if aln.PNEXT > ln {
+			report(InvalidPosition, "PNEXT beyond reference sequence length %v", ln)
+		}
+	}
+}
+
+// Repair repairs a problem with an alignment, if possible, and
+// returns whether it did.
+func Repair(aln *Alignment, issue ValidationIssue) bool {
+	switch issue {
+	case InvalidFlag:
+		aln.FLAG &^= undefinedFlags
+		if !aln.IsMultiple() {
+			aln.FLAG &^= pairedFlags
+		}
+		return true
+	case InvalidQuality:
+		if aln.HasSeq() && len(aln.QUAL) != aln.SEQ.Len() {
+			aln.QUAL = make([]byte, aln.SEQ.Len())
+			for i := range aln.QUAL {
+				aln.QUAL[i] = 0xff
+			}
+			return true
+		}
+		for i, q := range aln.QUAL {
+			if q > maxQual {
+				aln.QUAL[i] = maxQual
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// A ValidationReport counts the problems found by lenient
+// validation. It is safe for concurrent use.
+type ValidationReport struct {
+	repaired, removed [nofValidationIssues]int64
+}
+
+// Count counts a problem, which was either repaired, or caused the
+// alignment to be removed.
+func (report *ValidationReport) Count(issue ValidationIssue, repaired bool) {
+	if repaired {
+		atomic.AddInt64(&report.repaired[issue], 1)
+	} else {
+		atomic.AddInt64(&report.removed[issue], 1)
+	}
+}
+
+// Repaired returns how many times the given problem was repaired.
+func (report *ValidationReport) Repaired(issue ValidationIssue) int64 {
+	return atomic.LoadInt64(&report.repaired[issue])
+}
+
+// Removed returns how many alignments were removed because of the
+// given problem.
+func (report *ValidationReport) Removed(issue ValidationIssue) int64 {
+	return atomic.LoadInt64(&report.removed[issue])
+}
+
+// Write writes a line for each problem that was found.
+func (report *ValidationReport) Write(w io.Writer) error {
+	var lines strings.Builder
+	for issue := ValidationIssue(0); issue < nofValidationIssues; issue++ {
+		if repaired, removed := report.Repaired(issue), report.Removed(issue); repaired > 0 || removed > 0 {
+			fmt.Fprintf(&lines, "%v: %v repaired, %v alignments removed\n", issue, repaired, removed)
+		}
+	}
+	if lines.Len() == 0 {
+		lines.WriteString("no invalid alignments found\n")
+	}
+	_, err := io.WriteString(w, lines.String())
+	return err
+}
@@ -0,0 +1,81 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestValidator(t *testing.T) {
+	hdr := NewHeader()
+	hdr.SQ = []utils.StringMap{{"SN": "chr1", "LN": "1000"}}
+	validator := NewValidator(hdr)
+	issues := func(line string) (result []ValidationIssue) {
+		aln, err := (*samReader)(nil).ParseAlignment([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, err := range validator.Validate(aln) {
+			result = append(result, err.Issue)
+		}
+		return result
+	}
+	for _, test := range []struct {
+		line   string
+		issues []ValidationIssue
+	}{
+		{"r1\t0\tchr1\t10\t60\t4M\t*\t0\t0\tACGT\tABCD", nil},
+		{"r1\t256\tchr1\t10\t60\t4M\t*\t0\t0\t*\t*", nil},
+		{"r1\t4\t*\t0\t0\t*\t*\t0\t0\tAC\tAB", nil},
+		{"r1\t64\tchr1\t10\t60\t4M\t*\t0\t0\tACGT\tABCD", []ValidationIssue{InvalidFlag}},
+		{"r1\t0\tchr1\t1001\t60\t4M\t*\t0\t0\tACGT\tABCD", []ValidationIssue{InvalidPosition}},
+		{"r1\t0\tchr2\t10\t60\t4M\t*\t0\t0\tACGT\tABCD", []ValidationIssue{InvalidPosition}},
+		{"r1\t0\tchr1\t10\t60\t5M\t*\t0\t0\tACGT\tABCD", []ValidationIssue{CigarSeqMismatch}},
+		{"r1\t0\tchr1\t10\t60\t4M\t*\t0\t0\tACGT\tABC", []ValidationIssue{InvalidQuality}},
+		{"r1\t0\tchr1\t10\t60\t4M\t*\t0\t0\tACGT\tAB\x7fD", []ValidationIssue{InvalidQuality}},
+	} {
+		result := issues(test.line)
+		if len(result) != len(test.issues) {
+			t.Error("Validate failed", test.line, result)
+			continue
+		}
+		for i := range result {
+			if result[i] != test.issues[i] {
+				t.Error("Validate failed", test.line, result)
+			}
+		}
+	}
+
+	aln, err := (*samReader)(nil).ParseAlignment([]byte("r1\t64\tchr1\t10\t60\t4M\t*\t0\t0\tACGT\tABC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report ValidationReport
+	for _, err := range validator.Validate(aln) {
+		report.Count(err.Issue, Repair(aln, err.Issue))
+	}
+	if len(validator.Validate(aln)) != 0 || report.Repaired(InvalidFlag) != 1 || report.Repaired(InvalidQuality) != 1 {
+		t.Error("Repair failed")
+	}
+	if Repair(aln, CigarSeqMismatch) {
+		t.Error("Repair CIGAR failed")
+	}
+}
@@ -20,11 +20,17 @@ package sam
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/exascience/pargo/pipeline"
 )
@@ -41,7 +47,9 @@ type (
 
 	// InputFile represents a SAM or BAM file for input.
 	InputFile struct {
-		reader alignmentReader
+		reader       alignmentReader
+		check        SortingOrderCheck
+		groupFilters []GroupFilter
 	}
 )
 
@@ -125,25 +133,136 @@ func (f *OutputFile) Write(p []byte) (int, error) {
 
 // SAM file extensions.
 const (
-	SamExt  = ".sam"
-	BamExt  = ".bam"
-	cramExt = ".cram"
+	SamExt   = ".sam"
+	SamGzExt = ".sam.gz"
+	BamExt   = ".bam"
+	cramExt  = ".cram"
 )
 
+// FileExt returns the extension of a SAM or BAM file name, which is
+// the same as filepath.Ext, except that it returns .sam.gz for
+// compressed SAM files.
+func FileExt(name string) string {
+	if strings.HasSuffix(name, SamGzExt) {
+		return SamGzExt
+	}
+	return filepath.Ext(name)
+}
+
+// OutputFormat determines the file format of an OutputFile.
+type OutputFormat int
+
+const (
+	// DefaultFormat determines the file format from the file name
+	// extension.
+	DefaultFormat OutputFormat = iota
+	// SamFormat is plain SAM text.
+	SamFormat
+	// SamGzFormat is SAM text compressed with BGZF, which can also be
+	// read with gzip tools.
+	SamGzFormat
+	// BamFormat is BAM.
+	BamFormat
+	// UncompressedBamFormat is BAM with BGZF blocks that are not
+	// compressed, which is faster to write and read, for example when
+	// piping the output to another tool.
+	UncompressedBamFormat
+)
+
+// ParseOutputFormat parses the name of an OutputFormat, which is one of
+// "sam", "sam.gz", "bam", or "uncompressed-bam". The empty string
+// means DefaultFormat.
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch s {
+	case "":
+		return DefaultFormat, nil
+	case "sam":
+		return SamFormat, nil
+	case "sam.gz":
+		return SamGzFormat, nil
+	case "bam":
+		return BamFormat, nil
+	case "uncompressed-bam":
+		return UncompressedBamFormat, nil
+	default:
+		return DefaultFormat, fmt.Errorf("unknown output format %v", s)
+	}
+}
+
+// ResolveOutputFormat returns the given format, or if it is
+// DefaultFormat, the format determined by the extension of the given
+// file name. If the extension is neither .bam nor .sam.gz, then SAM is
+// assumed.
+func ResolveOutputFormat(name string, format OutputFormat) OutputFormat {
+	if format != DefaultFormat {
+		return format
+	}
+	switch FileExt(name) {
+	case BamExt:
+		return BamFormat
+	case SamGzExt:
+		return SamGzFormat
+	default:
+		return SamFormat
+	}
+}
+
+// alignmentFormatter returns a function that formats alignments for
+// output files with the given name, format, and header. This allows
+// formatting alignments before the files they are written to are
+// created.
+func alignmentFormatter(name string, format OutputFormat, hdr *Header) func(*Alignment, []byte) ([]byte, error) {
+	switch ResolveOutputFormat(name, format) {
+	case BamFormat, UncompressedBamFormat:
+		dictTable := bamDictTable(hdr)
+		return func(aln *Alignment, out []byte) ([]byte, error) {
+			return formatBamAlignment(aln, out, dictTable)
+		}
+	default:
+		return formatSamAlignment
+	}
+}
+
+// outputFileName inserts the given key in front of the file extension
+// of the given name. Characters in the key that are not letters,
+// digits, '.', '-', or '_' are replaced by '_'.
+func outputFileName(name, key string) string {
+	ext := FileExt(name)
+	return strings.TrimSuffix(name, ext) + "." + strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, key) + ext
+}
+
 // Open a SAM or BAM file for input.
 //
-// If the filename extension is not .bam, then .sam is always
-// assumed.
+// If the filename extension is neither .bam nor .sam.gz, then .sam is
+// always assumed. A .sam.gz file may be compressed with BGZF or
+// gzip.
+//
+// If the name is "/dev/stdin", then the input is read from os.Stdin,
+// and the format is detected from the first bytes of the input.
 //
-// If the name is "/dev/stdin", then the input is read from os.Stdin
+// If the name is an htsget URL, then the input is read with
+// OpenHtsget.
 func Open(name string) (*InputFile, error) {
-	switch filepath.Ext(name) {
+	if name == "/dev/stdin" {
+		return openStdin()
+	}
+	if IsHtsgetURL(name) {
+		return OpenHtsget(name, nil, nil)
+	}
+	switch FileExt(name) {
 	case BamExt:
 		file, err := os.Open(name)
 		if err != nil {
 			return nil, err
 		}
-		bgzf, err := NewBGZFReader(bufio.NewReader(file))
+		bgzf, err := NewBGZFReaderWithOptions(bufio.NewReader(file), bgzfOptions)
 		if err != nil {
 			return nil, err
 		}
@@ -153,17 +272,25 @@ func Open(name string) (*InputFile, error) {
 				bgzf: bgzf,
 			},
 		}, nil
+	case SamGzExt:
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		gz, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		return &InputFile{
+			reader: &samReader{
+				rc:  file,
+				buf: bufio.NewReader(gz),
+			},
+		}, nil
 	case cramExt:
 		return nil, fmt.Errorf("CRAM format not supported when opening %v", name)
 	default:
-		if name == "/dev/stdin" {
-			return &InputFile{
-				reader: &samReader{
-					rc:  os.Stdin,
-					buf: bufio.NewReader(os.Stdin),
-				},
-			}, nil
-		}
 		file, err := os.Open(name)
 		if err != nil {
 			return nil, err
@@ -177,36 +304,175 @@ func Open(name string) (*InputFile, error) {
 	}
 }
 
+// openStdin opens os.Stdin for input, and determines whether it
+// contains BAM, compressed SAM, or SAM data.
+func openStdin() (*InputFile, error) {
+	// large enough to peek at a complete BGZF block
+	buf := bufio.NewReaderSize(os.Stdin, 2*maxBgzfBlockSize)
+	format, err := detectFormat(buf)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case BamExt:
+		bgzf, err := NewBGZFReaderWithOptions(buf, bgzfOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &InputFile{
+			reader: &bamReader{
+				rc:   os.Stdin,
+				bgzf: bgzf,
+			},
+		}, nil
+	case SamGzExt:
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, err
+		}
+		return &InputFile{
+			reader: &samReader{
+				rc:  os.Stdin,
+				buf: bufio.NewReader(gz),
+			},
+		}, nil
+	case cramExt:
+		return nil, errors.New("CRAM format not supported when opening /dev/stdin")
+	default:
+		return &InputFile{
+			reader: &samReader{
+				rc:  os.Stdin,
+				buf: buf,
+			},
+		}, nil
+	}
+}
+
+// detectFormat peeks at the first bytes of the given input to detect
+// its format, and returns the corresponding file extension: .bam for
+// BGZF-compressed data that starts with the BAM magic string, .sam.gz
+// for other gzip-compressed data, .cram for CRAM data, and .sam
+// otherwise.
+func detectFormat(buf *bufio.Reader) (string, error) {
+	magic, err := buf.Peek(4)
+	if err == io.EOF {
+		return SamExt, nil
+	} else if err != nil {
+		return "", err
+	}
+	switch {
+	case string(magic) == "CRAM":
+		return cramExt, nil
+	case magic[0] != 0x1f || magic[1] != 0x8b:
+		return SamExt, nil
+	}
+	// a BGZF block has an extra subfield BC with the block size
+	header, err := buf.Peek(18)
+	if err == io.EOF {
+		return SamGzExt, nil
+	} else if err != nil {
+		return "", err
+	}
+	if header[3]&4 == 0 || header[12] != 'B' || header[13] != 'C' || binary.LittleEndian.Uint16(header[14:]) != 2 {
+		return SamGzExt, nil
+	}
+	blockSize := int(binary.LittleEndian.Uint16(header[16:])) + 1
+	block, err := buf.Peek(blockSize)
+	if err == io.EOF || len(block) < 26 {
+		return SamGzExt, nil
+	} else if err != nil {
+		return "", err
+	}
+	var data [4]byte
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(block[18:blockSize-8])), data[:]); err != nil {
+		return SamGzExt, nil
+	}
+	if string(data[:]) == "BAM\x01" {
+		return BamExt, nil
+	}
+	return SamGzExt, nil
+}
+
 // Create a SAM or BAM file for output.
 //
-// If the filename extension is not .bam, then .sam is always
-// assumed.
+// If the filename extension is neither .bam nor .sam.gz, then .sam is
+// always assumed.
 //
 // If the name is "/dev/stdout", then the output is written to
 // os.Stdout.
 func Create(name string) (*OutputFile, error) {
-	switch filepath.Ext(name) {
-	case BamExt:
-		file, err := os.Create(name)
+	return CreateFormat(name, DefaultFormat)
+}
+
+// CreateFormat creates a SAM or BAM file for output, like Create, but
+// in the given format, regardless of the filename extension, unless
+// the format is DefaultFormat.
+func CreateFormat(name string, format OutputFormat) (*OutputFile, error) {
+	if format == DefaultFormat && filepath.Ext(name) == cramExt {
+		return nil, fmt.Errorf("CRAM format not supported when opening %v", name)
+	}
+	var file io.WriteCloser
+	if name == "/dev/stdout" {
+		file = os.Stdout
+	} else {
+		f, err := os.Create(name)
 		if err != nil {
 			return nil, err
 		}
+		file = f
+	}
+	switch resolved := ResolveOutputFormat(name, format); resolved {
+	case BamFormat, UncompressedBamFormat:
+		level := bgzfOptions.flateLevel()
+		if resolved == UncompressedBamFormat {
+			level = flate.NoCompression
+		}
+		bgzf, err := newBGZFWriter(file, bgzfOptions, level)
+		if err != nil {
+			if file != os.Stdout {
+				_ = file.Close()
+			}
+			return nil, err
+		}
 		return &OutputFile{
 			writer: &bamWriter{
 				wc:   file,
-				bgzf: NewBGZFWriter(file),
+				bgzf: bgzf,
 			},
 		}, nil
-	case cramExt:
-		return nil, fmt.Errorf("CRAM format not supported when opening %v", name)
-	default:
-		if name == "/dev/stdout" {
-			return &OutputFile{writer: &samWriter{wc: os.Stdout}}, nil
-		}
-		file, err := os.Create(name)
+	case SamGzFormat:
+		bgzf, err := NewBGZFWriterWithOptions(file, bgzfOptions)
 		if err != nil {
+			if file != os.Stdout {
+				_ = file.Close()
+			}
 			return nil, err
 		}
+		return &OutputFile{writer: &samWriter{wc: &bgzfFile{bgzf: bgzf, file: file}}}, nil
+	default:
 		return &OutputFile{writer: &samWriter{wc: file}}, nil
 	}
 }
+
+// A bgzfFile writes BGZF-compressed data to a file.
+type bgzfFile struct {
+	bgzf *BGZFWriter
+	file io.WriteCloser
+}
+
+// Write implements the method of the io.Writer interface.
+func (f *bgzfFile) Write(p []byte) (int, error) {
+	return f.bgzf.Write(p)
+}
+
+// Close flushes the BGZF data, and closes the file unless it is
+// os.Stdout.
+func (f *bgzfFile) Close() error {
+	err := f.bgzf.Close()
+	if f.file != os.Stdout {
+		if nerr := f.file.Close(); err == nil {
+			err = nerr
+		}
+	}
+	return err
+}
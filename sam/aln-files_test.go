@@ -0,0 +1,208 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestSamGz(t *testing.T) {
+	dir := t.TempDir()
+	samName := filepath.Join(dir, "test.sam")
+	samData := "@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:100000\n@SQ\tSN:chr2\tLN:100000\n"
+	for _, line := range indexedBamLines[:3] {
+		samData += line + "\n"
+	}
+	if err := ioutil.WriteFile(samName, []byte(samData), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test.sam.gz", "test-format.sam"} {
+		gzName := filepath.Join(dir, name)
+		input, err := Open(samName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		format := DefaultFormat
+		if name == "test-format.sam" {
+			format = SamGzFormat
+		}
+		output, err := CreateFormat(gzName, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := input.RunPipeline(output, nil, Keep); err != nil {
+			t.Fatal(err)
+		}
+		if err := input.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := output.Close(); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(gzName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(gz)
+		_ = file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(string(data), "\n"); len(lines) != 7 || lines[5] != "r3\t0\tchr2\t10\t60\t50M\t*\t0\t0\tN\t*" {
+			t.Error("sam.gz output failed", name, string(data))
+		}
+	}
+	if qnames := iterateFile(t, filepath.Join(dir, "test.sam.gz")); len(qnames) != 3 {
+		t.Error("sam.gz input failed", qnames)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	dir := t.TempDir()
+	samData := "@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:100000\n@SQ\tSN:chr2\tLN:100000\n" + indexedBamLines[0] + "\n"
+	samName := filepath.Join(dir, "test.sam")
+	if err := ioutil.WriteFile(samName, []byte(samData), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var gzData bytes.Buffer
+	gz := gzip.NewWriter(&gzData)
+	if _, err := gz.Write([]byte(samData)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]byte{
+		SamExt:   []byte(samData),
+		SamGzExt: gzData.Bytes(),
+		cramExt:  []byte("CRAM\x03\x00"),
+	}
+	for _, ext := range []string{BamExt, SamGzExt} {
+		name := filepath.Join(dir, "test"+ext)
+		input, err := Open(samName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := input.RunPipeline(output, nil, Keep); err != nil {
+			t.Fatal(err)
+		}
+		_ = input.Close()
+		if err := output.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ext == BamExt {
+			tests[BamExt] = data
+		} else {
+			tests[".bgzf"+SamGzExt] = data
+		}
+	}
+	for expected, data := range tests {
+		format, err := detectFormat(bufio.NewReaderSize(bytes.NewReader(data), 2*maxBgzfBlockSize))
+		if err != nil {
+			t.Error(err)
+		} else if format != strings.TrimPrefix(expected, ".bgzf") {
+			t.Error("detectFormat failed", expected, format)
+		}
+	}
+}
+
+func TestUncompressedBam(t *testing.T) {
+	dir := t.TempDir()
+	hdr := NewHeader()
+	hdr.SQ = []utils.StringMap{{"SN": "chr1", "LN": "1000000"}}
+	random := rand.New(rand.NewSource(42))
+	var lines []string
+	for i := 0; i < 100; i++ {
+		noise := make([]byte, 3000)
+		for j := range noise {
+			noise[j] = "0123456789abcdef"[random.Intn(16)]
+		}
+		lines = append(lines, fmt.Sprintf("r%v\t0\tchr1\t%v\t60\t50M\t*\t0\t0\t*\t*\tXN:Z:%s", i, i+1, noise))
+	}
+	for _, format := range []OutputFormat{BamFormat, UncompressedBamFormat} {
+		name := filepath.Join(dir, fmt.Sprintf("test%v.bam", format))
+		output, err := CreateFormat(name, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := output.FormatHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range lines {
+			aln, err := (*samReader)(nil).ParseAlignment([]byte(line))
+			if err != nil {
+				t.Fatal(err)
+			}
+			record, err := output.FormatAlignment(aln, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := output.Write(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := output.Close(); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := info.Size() < 300000; compressed != (format == BamFormat) {
+			t.Error("uncompressed BAM size failed", format, info.Size())
+		}
+		input, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reads := NewSam()
+		if err := input.RunPipeline(reads, nil, Keep); err != nil {
+			t.Fatal(err)
+		}
+		if err := input.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(reads.Alignments) != 100 || reads.Alignments[99].QNAME != "r99" {
+			t.Error("uncompressed BAM round trip failed", format)
+		}
+	}
+}
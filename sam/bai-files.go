@@ -0,0 +1,283 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A VirtualOffset is a position in a BGZF file: the offset of a
+// compressed block in the file, shifted left by 16 bits, combined
+// with an offset into the uncompressed data of that block. See
+// http://samtools.github.io/hts-specs/SAMv1.pdf - Section 4.1.1.
+type VirtualOffset uint64
+
+// NewVirtualOffset creates a VirtualOffset from the offset of a
+// compressed block in a BGZF file and an offset into the uncompressed
+// data of that block.
+func NewVirtualOffset(blockOffset int64, dataOffset int) VirtualOffset {
+	return VirtualOffset(uint64(blockOffset)<<16 | uint64(dataOffset))
+}
+
+// BlockOffset returns the offset of the compressed block in the BGZF
+// file.
+func (offset VirtualOffset) BlockOffset() int64 {
+	return int64(offset >> 16)
+}
+
+// DataOffset returns the offset into the uncompressed data of the
+// block.
+func (offset VirtualOffset) DataOffset() int {
+	return int(offset & 0xFFFF)
+}
+
+// A Chunk is a range [Begin, End) of virtual offsets in a BAM file.
+type Chunk struct {
+	Begin, End VirtualOffset
+}
+
+// A BAMIndex is an index of a coordinate-sorted BAM file, either a
+// BAI or a CSI.
+type BAMIndex interface {
+	// Chunks returns the chunks of the BAM file that may contain
+	// alignments on the reference sequence with the given index that
+	// overlap with the 0-based, half-open range [beg, end). The chunks
+	// are sorted, and do not overlap with each other.
+	Chunks(refID int, beg, end int32) []Chunk
+}
+
+// A BAIReference is the index of the alignments for one reference
+// sequence in a BAI file.
+type BAIReference struct {
+	// The chunks of each bin.
+	Bins map[uint32][]Chunk
+	// The linear index: Intervals[i] is the smallest virtual offset
+	// of the alignments that overlap with the 16kbp window i.
+	Intervals []VirtualOffset
+}
+
+// A BAI is the index of a coordinate-sorted BAM file. See
+// http://samtools.github.io/hts-specs/SAMv1.pdf - Section 5.2.
+type BAI struct {
+	References []BAIReference
+	// The number of unplaced unmapped reads, or -1 if unknown.
+	NoCoordinate int64
+}
+
+// baiMagic is the magic string for the BAI format.
+const baiMagic = "BAI\x01"
+
+// binLimit is the pseudo-bin that BAI files use for metadata.
+const binLimit = 37450
+
+// ParseBAI parses a BAI file.
+func ParseBAI(filename string) (index *BAI, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	return readBAI(bufio.NewReader(file))
+}
+
+func readBAI(reader io.Reader) (*BAI, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	} else if string(magic) != baiMagic {
+		return nil, errors.New("invalid BAI file header")
+	}
+	var nRef int32
+	if err := binary.Read(reader, binary.LittleEndian, &nRef); err != nil {
+		return nil, err
+	}
+	index := &BAI{References: make([]BAIReference, nRef), NoCoordinate: -1}
+	for i := range index.References {
+		ref := &index.References[i]
+		var nBin int32
+		if err := binary.Read(reader, binary.LittleEndian, &nBin); err != nil {
+			return nil, err
+		}
+		ref.Bins = make(map[uint32][]Chunk, nBin)
+		for j := int32(0); j < nBin; j++ {
+			var bin uint32
+			if err := binary.Read(reader, binary.LittleEndian, &bin); err != nil {
+				return nil, err
+			}
+			var nChunk int32
+			if err := binary.Read(reader, binary.LittleEndian, &nChunk); err != nil {
+				return nil, err
+			}
+			chunks := make([]Chunk, nChunk)
+			if err := binary.Read(reader, binary.LittleEndian, chunks); err != nil {
+				return nil, err
+			}
+			ref.Bins[bin] = chunks
+		}
+		var nIntv int32
+		if err := binary.Read(reader, binary.LittleEndian, &nIntv); err != nil {
+			return nil, err
+		}
+		ref.Intervals = make([]VirtualOffset, nIntv)
+		if err := binary.Read(reader, binary.LittleEndian, ref.Intervals); err != nil {
+			return nil, err
+		}
+	}
+	var nNoCoor uint64
+	if err := binary.Read(reader, binary.LittleEndian, &nNoCoor); err == nil {
+		index.NoCoordinate = int64(nNoCoor)
+	} else if err != io.EOF {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Write writes a BAI file.
+func (index *BAI) Write(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	write := func(data interface{}) {
+		// Errors are reported by Flush.
+		_ = binary.Write(out, binary.LittleEndian, data)
+	}
+	out.WriteString(baiMagic)
+	write(int32(len(index.References)))
+	for _, ref := range index.References {
+		write(int32(len(ref.Bins)))
+		for _, bin := range sortedBins(ref.Bins) {
+			write(bin)
+			write(int32(len(ref.Bins[bin])))
+			write(ref.Bins[bin])
+		}
+		write(int32(len(ref.Intervals)))
+		write(ref.Intervals)
+	}
+	if index.NoCoordinate >= 0 {
+		write(uint64(index.NoCoordinate))
+	}
+	return out.Flush()
+}
+
+// Returns the keys of a map of bins in ascending order, so that
+// indexes are written deterministically.
+func sortedBins(bins interface{}) (result []uint32) {
+	switch bins := bins.(type) {
+	case map[uint32][]Chunk:
+		for bin := range bins {
+			result = append(result, bin)
+		}
+	case map[uint32]CSIBin:
+		for bin := range bins {
+			result = append(result, bin)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// ParseBAMIndex parses the index of a BAM file. The index is looked
+// up as name + ".bai", as name with the .bam extension replaced by
+// .bai, or as name + ".csi", in that order.
+func ParseBAMIndex(name string) (BAMIndex, error) {
+	for _, indexName := range []string{name + ".bai", strings.TrimSuffix(name, BamExt) + ".bai"} {
+		if _, err := os.Stat(indexName); err == nil {
+			return ParseBAI(indexName)
+		}
+	}
+	if _, err := os.Stat(name + ".csi"); err == nil {
+		return ParseCSI(name + ".csi")
+	}
+	return nil, fmt.Errorf("no .bai or .csi index found for %v", name)
+}
+
+// regionToBins returns the bins that may contain alignments that
+// overlap with the 0-based, half-open range [beg, end). See
+// http://samtools.github.io/hts-specs/SAMv1.pdf - Section 5.3.
+func regionToBins(beg, end int32) (bins []uint32) {
+	end--
+	bins = append(bins, 0)
+	for _, level := range []struct {
+		offset int32
+		shift  uint
+	}{{1, 26}, {9, 23}, {73, 20}, {585, 17}, {4681, 14}} {
+		for k := level.offset + beg>>level.shift; k <= level.offset+end>>level.shift; k++ {
+			bins = append(bins, uint32(k))
+		}
+	}
+	return bins
+}
+
+// Chunks implements the method of the BAMIndex interface.
+func (index *BAI) Chunks(refID int, beg, end int32) []Chunk {
+	if refID < 0 || refID >= len(index.References) || beg >= end {
+		return nil
+	}
+	ref := &index.References[refID]
+	var minOffset VirtualOffset
+	if n := len(ref.Intervals); n > 0 {
+		if window := int(beg >> 14); window < n {
+			minOffset = ref.Intervals[window]
+		} else {
+			minOffset = ref.Intervals[n-1]
+		}
+	}
+	var chunks []Chunk
+	for _, bin := range regionToBins(beg, end) {
+		for _, chunk := range ref.Bins[bin] {
+			if chunk.End > minOffset {
+				chunks = append(chunks, chunk)
+			}
+		}
+	}
+	return mergeChunks(chunks)
+}
+
+// Sorts chunks, and merges chunks that overlap or are adjacent.
+func mergeChunks(chunks []Chunk) []Chunk {
+	if len(chunks) == 0 {
+		return nil
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Begin < chunks[j].Begin
+	})
+	merged := chunks[:1]
+	for _, chunk := range chunks[1:] {
+		last := &merged[len(merged)-1]
+		if chunk.Begin <= last.End {
+			if chunk.End > last.End {
+				last.End = chunk.End
+			}
+		} else {
+			merged = append(merged, chunk)
+		}
+	}
+	return merged
+}
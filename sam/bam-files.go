@@ -196,7 +196,7 @@ func parseBamU32(record []byte, index int) (value interface{}, newIndex int) {
 // it as an float32. See http://samtools.github.io/hts-specs/SAMv1.pdf - Section
 // 4.2.4.
 func parseBamFloat(record []byte, index int) (value interface{}, newIndex int) {
-	return math.Float32frombits(binary.LittleEndian.Uint32(record[index : index+2])), index + 2
+	return math.Float32frombits(binary.LittleEndian.Uint32(record[index : index+4])), index + 4
 }
 
 // parseBamString parses a Z optional field in a BAM alignment record and returns
@@ -219,7 +219,7 @@ func parseBamString(record []byte, index int) (value interface{}, newIndex int)
 // 4.2.4.
 func parseBamByteArray(record []byte, index int) (value interface{}, newIndex int) {
 	for end := index; end < len(record); end++ {
-		if record[end] == '0' {
+		if record[end] == 0 {
 			result := ByteArray(make([]byte, 0, (end-index)>>1))
 			for i := index; i < end; i += 2 {
 				val, err := strconv.ParseUint(string(record[i:i+2]), 16, 8)
@@ -394,34 +394,127 @@ func parseBamAlignment(record []byte, references []BAMReference) (*Alignment, er
 	aln.QUAL = append([]byte(nil), record[index:index+int(lSeq)]...)
 	index += int(lSeq)
 
-	for index < len(record) {
-		tag := utils.Intern(string(record[index : index+2]))
-		typebyte := record[index+2]
-		index += 3
-		value, newIndex := optionalBAMFieldParseTable[typebyte](record, index)
-		if tag == cg && typebyte == 'B' {
-			if cigars, ok := value.([]uint32); ok {
-				if len(aln.CIGAR) > 0 {
-					if op := aln.CIGAR[0]; op.Operation == 'S' && int(op.Length) == aln.SEQ.Len() {
-						aln.CIGAR = aln.CIGAR[:0]
-						for _, cigar := range cigars {
-							aln.CIGAR = append(aln.CIGAR, CigarOperation{
-								Length:    int32(cigar >> 4),
-								Operation: cigarOps[int(0xF&cigar)],
-							})
+	if index < len(record) {
+		hasCG, err := checkBamTags(record[index:])
+		if err != nil {
+			return nil, err
+		}
+		if hasCG && isCigarPlaceholder(aln.CIGAR, aln.SEQ.Len()) {
+			aln.TAGS = parseBamTags(record[index:])
+			if value, ok := aln.TAGS.Get(cg); ok {
+				if cigars, ok := value.([]uint32); ok {
+					aln.CIGAR = make([]CigarOperation, len(cigars))
+					for i, cigar := range cigars {
+						aln.CIGAR[i] = CigarOperation{
+							Length:    int32(cigar >> 4),
+							Operation: cigarOps[int(0xF&cigar)],
 						}
 					}
+					aln.TAGS, _ = aln.TAGS.Delete(cg)
 				}
-				continue
 			}
+		} else {
+			aln.rawTags = append([]byte(nil), record[index:]...)
 		}
-		aln.TAGS = append(aln.TAGS, utils.SmallMapEntry{Key: tag, Value: value})
-		index = newIndex
 	}
 
 	return aln, nil
 }
 
+// Returns the size of the value of an optional field of the given
+// type that starts at the given index in the optional fields of a BAM
+// alignment record, or an error if the value is malformed.
+func bamTagValueSize(tags []byte, index int, typebyte byte) (int, error) {
+	var size int
+	switch typebyte {
+	case 'A', 'c', 'C':
+		size = 1
+	case 's', 'S':
+		size = 2
+	case 'i', 'I', 'f':
+		size = 4
+	case 'Z', 'H':
+		end := bytes.IndexByte(tags[index:], 0)
+		if end < 0 {
+			return 0, errors.New("missing NUL byte in an optional string field in a BAM alignment record")
+		}
+		size = end + 1
+	case 'B':
+		if index+5 > len(tags) {
+			return 0, errors.New("truncated numeric array in a BAM alignment record")
+		}
+		var elementSize int
+		switch tags[index] {
+		case 'c', 'C':
+			elementSize = 1
+		case 's', 'S':
+			elementSize = 2
+		case 'i', 'I', 'f':
+			elementSize = 4
+		default:
+			return 0, errors.New("invalid subtype in a numeric array in a BAM alignment record")
+		}
+		count := int64(binary.LittleEndian.Uint32(tags[index+1 : index+5]))
+		if count*int64(elementSize) > int64(len(tags)-index-5) {
+			return 0, errors.New("truncated numeric array in a BAM alignment record")
+		}
+		size = 5 + int(count)*elementSize
+	default:
+		return 0, fmt.Errorf("invalid type %v for optional field %v in BAM alignment record", string(typebyte), string(tags[index-3:index-1]))
+	}
+	if index+size > len(tags) {
+		return 0, errors.New("truncated optional field in a BAM alignment record")
+	}
+	return size, nil
+}
+
+// Checks that the optional fields of a BAM alignment record are well
+// formed without decoding them, and reports whether there is a CG
+// optional field.
+func checkBamTags(tags []byte) (hasCG bool, err error) {
+	for index := 0; index < len(tags); {
+		if index+3 > len(tags) {
+			return false, errors.New("truncated optional field in a BAM alignment record")
+		}
+		if tags[index] == 'C' && tags[index+1] == 'G' {
+			hasCG = true
+		}
+		size, err := bamTagValueSize(tags, index+3, tags[index+2])
+		if err != nil {
+			return false, err
+		}
+		index += 3 + size
+	}
+	return hasCG, nil
+}
+
+// Decodes the well-formed optional fields of a BAM alignment record.
+func parseBamTags(tags []byte) (result utils.SmallMap) {
+	for index := 0; index < len(tags); {
+		tag := utils.Intern(string(tags[index : index+2]))
+		value, newIndex := optionalBAMFieldParseTable[tags[index+2]](tags, index+3)
+		result = append(result, utils.SmallMapEntry{Key: tag, Value: value})
+		index = newIndex
+	}
+	return result
+}
+
+// Decodes the value of the given optional field in the well-formed
+// optional fields of a BAM alignment record, without decoding the
+// other optional fields.
+func findBamTag(tags []byte, tag utils.Symbol) (interface{}, bool) {
+	key := *tag
+	for index := 0; index < len(tags); {
+		if len(key) == 2 && tags[index] == key[0] && tags[index+1] == key[1] {
+			value, _ := optionalBAMFieldParseTable[tags[index+2]](tags, index+3)
+			return value, true
+		}
+		size, _ := bamTagValueSize(tags, index+3, tags[index+2])
+		index += 3 + size
+	}
+	return nil, false
+}
+
 func enlarge(out []byte, by int) (int, []byte) {
 	index := len(out)
 	length := index + by
@@ -462,7 +555,20 @@ func (hdr *Header) FormatBam(out []byte) []byte {
 	return out
 }
 
-var cigarConsumesReferenceBases = map[byte]int32{'M': 1, 'D': 1, 'N': 1, '=': 1, 'X': 1}
+var (
+	cigarConsumesReferenceBases = map[byte]int32{'M': 1, 'D': 1, 'N': 1, '=': 1, 'X': 1}
+	cigarConsumesReadBases      = map[byte]int32{'M': 1, 'I': 1, 'S': 1, '=': 1, 'X': 1}
+)
+
+// isCigarPlaceholder determines whether the CIGAR string of a BAM
+// alignment record is the placeholder kSmN for a CIGAR string with
+// more than 65535 operations, which is then stored in the CG tag. See
+// http://samtools.github.io/hts-specs/SAMv1.pdf - Section 4.2.2.
+func isCigarPlaceholder(cigar []CigarOperation, seqLength int) bool {
+	return len(cigar) == 2 &&
+		cigar[0].Operation == 'S' && (seqLength == 0 || int(cigar[0].Length) == seqLength) &&
+		cigar[1].Operation == 'N'
+}
 
 func (aln *Alignment) bin() uint16 {
 	beg := aln.POS - 1
@@ -722,11 +828,12 @@ func formatBamAlignment(aln *Alignment, out []byte, dictTable map[string]uint32)
 		}
 	} else {
 		index, out = enlarge(out, 2*4)
-		binary.LittleEndian.PutUint32(out[index:index+4], uint32(int32(aln.SEQ.Len()<<4)|int32(cigarMap['S'])))
-		var m int32
+		var k, m int32
 		for _, op := range aln.CIGAR {
+			k += cigarConsumesReadBases[op.Operation] * op.Length
 			m += cigarConsumesReferenceBases[op.Operation] * op.Length
 		}
+		binary.LittleEndian.PutUint32(out[index:index+4], uint32((k<<4)|int32(cigarMap['S'])))
 		binary.LittleEndian.PutUint32(out[index+4:index+8], uint32((m<<4)|int32(cigarMap['N'])))
 	}
 
@@ -737,7 +844,17 @@ func formatBamAlignment(aln *Alignment, out []byte, dictTable map[string]uint32)
 	index, out = enlarge(out, len(aln.QUAL))
 	copy(out[index:], aln.QUAL)
 
+	if len(aln.CIGAR) <= math.MaxUint16 {
+		// Optional fields that were not decoded are copied verbatim.
+		out = append(out, aln.rawTags...)
+	} else {
+		aln.DecodeTags()
+	}
 	for _, entry := range aln.TAGS {
+		if entry.Key == cg && len(aln.CIGAR) > math.MaxUint16 {
+			// Replaced by the CIGAR string below.
+			continue
+		}
 		var err error
 		if out, err = formatBamTag(out, entry.Key, entry.Value); err != nil {
 			return nil, err
@@ -859,10 +976,23 @@ type bamWriter struct {
 	dictTable map[string]uint32
 	bgzf      *BGZFWriter
 	wc        io.Closer
+	// The index that is built while writing, if any, and the
+	// position in the uncompressed data.
+	indexFormat IndexFormat
+	indexName   string
+	index       *indexBuilder
+	offsetMap   *offsetMapBuilder
+	position    int64
 }
 
 func (writer *bamWriter) Close() (err error) {
 	err = writer.bgzf.Close()
+	if err == nil && writer.indexFormat != NoIndex {
+		err = writer.writeIndex()
+	}
+	if err == nil && writer.offsetMap != nil {
+		err = writer.offsetMap.write(writer.bgzf.virtualOffset)
+	}
 	if writer.wc != os.Stdout {
 		if nerr := writer.wc.Close(); err == nil {
 			err = nerr
@@ -871,15 +1001,34 @@ func (writer *bamWriter) Close() (err error) {
 	return
 }
 
-// FormatHeader implements the method of the AlignmentFileWriter interface.
-func (writer *bamWriter) FormatHeader(hdr *Header) error {
+// bamDictTable maps the reference sequence names of the header to
+// their BAM reference IDs.
+func bamDictTable(hdr *Header) map[string]uint32 {
 	dictTable := make(map[string]uint32)
 	dictTable["*"] = minus1
 	for index, entry := range hdr.SQ {
 		dictTable[entry["SN"]] = uint32(index)
 	}
-	writer.dictTable = dictTable
-	_, err := writer.Write(hdr.FormatBam(nil))
+	return dictTable
+}
+
+// FormatHeader implements the method of the AlignmentFileWriter interface.
+func (writer *bamWriter) FormatHeader(hdr *Header) error {
+	writer.dictTable = bamDictTable(hdr)
+	if writer.indexFormat != NoIndex {
+		index, err := newIndexBuilder(hdr, writer.indexFormat)
+		if err != nil {
+			return err
+		}
+		writer.index = index
+	}
+	if writer.offsetMap != nil {
+		if err := writer.offsetMap.setHeader(hdr); err != nil {
+			return err
+		}
+	}
+	n, err := writer.bgzf.Write(hdr.FormatBam(nil))
+	writer.position += int64(n)
 	return err
 }
 
@@ -890,5 +1039,15 @@ func (writer *bamWriter) FormatAlignment(aln *Alignment, out []byte) ([]byte, er
 
 // Write implements the method of the io.Writer interface.
 func (writer *bamWriter) Write(p []byte) (n int, err error) {
+	if writer.index != nil || writer.offsetMap != nil {
+		begin := writer.position
+		writer.position += int64(len(p))
+		if writer.index != nil {
+			writer.index.add(p[4:], begin, writer.position)
+		}
+		if writer.offsetMap != nil {
+			writer.offsetMap.add(p[4:], begin, writer.position)
+		}
+	}
 	return writer.bgzf.Write(p)
 }
@@ -0,0 +1,101 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestLongCigar(t *testing.T) {
+	seq, qual := strings.Repeat("A", 210000), strings.Repeat("I", 210000)
+	aln, err := (*samReader)(nil).ParseAlignment([]byte("long\t0\tchr1\t100\t60\t*\t*\t0\t0\t" + seq + "\t" + qual + "\tNM:i:70000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 70000; i++ {
+		aln.CIGAR = append(aln.CIGAR, CigarOperation{Length: 2, Operation: 'M'}, CigarOperation{Length: 1, Operation: 'I'})
+	}
+	dictTable := map[string]uint32{"chr1": 0}
+	references := []BAMReference{{Name: "chr1", Length: 1000000}}
+	record, err := formatBamAlignment(aln, nil, dictTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseBamAlignment(record[4:], references)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.CIGAR, aln.CIGAR) {
+		t.Error("long CIGAR round trip failed")
+	}
+	if len(parsed.TAGS) != 1 || parsed.TAGS[0].Value != aln.TAGS[0].Value {
+		t.Error("long CIGAR tags failed", parsed.TAGS)
+	}
+	if _, pos, end := bamRecordSpan(record[4:]); pos != 99 || end != 99+140000 {
+		t.Error("long CIGAR span failed", pos, end)
+	}
+}
+
+func TestLazyBamTags(t *testing.T) {
+	line := "r1\t0\tchr1\t100\t60\t4M\t*\t0\t0\tACGT\tIIII\tRG:Z:lane\tNM:i:1\tXb:B:s,-3,7"
+	aln, err := (*samReader)(nil).ParseAlignment([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dictTable := map[string]uint32{"chr1": 0}
+	references := []BAMReference{{Name: "chr1", Length: 1000}}
+	record, err := formatBamAlignment(aln, nil, dictTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseBamAlignment(record[4:], references)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.TAGS) != 0 || parsed.rawTags == nil {
+		t.Error("lazy BAM tags not kept raw")
+	}
+	if rg, ok := parsed.TagString(RG); !ok || rg != "lane" || !parsed.HasTag(utils.Intern("Xb")) || parsed.rawTags == nil {
+		t.Error("lazy BAM tag lookup failed")
+	}
+	formatted, err := formatBamAlignment(parsed, nil, dictTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != string(record) {
+		t.Error("lazy BAM tags not copied verbatim")
+	}
+	if err := parsed.SetTag(utils.Intern("NM"), 2); err != nil || parsed.rawTags != nil || len(parsed.TAGS) != 3 {
+		t.Error("lazy BAM tag decoding failed", parsed.TAGS)
+	}
+	samLine, err := formatSamAlignment(parsed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(samLine) != strings.Replace(line, "NM:i:1", "NM:i:2", 1)+"\n" {
+		t.Error("lazy BAM tags SAM formatting failed", string(samLine))
+	}
+	if _, err := parseBamAlignment(record[4:len(record)-2], references); err == nil {
+		t.Error("truncated BAM tags not detected")
+	}
+}
@@ -0,0 +1,308 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// IndexFormat selects the index that CreateIndexed writes along with
+// a BAM file.
+type IndexFormat int
+
+const (
+	// NoIndex means that no index is written.
+	NoIndex IndexFormat = iota
+	// BAIIndex means that a .bai index is written.
+	BAIIndex
+	// CSIIndex means that a .csi index is written.
+	CSIIndex
+)
+
+// ParseIndexFormat parses the name of an index format, which is
+// either "bai" or "csi". The empty string means NoIndex.
+func ParseIndexFormat(s string) (IndexFormat, error) {
+	switch s {
+	case "":
+		return NoIndex, nil
+	case "bai":
+		return BAIIndex, nil
+	case "csi":
+		return CSIIndex, nil
+	default:
+		return NoIndex, fmt.Errorf("unknown index format %v", s)
+	}
+}
+
+// CreateIndexed creates a SAM or BAM file for output, like
+// CreateFormat. If the index format is BAIIndex or CSIIndex, then a
+// .bai or .csi index is built while the alignments are written, and
+// stored next to the BAM file when the OutputFile is closed. This
+// requires that the output is a BAM file, and that the alignments are
+// written in coordinate order, which is checked while the index is
+// built.
+func CreateIndexed(name string, format OutputFormat, index IndexFormat) (*OutputFile, error) {
+	if index == NoIndex {
+		return CreateFormat(name, format)
+	}
+	if resolved := ResolveOutputFormat(name, format); resolved != BamFormat && resolved != UncompressedBamFormat {
+		return nil, fmt.Errorf("cannot write an index for %v: only BAM files can be indexed", name)
+	}
+	if name == "/dev/stdout" {
+		return nil, fmt.Errorf("cannot write an index for BAM output to %v", name)
+	}
+	output, err := CreateFormat(name, format)
+	if err != nil {
+		return nil, err
+	}
+	writer := output.writer.(*bamWriter)
+	writer.bgzf.recordOffsets = true
+	writer.indexFormat = index
+	if index == BAIIndex {
+		writer.indexName = name + ".bai"
+	} else {
+		writer.indexName = name + ".csi"
+	}
+	return output, nil
+}
+
+// An indexChunk is a range of positions in the uncompressed data of a
+// BAM file. Positions are only converted into virtual offsets once all
+// BGZF blocks are compressed.
+type indexChunk struct {
+	begin, end int64
+}
+
+// A referenceIndexBuilder collects the index information for one
+// reference sequence.
+type referenceIndexBuilder struct {
+	bins map[uint32][]indexChunk
+	// windows[i] is the smallest position of the alignments that
+	// overlap with window i of size 1<<minShift, or -1 if there are
+	// none.
+	windows          []int64
+	begin, end       int64
+	mapped, unmapped uint64
+}
+
+// An indexBuilder builds a BAI or CSI index from the raw alignment
+// records of a coordinate-sorted BAM file, as they are written.
+type indexBuilder struct {
+	minShift, depth int32
+	references      []referenceIndexBuilder
+	lastRefID       int32
+	lastPos         int32
+	noCoordinate    int64
+	err             error
+}
+
+// Returns an indexBuilder for a BAM file with the given header. BAI
+// indexes use the fixed binning scheme with 16kbp windows and five
+// levels. CSI indexes use 16kbp windows as well, and as many levels as
+// needed for the longest reference sequence, as in samtools.
+func newIndexBuilder(hdr *Header, format IndexFormat) (*indexBuilder, error) {
+	var maxLength int64
+	for _, sq := range hdr.SQ {
+		length, err := SQLN(sq)
+		if err != nil {
+			return nil, err
+		}
+		if format == BAIIndex && length > 1<<29 {
+			return nil, fmt.Errorf("reference sequence %v is too long for a BAI index, use a CSI index instead", sq["SN"])
+		}
+		if int64(length) > maxLength {
+			maxLength = int64(length)
+		}
+	}
+	builder := &indexBuilder{
+		minShift:   14,
+		depth:      5,
+		references: make([]referenceIndexBuilder, len(hdr.SQ)),
+	}
+	if format == CSIIndex {
+		builder.depth = 0
+		for size := int64(1) << 14; maxLength+256 > size; size <<= 3 {
+			builder.depth++
+		}
+	}
+	return builder, nil
+}
+
+// Adds a raw alignment record, without its block_size field, that
+// occupies the given positions in the uncompressed data.
+func (builder *indexBuilder) add(record []byte, begin, end int64) {
+	if builder.err != nil {
+		return
+	}
+	refID, pos, recordEnd := bamRecordSpan(record)
+	// Unplaced reads, with refID -1, come last.
+	if uint32(refID) < uint32(builder.lastRefID) || (refID == builder.lastRefID && pos < builder.lastPos) {
+		builder.err = errors.New("cannot write an index for BAM output that is not sorted by coordinate")
+		return
+	}
+	builder.lastRefID, builder.lastPos = refID, pos
+	if refID < 0 {
+		builder.noCoordinate++
+		return
+	}
+	if int(refID) >= len(builder.references) {
+		builder.err = fmt.Errorf("invalid reference sequence index %v while writing an index", refID)
+		return
+	}
+	ref := &builder.references[refID]
+	if ref.bins == nil {
+		ref.bins = make(map[uint32][]indexChunk)
+		ref.begin = begin
+	}
+	ref.end = end
+	if binary.LittleEndian.Uint16(record[flagIndex:flagIndex+2])&Unmapped != 0 {
+		ref.unmapped++
+	} else {
+		ref.mapped++
+	}
+	bin := regionToCSIBin(pos, recordEnd, builder.minShift, builder.depth)
+	chunks := ref.bins[bin]
+	if n := len(chunks); n > 0 && chunks[n-1].end == begin {
+		chunks[n-1].end = end
+	} else {
+		ref.bins[bin] = append(chunks, indexChunk{begin, end})
+	}
+	for window := int(pos >> uint(builder.minShift)); window <= int((recordEnd-1)>>uint(builder.minShift)); window++ {
+		for len(ref.windows) <= window {
+			ref.windows = append(ref.windows, -1)
+		}
+		if ref.windows[window] < 0 {
+			ref.windows[window] = begin
+		}
+	}
+}
+
+// Fills the windows without alignments with the position of the
+// closest window to their left, or the first alignment of the
+// reference sequence, so that they can serve as a lower bound.
+func (ref *referenceIndexBuilder) fillWindows() {
+	last := ref.begin
+	for i, position := range ref.windows {
+		if position < 0 {
+			ref.windows[i] = last
+		} else {
+			last = position
+		}
+	}
+}
+
+// Returns the chunks of a bin as virtual offsets.
+func virtualChunks(chunks []indexChunk, offset func(int64) VirtualOffset) []Chunk {
+	result := make([]Chunk, len(chunks))
+	for i, chunk := range chunks {
+		result[i] = Chunk{offset(chunk.begin), offset(chunk.end)}
+	}
+	return result
+}
+
+// Returns the chunks of the pseudo-bin that samtools uses for the
+// range of a reference sequence in the file and its numbers of mapped
+// and unmapped reads.
+func (ref *referenceIndexBuilder) metadata(offset func(int64) VirtualOffset) []Chunk {
+	return []Chunk{
+		{offset(ref.begin), offset(ref.end)},
+		{VirtualOffset(ref.mapped), VirtualOffset(ref.unmapped)},
+	}
+}
+
+// Returns the BAI index, converting positions in the uncompressed
+// data into virtual offsets with the given function.
+func (builder *indexBuilder) bai(offset func(int64) VirtualOffset) *BAI {
+	index := &BAI{References: make([]BAIReference, len(builder.references)), NoCoordinate: builder.noCoordinate}
+	for i := range builder.references {
+		ref := &builder.references[i]
+		bins := make(map[uint32][]Chunk, len(ref.bins)+1)
+		if ref.bins != nil {
+			for bin, chunks := range ref.bins {
+				bins[bin] = virtualChunks(chunks, offset)
+			}
+			bins[binLimit] = ref.metadata(offset)
+		}
+		ref.fillWindows()
+		intervals := make([]VirtualOffset, len(ref.windows))
+		for j, position := range ref.windows {
+			intervals[j] = offset(position)
+		}
+		index.References[i] = BAIReference{Bins: bins, Intervals: intervals}
+	}
+	return index
+}
+
+// Returns the CSI index, converting positions in the uncompressed
+// data into virtual offsets with the given function. The loffset of
+// each bin is the smallest position of the alignments that overlap
+// with the start of the bin.
+func (builder *indexBuilder) csi(offset func(int64) VirtualOffset) *CSI {
+	index := NewCSI(builder.minShift, builder.depth)
+	index.References = make([]map[uint32]CSIBin, len(builder.references))
+	index.NoCoordinate = builder.noCoordinate
+	for i := range builder.references {
+		ref := &builder.references[i]
+		bins := make(map[uint32]CSIBin, len(ref.bins)+1)
+		if ref.bins != nil {
+			ref.fillWindows()
+			for bin, chunks := range ref.bins {
+				level := builder.depth
+				for bin < firstBin(level) {
+					level--
+				}
+				window := int(bin-firstBin(level)) << uint(3*(builder.depth-level))
+				loffset := ref.begin
+				if window < len(ref.windows) {
+					loffset = ref.windows[window]
+				}
+				bins[bin] = CSIBin{Loffset: offset(loffset), Chunks: virtualChunks(chunks, offset)}
+			}
+			bins[firstBin(builder.depth+1)+1] = CSIBin{Chunks: ref.metadata(offset)}
+		}
+		index.References[i] = bins
+	}
+	return index
+}
+
+// Writes the index after the BGZF stream of the BAM file is closed.
+func (writer *bamWriter) writeIndex() (err error) {
+	if writer.index == nil {
+		return errors.New("cannot write an index for BAM output without a header")
+	}
+	if writer.index.err != nil {
+		return writer.index.err
+	}
+	file, err := os.Create(writer.indexName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	if writer.indexFormat == BAIIndex {
+		return writer.index.bai(writer.bgzf.virtualOffset).Write(file)
+	}
+	return writer.index.csi(writer.bgzf.virtualOffset).Write(file)
+}
@@ -0,0 +1,463 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Locus is a range of a reference sequence, given as a 0-based,
+// half-open range [Start, End).
+type Locus struct {
+	RNAME      string
+	Start, End int32
+}
+
+// ParseLocus parses a locus in the notation of samtools: "chr1" for a
+// complete reference sequence, "chr1:100" for the part starting at
+// position 100, or "chr1:100-200" for positions 100 to 200. Positions
+// are 1-based and inclusive, as in SAM files.
+func ParseLocus(s string) (Locus, error) {
+	locus := Locus{RNAME: s, End: math.MaxInt32}
+	colon := strings.LastIndexByte(s, ':')
+	if colon < 0 {
+		return locus, nil
+	}
+	locus.RNAME = s[:colon]
+	positions := s[colon+1:]
+	from, to := positions, ""
+	if dash := strings.IndexByte(positions, '-'); dash >= 0 {
+		from, to = positions[:dash], positions[dash+1:]
+	}
+	start, err := strconv.ParseInt(from, 10, 32)
+	if err != nil || start < 1 {
+		return Locus{}, fmt.Errorf("invalid start position in locus %v", s)
+	}
+	locus.Start = int32(start - 1)
+	if to != "" {
+		end, err := strconv.ParseInt(to, 10, 32)
+		if err != nil || end < start {
+			return Locus{}, fmt.Errorf("invalid end position in locus %v", s)
+		}
+		locus.End = int32(end)
+	}
+	return locus, nil
+}
+
+// A seekableBGZFReader reads a BGZF file sequentially, one block at
+// a time, and supports seeking to virtual offsets. Unlike BGZFReader,
+// it does not decompress blocks in parallel, which is not worth it
+// for the short stretches read for a region query.
+type seekableBGZFReader struct {
+	r io.ReadSeeker
+	// The offset of the current block, and of the next block.
+	blockOffset, nextOffset int64
+	header                  [18]byte
+	compressed              []byte
+	data                    []byte
+	index                   int
+	flate                   io.ReadCloser
+}
+
+// Reads the block at nextOffset. Returns io.EOF at the end of the file.
+func (bgzf *seekableBGZFReader) readBlock() error {
+	if _, err := io.ReadFull(bgzf.r, bgzf.header[:12]); err != nil {
+		return err
+	}
+	if bgzf.header[0] != 0x1f || bgzf.header[1] != 0x8b || bgzf.header[2] != 8 || bgzf.header[3]&4 == 0 {
+		return errors.New("invalid BGZF block header")
+	}
+	xlen := int(binary.LittleEndian.Uint16(bgzf.header[10:12]))
+	extra := make([]byte, xlen)
+	if _, err := io.ReadFull(bgzf.r, extra); err != nil {
+		return err
+	}
+	bsize := -1
+	for i := 0; i+4 <= xlen; {
+		slen := int(binary.LittleEndian.Uint16(extra[i+2 : i+4]))
+		if extra[i] == 66 && extra[i+1] == 67 && slen == 2 && i+6 <= xlen {
+			bsize = int(binary.LittleEndian.Uint16(extra[i+4 : i+6]))
+			break
+		}
+		i += 4 + slen
+	}
+	if bsize < 0 {
+		return errors.New("missing BC extra subfield in BGZF header")
+	}
+	size := bsize - xlen - 19
+	if size < 0 {
+		return errors.New("invalid BGZF block size")
+	}
+	if cap(bgzf.compressed) < size+8 {
+		bgzf.compressed = make([]byte, size+8)
+	}
+	bgzf.compressed = bgzf.compressed[:size+8]
+	if _, err := io.ReadFull(bgzf.r, bgzf.compressed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	crc := binary.LittleEndian.Uint32(bgzf.compressed[size : size+4])
+	isize := int(binary.LittleEndian.Uint32(bgzf.compressed[size+4 : size+8]))
+	if isize > maxBgzfBlockSize {
+		return errors.New("invalid BGZF block size")
+	}
+	blockReader := byteReader(bgzf.compressed[:size])
+	if bgzf.flate == nil {
+		bgzf.flate = flate.NewReader(&blockReader)
+	} else if err := bgzf.flate.(flate.Resetter).Reset(&blockReader, nil); err != nil {
+		return err
+	}
+	if cap(bgzf.data) < isize {
+		bgzf.data = make([]byte, isize, maxBgzfBlockSize)
+	}
+	bgzf.data = bgzf.data[:isize]
+	if _, err := io.ReadFull(bgzf.flate, bgzf.data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if crc32.ChecksumIEEE(bgzf.data) != crc {
+		return errors.New("invalid CRC-32 value for a data block in a BGZF file")
+	}
+	bgzf.blockOffset = bgzf.nextOffset
+	bgzf.nextOffset += int64(bsize) + 1
+	bgzf.index = 0
+	return nil
+}
+
+// A byteReader is a minimal io.ByteReader over a byte slice, so that
+// flate does not wrap it in a bufio.Reader.
+type byteReader []byte
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, *r)
+	*r = (*r)[n:]
+	return n, nil
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	b := (*r)[0]
+	*r = (*r)[1:]
+	return b, nil
+}
+
+// Seek moves to the given virtual offset.
+func (bgzf *seekableBGZFReader) Seek(offset VirtualOffset) error {
+	if _, err := bgzf.r.Seek(offset.BlockOffset(), io.SeekStart); err != nil {
+		return err
+	}
+	bgzf.nextOffset = offset.BlockOffset()
+	if err := bgzf.readBlock(); err != nil {
+		return err
+	}
+	if offset.DataOffset() > len(bgzf.data) {
+		return errors.New("invalid virtual offset in BGZF file")
+	}
+	bgzf.index = offset.DataOffset()
+	return nil
+}
+
+// Tell returns the virtual offset of the next byte to be read. At the
+// end of a block, this is the start of the next block.
+func (bgzf *seekableBGZFReader) Tell() VirtualOffset {
+	if bgzf.index == len(bgzf.data) {
+		return NewVirtualOffset(bgzf.nextOffset, 0)
+	}
+	return NewVirtualOffset(bgzf.blockOffset, bgzf.index)
+}
+
+// Read implements the corresponding method of io.Reader.
+func (bgzf *seekableBGZFReader) Read(p []byte) (n int, err error) {
+	for bgzf.index == len(bgzf.data) {
+		if err = bgzf.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, bgzf.data[bgzf.index:])
+	bgzf.index += n
+	return n, nil
+}
+
+// A regionBamReader is an alignmentReader for the alignments of an
+// indexed BAM file that overlap with a set of loci.
+type regionBamReader struct {
+	file       *os.File
+	bgzf       seekableBGZFReader
+	index      BAMIndex
+	loci       []Locus
+	aliases    ContigAliases
+	references []BAMReference
+	// The loci per reference sequence index, sorted by start position.
+	refLoci map[int32][]Locus
+	chunks  []Chunk
+	err     error
+	buf     []byte
+	data    interface{}
+}
+
+// OpenRegions opens an indexed BAM file for input, restricted to the
+// alignments that overlap with at least one of the given loci. Only
+// the parts of the file that the index refers to for these loci are
+// read and decompressed, which is much faster than reading the whole
+// file if the loci cover a small part of the genome, as for targeted
+// sequencing panels. The alignments are produced in the order of the
+// file, and each of them is produced only once, even if it overlaps
+// with several loci.
+//
+// The index is read with ParseBAMIndex, and can be either a BAI or a
+// CSI. If no loci are given, OpenRegions is the same as Open.
+//
+// The reference sequences of the loci are resolved with
+// Header.ContigNames, so they may also be given by the alternative
+// names in the AN fields of the @SQ lines.
+func OpenRegions(name string, loci []Locus) (*InputFile, error) {
+	return OpenRegionsWithAliases(name, loci, nil)
+}
+
+// OpenRegionsWithAliases is like OpenRegions, but the reference
+// sequences of the loci may also be given by the names that the given
+// aliases list together with the names in the BAM header.
+//
+// If the name is an htsget URL, the loci are passed to the server
+// with OpenHtsget instead, and no index is needed.
+func OpenRegionsWithAliases(name string, loci []Locus, aliases ContigAliases) (*InputFile, error) {
+	if len(loci) == 0 {
+		return Open(name)
+	}
+	if IsHtsgetURL(name) {
+		return OpenHtsget(name, loci, aliases)
+	}
+	if filepath.Ext(name) != BamExt {
+		return nil, fmt.Errorf("region queries require an indexed BAM file, not %v", name)
+	}
+	index, err := ParseBAMIndex(name)
+	if err != nil {
+		return nil, fmt.Errorf("%v, while reading the index of %v", err, name)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &InputFile{
+		reader: &regionBamReader{
+			file:    file,
+			bgzf:    seekableBGZFReader{r: file},
+			index:   index,
+			loci:    loci,
+			aliases: aliases,
+		},
+	}, nil
+}
+
+// Close the BAM input file.
+func (reader *regionBamReader) Close() error {
+	return reader.file.Close()
+}
+
+// Resolves the reference sequences of the loci with
+// Header.ContigNames, and returns the loci per reference sequence
+// index, sorted by start position.
+func resolveLoci(hdr *Header, references []BAMReference, loci []Locus, aliases ContigAliases) (map[int32][]Locus, error) {
+	refIDs := make(map[string]int32, len(references))
+	for i, ref := range references {
+		refIDs[ref.Name] = int32(i)
+	}
+	names := hdr.ContigNames(aliases)
+	refLoci := make(map[int32][]Locus)
+	for _, locus := range loci {
+		refID, found := refIDs[names[locus.RNAME]]
+		if !found {
+			return nil, fmt.Errorf("unknown reference sequence %v in region query", locus.RNAME)
+		}
+		refLoci[refID] = append(refLoci[refID], locus)
+	}
+	for _, loci := range refLoci {
+		sort.Slice(loci, func(i, j int) bool {
+			return loci[i].Start < loci[j].Start
+		})
+	}
+	return refLoci, nil
+}
+
+// Determines the chunks to read for the loci, once the header is
+// known.
+func (reader *regionBamReader) prepareChunks(hdr *Header) (err error) {
+	if reader.refLoci, err = resolveLoci(hdr, reader.references, reader.loci, reader.aliases); err != nil {
+		return err
+	}
+	var chunks []Chunk
+	for refID, loci := range reader.refLoci {
+		for _, locus := range loci {
+			chunks = append(chunks, reader.index.Chunks(int(refID), locus.Start, locus.End)...)
+		}
+	}
+	reader.chunks = mergeChunks(chunks)
+	reader.buf = make([]byte, 4)
+	return nil
+}
+
+// ParseHeader implements the method of the alignmentReader interface.
+func (reader *regionBamReader) ParseHeader() (hdr *Header, err error) {
+	if err = reader.bgzf.Seek(0); err != nil {
+		return nil, err
+	}
+	if hdr, reader.references, err = ParseBamHeader(&reader.bgzf); err != nil {
+		return nil, err
+	}
+	return hdr, reader.prepareChunks(hdr)
+}
+
+// SkipHeader implements the method of the alignmentReader interface.
+// The header is still parsed, since the loci may refer to the
+// alternative names of the reference sequences.
+func (reader *regionBamReader) SkipHeader() error {
+	_, err := reader.ParseHeader()
+	return err
+}
+
+// Determines whether a BAM alignment record overlaps with one of the
+// loci, given per reference sequence index as by resolveLoci.
+func lociOverlap(refLoci map[int32][]Locus, record []byte) bool {
+	refID, pos, end := bamRecordSpan(record)
+	loci := refLoci[refID]
+	if len(loci) == 0 {
+		return false
+	}
+	for _, locus := range loci {
+		if locus.Start >= end {
+			break
+		}
+		if locus.End > pos {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the reference sequence index of a raw BAM record, and the
+// 0-based, half-open range it covers on that reference sequence,
+// computed from the CIGAR string. Unmapped reads, and reads without
+// reference bases in their CIGAR strings, cover one base, as in
+// samtools.
+func bamRecordSpan(record []byte) (refID, pos, end int32) {
+	refID = int32(binary.LittleEndian.Uint32(record[refIDIndex : refIDIndex+4]))
+	pos = int32(binary.LittleEndian.Uint32(record[posIndex : posIndex+4]))
+	end = pos
+	if binary.LittleEndian.Uint16(record[flagIndex:flagIndex+2])&Unmapped == 0 {
+		nCigarOp := int(binary.LittleEndian.Uint16(record[nCigarOpIndex : nCigarOpIndex+2]))
+		index := readNameIndex + int(record[lReadNameIndex])
+		for i := 0; i < nCigarOp; i, index = i+1, index+4 {
+			cigar := binary.LittleEndian.Uint32(record[index : index+4])
+			end += cigarConsumesReferenceBases[cigarOps[int(0xF&cigar)]] * int32(cigar>>4)
+		}
+	}
+	if end == pos {
+		end = pos + 1
+	}
+	return refID, pos, end
+}
+
+// Err implements the method of the pipeline.Source interface.
+func (reader *regionBamReader) Err() error {
+	return reader.err
+}
+
+// Prepare implements the method of the pipeline.Source interface.
+func (*regionBamReader) Prepare(_ context.Context) (size int) {
+	return -1
+}
+
+// Fetch implements the method of the pipeline.Source interface.
+func (reader *regionBamReader) Fetch(size int) (fetched int) {
+	var records [][]byte
+	for fetched < size && len(reader.chunks) > 0 {
+		chunk := reader.chunks[0]
+		if offset := reader.bgzf.Tell(); offset < chunk.Begin {
+			if err := reader.bgzf.Seek(chunk.Begin); err != nil {
+				reader.err = err
+				reader.data = nil
+				return 0
+			}
+		} else if offset >= chunk.End {
+			reader.chunks = reader.chunks[1:]
+			continue
+		}
+		if _, err := io.ReadFull(&reader.bgzf, reader.buf); err != nil {
+			if err != io.EOF {
+				reader.err = err
+				reader.data = nil
+				return 0
+			}
+			reader.chunks = nil
+			break
+		}
+		length := int(int32(binary.LittleEndian.Uint32(reader.buf)))
+		for cap(reader.buf) < length {
+			reader.buf = append(reader.buf[:cap(reader.buf)], 0)
+		}
+		reader.buf = reader.buf[:length]
+		if _, err := io.ReadFull(&reader.bgzf, reader.buf); err != nil {
+			if err == io.EOF {
+				reader.err = io.ErrUnexpectedEOF
+			} else {
+				reader.err = err
+			}
+			reader.data = nil
+			return 0
+		}
+		if lociOverlap(reader.refLoci, reader.buf) {
+			records = append(records, append([]byte(nil), reader.buf...))
+			fetched++
+		}
+		reader.buf = reader.buf[:4]
+	}
+	reader.data = records
+	return fetched
+}
+
+// Data implements the method of the pipeline.Source interface.
+func (reader *regionBamReader) Data() interface{} {
+	return reader.data
+}
+
+// ParseAlignment implements the method of the alignmentReader interface.
+func (reader *regionBamReader) ParseAlignment(record []byte) (*Alignment, error) {
+	return parseBamAlignment(record, reader.references)
+}
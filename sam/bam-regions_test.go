@@ -0,0 +1,311 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"compress/flate"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// Writes a small coordinate-sorted BAM file, with all records in the
+// first BGZF block, and a matching BAI or CSI file.
+func writeIndexedBam(t *testing.T, name string, lines []string, csi bool) {
+	hdr := NewHeader()
+	hdr.SQ = []utils.StringMap{{"SN": "chr1", "LN": "100000", "AN": "1,NC_000001.11"}, {"SN": "chr2", "LN": "700000000"}}
+	hdr.SetHDSO(Coordinate)
+	dictTable := map[string]uint32{"chr1": 0, "chr2": 1}
+	out := hdr.FormatBam(nil)
+	bai := &BAI{References: make([]BAIReference, 2), NoCoordinate: 0}
+	csiIndex := NewCSI(14, 6)
+	for i := range bai.References {
+		bai.References[i].Bins = make(map[uint32][]Chunk)
+		csiIndex.References = append(csiIndex.References, make(map[uint32]CSIBin))
+	}
+	for _, line := range lines {
+		aln, err := (*samReader)(nil).ParseAlignment([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		begin := NewVirtualOffset(0, len(out))
+		if out, err = formatBamAlignment(aln, out, dictTable); err != nil {
+			t.Fatal(err)
+		}
+		chunk := Chunk{begin, NewVirtualOffset(0, len(out))}
+		refID := dictTable[aln.RNAME]
+		bin := uint32(aln.bin())
+		bai.References[refID].Bins[bin] = append(bai.References[refID].Bins[bin], chunk)
+		beg := aln.POS - 1
+		bin = regionToCSIBin(beg, beg+50, 14, 6)
+		csiIndex.References[refID][bin] = CSIBin{Loffset: begin, Chunks: []Chunk{chunk}}
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bgzf := NewBGZFWriter(file)
+	if _, err := bgzf.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	if err := bgzf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	indexName := name + ".bai"
+	if csi {
+		indexName = name + ".csi"
+	}
+	index, err := os.Create(indexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csi {
+		err = csiIndex.Write(index)
+	} else {
+		err = bai.Write(index)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var indexedBamLines = []string{
+	"r1\t0\tchr1\t100\t60\t50M\t*\t0\t0\t*\t*",
+	"r2\t0\tchr1\t20000\t60\t50M\t*\t0\t0\t*\t*",
+	"r3\t0\tchr2\t10\t60\t50M\t*\t0\t0\t*\t*",
+	"r4\t0\tchr2\t600000000\t60\t50M\t*\t0\t0\t*\t*",
+}
+
+// Returns the names of the reads of a BAM file that overlap with the
+// given regions.
+func queryRegions(t *testing.T, name string, regions ...string) (qnames []string) {
+	var loci []Locus
+	for _, region := range regions {
+		locus, err := ParseLocus(region)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loci = append(loci, locus)
+	}
+	input, err := OpenRegions(name, loci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := NewSam()
+	if err := input.RunPipeline(reads, nil, Keep); err != nil {
+		t.Fatal(err)
+	}
+	if err := input.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, aln := range reads.Alignments {
+		qnames = append(qnames, aln.QNAME)
+	}
+	return qnames
+}
+
+func equalNames(qnames []string, expected ...string) bool {
+	if len(qnames) != len(expected) {
+		return false
+	}
+	for i, qname := range qnames {
+		if qname != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOpenRegions(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.bam")
+	writeIndexedBam(t, name, indexedBamLines[:3], false)
+	if qnames := queryRegions(t, name, "chr1"); !equalNames(qnames, "r1", "r2") {
+		t.Error("OpenRegions chromosome failed", qnames)
+	}
+	if qnames := queryRegions(t, name, "chr1:140-20000"); !equalNames(qnames, "r1", "r2") {
+		t.Error("OpenRegions range failed", qnames)
+	}
+	if qnames := queryRegions(t, name, "chr1:150-19999"); !equalNames(qnames) {
+		t.Error("OpenRegions gap failed", qnames)
+	}
+	if qnames := queryRegions(t, name, "chr2:50", "chr1:1-100"); !equalNames(qnames, "r1", "r3") {
+		t.Error("OpenRegions several loci failed", qnames)
+	}
+	if qnames := queryRegions(t, name, "1:1-200"); !equalNames(qnames, "r1") {
+		t.Error("OpenRegions alternative name failed", qnames)
+	}
+	if _, err := ParseLocus("chr1:200-100"); err == nil {
+		t.Error("ParseLocus failed")
+	}
+}
+
+func TestOpenRegionsCSI(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.bam")
+	writeIndexedBam(t, name, indexedBamLines, true)
+	index, err := ParseBAMIndex(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csi, ok := index.(*CSI); !ok || csi.MinShift != 14 || csi.Depth != 6 || len(csi.References) != 2 {
+		t.Fatal("ParseCSI failed")
+	}
+	if qnames := queryRegions(t, name, "chr2:599999990-600000010"); !equalNames(qnames, "r4") {
+		t.Error("OpenRegions CSI long contig failed", qnames)
+	}
+	if qnames := queryRegions(t, name, "chr1:20000", "chr2:1-100"); !equalNames(qnames, "r2", "r3") {
+		t.Error("OpenRegions CSI failed", qnames)
+	}
+}
+
+// Writes a BAM file with CreateIndexed that spans several BGZF blocks.
+func writeBamWithIndex(t *testing.T, name string, format IndexFormat, lines []string) error {
+	hdr := NewHeader()
+	hdr.SQ = []utils.StringMap{{"SN": "chr1", "LN": "1000000"}, {"SN": "chr2", "LN": "1000000"}}
+	hdr.SetHDSO(Coordinate)
+	output, err := CreateIndexed(name, DefaultFormat, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := output.FormatHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		aln, err := (*samReader)(nil).ParseAlignment([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := output.FormatAlignment(aln, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := output.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return output.Close()
+}
+
+func TestCreateIndexed(t *testing.T) {
+	var lines []string
+	for _, chrom := range []string{"chr1", "chr2"} {
+		for i := 0; i < 4000; i++ {
+			lines = append(lines, fmt.Sprintf("%v-%v\t0\t%v\t%v\t60\t50M\t*\t0\t0\t*\t*", chrom, i, chrom, i*200+1))
+		}
+	}
+	lines = append(lines, "u1\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*")
+	for _, format := range []IndexFormat{BAIIndex, CSIIndex} {
+		name := filepath.Join(t.TempDir(), "test.bam")
+		if err := writeBamWithIndex(t, name, format, lines); err != nil {
+			t.Fatal(err)
+		}
+		qnames := queryRegions(t, name, "chr2:100001-200000")
+		if len(qnames) != 500 || qnames[0] != "chr2-500" || qnames[499] != "chr2-999" {
+			t.Error("CreateIndexed failed", format, len(qnames))
+		}
+		if qnames := queryRegions(t, name, "chr1:799000-799001", "chr2:1-1"); !equalNames(qnames, "chr1-3995", "chr2-0") {
+			t.Error("CreateIndexed failed", format, qnames)
+		}
+	}
+	name := filepath.Join(t.TempDir(), "test.bam")
+	if err := writeBamWithIndex(t, name, BAIIndex, []string{lines[1], lines[0]}); err == nil {
+		t.Error("CreateIndexed unsorted failed")
+	}
+}
+
+func TestBGZFOptions(t *testing.T) {
+	if err := SetBGZFOptions(BGZFOptions{BlockSize: maxBgzfBlockSize + 1}); err == nil {
+		t.Error("SetBGZFOptions block size failed")
+	}
+	if err := SetBGZFOptions(BGZFOptions{Workers: 2, QueueDepth: 4, BlockSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = SetBGZFOptions(BGZFOptions{})
+	}()
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf("r%v\t0\tchr1\t%v\t60\t50M\t*\t0\t0\t*\t*", i, i*100+1))
+	}
+	name := filepath.Join(t.TempDir(), "test.bam")
+	if err := writeBamWithIndex(t, name, BAIIndex, lines); err != nil {
+		t.Fatal(err)
+	}
+	if qnames := queryRegions(t, name, "chr1:49950-50001"); !equalNames(qnames, "r499", "r500") {
+		t.Error("BGZFOptions indexed query failed", qnames)
+	}
+	input, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := NewSam()
+	if err := input.RunPipeline(reads, nil, Keep); err != nil {
+		t.Fatal(err)
+	}
+	if err := input.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reads.Alignments) != 1000 || reads.Alignments[999].QNAME != "r999" {
+		t.Error("BGZFOptions round trip failed")
+	}
+}
+
+func TestBGZFCompressionLevel(t *testing.T) {
+	invalid := 10
+	if err := SetBGZFOptions(BGZFOptions{CompressionLevel: &invalid}); err == nil {
+		t.Error("SetBGZFOptions compression level failed")
+	}
+	defer func() {
+		_ = SetBGZFOptions(BGZFOptions{})
+	}()
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf("r%v\t0\tchr1\t%v\t60\t50M\t*\t0\t0\t*\t*\tXN:i:%v", i, i*100+1, i%7))
+	}
+	var sizes []int64
+	for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.BestCompression} {
+		level := level
+		if err := SetBGZFOptions(BGZFOptions{CompressionLevel: &level}); err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(t.TempDir(), "test.bam")
+		if err := writeBamWithIndex(t, name, BAIIndex, lines); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size())
+		if qnames := queryRegions(t, name, "chr1:49950-50001"); !equalNames(qnames, "r499", "r500") {
+			t.Error("BGZFCompressionLevel query failed", level, qnames)
+		}
+	}
+	if sizes[0] <= sizes[1] || sizes[1] < sizes[2] {
+		t.Error("BGZFCompressionLevel sizes failed", sizes)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"sync"
@@ -35,6 +36,12 @@ import (
 // maxBgzfBlockSize defines the maximum block size for BGZF files.
 const maxBgzfBlockSize = 65536
 
+// maxBgzfDataSize defines the maximum size of the uncompressed data in
+// the blocks written by a BGZFWriter. It is smaller than
+// maxBgzfBlockSize to leave room for the block header and trailer, and
+// for data that does not compress, as with compression level 0.
+const maxBgzfDataSize = 0xff00
+
 var bgzfEOF []byte
 
 func init() {
@@ -73,6 +80,78 @@ type (
 	internalBGZFReader BGZFReader
 )
 
+// BGZFOptions controls the parallelism of BGZFReader and BGZFWriter,
+// independently from the number of threads used by the filters.
+type BGZFOptions struct {
+	// The number of goroutines that compress or decompress blocks in
+	// parallel. If 0, runtime.GOMAXPROCS(0) is used.
+	Workers int
+	// The number of blocks that can be queued between the goroutine
+	// that reads or writes the file and the workers. If 0, one block
+	// is queued.
+	QueueDepth int
+	// The number of bytes of uncompressed data in each block written
+	// by a BGZFWriter, at most 65280. If 0, 65280 is used.
+	BlockSize int
+	// The compression level of the blocks written by a BGZFWriter,
+	// as defined by compress/flate: from flate.NoCompression (0) to
+	// flate.BestCompression (9), or flate.DefaultCompression (-1). If
+	// nil, flate.DefaultCompression is used.
+	CompressionLevel *int
+}
+
+// Checks the options, and fills in the defaults.
+func (options BGZFOptions) normalize() (BGZFOptions, error) {
+	if options.Workers < 0 {
+		return options, fmt.Errorf("invalid number of BGZF workers %v", options.Workers)
+	}
+	if options.QueueDepth < 0 {
+		return options, fmt.Errorf("invalid BGZF queue depth %v", options.QueueDepth)
+	}
+	if options.QueueDepth == 0 {
+		options.QueueDepth = 1
+	}
+	if options.BlockSize < 0 || options.BlockSize > maxBgzfDataSize {
+		return options, fmt.Errorf("invalid BGZF block size %v, must be at most %v", options.BlockSize, maxBgzfDataSize)
+	}
+	if options.BlockSize == 0 {
+		options.BlockSize = maxBgzfDataSize
+	}
+	if level := options.CompressionLevel; level != nil && (*level < flate.DefaultCompression || *level > flate.BestCompression) {
+		return options, fmt.Errorf("invalid BGZF compression level %v", *level)
+	}
+	return options, nil
+}
+
+// Returns the compression level as defined by compress/flate.
+func (options BGZFOptions) flateLevel() int {
+	if options.CompressionLevel == nil {
+		return flate.DefaultCompression
+	}
+	return *options.CompressionLevel
+}
+
+// The options used for the BAM files opened and created by this
+// package.
+var bgzfOptions BGZFOptions
+
+// SetBGZFOptions sets the options for the BGZFReaders and BGZFWriters
+// of the BAM files that are subsequently opened and created by this
+// package.
+func SetBGZFOptions(options BGZFOptions) error {
+	if _, err := options.normalize(); err != nil {
+		return err
+	}
+	bgzfOptions = options
+	return nil
+}
+
+// CurrentBGZFOptions returns the options set with SetBGZFOptions, for
+// BGZF files that are created outside of this package.
+func CurrentBGZFOptions() BGZFOptions {
+	return bgzfOptions
+}
+
 var blockPool = sync.Pool{New: func() interface{} {
 	return &bgzfBlock{Data: make([]byte, 0, maxBgzfBlockSize)}
 }}
@@ -145,6 +224,16 @@ var flateReaderPool sync.Pool
 
 // NewBGZFReader returns a BGZFReader for the given flate.Reader
 func NewBGZFReader(r flate.Reader) (*BGZFReader, error) {
+	return NewBGZFReaderWithOptions(r, BGZFOptions{})
+}
+
+// NewBGZFReaderWithOptions returns a BGZFReader for the given
+// flate.Reader with the given options. The block size is ignored.
+func NewBGZFReaderWithOptions(r flate.Reader, options BGZFOptions) (*BGZFReader, error) {
+	options, err := options.normalize()
+	if err != nil {
+		return nil, err
+	}
 	gz, err := gzip.NewReader(r)
 	if err != nil {
 		return nil, err
@@ -153,12 +242,12 @@ func NewBGZFReader(r flate.Reader) (*BGZFReader, error) {
 	bgzf := &BGZFReader{
 		r:       r,
 		gz:      gz,
-		channel: make(chan *bgzfBlock, 1),
+		channel: make(chan *bgzfBlock, options.QueueDepth),
 		ctx:     ctx,
 		cancel:  cancel,
 	}
 	bgzf.p.Source((*internalBGZFReader)(bgzf))
-	bgzf.p.Add(pipeline.LimitedPar(0, pipeline.Receive(func(_ int, data interface{}) interface{} {
+	bgzf.p.Add(pipeline.LimitedPar(options.Workers, pipeline.Receive(func(_ int, data interface{}) interface{} {
 		block := data.(*bgzfBlock)
 		blockReader := bytes.NewReader(block.Data)
 		var flateReader io.ReadCloser
@@ -260,6 +349,12 @@ type (
 		block   *bytesBlock
 		channel chan *bytesBlock
 		data    interface{}
+		// The offsets of the compressed blocks in the file, if
+		// recorded, followed by the offset of the end of the data.
+		blockOffsets  []int64
+		recordOffsets bool
+		written       int64
+		blockSize     int
 	}
 
 	internalBGZFWriter BGZFWriter
@@ -291,18 +386,42 @@ var (
 		return &bytesBlock{bytes: make([]byte, 0, maxBgzfBlockSize)}
 	}}
 
-	flateWriterPool sync.Pool
+	// one pool per compression level, from -1 to 9
+	flateWriterPools [11]sync.Pool
 )
 
 // NewBGZFWriter returns a BGZFWriter for the given io.Writer.
 func NewBGZFWriter(w io.Writer) *BGZFWriter {
+	bgzf, _ := NewBGZFWriterWithOptions(w, BGZFOptions{})
+	return bgzf
+}
+
+// NewBGZFWriterWithOptions returns a BGZFWriter for the given
+// io.Writer with the given options.
+func NewBGZFWriterWithOptions(w io.Writer, options BGZFOptions) (*BGZFWriter, error) {
+	return newBGZFWriter(w, options, options.flateLevel())
+}
+
+// newBGZFWriter returns a BGZFWriter for the given io.Writer with the
+// given options and compression level, as defined by compress/flate.
+// Level 0 writes BGZF blocks without compression.
+func newBGZFWriter(w io.Writer, options BGZFOptions, level int) (*BGZFWriter, error) {
+	options, err := options.normalize()
+	if err != nil {
+		return nil, err
+	}
+	if level < flate.DefaultCompression || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid BGZF compression level %v", level)
+	}
 	bgzf := &BGZFWriter{
-		w:       w,
-		block:   bytesPool.Get().(*bytesBlock),
-		channel: make(chan *bytesBlock, 1),
+		w:         w,
+		block:     bytesPool.Get().(*bytesBlock),
+		channel:   make(chan *bytesBlock, options.QueueDepth),
+		blockSize: options.BlockSize,
 	}
+	flateWriterPool := &flateWriterPools[level+1]
 	bgzf.p.Source((*internalBGZFWriter)(bgzf))
-	bgzf.p.Add(pipeline.LimitedPar(0, pipeline.Receive(func(n int, data interface{}) interface{} {
+	bgzf.p.Add(pipeline.LimitedPar(options.Workers, pipeline.Receive(func(n int, data interface{}) interface{} {
 		block := data.(*bytesBlock)
 		gzBytes := bytesPool.Get().(*bytesBlock)
 		gzBuf := bytes.NewBuffer(gzBytes.bytes)
@@ -319,7 +438,7 @@ func NewBGZFWriter(w io.Writer) *BGZFWriter {
 			flateWriter.Reset(gzBuf)
 		} else {
 			var err error
-			flateWriter, err = flate.NewWriter(gzBuf, -1)
+			flateWriter, err = flate.NewWriter(gzBuf, level)
 			if err != nil {
 				bgzf.p.SetErr(err)
 			}
@@ -329,9 +448,11 @@ func NewBGZFWriter(w io.Writer) *BGZFWriter {
 		} else if err := flateWriter.Close(); err != nil {
 			bgzf.p.SetErr(err)
 		}
-		gzBytes.bytes = gzBuf.Bytes()
-		index := len(gzBytes.bytes)
-		gzBytes.bytes = gzBytes.bytes[:index+8]
+		index := gzBuf.Len()
+		gzBytes.bytes = append(gzBuf.Bytes(), 0, 0, 0, 0, 0, 0, 0, 0)
+		if len(gzBytes.bytes) > maxBgzfBlockSize {
+			bgzf.p.SetErr(fmt.Errorf("BGZF block too large: %v bytes", len(gzBytes.bytes)))
+		}
 		binary.LittleEndian.PutUint32(gzBytes.bytes[index:index+4], crc32.ChecksumIEEE(block.bytes))
 		binary.LittleEndian.PutUint32(gzBytes.bytes[index+4:index+8], uint32(len(block.bytes)))
 		binary.LittleEndian.PutUint16(gzBytes.bytes[16:18], uint16(len(gzBytes.bytes)-1))
@@ -341,6 +462,10 @@ func NewBGZFWriter(w io.Writer) *BGZFWriter {
 		return gzBytes
 	})), pipeline.StrictOrd(pipeline.Receive(func(_ int, data interface{}) interface{} {
 		gzBytes := data.(*bytesBlock)
+		if bgzf.recordOffsets {
+			bgzf.blockOffsets = append(bgzf.blockOffsets, bgzf.written)
+			bgzf.written += int64(len(gzBytes.bytes))
+		}
 		if _, err := w.Write(gzBytes.bytes); err != nil {
 			bgzf.p.SetErr(err)
 		}
@@ -353,7 +478,7 @@ func NewBGZFWriter(w io.Writer) *BGZFWriter {
 		defer bgzf.wait.Done()
 		bgzf.p.Run()
 	}()
-	return bgzf
+	return bgzf, nil
 }
 
 // Close closes this BGZFWriter.
@@ -366,18 +491,30 @@ func (bgzf *BGZFWriter) Close() error {
 	if err := bgzf.p.Err(); err != nil {
 		return err
 	}
+	if bgzf.recordOffsets {
+		bgzf.blockOffsets = append(bgzf.blockOffsets, bgzf.written)
+	}
 	_, err := bgzf.w.Write(bgzfEOF)
 	return err
 }
 
+// Returns the virtual offset of the given position in the
+// uncompressed data. Only valid after Close, and only if block offsets
+// were recorded. Every block except the last one holds exactly
+// blockSize bytes of uncompressed data.
+func (bgzf *BGZFWriter) virtualOffset(position int64) VirtualOffset {
+	blockSize := int64(bgzf.blockSize)
+	return NewVirtualOffset(bgzf.blockOffsets[position/blockSize], int(position%blockSize))
+}
+
 // Write implements the corresponding method of io.Writer.
 func (bgzf *BGZFWriter) Write(p []byte) (n int, err error) {
 	n = len(p)
 	for {
 		blockIndex := len(bgzf.block.bytes)
 		newBlockLength := blockIndex + len(p)
-		if newBlockLength >= maxBgzfBlockSize {
-			bgzf.block.bytes = bgzf.block.bytes[:maxBgzfBlockSize]
+		if newBlockLength >= bgzf.blockSize {
+			bgzf.block.bytes = bgzf.block.bytes[:bgzf.blockSize]
 			k := copy(bgzf.block.bytes[blockIndex:], p)
 			p = p[k:]
 			bgzf.channel <- bgzf.block
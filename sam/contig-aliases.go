@@ -0,0 +1,101 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// ContigAliases lists groups of names that refer to the same reference
+// sequence, for example "chr1", "1", and "NC_000001.11".
+type ContigAliases [][]string
+
+// ParseContigAliases parses a table of reference sequence names. Each
+// line lists the names of one reference sequence, separated by tabs or
+// spaces, as in the chromAlias.txt files of the UCSC Genome Browser.
+// Empty lines and lines starting with '#' are ignored.
+func ParseContigAliases(filename string) (aliases ContigAliases, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if names := strings.Fields(line); len(names) > 0 {
+			aliases = append(aliases, names)
+		}
+	}
+	return aliases, scanner.Err()
+}
+
+// ContigNames returns a map from the names by which the reference
+// sequences of the header can be referred to, to the SN names of these
+// reference sequences. These are the SN names themselves, the
+// alternative names in the AN fields of the @SQ lines, and the names
+// that the given aliases list together with any of these names. If a
+// name could refer to several reference sequences, an SN name takes
+// precedence over an AN name, which takes precedence over an alias,
+// and otherwise the first reference sequence in the header is taken.
+func (hdr *Header) ContigNames(aliases ContigAliases) map[string]string {
+	names := make(map[string]string)
+	for _, sq := range hdr.SQ {
+		names[sq["SN"]] = sq["SN"]
+	}
+	for _, sq := range hdr.SQ {
+		an, found := sq["AN"]
+		if !found {
+			continue
+		}
+		for _, name := range strings.Split(an, ",") {
+			if _, found := names[name]; !found {
+				names[name] = sq["SN"]
+			}
+		}
+	}
+	resolved := make(map[string]string)
+	for _, group := range aliases {
+		for _, name := range group {
+			if sn, found := names[name]; found {
+				for _, alias := range group {
+					if _, found := names[alias]; !found {
+						if _, found := resolved[alias]; !found {
+							resolved[alias] = sn
+						}
+					}
+				}
+				break
+			}
+		}
+	}
+	for alias, sn := range resolved {
+		names[alias] = sn
+	}
+	return names
+}
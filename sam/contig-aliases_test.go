@@ -0,0 +1,62 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestContigNames(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "aliases.txt")
+	if err := ioutil.WriteFile(filename, []byte("# ucsc\tensembl\trefseq\nchr1\t1\tNC_000001.11\nchr2\t2\tNC_000002.12\n\nchrM\tMT\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := ParseContigAliases(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 3 || len(aliases[2]) != 2 {
+		t.Error("ParseContigAliases failed", aliases)
+	}
+	hdr := NewHeader()
+	hdr.SQ = []utils.StringMap{
+		{"SN": "1", "LN": "1000"},
+		{"SN": "chr2", "LN": "1000", "AN": "2,1"},
+	}
+	names := hdr.ContigNames(aliases)
+	for name, sn := range map[string]string{
+		"1":            "1",
+		"chr1":         "1",
+		"NC_000001.11": "1",
+		"chr2":         "chr2",
+		"2":            "chr2",
+		"NC_000002.12": "chr2",
+	} {
+		if names[name] != sn {
+			t.Error("ContigNames failed for", name, names[name])
+		}
+	}
+	if _, found := names["MT"]; found || len(names) != 6 {
+		t.Error("ContigNames failed", names)
+	}
+}
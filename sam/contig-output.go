@@ -0,0 +1,230 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/exascience/pargo/pipeline"
+)
+
+// UnmappedContig is used in place of a reference sequence name in the
+// name of the file that receives the alignments of a ContigOutput
+// that are not placed on any reference sequence.
+const UnmappedContig = "unmapped"
+
+// A ContigOutput is a PipelineOutput that writes the alignments of a
+// coordinate-sorted pipeline to a separate SAM/BAM file for each
+// reference sequence, and the alignments that are not placed on any
+// reference sequence to another file. Each file gets the full header
+// of the pipeline. Since the alignments are sorted, only one file per
+// reference sequence is open at a time.
+type ContigOutput struct {
+	name   string
+	format OutputFormat
+	index  IndexFormat
+	header *Header
+	// The index of the reference sequence in the header for which the
+	// next file is created.
+	next     int
+	contigs  map[string]int
+	current  *OutputFile
+	unmapped *OutputFile
+	names    map[string]bool
+}
+
+// CreatePerContig returns a ContigOutput for writing one file per
+// reference sequence. The file names are derived from the given name
+// by inserting the reference sequence name in front of the file
+// extension, see ContigFileName. The files are created once the header
+// is known, when the pipeline runs. The format and index are handled
+// for each file as by CreateIndexed.
+func CreatePerContig(name string, format OutputFormat, index IndexFormat) (*ContigOutput, error) {
+	if err := checkSplitOutput(name, format, index); err != nil {
+		return nil, err
+	}
+	return &ContigOutput{
+		name:   name,
+		format: format,
+		index:  index,
+		names:  make(map[string]bool),
+	}, nil
+}
+
+// ContigFileName returns the name of the file that receives the
+// alignments of the reference sequence with the given name when
+// writing one file per reference sequence to the given name. For
+// example, the alignments on chr1 for output.bam are written to
+// output.chr1.bam. Characters in the reference sequence name that are
+// not letters, digits, '.', '-', or '_' are replaced by '_'.
+func ContigFileName(name, contig string) string {
+	return outputFileName(name, contig)
+}
+
+func (output *ContigOutput) create(contig string) (*OutputFile, error) {
+	name := ContigFileName(output.name, contig)
+	if output.names[name] {
+		return nil, fmt.Errorf("reference sequence %v results in the same file name %v as another reference sequence", contig, name)
+	}
+	output.names[name] = true
+	file, err := CreateIndexed(name, output.format, output.index)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.FormatHeader(output.header); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("%v, while writing a SAM header to %v", err, name)
+	}
+	return file, nil
+}
+
+// advance closes the current file, and creates the files for the
+// reference sequences up to and including the one with the given
+// index. The files for reference sequences without alignments are
+// closed immediately.
+func (output *ContigOutput) advance(index int) error {
+	if index < output.next-1 || (index == output.next-1 && output.current == nil) {
+		return fmt.Errorf("alignments on %v are not sorted by coordinate in ContigOutput", output.header.SQ[index]["SN"])
+	}
+	for output.next <= index {
+		if output.current != nil {
+			err := output.current.Close()
+			output.current = nil
+			if err != nil {
+				return err
+			}
+		}
+		file, err := output.create(output.header.SQ[output.next]["SN"])
+		if err != nil {
+			return err
+		}
+		output.current = file
+		output.next++
+	}
+	return nil
+}
+
+// A contigRun holds consecutive formatted alignments of a batch that
+// are placed on the same reference sequence. The index is -1 for
+// alignments that are not placed on any reference sequence.
+type contigRun struct {
+	index   int
+	records [][]byte
+}
+
+// AddNodes implements the PipelineOutput interface for ContigOutput
+// values. The header must have coordinate sorting order.
+func (output *ContigOutput) AddNodes(p *pipeline.Pipeline, header *Header, sortingOrder SortingOrder) {
+	switch sortingOrder {
+	case Keep, Unknown:
+	case Coordinate, Queryname:
+		p.Add(errorNode(errors.New("sorting on files not supported")))
+		return
+	default:
+		p.Add(errorNode(fmt.Errorf("sorting order %v not supported when writing one file per reference sequence", sortingOrder)))
+		return
+	}
+	if header.HDSO() != Coordinate {
+		p.Add(errorNode(errors.New("writing one file per reference sequence requires coordinate-sorted alignments")))
+		return
+	}
+	output.header = header
+	output.contigs = make(map[string]int)
+	for index, sq := range header.SQ {
+		output.contigs[sq["SN"]] = index
+	}
+	unmapped, err := output.create(UnmappedContig)
+	if err != nil {
+		p.Add(errorNode(err))
+		return
+	}
+	output.unmapped = unmapped
+	formatAlignment := alignmentFormatter(output.name, output.format, header)
+	p.Add(
+		pipeline.LimitedPar(0, pipeline.Receive(func(_ int, data interface{}) interface{} {
+			var runs []contigRun
+			var buf []byte
+			var err error
+			for _, aln := range data.([]*Alignment) {
+				index := -1
+				if aln.RNAME != "*" {
+					var found bool
+					if index, found = output.contigs[aln.RNAME]; !found {
+						p.SetErr(fmt.Errorf("unknown reference sequence %v in ContigOutput", aln.RNAME))
+						return runs
+					}
+				}
+				buf, err = formatAlignment(aln, buf[:0])
+				if err != nil {
+					p.SetErr(fmt.Errorf("%v in ContigOutput", err))
+				}
+				record := append([]byte(nil), buf...)
+				if n := len(runs); n > 0 && runs[n-1].index == index {
+					runs[n-1].records = append(runs[n-1].records, record)
+				} else {
+					runs = append(runs, contigRun{index: index, records: [][]byte{record}})
+				}
+			}
+			return runs
+		})),
+		pipeline.StrictOrd(pipeline.ReceiveAndFinalize(func(_ int, data interface{}) interface{} {
+			for _, run := range data.([]contigRun) {
+				file := output.unmapped
+				if run.index >= 0 {
+					if output.next-1 != run.index || output.current == nil {
+						if err := output.advance(run.index); err != nil {
+							p.SetErr(err)
+							return data
+						}
+					}
+					file = output.current
+				}
+				for _, record := range run.records {
+					if _, err := file.Write(record); err != nil {
+						p.SetErr(fmt.Errorf("%v, while writing SAM alignment strings to output", err))
+						return data
+					}
+				}
+			}
+			return data
+		}, func() {
+			if n := len(output.header.SQ); n > 0 {
+				if err := output.advance(n - 1); err != nil {
+					p.SetErr(err)
+				}
+			}
+		})),
+	)
+}
+
+// Close closes the files of a ContigOutput that are still open.
+func (output *ContigOutput) Close() (err error) {
+	if output.current != nil {
+		err = output.current.Close()
+		output.current = nil
+	}
+	if output.unmapped != nil {
+		if nerr := output.unmapped.Close(); err == nil {
+			err = nerr
+		}
+		output.unmapped = nil
+	}
+	return
+}
@@ -0,0 +1,92 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContigOutput(t *testing.T) {
+	names := writeSamFiles(t,
+		"@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:1000\n@SQ\tSN:chr2\tLN:1000\n@SQ\tSN:chr3\tLN:1000\n"+
+			"r1\t0\tchr1\t10\t60\t1M\t*\t0\t0\tA\tI\n"+
+			"r2\t0\tchr1\t20\t60\t1M\t*\t0\t0\tA\tI\n"+
+			"r3\t0\tchr3\t5\t60\t1M\t*\t0\t0\tA\tI\n"+
+			"r4\t4\t*\t0\t0\t*\t*\t0\t0\tA\tI\n",
+		"@HD\tVN:1.6\tSO:unsorted\n@SQ\tSN:chr1\tLN:1000\n"+
+			"r1\t0\tchr1\t10\t60\t1M\t*\t0\t0\tA\tI\n")
+	name := filepath.Join(t.TempDir(), "out.bam")
+	output, err := CreatePerContig(name, DefaultFormat, BAIIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := input.RunPipeline(output, nil, Keep); err != nil {
+		t.Fatal(err)
+	}
+	_ = input.Close()
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for contig, expected := range map[string][]string{
+		"chr1":         {"r1", "r2"},
+		"chr2":         nil,
+		"chr3":         {"r3"},
+		UnmappedContig: {"r4"},
+	} {
+		if _, err := os.Stat(ContigFileName(name, contig) + ".bai"); err != nil {
+			t.Error("ContigOutput index failed for", contig, err)
+		}
+		input, err := Open(ContigFileName(name, contig))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reads := NewSam()
+		if err := input.RunPipeline(reads, nil, Keep); err != nil {
+			t.Fatal(err)
+		}
+		_ = input.Close()
+		var qnames []string
+		for _, aln := range reads.Alignments {
+			qnames = append(qnames, aln.QNAME)
+		}
+		if !equalNames(qnames, expected...) || len(reads.Header.SQ) != 3 {
+			t.Error("ContigOutput failed for", contig, qnames)
+		}
+	}
+
+	output, err = CreatePerContig(filepath.Join(t.TempDir(), "out.sam"), DefaultFormat, NoIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err = Open(names[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := input.RunPipeline(output, nil, Keep); err == nil {
+		t.Error("ContigOutput sorting order check failed")
+	}
+	_ = input.Close()
+	_ = output.Close()
+}
@@ -0,0 +1,239 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// A CSIBin is a bin of a CSI index.
+type CSIBin struct {
+	// The smallest virtual offset of the alignments that overlap with
+	// the bin, which replaces the linear index of BAI files.
+	Loffset VirtualOffset
+	Chunks  []Chunk
+}
+
+// A CSI is a coordinate-sorted index of a BAM file. Unlike a BAI, the
+// size of the smallest bins and the number of levels of bins are
+// configurable, so a CSI can index reference sequences longer than
+// 2^29-1 bases. See http://samtools.github.io/hts-specs/CSIv1.pdf
+type CSI struct {
+	// The smallest bins span 1<<MinShift bases, and there are Depth+1
+	// levels of bins.
+	MinShift, Depth int32
+	// Auxiliary data, typically for tabix-style indexes.
+	Aux []byte
+	// The bins per reference sequence.
+	References []map[uint32]CSIBin
+	// The number of unplaced unmapped reads, or -1 if unknown.
+	NoCoordinate int64
+}
+
+// csiMagic is the magic string for the CSI format.
+const csiMagic = "CSI\x01"
+
+// NewCSI returns an empty CSI with the given parameters. The default
+// used by samtools is a MinShift of 14 and a Depth of 5, which
+// corresponds to the binning scheme of BAI files. Each additional
+// level of depth allows indexing reference sequences that are eight
+// times longer.
+func NewCSI(minShift, depth int32) *CSI {
+	return &CSI{MinShift: minShift, Depth: depth, NoCoordinate: -1}
+}
+
+// ParseCSI parses a CSI file.
+func ParseCSI(filename string) (index *CSI, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := gz.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	return readCSI(bufio.NewReader(gz))
+}
+
+func readCSI(reader io.Reader) (*CSI, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	} else if string(magic) != csiMagic {
+		return nil, errors.New("invalid CSI file header")
+	}
+	var params [3]int32
+	if err := binary.Read(reader, binary.LittleEndian, params[:]); err != nil {
+		return nil, err
+	}
+	if params[0] < 0 || params[1] < 0 || params[2] < 0 {
+		return nil, errors.New("invalid CSI file header")
+	}
+	index := NewCSI(params[0], params[1])
+	index.Aux = make([]byte, params[2])
+	if _, err := io.ReadFull(reader, index.Aux); err != nil {
+		return nil, err
+	}
+	var nRef int32
+	if err := binary.Read(reader, binary.LittleEndian, &nRef); err != nil {
+		return nil, err
+	}
+	index.References = make([]map[uint32]CSIBin, nRef)
+	for i := range index.References {
+		var nBin int32
+		if err := binary.Read(reader, binary.LittleEndian, &nBin); err != nil {
+			return nil, err
+		}
+		bins := make(map[uint32]CSIBin, nBin)
+		for j := int32(0); j < nBin; j++ {
+			var header struct {
+				Bin     uint32
+				Loffset VirtualOffset
+				NChunk  int32
+			}
+			if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+				return nil, err
+			}
+			chunks := make([]Chunk, header.NChunk)
+			if err := binary.Read(reader, binary.LittleEndian, chunks); err != nil {
+				return nil, err
+			}
+			bins[header.Bin] = CSIBin{Loffset: header.Loffset, Chunks: chunks}
+		}
+		index.References[i] = bins
+	}
+	var nNoCoor uint64
+	if err := binary.Read(reader, binary.LittleEndian, &nNoCoor); err == nil {
+		index.NoCoordinate = int64(nNoCoor)
+	} else if err != io.EOF {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Write writes a CSI file, compressed with BGZF.
+func (index *CSI) Write(w io.Writer) error {
+	bgzf := NewBGZFWriter(w)
+	out := bufio.NewWriter(bgzf)
+	write := func(data interface{}) {
+		// Errors are reported by Flush.
+		_ = binary.Write(out, binary.LittleEndian, data)
+	}
+	out.WriteString(csiMagic)
+	write([]int32{index.MinShift, index.Depth, int32(len(index.Aux))})
+	out.Write(index.Aux)
+	write(int32(len(index.References)))
+	for _, bins := range index.References {
+		write(int32(len(bins)))
+		for _, bin := range sortedBins(bins) {
+			write(bin)
+			write(bins[bin].Loffset)
+			write(int32(len(bins[bin].Chunks)))
+			write(bins[bin].Chunks)
+		}
+	}
+	if index.NoCoordinate >= 0 {
+		write(uint64(index.NoCoordinate))
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return bgzf.Close()
+}
+
+// Returns the number of the first bin of a level of a binning scheme.
+func firstBin(level int32) uint32 {
+	return uint32((1<<(3*uint(level)) - 1) / 7)
+}
+
+// regionToCSIBins is the generalization of regionToBins for CSI
+// indexes. See http://samtools.github.io/hts-specs/CSIv1.pdf
+func regionToCSIBins(beg, end int32, minShift, depth int32) (bins []uint32) {
+	end--
+	shift := uint(minShift + 3*depth)
+	for level := int32(0); level <= depth; level, shift = level+1, shift-3 {
+		first := firstBin(level)
+		for k := first + uint32(beg>>shift); k <= first+uint32(end>>shift); k++ {
+			bins = append(bins, k)
+		}
+	}
+	return bins
+}
+
+// regionToCSIBin returns the smallest bin of a binning scheme that
+// contains the 0-based, half-open range [beg, end). See
+// http://samtools.github.io/hts-specs/CSIv1.pdf
+func regionToCSIBin(beg, end int32, minShift, depth int32) uint32 {
+	end--
+	shift := uint(minShift)
+	for level := depth; level > 0; level, shift = level-1, shift+3 {
+		if beg>>shift == end>>shift {
+			return firstBin(level) + uint32(beg>>shift)
+		}
+	}
+	return 0
+}
+
+// Chunks implements the method of the BAMIndex interface.
+func (index *CSI) Chunks(refID int, beg, end int32) []Chunk {
+	if refID < 0 || refID >= len(index.References) || beg >= end {
+		return nil
+	}
+	bins := index.References[refID]
+	// Without a linear index, the smallest offset is taken from the
+	// bin that contains beg at the lowest level, or the closest bin to
+	// its left or above it that is present in the index.
+	bin := firstBin(index.Depth) + uint32(beg>>uint(index.MinShift))
+	for bin > 0 {
+		if _, found := bins[bin]; found {
+			break
+		}
+		parent := (bin - 1) >> 3
+		if bin > parent<<3+1 {
+			bin--
+		} else {
+			bin = parent
+		}
+	}
+	minOffset := bins[bin].Loffset
+	var chunks []Chunk
+	for _, bin := range regionToCSIBins(beg, end, index.MinShift, index.Depth) {
+		for _, chunk := range bins[bin].Chunks {
+			if chunk.End > minOffset {
+				chunks = append(chunks, chunk)
+			}
+		}
+	}
+	return mergeChunks(chunks)
+}
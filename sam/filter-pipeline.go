@@ -42,7 +42,8 @@ type (
 	// alignments that it receives to be sorted according to that
 	// sortingOrder if possible, or report an error if it can't perform
 	// such a sort. Any error should be reported to the pipeline by
-	// calling p.Err(err) with a non-nil error value.
+	// calling p.SetErr(err) with a non-nil error value while the
+	// pipeline runs, for example from a node that AddNodes adds.
 	PipelineOutput interface {
 		AddNodes(p *pipeline.Pipeline, header *Header, sortingOrder SortingOrder)
 	}
@@ -57,6 +58,16 @@ type (
 	}
 )
 
+// errorNode returns a pargo pipeline.Node that reports the given error
+// once the pipeline runs. AddNodes methods use it to report errors,
+// since a pipeline cannot be canceled before it runs.
+func errorNode(err error) pipeline.Node {
+	return pipeline.Seq(func(p *pipeline.Pipeline, _ pipeline.NodeKind, _ *int) (_ pipeline.Receiver, _ pipeline.Finalizer) {
+		p.SetErr(err)
+		return
+	})
+}
+
 // AlignmentToBytes returns a pargo pipeline.Filter that formats
 // slices of Alignment pointers into slices of bytes representing
 // these alignments according to the SAM/BAM file format.
@@ -153,19 +164,19 @@ func (sam *Sam) AddNodes(p *pipeline.Pipeline, header *Header, sortingOrder Sort
 	case Queryname:
 		p.Add(pipeline.Seq(
 			pipeline.Slice(&sam.Alignments),
-			pipeline.Finalize(func() { By(QNAMELess).ParallelStableSort(sam.Alignments) }),
+			pipeline.Finalize(func() { By(QuerynameLess(header.HDQuerynameCollation())).ParallelStableSort(sam.Alignments) }),
 		))
 	case Unsorted:
 		p.Add(pipeline.Seq(pipeline.Slice(&sam.Alignments)))
 	default:
-		p.SetErr(fmt.Errorf("unknown sorting order %v", sortingOrder))
+		p.Add(errorNode(fmt.Errorf("unknown sorting order %v", sortingOrder)))
 	}
 }
 
 // AddNodes implements the PipelineOutput interface for SAM/BAM OutputFile values.
 func (f *OutputFile) AddNodes(p *pipeline.Pipeline, header *Header, sortingOrder SortingOrder) {
 	if err := f.FormatHeader(header); err != nil {
-		p.SetErr(fmt.Errorf("%v, while writing a SAM header to output", err))
+		p.Add(errorNode(fmt.Errorf("%v, while writing a SAM header to output", err)))
 		return
 	}
 	var nodeCons func(...pipeline.Filter) pipeline.Node
@@ -173,12 +184,12 @@ func (f *OutputFile) AddNodes(p *pipeline.Pipeline, header *Header, sortingOrder
 	case Keep, Unknown:
 		nodeCons = pipeline.StrictOrd
 	case Coordinate, Queryname:
-		p.SetErr(errors.New("sorting on files not supported"))
+		p.Add(errorNode(errors.New("sorting on files not supported")))
 		return
 	case Unsorted:
 		nodeCons = pipeline.Seq
 	default:
-		p.SetErr(fmt.Errorf("unknown sorting order %v", sortingOrder))
+		p.Add(errorNode(fmt.Errorf("unknown sorting order %v", sortingOrder)))
 		return
 	}
 	p.Add(
@@ -247,14 +258,22 @@ func ComposeFilters(header *Header, hdrFilters []Filter) (receiver pipeline.Rece
 // Coordinate or Queryname, and the current sorting order already
 // fulfills it, then we can just return Keep to avoid any additional
 // sorting.
-func effectiveSortingOrder(sortingOrder SortingOrder, header *Header, originalSortingOrder SortingOrder) SortingOrder {
+//
+// For Queryname, the sub-sorting order in the header must also be the
+// same as in the input, since it determines the collation of query
+// template names.
+//
+// For Unknown and Unsorted, the order of the input is kept if the
+// header groups the alignments by query (GO:query), so that the
+// alignments of each query template stay adjacent.
+func effectiveSortingOrder(sortingOrder SortingOrder, header *Header, originalSortingOrder SortingOrder, originalSubSortingOrder string) SortingOrder {
 	if sortingOrder == Keep {
 		sortingOrder = originalSortingOrder
 	}
 	currentSortingOrder := header.HDSO()
 	switch sortingOrder {
 	case Coordinate, Queryname:
-		if currentSortingOrder == sortingOrder {
+		if currentSortingOrder == sortingOrder && (sortingOrder != Queryname || header.HD["SS"] == originalSubSortingOrder) {
 			return Keep
 		}
 		header.SetHDSO(sortingOrder)
@@ -262,6 +281,10 @@ func effectiveSortingOrder(sortingOrder SortingOrder, header *Header, originalSo
 		if currentSortingOrder != sortingOrder {
 			header.SetHDSO(sortingOrder)
 		}
+		if header.HDGO() == Query {
+			// Keep the alignments of each query template adjacent.
+			return Keep
+		}
 	}
 	return sortingOrder
 }
@@ -286,9 +309,9 @@ func (sam *Sam) RunPipeline(output PipelineOutput, hdrFilters []Filter, sortingO
 	alns := sam.Alignments
 	sam.Header = NewHeader()
 	sam.Alignments = nil
-	originalSortingOrder := header.HDSO()
+	originalSortingOrder, originalSubSortingOrder := header.HDSO(), header.HD["SS"]
 	alnFilter := ComposeFilters(header, hdrFilters)
-	sortingOrder = effectiveSortingOrder(sortingOrder, header, originalSortingOrder)
+	sortingOrder = effectiveSortingOrder(sortingOrder, header, originalSortingOrder, originalSubSortingOrder)
 	if out, ok := output.(*Sam); ok && (runtime.GOMAXPROCS(0) <= 3) {
 		out.Header = header
 		if alnFilter != nil {
@@ -298,9 +321,10 @@ func (sam *Sam) RunPipeline(output PipelineOutput, hdrFilters []Filter, sortingO
 		}
 		switch sortingOrder {
 		case Coordinate:
-			sort.Slice(out.Alignments, func(i, j int) bool { return CoordinateLess(alns[i], alns[j]) })
+			sort.SliceStable(out.Alignments, func(i, j int) bool { return CoordinateLess(out.Alignments[i], out.Alignments[j]) })
 		case Queryname:
-			sort.Slice(out.Alignments, func(i, j int) bool { return QNAMELess(alns[i], alns[i]) })
+			less := QuerynameLess(header.HDQuerynameCollation())
+			sort.SliceStable(out.Alignments, func(i, j int) bool { return less(out.Alignments[i], out.Alignments[j]) })
 		case Keep, Unknown, Unsorted:
 			// nothing to do
 		default:
@@ -334,11 +358,25 @@ func (f *InputFile) RunPipelineFI(output PipelineOutput, hdrFilters []Filter, so
 	if err != nil {
 		return err
 	}
-	originalSortingOrder := header.HDSO()
+	originalSortingOrder, originalSubSortingOrder := header.HDSO(), header.HD["SS"]
+	if len(f.groupFilters) > 0 {
+		if !header.IsQueryGrouped() {
+			return errNotQueryGrouped
+		}
+		if setFileIndex {
+			return errors.New("filters that process query templates at once cannot be combined with file indexes")
+		}
+	}
+	checker := newSortingOrderChecker(header, f.check)
 	alnFilter := ComposeFilters(header, hdrFilters)
-	sortingOrder = effectiveSortingOrder(sortingOrder, header, originalSortingOrder)
+	groupFilter := ComposeGroupFilters(header, f.groupFilters)
+	sortingOrder = effectiveSortingOrder(sortingOrder, header, originalSortingOrder, originalSubSortingOrder)
 	var p pipeline.Pipeline
-	p.Source(f)
+	if groupFilter != nil {
+		p.Source(newQueryGroupSource(f))
+	} else {
+		p.Source(f)
+	}
 	if setFileIndex {
 		// needed so that BytesToAlignment can compute file indexes for alignments
 		p.SetVariableBatchSize(maxBatchSize, maxBatchSize)
@@ -346,6 +384,12 @@ func (f *InputFile) RunPipelineFI(output PipelineOutput, hdrFilters []Filter, so
 		p.SetVariableBatchSize(minBatchSize, maxBatchSize)
 	}
 	p.Add(pipeline.LimitedPar(0, BytesToAlignmentFI(f, setFileIndex)))
+	if checker != nil {
+		p.Add(checker.node(&p, header, sortingOrder))
+	}
+	if groupFilter != nil {
+		p.Add(pipeline.LimitedPar(0, queryGroupNode(groupFilter)))
+	}
 	if alnFilter != nil {
 		p.Add(pipeline.LimitedPar(0, pipeline.Receive(alnFilter)))
 	}
@@ -0,0 +1,244 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// Checks that a @RG or @PG header line has a non-empty ID, and that
+// its tags and values can be formatted as a SAM header line.
+func checkHeaderRecord(code string, record utils.StringMap) error {
+	if record["ID"] == "" {
+		return fmt.Errorf("missing ID in %v header line", code)
+	}
+	for tag, value := range record {
+		if len(tag) != 2 {
+			return fmt.Errorf("invalid tag %v in %v header line", tag, code)
+		}
+		if strings.ContainsAny(value, "\t\n") || value == "" {
+			return fmt.Errorf("invalid value for tag %v in %v header line", tag, code)
+		}
+	}
+	return nil
+}
+
+// Returns the index of the record with the given ID, or -1.
+func findID(records []utils.StringMap, id string) int {
+	return utils.Find(records, func(record utils.StringMap) bool { return record["ID"] == id })
+}
+
+// AddRG adds a @RG line to the header. The ID of the read group must
+// be unique.
+func (hdr *Header) AddRG(record utils.StringMap) error {
+	if err := checkHeaderRecord("@RG", record); err != nil {
+		return err
+	}
+	if findID(hdr.RG, record["ID"]) >= 0 {
+		return fmt.Errorf("duplicate @RG ID %v", record["ID"])
+	}
+	hdr.RG = append(hdr.RG, record)
+	return nil
+}
+
+// ReplaceRG replaces the @RG line with the same ID as the given
+// record.
+func (hdr *Header) ReplaceRG(record utils.StringMap) error {
+	if err := checkHeaderRecord("@RG", record); err != nil {
+		return err
+	}
+	i := findID(hdr.RG, record["ID"])
+	if i < 0 {
+		return fmt.Errorf("unknown @RG ID %v", record["ID"])
+	}
+	hdr.RG[i] = record
+	return nil
+}
+
+// RemoveRG removes the @RG line with the given ID, and reports
+// whether it was found.
+func (hdr *Header) RemoveRG(id string) bool {
+	i := findID(hdr.RG, id)
+	if i < 0 {
+		return false
+	}
+	hdr.RG = append(hdr.RG[:i], hdr.RG[i+1:]...)
+	return true
+}
+
+// Returns the index of the @PG line that is the last one in its
+// chain, that is, that is not the previous program of another @PG
+// line. If there are several chains, the first one is chosen. Returns
+// -1 if there are no @PG lines.
+func (hdr *Header) lastPG() int {
+	for i, pg := range hdr.PG {
+		id := pg["ID"]
+		if findPP(hdr.PG, id) < 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the index of the @PG line whose previous program has the
+// given ID, or -1.
+func findPP(records []utils.StringMap, id string) int {
+	return utils.Find(records, func(record utils.StringMap) bool { return record["PP"] == id })
+}
+
+// Checks that the PP of a @PG line refers to another @PG line, and
+// that following the PP references from there does not lead back to
+// the given line.
+func (hdr *Header) checkPP(record utils.StringMap) error {
+	pp, found := record["PP"]
+	if !found {
+		return nil
+	}
+	for seen := 0; seen <= len(hdr.PG); seen++ {
+		if pp == record["ID"] {
+			return fmt.Errorf("cyclic PP chain for @PG ID %v", record["ID"])
+		}
+		i := findID(hdr.PG, pp)
+		if i < 0 {
+			return fmt.Errorf("unknown PP %v in @PG ID %v", pp, record["ID"])
+		}
+		if pp, found = hdr.PG[i]["PP"]; !found {
+			return nil
+		}
+	}
+	return fmt.Errorf("cyclic PP chain for @PG ID %v", record["ID"])
+}
+
+// AddPG adds a @PG line to the header. The ID of the program must be
+// unique. If the record has no PP, it is chained after the last
+// program of the first chain in the header. Otherwise, the PP must
+// refer to an existing @PG line.
+func (hdr *Header) AddPG(record utils.StringMap) error {
+	if err := checkHeaderRecord("@PG", record); err != nil {
+		return err
+	}
+	if findID(hdr.PG, record["ID"]) >= 0 {
+		return fmt.Errorf("duplicate @PG ID %v", record["ID"])
+	}
+	if _, found := record["PP"]; !found {
+		if last := hdr.lastPG(); last >= 0 {
+			record["PP"] = hdr.PG[last]["ID"]
+		}
+	} else if err := hdr.checkPP(record); err != nil {
+		return err
+	}
+	hdr.PG = append(hdr.PG, record)
+	return nil
+}
+
+// ReplacePG replaces the @PG line with the same ID as the given
+// record. The PP of the record, if any, must refer to another @PG
+// line without introducing a cycle.
+func (hdr *Header) ReplacePG(record utils.StringMap) error {
+	if err := checkHeaderRecord("@PG", record); err != nil {
+		return err
+	}
+	i := findID(hdr.PG, record["ID"])
+	if i < 0 {
+		return fmt.Errorf("unknown @PG ID %v", record["ID"])
+	}
+	old := hdr.PG[i]
+	hdr.PG[i] = record
+	if err := hdr.checkPP(record); err != nil {
+		hdr.PG[i] = old
+		return err
+	}
+	return nil
+}
+
+// RemovePG removes the @PG line with the given ID, and reports
+// whether it was found. The @PG lines that refer to the removed line
+// as their previous program are chained to its PP instead, or become
+// the start of their chain if it has none.
+func (hdr *Header) RemovePG(id string) bool {
+	i := findID(hdr.PG, id)
+	if i < 0 {
+		return false
+	}
+	pp, hasPP := hdr.PG[i]["PP"]
+	hdr.PG = append(hdr.PG[:i], hdr.PG[i+1:]...)
+	for _, pg := range hdr.PG {
+		if pg["PP"] == id {
+			if hasPP {
+				pg["PP"] = pp
+			} else {
+				delete(pg, "PP")
+			}
+		}
+	}
+	return true
+}
+
+// UniquePGID returns the given ID if no @PG line in the header has
+// it yet. Otherwise, it returns the ID with the smallest numeric
+// suffix that makes it unique.
+func (hdr *Header) UniquePGID(id string) string {
+	if findID(hdr.PG, id) < 0 {
+		return id
+	}
+	return uniqueID(hdr.PG, id)
+}
+
+// AddCO adds a @CO line to the header.
+func (hdr *Header) AddCO(comment string) error {
+	if strings.ContainsRune(comment, '\n') {
+		return errors.New("invalid newline in @CO header line")
+	}
+	hdr.CO = append(hdr.CO, comment)
+	return nil
+}
+
+// ReplaceCO replaces all @CO lines that are equal to old with
+// comment, and reports whether any were found.
+func (hdr *Header) ReplaceCO(old, comment string) (bool, error) {
+	if strings.ContainsRune(comment, '\n') {
+		return false, errors.New("invalid newline in @CO header line")
+	}
+	var found bool
+	for i, co := range hdr.CO {
+		if co == old {
+			hdr.CO[i] = comment
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// RemoveCO removes all @CO lines that are equal to the given comment,
+// and reports whether any were found.
+func (hdr *Header) RemoveCO(comment string) bool {
+	result := hdr.CO[:0]
+	for _, co := range hdr.CO {
+		if co != comment {
+			result = append(result, co)
+		}
+	}
+	found := len(result) < len(hdr.CO)
+	hdr.CO = result
+	return found
+}
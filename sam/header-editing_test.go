@@ -0,0 +1,78 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"testing"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestHeaderEditing(t *testing.T) {
+	hdr := NewHeader()
+	if err := hdr.AddRG(utils.StringMap{"ID": "rg1", "SM": "s1"}); err != nil {
+		t.Error("AddRG failed", err)
+	}
+	if err := hdr.AddRG(utils.StringMap{"ID": "rg1"}); err == nil {
+		t.Error("AddRG duplicate failed")
+	}
+	if err := hdr.ReplaceRG(utils.StringMap{"ID": "rg1", "SM": "s2"}); err != nil || hdr.RG[0]["SM"] != "s2" {
+		t.Error("ReplaceRG failed", err)
+	}
+	if !hdr.RemoveRG("rg1") || len(hdr.RG) != 0 {
+		t.Error("RemoveRG failed")
+	}
+
+	for _, id := range []string{"bwa", "elprep", "gatk"} {
+		if err := hdr.AddPG(utils.StringMap{"ID": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hdr.PG[1]["PP"] != "bwa" || hdr.PG[2]["PP"] != "elprep" {
+		t.Error("AddPG chaining failed", hdr.PG)
+	}
+	if err := hdr.AddPG(utils.StringMap{"ID": "x", "PP": "unknown"}); err == nil {
+		t.Error("AddPG unknown PP failed")
+	}
+	if err := hdr.ReplacePG(utils.StringMap{"ID": "bwa", "PP": "gatk"}); err == nil || hdr.PG[0]["PP"] != "" {
+		t.Error("ReplacePG cycle failed", err)
+	}
+	if !hdr.RemovePG("elprep") || len(hdr.PG) != 2 || hdr.PG[1]["PP"] != "bwa" {
+		t.Error("RemovePG failed", hdr.PG)
+	}
+	if hdr.UniquePGID("x") != "x" || hdr.UniquePGID("bwa") != "bwa-1" {
+		t.Error("UniquePGID failed")
+	}
+	if line := string(formatSamHeaderLine(nil, "@PG", utils.StringMap{"DS": "d", "CL": "c", "ID": "x", "PN": "p"})); line != "@PG\tID:x\tPN:p\tCL:c\tDS:d\n" {
+		t.Error("formatSamHeaderLine order failed", line)
+	}
+
+	_ = hdr.AddCO("a")
+	_ = hdr.AddCO("b")
+	_ = hdr.AddCO("a")
+	if found, err := hdr.ReplaceCO("b", "c"); !found || err != nil || hdr.CO[1] != "c" {
+		t.Error("ReplaceCO failed")
+	}
+	if !hdr.RemoveCO("a") || len(hdr.CO) != 1 {
+		t.Error("RemoveCO failed", hdr.CO)
+	}
+	if err := hdr.AddCO("a\nb"); err == nil {
+		t.Error("AddCO failed")
+	}
+}
@@ -0,0 +1,392 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URL schemes for reads on htsget servers. The htsget:// scheme
+// refers to a server that is accessed with HTTPS. The htsget+http://
+// scheme refers to a server that is accessed with plain HTTP, for
+// example on a local network.
+const (
+	HtsgetScheme     = "htsget://"
+	HtsgetHTTPScheme = "htsget+http://"
+)
+
+// IsHtsgetURL reports whether the given name refers to reads on an
+// htsget server.
+func IsHtsgetURL(name string) bool {
+	return strings.HasPrefix(name, HtsgetScheme) || strings.HasPrefix(name, HtsgetHTTPScheme)
+}
+
+// htsgetEndpoint returns the HTTP(S) URL of the reads endpoint of an
+// htsget URL.
+func htsgetEndpoint(name string) (*url.URL, error) {
+	var endpoint string
+	switch {
+	case strings.HasPrefix(name, HtsgetScheme):
+		endpoint = "https://" + name[len(HtsgetScheme):]
+	case strings.HasPrefix(name, HtsgetHTTPScheme):
+		endpoint = "http://" + name[len(HtsgetHTTPScheme):]
+	default:
+		return nil, fmt.Errorf("%v is not an htsget URL", name)
+	}
+	return url.Parse(endpoint)
+}
+
+type (
+	// An htsgetRegion is a region in the body of a POST request to an
+	// htsget server, as a 0-based, half-open range.
+	htsgetRegion struct {
+		ReferenceName string `json:"referenceName"`
+		Start         *int32 `json:"start,omitempty"`
+		End           *int32 `json:"end,omitempty"`
+	}
+
+	// An htsgetURL is one of the blocks of data of an htsget ticket.
+	htsgetURL struct {
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+	}
+
+	// An htsgetTicket is the response of an htsget server, which
+	// lists the blocks of data that make up the requested reads.
+	htsgetTicket struct {
+		Htsget struct {
+			Format  string      `json:"format"`
+			URLs    []htsgetURL `json:"urls"`
+			Error   string      `json:"error"`
+			Message string      `json:"message"`
+		} `json:"htsget"`
+	}
+)
+
+func newHtsgetRegion(locus Locus) htsgetRegion {
+	region := htsgetRegion{ReferenceName: locus.RNAME}
+	if locus.Start > 0 {
+		start := locus.Start
+		region.Start = &start
+	}
+	if locus.End < math.MaxInt32 {
+		end := locus.End
+		region.End = &end
+	}
+	return region
+}
+
+// requestHtsgetTicket requests a ticket for the reads of an htsget
+// endpoint in BAM format. The loci are passed to the server, which
+// then only returns the data that is needed for alignments that
+// overlap with them. A single locus is passed as query parameters of
+// a GET request, and several loci in the body of a POST request. If
+// class is not empty, it is passed as the class of the request, which
+// can be "header" to only request the header.
+func requestHtsgetTicket(endpoint *url.URL, loci []Locus, class string) (*htsgetTicket, error) {
+	query := endpoint.Query()
+	query.Set("format", "BAM")
+	if class != "" {
+		query.Set("class", class)
+	}
+	var request *http.Request
+	var err error
+	if len(loci) > 1 {
+		body := struct {
+			Format  string         `json:"format"`
+			Class   string         `json:"class,omitempty"`
+			Regions []htsgetRegion `json:"regions"`
+		}{Format: "BAM", Class: class}
+		for _, locus := range loci {
+			body.Regions = append(body.Regions, newHtsgetRegion(locus))
+		}
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		u := *endpoint
+		u.RawQuery = query.Encode()
+		if request, err = http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+	} else {
+		if len(loci) == 1 {
+			region := newHtsgetRegion(loci[0])
+			query.Set("referenceName", region.ReferenceName)
+			if region.Start != nil {
+				query.Set("start", strconv.FormatInt(int64(*region.Start), 10))
+			}
+			if region.End != nil {
+				query.Set("end", strconv.FormatInt(int64(*region.End), 10))
+			}
+		}
+		u := *endpoint
+		u.RawQuery = query.Encode()
+		if request, err = http.NewRequest(http.MethodGet, u.String(), nil); err != nil {
+			return nil, err
+		}
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	var ticket htsgetTicket
+	if err := json.NewDecoder(response.Body).Decode(&ticket); err != nil {
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("htsget request for %v failed: %v", endpoint, response.Status)
+		}
+		return nil, fmt.Errorf("%v, while reading htsget ticket for %v", err, endpoint)
+	}
+	if response.StatusCode != http.StatusOK || ticket.Htsget.Error != "" {
+		return nil, fmt.Errorf("htsget request for %v failed: %v %v %v", endpoint, response.Status, ticket.Htsget.Error, ticket.Htsget.Message)
+	}
+	if ticket.Htsget.Format != "" && ticket.Htsget.Format != "BAM" {
+		return nil, fmt.Errorf("htsget server returned format %v instead of BAM for %v", ticket.Htsget.Format, endpoint)
+	}
+	return &ticket, nil
+}
+
+// An htsgetStream reads the concatenated blocks of data of an htsget
+// ticket. The blocks are only fetched when they are read.
+type htsgetStream struct {
+	urls    []htsgetURL
+	current io.ReadCloser
+}
+
+// openBlock opens the next block of data, which is either given
+// inline as a data URL, or fetched from a URL with the given headers.
+func (stream *htsgetStream) openBlock() error {
+	block := stream.urls[0]
+	stream.urls = stream.urls[1:]
+	if strings.HasPrefix(block.URL, "data:") {
+		comma := strings.IndexByte(block.URL, ',')
+		if comma < 0 {
+			return errors.New("invalid data URL in htsget ticket")
+		}
+		data := block.URL[comma+1:]
+		if !strings.HasSuffix(block.URL[:comma], ";base64") {
+			unescaped, err := url.PathUnescape(data)
+			if err != nil {
+				return err
+			}
+			stream.current = ioutil.NopCloser(strings.NewReader(unescaped))
+			return nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return fmt.Errorf("%v, while decoding data URL in htsget ticket", err)
+		}
+		stream.current = ioutil.NopCloser(bytes.NewReader(decoded))
+		return nil
+	}
+	request, err := http.NewRequest(http.MethodGet, block.URL, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range block.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		_ = response.Body.Close()
+		return fmt.Errorf("htsget data request for %v failed: %v", block.URL, response.Status)
+	}
+	stream.current = response.Body
+	return nil
+}
+
+// Read implements the method of the io.Reader interface.
+func (stream *htsgetStream) Read(p []byte) (int, error) {
+	for {
+		if stream.current == nil {
+			if len(stream.urls) == 0 {
+				return 0, io.EOF
+			}
+			if err := stream.openBlock(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := stream.current.Read(p)
+		if err == io.EOF {
+			err = stream.current.Close()
+			stream.current = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close implements the method of the io.Closer interface.
+func (stream *htsgetStream) Close() error {
+	if stream.current != nil {
+		err := stream.current.Close()
+		stream.current = nil
+		return err
+	}
+	return nil
+}
+
+// An htsgetReader is an alignmentReader for the alignments that an
+// htsget server returns for a set of loci. Since a server may return
+// complete BGZF blocks, the alignments that do not overlap with the
+// loci are skipped.
+type htsgetReader struct {
+	*bamReader
+	loci    []Locus
+	aliases ContigAliases
+	refLoci map[int32][]Locus
+}
+
+// ParseHeader implements the method of the alignmentReader interface.
+func (reader *htsgetReader) ParseHeader() (hdr *Header, err error) {
+	if hdr, err = reader.bamReader.ParseHeader(); err != nil {
+		return nil, err
+	}
+	reader.refLoci, err = resolveLoci(hdr, reader.references, reader.loci, reader.aliases)
+	return hdr, err
+}
+
+// SkipHeader implements the method of the alignmentReader interface.
+// The header is still parsed to resolve the loci.
+func (reader *htsgetReader) SkipHeader() error {
+	_, err := reader.ParseHeader()
+	return err
+}
+
+// Fetch implements the method of the pipeline.Source interface.
+func (reader *htsgetReader) Fetch(size int) (fetched int) {
+	var records [][]byte
+	for fetched == 0 {
+		if reader.bamReader.Fetch(size) == 0 {
+			break
+		}
+		for _, record := range reader.bamReader.data.([][]byte) {
+			if lociOverlap(reader.refLoci, record) {
+				records = append(records, record)
+				fetched++
+			}
+		}
+	}
+	if reader.err != nil {
+		reader.data = nil
+		return 0
+	}
+	reader.data = records
+	return fetched
+}
+
+// OpenHtsget opens the reads of an htsget URL for input, for example
+// htsget://htsget.example.org/reads/sample1, which refers to the reads
+// endpoint https://htsget.example.org/reads/sample1. The reads are
+// requested in BAM format, and streamed from the server without
+// downloading them first.
+//
+// If loci are given, they are passed to the server, so that only the
+// data for the alignments that overlap with them is transferred. The
+// reference sequences of the loci are resolved against the header, as
+// for OpenRegionsWithAliases, which is requested from the server
+// first.
+func OpenHtsget(name string, loci []Locus, aliases ContigAliases) (*InputFile, error) {
+	endpoint, err := htsgetEndpoint(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(loci) > 0 {
+		if loci, err = resolveHtsgetLoci(endpoint, loci, aliases); err != nil {
+			return nil, err
+		}
+	}
+	ticket, err := requestHtsgetTicket(endpoint, loci, "")
+	if err != nil {
+		return nil, err
+	}
+	stream := &htsgetStream{urls: ticket.Htsget.URLs}
+	bgzf, err := NewBGZFReaderWithOptions(bufio.NewReader(stream), bgzfOptions)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	reader := &bamReader{rc: stream, bgzf: bgzf}
+	if len(loci) == 0 {
+		return &InputFile{reader: reader}, nil
+	}
+	return &InputFile{reader: &htsgetReader{bamReader: reader, loci: loci}}, nil
+}
+
+// resolveHtsgetLoci requests the header of an htsget endpoint, and
+// renames the reference sequences of the loci to the names in the
+// header, so that the server recognizes them.
+func resolveHtsgetLoci(endpoint *url.URL, loci []Locus, aliases ContigAliases) (_ []Locus, err error) {
+	ticket, err := requestHtsgetTicket(endpoint, nil, "header")
+	if err != nil {
+		return nil, err
+	}
+	stream := &htsgetStream{urls: ticket.Htsget.URLs}
+	defer func() {
+		if nerr := stream.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	bgzf, err := NewBGZFReaderWithOptions(bufio.NewReader(stream), bgzfOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := bgzf.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	hdr, _, err := ParseBamHeader(bgzf)
+	if err != nil {
+		return nil, fmt.Errorf("%v, while reading the header from %v", err, endpoint)
+	}
+	names := hdr.ContigNames(aliases)
+	resolved := make([]Locus, 0, len(loci))
+	for _, locus := range loci {
+		sn, found := names[locus.RNAME]
+		if !found {
+			return nil, fmt.Errorf("unknown reference sequence %v in region query", locus.RNAME)
+		}
+		locus.RNAME = sn
+		resolved = append(resolved, locus)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,105 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenHtsget(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.bam")
+	writeIndexedBam(t, name, indexedBamLines, false)
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var referenceName string
+	var nofRegions int
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/reads/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "BAM" {
+			http.Error(w, `{"htsget":{"error":"UnsupportedFormat"}}`, http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost {
+			var body struct {
+				Regions []htsgetRegion `json:"regions"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			nofRegions = len(body.Regions)
+		} else if r.URL.Query().Get("class") == "" {
+			referenceName = r.URL.Query().Get("referenceName")
+		}
+		// the data is split at an arbitrary position into an inline
+		// block and a block that is fetched separately
+		fmt.Fprintf(w, `{"htsget":{"format":"BAM","urls":[{"url":"data:application/vnd.ga4gh.bam;base64,%v"},{"url":"%v/data","headers":{"Authorization":"Bearer token"}}]}}`,
+			base64.StdEncoding.EncodeToString(data[:100]), server.URL)
+	})
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write(data[100:])
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+	url := HtsgetHTTPScheme + strings.TrimPrefix(server.URL, "http://") + "/reads/test"
+
+	query := func(loci ...Locus) (qnames []string) {
+		input, err := OpenRegions(url, loci)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reads := NewSam()
+		if err := input.RunPipeline(reads, nil, Keep); err != nil {
+			t.Fatal(err)
+		}
+		if err := input.Close(); err != nil {
+			t.Error(err)
+		}
+		for _, aln := range reads.Alignments {
+			qnames = append(qnames, aln.QNAME)
+		}
+		return qnames
+	}
+	if qnames := query(); !equalNames(qnames, "r1", "r2", "r3", "r4") {
+		t.Error("OpenHtsget failed", qnames)
+	}
+	if qnames := query(Locus{RNAME: "1", Start: 0, End: 200}); !equalNames(qnames, "r1") || referenceName != "chr1" {
+		t.Error("OpenHtsget region failed", qnames, referenceName)
+	}
+	if qnames := query(Locus{RNAME: "chr1", Start: 19000, End: 21000}, Locus{RNAME: "chr2", Start: 0, End: 100}); !equalNames(qnames, "r2", "r3") || nofRegions != 2 {
+		t.Error("OpenHtsget regions failed", qnames, nofRegions)
+	}
+	if _, err := OpenHtsget(HtsgetHTTPScheme+strings.TrimPrefix(server.URL, "http://")+"/reads/missing", nil, nil); err == nil {
+		t.Error("OpenHtsget error failed")
+	}
+}
@@ -0,0 +1,533 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/exascience/elprep/v4/internal"
+	"github.com/exascience/elprep/v4/utils"
+)
+
+// A mergedReader reads the alignments of several input files as if
+// they were a single file, with a header that reconciles the headers
+// of the input files.
+//
+// Each record it produces is prefixed with the index of its input
+// file as a 16-bit integer, so that ParseAlignment can dispatch to the
+// corresponding input file.
+type mergedReader struct {
+	inputs    []*InputFile
+	iterators []*AlignmentIterator
+	header    *Header
+	// The new IDs of @RG and @PG lines for each input file, for the
+	// IDs that had to be changed to make them unique.
+	rgIDs, pgIDs []map[string]string
+	// If the input files are sorted in the same order, the next
+	// record of each input file, otherwise nil.
+	heads        []*mergedHead
+	dictTable    map[string]int32
+	sortingOrder SortingOrder
+	less         func(name1, name2 string) bool
+	current      int
+	data         [][]byte
+	err          error
+}
+
+// A mergedHead is the next record of an input file of a mergedReader,
+// with the fields that are needed to determine the merge order.
+type mergedHead struct {
+	record   *Record
+	refIndex int32
+	pos      int32
+	qname    string
+}
+
+// OpenMerged returns an InputFile that reads the alignments of the
+// given input files as if they were a single file. The input files
+// are closed when the returned InputFile is closed.
+//
+// The header of the returned InputFile reconciles the headers of the
+// input files. The @SQ lines are merged by reference sequence name,
+// and it is an error if the same name has different lengths. @RG and
+// @PG lines that occur in several input files with the same ID but
+// different contents are given a unique ID, and the RG and PG
+// optional fields of the alignments are changed accordingly.
+//
+// If all input files are sorted by coordinate, or all by queryname,
+// and their reference sequences occur in the same order, then the
+// alignments are interleaved so that the result is sorted in the same
+// way. Otherwise, the alignments of the input files are concatenated,
+// and the sorting order is unknown.
+func OpenMerged(inputs []*InputFile) (*InputFile, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("no input files to merge")
+	}
+	if len(inputs) > math.MaxUint16 {
+		return nil, fmt.Errorf("too many input files to merge: %v", len(inputs))
+	}
+	if len(inputs) == 1 {
+		return inputs[0], nil
+	}
+	reader := &mergedReader{
+		inputs: inputs,
+		header: NewHeader(),
+		rgIDs:  make([]map[string]string, len(inputs)),
+		pgIDs:  make([]map[string]string, len(inputs)),
+	}
+	for i, input := range inputs {
+		it, err := input.Iterator()
+		if err != nil {
+			return nil, err
+		}
+		reader.iterators = append(reader.iterators, it)
+		if err := reader.mergeHeader(i, it.Header()); err != nil {
+			return nil, err
+		}
+	}
+	reader.dictTable = make(map[string]int32, len(reader.header.SQ))
+	for index, sn := range reader.header.SQ {
+		reader.dictTable[sn["SN"]] = int32(index)
+	}
+	if reader.sortingOrder = reader.commonSortingOrder(); reader.sortingOrder != Unknown {
+		reader.header.SetHDSO(reader.sortingOrder)
+		if reader.sortingOrder == Queryname {
+			collation := reader.iterators[0].Header().HDQuerynameCollation()
+			reader.header.SetHDQuerynameCollation(collation)
+			if collation == Natural {
+				reader.less = func(name1, name2 string) bool { return NaturalCompare(name1, name2) < 0 }
+			} else {
+				reader.less = func(name1, name2 string) bool { return name1 < name2 }
+			}
+		}
+		reader.heads = make([]*mergedHead, len(inputs))
+		for i := range inputs {
+			if err := reader.advance(i); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		reader.header.SetHDSO(Unknown)
+		// Concatenation does not keep query templates that occur in
+		// several input files together.
+		reader.header.SetHDGO(None)
+	}
+	return &InputFile{reader: reader}, nil
+}
+
+// Returns a unique ID for a @RG or @PG line, based on the given ID.
+func uniqueID(records []utils.StringMap, id string) string {
+	for n := 1; ; n++ {
+		if newID := fmt.Sprintf("%v-%v", id, n); findID(records, newID) < 0 {
+			return newID
+		}
+	}
+}
+
+func equalRecords(record1, record2 utils.StringMap) bool {
+	if len(record1) != len(record2) {
+		return false
+	}
+	for key, value := range record1 {
+		if value2, found := record2[key]; !found || value != value2 {
+			return false
+		}
+	}
+	return true
+}
+
+// Merges the header of input file i into the merged header.
+func (reader *mergedReader) mergeHeader(i int, hdr *Header) error {
+	merged := reader.header
+	if i == 0 {
+		merged.HD = make(utils.StringMap)
+		for key, value := range hdr.EnsureHD() {
+			merged.HD[key] = value
+		}
+	}
+	for _, sq := range hdr.SQ {
+		j := utils.Find(merged.SQ, func(record utils.StringMap) bool { return record["SN"] == sq["SN"] })
+		if j < 0 {
+			merged.SQ = append(merged.SQ, sq)
+		} else if sq["LN"] != merged.SQ[j]["LN"] {
+			return fmt.Errorf("reference sequence %v has different lengths %v and %v in the input files", sq["SN"], merged.SQ[j]["LN"], sq["LN"])
+		}
+	}
+	reader.rgIDs[i] = make(map[string]string)
+	for _, rg := range hdr.RG {
+		j := findID(merged.RG, rg["ID"])
+		if j >= 0 && equalRecords(rg, merged.RG[j]) {
+			continue
+		}
+		if j >= 0 {
+			newID := uniqueID(merged.RG, rg["ID"])
+			reader.rgIDs[i][rg["ID"]] = newID
+			rg = copyRecord(rg)
+			rg["ID"] = newID
+		}
+		merged.RG = append(merged.RG, rg)
+	}
+	// A @PG line is kept only once if an identical line, including its
+	// previous program, is already in the merged header, so that
+	// identical chains of @PG lines are not repeated. The @PG lines are
+	// therefore considered in chain order, and their PP references are
+	// changed before they are compared.
+	reader.pgIDs[i] = make(map[string]string)
+	kept := make([]utils.StringMap, len(hdr.PG))
+	var pgs []utils.StringMap
+	for _, k := range pgChainOrder(hdr.PG) {
+		pg := copyRecord(hdr.PG[k])
+		if newPP, found := reader.pgIDs[i][pg["PP"]]; found {
+			pg["PP"] = newPP
+		}
+		j := findID(merged.PG, pg["ID"])
+		if j >= 0 && equalRecords(pg, merged.PG[j]) {
+			continue
+		}
+		if j >= 0 || findID(pgs, pg["ID"]) >= 0 {
+			newID := uniqueID(append(merged.PG, pgs...), pg["ID"])
+			reader.pgIDs[i][pg["ID"]] = newID
+			pg["ID"] = newID
+		}
+		pgs = append(pgs, pg)
+		kept[k] = pg
+	}
+	for _, pg := range kept {
+		if pg != nil {
+			merged.PG = append(merged.PG, pg)
+		}
+	}
+	for _, co := range hdr.CO {
+		if !containsString(merged.CO, co) {
+			merged.CO = append(merged.CO, co)
+		}
+	}
+	for code, records := range hdr.UserRecords {
+		for _, record := range records {
+			merged.AddUserRecord(code, record)
+		}
+	}
+	return nil
+}
+
+// Returns the indices of the given @PG lines such that each line
+// comes after the line its PP refers to. Lines with a PP that does not
+// refer to any of the given lines, or that are part of a cycle, keep
+// their relative order.
+func pgChainOrder(records []utils.StringMap) []int {
+	order := make([]int, 0, len(records))
+	done := make([]bool, len(records))
+	seen := make(map[string]bool, len(records))
+	for len(order) < len(records) {
+		progress := false
+		for k, record := range records {
+			if done[k] {
+				continue
+			}
+			if pp, found := record["PP"]; found && !seen[pp] && findID(records, pp) >= 0 {
+				continue
+			}
+			order = append(order, k)
+			done[k] = true
+			seen[record["ID"]] = true
+			progress = true
+		}
+		if !progress {
+			for k := range records {
+				if !done[k] {
+					order = append(order, k)
+				}
+			}
+			break
+		}
+	}
+	return order
+}
+
+func copyRecord(record utils.StringMap) utils.StringMap {
+	result := make(utils.StringMap, len(record))
+	for key, value := range record {
+		result[key] = value
+	}
+	return result
+}
+
+func containsString(list []string, s string) bool {
+	for _, str := range list {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the sorting order that all input files have in common, if
+// the alignments can be interleaved accordingly, or else Unknown.
+func (reader *mergedReader) commonSortingOrder() SortingOrder {
+	first := reader.iterators[0].Header()
+	sortingOrder := first.HDSO()
+	if sortingOrder != Coordinate && sortingOrder != Queryname {
+		return Unknown
+	}
+	for _, it := range reader.iterators[1:] {
+		hdr := it.Header()
+		if hdr.HDSO() != sortingOrder || hdr.HD["SS"] != first.HD["SS"] {
+			return Unknown
+		}
+	}
+	if sortingOrder == Coordinate {
+		// the reference sequences of each input file must occur in the
+		// same order as in the merged header
+		for _, it := range reader.iterators {
+			last := int32(-1)
+			for _, sq := range it.Header().SQ {
+				index := reader.dictTable[sq["SN"]]
+				if index < last {
+					return Unknown
+				}
+				last = index
+			}
+		}
+	}
+	return sortingOrder
+}
+
+// Fetches the next record of input file i into heads[i], or nil at
+// the end of the input file.
+func (reader *mergedReader) advance(i int) error {
+	record, err := reader.iterators[i].NextRecord()
+	if err == io.EOF {
+		reader.heads[i] = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	head := &mergedHead{record: record}
+	if reader.sortingOrder == Coordinate {
+		rname, err := record.RNAME()
+		if err != nil {
+			return err
+		}
+		index, found := reader.dictTable[rname]
+		if !found {
+			// unmapped alignments come last
+			index = math.MaxInt32
+		}
+		head.refIndex = index
+		if head.pos, err = record.POS(); err != nil {
+			return err
+		}
+	} else if head.qname, err = record.QNAME(); err != nil {
+		return err
+	}
+	reader.heads[i] = head
+	return nil
+}
+
+// Returns the index of the input file with the next record in merge
+// order, or -1 if all input files are exhausted. Ties are broken in
+// favor of earlier input files.
+func (reader *mergedReader) next() int {
+	result := -1
+	for i, head := range reader.heads {
+		if head == nil {
+			continue
+		}
+		if result < 0 {
+			result = i
+			continue
+		}
+		min := reader.heads[result]
+		if reader.sortingOrder == Coordinate {
+			if head.refIndex < min.refIndex || (head.refIndex == min.refIndex && head.pos < min.pos) {
+				result = i
+			}
+		} else if reader.less(head.qname, min.qname) {
+			result = i
+		}
+	}
+	return result
+}
+
+// Returns a copy of the given record, prefixed with the index of its
+// input file.
+func prefixRecord(i int, record []byte) []byte {
+	result := make([]byte, 2+len(record))
+	binary.LittleEndian.PutUint16(result, uint16(i))
+	copy(result[2:], record)
+	return result
+}
+
+// Close closes all input files.
+func (reader *mergedReader) Close() (err error) {
+	for _, input := range reader.inputs {
+		if nerr := input.Close(); err == nil {
+			err = nerr
+		}
+	}
+	return
+}
+
+// ParseHeader returns the merged header.
+func (reader *mergedReader) ParseHeader() (*Header, error) {
+	return reader.header, nil
+}
+
+// SkipHeader does nothing, since the headers of the input files are
+// already parsed.
+func (reader *mergedReader) SkipHeader() error {
+	return nil
+}
+
+// ParseAlignment parses a record of one of the input files, and
+// changes its RG and PG optional fields if the corresponding IDs were
+// changed in the merged header.
+func (reader *mergedReader) ParseAlignment(record []byte) (*Alignment, error) {
+	i := int(binary.LittleEndian.Uint16(record))
+	aln, err := reader.inputs[i].ParseAlignment(record[2:])
+	if err != nil {
+		return nil, err
+	}
+	if len(reader.rgIDs[i]) > 0 {
+		if rg, ok := aln.TagString(RG); ok {
+			if newID, found := reader.rgIDs[i][rg]; found {
+				aln.SetRG(newID)
+			}
+		}
+	}
+	if len(reader.pgIDs[i]) > 0 {
+		if pg, ok := aln.TagString(PG); ok {
+			if newID, found := reader.pgIDs[i][pg]; found {
+				aln.DecodeTags()
+				aln.TAGS.Set(PG, newID)
+			}
+		}
+	}
+	return aln, nil
+}
+
+// Err implements the method of the pipeline.Source interface.
+func (reader *mergedReader) Err() error {
+	return reader.err
+}
+
+// Prepare implements the method of the pipeline.Source interface.
+func (reader *mergedReader) Prepare(_ context.Context) int {
+	return -1
+}
+
+// Fetch implements the method of the pipeline.Source interface.
+func (reader *mergedReader) Fetch(size int) (fetched int) {
+	reader.data = nil
+	if reader.err != nil {
+		return 0
+	}
+	data := make([][]byte, 0, size)
+	if reader.heads == nil {
+		for len(data) < size && reader.current < len(reader.iterators) {
+			record, err := reader.iterators[reader.current].NextRecord()
+			if err == io.EOF {
+				reader.current++
+				continue
+			} else if err != nil {
+				reader.err = err
+				return 0
+			}
+			data = append(data, prefixRecord(reader.current, record.Bytes()))
+		}
+	} else {
+		for len(data) < size {
+			i := reader.next()
+			if i < 0 {
+				break
+			}
+			data = append(data, prefixRecord(i, reader.heads[i].record.Bytes()))
+			if err := reader.advance(i); err != nil {
+				reader.err = err
+				return 0
+			}
+		}
+	}
+	reader.data = data
+	return len(data)
+}
+
+// Data implements the method of the pipeline.Source interface.
+func (reader *mergedReader) Data() interface{} {
+	return reader.data
+}
+
+// InputFiles returns the SAM/BAM files for an input argument, which
+// is either a single file, an htsget URL, or a directory. For a
+// directory, all .sam, .sam.gz, and .bam files in it are returned,
+// sorted by name.
+func InputFiles(input string) ([]string, error) {
+	if IsHtsgetURL(input) {
+		return []string{input}, nil
+	}
+	info, err := os.Stat(input)
+	if err != nil || !info.IsDir() {
+		return []string{input}, err
+	}
+	names, err := internal.Directory(input)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range names {
+		switch FileExt(name) {
+		case SamExt, SamGzExt, BamExt:
+			files = append(files, filepath.Join(input, name))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no SAM or BAM files in directory %v", input)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// OpenMergedRegions opens the given SAM or BAM files with
+// OpenRegionsWithAliases, and merges them with OpenMerged.
+func OpenMergedRegions(names []string, loci []Locus, aliases ContigAliases) (_ *InputFile, err error) {
+	var inputs []*InputFile
+	defer func() {
+		if err != nil {
+			for _, input := range inputs {
+				_ = input.Close()
+			}
+		}
+	}()
+	for _, name := range names {
+		input, err := OpenRegionsWithAliases(name, loci, aliases)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, input)
+	}
+	return OpenMerged(inputs)
+}
@@ -0,0 +1,122 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeSamFiles(t *testing.T, contents ...string) (names []string) {
+	dir := t.TempDir()
+	for i, content := range contents {
+		name := filepath.Join(dir, string(rune('a'+i))+".sam")
+		if err := ioutil.WriteFile(name, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestOpenMerged(t *testing.T) {
+	names := writeSamFiles(t,
+		"@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:1000\n@SQ\tSN:chr2\tLN:1000\n@RG\tID:lane\tSM:s1\n@PG\tID:bwa\tPN:bwa\n"+
+			"a1\t0\tchr1\t10\t60\t1M\t*\t0\t0\tA\tI\tRG:Z:lane\n"+
+			"a2\t0\tchr2\t5\t60\t1M\t*\t0\t0\tA\tI\tRG:Z:lane\n"+
+			"a3\t4\t*\t0\t0\t*\t*\t0\t0\tA\tI\tRG:Z:lane\n",
+		"@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:1000\n@SQ\tSN:chr2\tLN:1000\n@SQ\tSN:chr3\tLN:1000\n@RG\tID:lane\tSM:s2\n@PG\tID:bwa\tPN:bwa\n"+
+			"b1\t0\tchr1\t20\t60\t1M\t*\t0\t0\tA\tI\tRG:Z:lane\n"+
+			"b2\t0\tchr2\t1\t60\t1M\t*\t0\t0\tA\tI\tRG:Z:lane\n"+
+			"b3\t0\tchr3\t1\t60\t1M\t*\t0\t0\tA\tI\tRG:Z:lane\n")
+	input, err := OpenMergedRegions(names, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := NewSam()
+	if err := input.RunPipeline(reads, nil, Keep); err != nil {
+		t.Fatal(err)
+	}
+	if err := input.Close(); err != nil {
+		t.Error(err)
+	}
+	hdr := reads.Header
+	if hdr.HDSO() != Coordinate || len(hdr.SQ) != 3 || len(hdr.RG) != 2 || len(hdr.PG) != 1 {
+		t.Error("OpenMerged header failed", hdr.HD, hdr.SQ, hdr.RG, hdr.PG)
+	}
+	if hdr.RG[1]["ID"] != "lane-1" || hdr.RG[1]["SM"] != "s2" {
+		t.Error("OpenMerged read groups failed", hdr.RG)
+	}
+	var qnames, rgs []string
+	for _, aln := range reads.Alignments {
+		qnames = append(qnames, aln.QNAME)
+		rg, _ := aln.TagString(RG)
+		rgs = append(rgs, rg)
+	}
+	if !equalNames(qnames, "a1", "b1", "b2", "a2", "b3", "a3") {
+		t.Error("OpenMerged order failed", qnames)
+	}
+	if !equalNames(rgs, "lane", "lane-1", "lane-1", "lane", "lane-1", "lane") {
+		t.Error("OpenMerged RG rewriting failed", rgs)
+	}
+
+	names = writeSamFiles(t,
+		"@HD\tVN:1.6\tSO:unsorted\n@SQ\tSN:chr1\tLN:1000\nb\t0\tchr1\t20\t60\t1M\t*\t0\t0\tA\tI\n",
+		"@HD\tVN:1.6\tSO:unsorted\n@SQ\tSN:chr1\tLN:1000\na\t0\tchr1\t10\t60\t1M\t*\t0\t0\tA\tI\n")
+	input, err = OpenMergedRegions(names, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads = NewSam()
+	if err := input.RunPipeline(reads, nil, Keep); err != nil {
+		t.Fatal(err)
+	}
+	_ = input.Close()
+	if reads.Header.HDSO() != Unknown || len(reads.Alignments) != 2 || reads.Alignments[0].QNAME != "b" {
+		t.Error("OpenMerged concatenation failed")
+	}
+
+	names = writeSamFiles(t,
+		"@SQ\tSN:chr1\tLN:1000\n@PG\tID:elprep\tPN:elprep\tPP:bwa\n@PG\tID:bwa\tPN:bwa\tCL:bwa mem\n",
+		"@SQ\tSN:chr1\tLN:1000\n@PG\tID:bwa\tPN:bwa\tCL:bwa mem -M\n@PG\tID:elprep\tPN:elprep\tPP:bwa\n",
+		"@SQ\tSN:chr1\tLN:1000\n@PG\tID:bwa\tPN:bwa\tCL:bwa mem\n@PG\tID:elprep\tPN:elprep\tPP:bwa\n")
+	input, err = OpenMergedRegions(names, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err = input.ParseHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = input.Close()
+	pgs := hdr.PG
+	if len(pgs) != 4 ||
+		pgs[0]["ID"] != "elprep" || pgs[1]["ID"] != "bwa" ||
+		pgs[2]["ID"] != "bwa-1" || pgs[3]["ID"] != "elprep-1" || pgs[3]["PP"] != "bwa-1" {
+		t.Error("OpenMerged @PG chains failed", pgs)
+	}
+
+	names = writeSamFiles(t,
+		"@SQ\tSN:chr1\tLN:1000\n",
+		"@SQ\tSN:chr1\tLN:2000\n")
+	if _, err := OpenMergedRegions(names, nil, nil); err == nil {
+		t.Error("OpenMerged dictionary check failed")
+	}
+}
@@ -0,0 +1,206 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// OffsetMapExt is the extension of the offset map that is written
+// next to a BAM file with OutputFile.AddOffsetMap.
+const OffsetMapExt = ".offsets"
+
+// An OffsetMapEntry describes the alignments of a BAM file that start
+// in a bin of a reference sequence. The bin is the 0-based half-open
+// interval [Start, End). The alignments are stored in the range
+// [BeginOffset, EndOffset) of virtual offsets. Unplaced reads are described by an
+// entry with reference sequence name "*". The entries of an offset map
+// are sorted by position in the BAM file, and the EndOffset of an
+// entry is the BeginOffset of the next entry, so the alignments of
+// a BAM file can be split into consecutive ranges of entries without
+// reading the file.
+type OffsetMapEntry struct {
+	RNAME                  string
+	Start, End             int32
+	BeginOffset, EndOffset VirtualOffset
+	Count                  int64
+}
+
+// An offsetMapBuilder collects the entries of an offset map from the
+// raw alignment records of a coordinate-sorted BAM file, as they are
+// written. Positions in the uncompressed data are only converted into
+// virtual offsets once all BGZF blocks are compressed.
+type offsetMapBuilder struct {
+	name    string
+	binSize int32
+	lengths []int32
+	names   []string
+	entries []offsetMapBuilderEntry
+	err     error
+}
+
+type offsetMapBuilderEntry struct {
+	refID, bin int32
+	begin, end int64
+	count      int64
+}
+
+// AddOffsetMap requests that an offset map with bins of the given
+// size is written to the file with the given name when the
+// OutputFile is closed, see OffsetMapEntry. This requires that the
+// output is a BAM file, and that the alignments are written in
+// coordinate order. AddOffsetMap must be called before the header is
+// written.
+func (f *OutputFile) AddOffsetMap(name string, binSize int32) error {
+	writer, ok := f.writer.(*bamWriter)
+	if !ok {
+		return fmt.Errorf("cannot write offset map %v: only BAM files are supported", name)
+	}
+	if binSize <= 0 {
+		return fmt.Errorf("invalid offset map bin size %v", binSize)
+	}
+	if writer.position > 0 {
+		return errors.New("AddOffsetMap called after the header is written")
+	}
+	writer.bgzf.recordOffsets = true
+	writer.offsetMap = &offsetMapBuilder{name: name, binSize: binSize}
+	return nil
+}
+
+// Sets the reference sequences from the header.
+func (builder *offsetMapBuilder) setHeader(hdr *Header) error {
+	builder.lengths = make([]int32, len(hdr.SQ))
+	builder.names = make([]string, len(hdr.SQ))
+	for i, sq := range hdr.SQ {
+		length, err := SQLN(sq)
+		if err != nil {
+			return err
+		}
+		builder.lengths[i], builder.names[i] = length, sq["SN"]
+	}
+	return nil
+}
+
+// Adds a raw alignment record, without its block_size field, that
+// occupies the given positions in the uncompressed data.
+func (builder *offsetMapBuilder) add(record []byte, begin, end int64) {
+	if builder.err != nil {
+		return
+	}
+	refID, pos, _ := bamRecordSpan(record)
+	bin := int32(0)
+	if refID >= 0 {
+		if int(refID) >= len(builder.names) {
+			builder.err = fmt.Errorf("invalid reference sequence index %v while writing an offset map", refID)
+			return
+		}
+		bin = pos / builder.binSize
+	}
+	if n := len(builder.entries); n > 0 {
+		last := &builder.entries[n-1]
+		if last.refID == refID && last.bin == bin {
+			last.end = end
+			last.count++
+			return
+		}
+		// Unplaced reads, with refID -1, come last.
+		if uint32(refID) < uint32(last.refID) || (refID == last.refID && bin < last.bin) {
+			builder.err = errors.New("cannot write an offset map for BAM output that is not sorted by coordinate")
+			return
+		}
+	}
+	builder.entries = append(builder.entries, offsetMapBuilderEntry{refID, bin, begin, end, 1})
+}
+
+// Writes the offset map, converting positions in the uncompressed
+// data into virtual offsets with the given function.
+func (builder *offsetMapBuilder) write(offset func(int64) VirtualOffset) (err error) {
+	if builder.err != nil {
+		return builder.err
+	}
+	file, err := os.Create(builder.name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	out := bufio.NewWriter(file)
+	fmt.Fprintln(out, "#rname\tstart\tend\tbegin_offset\tend_offset\tcount")
+	for _, entry := range builder.entries {
+		rname, start, end := "*", int32(0), int32(0)
+		if entry.refID >= 0 {
+			rname = builder.names[entry.refID]
+			start = entry.bin * builder.binSize
+			end = start + builder.binSize
+			if length := builder.lengths[entry.refID]; end > length || end < start {
+				end = length
+			}
+		}
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\t%v\n", rname, start, end, uint64(offset(entry.begin)), uint64(offset(entry.end)), entry.count)
+	}
+	return out.Flush()
+}
+
+// ParseOffsetMap parses an offset map that was written with
+// OutputFile.AddOffsetMap.
+func ParseOffsetMap(name string) (entries []OffsetMapEntry, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid number of fields in line %v of offset map %v", line, name)
+		}
+		var numbers [5]uint64
+		for i := range numbers {
+			if numbers[i], err = strconv.ParseUint(fields[i+1], 10, 64); err != nil {
+				return nil, fmt.Errorf("%v, in line %v of offset map %v", err, line, name)
+			}
+		}
+		entries = append(entries, OffsetMapEntry{
+			RNAME:       fields[0],
+			Start:       int32(numbers[0]),
+			End:         int32(numbers[1]),
+			BeginOffset: VirtualOffset(numbers[2]),
+			EndOffset:   VirtualOffset(numbers[3]),
+			Count:       int64(numbers[4]),
+		})
+	}
+	return entries, scanner.Err()
+}
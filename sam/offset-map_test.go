@@ -0,0 +1,154 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/exascience/elprep/v4/utils"
+)
+
+func TestOffsetMap(t *testing.T) {
+	if err := SetBGZFOptions(BGZFOptions{BlockSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = SetBGZFOptions(BGZFOptions{})
+	}()
+	var lines []string
+	for i := 0; i < 300; i++ {
+		lines = append(lines, fmt.Sprintf("r%v\t0\tchr1\t%v\t60\t50M\t*\t0\t0\t*\t*", i, i*10+1))
+	}
+	lines = append(lines, "r300\t0\tchr2\t5\t60\t50M\t*\t0\t0\t*\t*", "r301\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*")
+	dir := t.TempDir()
+	name := filepath.Join(dir, "test.bam")
+	output, err := CreateFormat(name, DefaultFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := output.AddOffsetMap(name+OffsetMapExt, 1000); err != nil {
+		t.Fatal(err)
+	}
+	hdr := NewHeader()
+	hdr.SQ = []utils.StringMap{{"SN": "chr1", "LN": "2500"}, {"SN": "chr2", "LN": "1000000"}}
+	hdr.SetHDSO(Coordinate)
+	if err := output.FormatHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		aln, err := (*samReader)(nil).ParseAlignment([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := output.FormatAlignment(aln, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := output.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ParseOffsetMap(name + OffsetMapExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []OffsetMapEntry{
+		{RNAME: "chr1", Start: 0, End: 1000, Count: 100},
+		{RNAME: "chr1", Start: 1000, End: 2000, Count: 100},
+		{RNAME: "chr1", Start: 2000, End: 2500, Count: 100},
+		{RNAME: "chr2", Start: 0, End: 1000, Count: 1},
+		{RNAME: "*", Start: 0, End: 0, Count: 1},
+	}
+	if len(entries) != len(expected) {
+		t.Fatal("ParseOffsetMap failed", entries)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	bgzf := &seekableBGZFReader{r: file}
+	for i, entry := range entries {
+		if entry.RNAME != expected[i].RNAME || entry.Start != expected[i].Start || entry.End != expected[i].End || entry.Count != expected[i].Count {
+			t.Error("OffsetMap entry failed", i, entry)
+		}
+		if i > 0 && entries[i-1].EndOffset != entry.BeginOffset {
+			t.Error("OffsetMap offsets failed", i)
+		}
+		if err := bgzf.Seek(entry.BeginOffset); err != nil {
+			t.Fatal(err)
+		}
+		var blockSize [4]byte
+		if _, err := bgzf.Read(blockSize[:]); err != nil {
+			t.Fatal(err)
+		}
+		record := make([]byte, binary.LittleEndian.Uint32(blockSize[:]))
+		for n := 0; n < len(record); {
+			k, err := bgzf.Read(record[n:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			n += k
+		}
+		aln, err := parseBamAlignment(record, []BAMReference{{Name: "chr1"}, {Name: "chr2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first := []string{"r0", "r100", "r200", "r300", "r301"}[i]; aln.QNAME != first {
+			t.Error("OffsetMap begin offset failed", i, aln.QNAME)
+		}
+	}
+
+	unsorted := filepath.Join(dir, "unsorted.bam")
+	if output, err = CreateFormat(unsorted, DefaultFormat); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.AddOffsetMap(unsorted+OffsetMapExt, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.FormatHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{lines[300], lines[0]} {
+		aln, err := (*samReader)(nil).ParseAlignment([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := output.FormatAlignment(aln, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := output.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := output.Close(); err == nil {
+		t.Error("OffsetMap unsorted failed")
+	}
+}
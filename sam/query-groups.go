@@ -0,0 +1,197 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/exascience/pargo/pipeline"
+)
+
+// A GroupFilter receives a Header and returns a QueryGroupFilter or
+// nil.
+//
+// GroupFilters are for filters that need to see all alignments of a
+// query template at once, such as filters that update the mate
+// information of paired reads. They can only be used with input that
+// is sorted or grouped by query template name.
+type GroupFilter func(*Header) QueryGroupFilter
+
+// A QueryGroupFilter receives the alignments of a query template,
+// which are adjacent in the input, in input order. It can modify the
+// alignments, but cannot remove them.
+type QueryGroupFilter func([]*Alignment)
+
+// IsQueryGrouped reports whether the header claims that the
+// alignments with the same query template name are adjacent, either
+// because they are sorted by queryname, or because they are grouped
+// by query (GO:query). See
+// http://samtools.github.io/hts-specs/SAMv1.pdf - Section 1.3, Tag
+// @HD.
+func (hdr *Header) IsQueryGrouped() bool {
+	return hdr.HDSO() == Queryname || hdr.HDGO() == Query
+}
+
+// SetGroupFilters determines the GroupFilters that subsequent calls of
+// RunPipeline and RunPipelineFI apply to the alignments of this
+// InputFile, before all other filters. The header of the InputFile must
+// then claim that the alignments are grouped by query template name,
+// and the batches of alignments in the pipeline never split a query
+// template. The alignments keep their input order, unless they are
+// sorted for the output.
+func (f *InputFile) SetGroupFilters(filters []GroupFilter) {
+	f.groupFilters = filters
+}
+
+// ComposeGroupFilters composes the given GroupFilters for the given
+// header into a single QueryGroupFilter, or nil if none of them
+// returns a QueryGroupFilter.
+func ComposeGroupFilters(header *Header, filters []GroupFilter) QueryGroupFilter {
+	var groupFilters []QueryGroupFilter
+	for _, filter := range filters {
+		if filter == nil {
+			continue
+		}
+		if groupFilter := filter(header); groupFilter != nil {
+			groupFilters = append(groupFilters, groupFilter)
+		}
+	}
+	switch len(groupFilters) {
+	case 0:
+		return nil
+	case 1:
+		return groupFilters[0]
+	default:
+		return func(group []*Alignment) {
+			for _, groupFilter := range groupFilters {
+				groupFilter(group)
+			}
+		}
+	}
+}
+
+// QueryGroups calls f for each run of adjacent alignments with the
+// same query template name.
+func QueryGroups(alns []*Alignment, f func(group []*Alignment)) {
+	for start := 0; start < len(alns); {
+		end := start + 1
+		for end < len(alns) && alns[end].QNAME == alns[start].QNAME {
+			end++
+		}
+		f(alns[start:end])
+		start = end
+	}
+}
+
+// Returns a pargo pipeline.Filter that applies the given
+// QueryGroupFilter to each query template in the batches of
+// alignments it receives.
+func queryGroupNode(groupFilter QueryGroupFilter) pipeline.Filter {
+	return pipeline.Receive(func(_ int, data interface{}) interface{} {
+		QueryGroups(data.([]*Alignment), groupFilter)
+		return data
+	})
+}
+
+// A queryGroupSource wraps an InputFile as a pargo pipeline.Source
+// such that no batch of records splits the alignments of a query
+// template. After fetching the requested number of records, it keeps
+// fetching records as long as they have the same query template name
+// as the last one, and holds back the first record of the next query
+// template for the next batch.
+type queryGroupSource struct {
+	f       *InputFile
+	it      *AlignmentIterator
+	pending [][]byte
+	data    [][]byte
+	err     error
+}
+
+// Returns a queryGroupSource for an InputFile whose header is parsed.
+func newQueryGroupSource(f *InputFile) *queryGroupSource {
+	it := &AlignmentIterator{input: f}
+	it.bam, it.references = f.bamReferences()
+	return &queryGroupSource{f: f, it: it}
+}
+
+// Returns the query template name of a raw record, without decoding
+// its other fields.
+func (source *queryGroupSource) qname(data []byte) (string, bool) {
+	record := Record{data: data, it: source.it}
+	qname, err := record.QNAME()
+	if err != nil {
+		source.err = fmt.Errorf("%v, while grouping alignments by query template name", err)
+		return "", false
+	}
+	return qname, true
+}
+
+// Err implements the method of the pipeline.Source interface.
+func (source *queryGroupSource) Err() error {
+	if source.err != nil {
+		return source.err
+	}
+	return source.f.Err()
+}
+
+// Prepare implements the method of the pipeline.Source interface.
+func (source *queryGroupSource) Prepare(ctx context.Context) int {
+	return source.f.Prepare(ctx)
+}
+
+// Fetch implements the method of the pipeline.Source interface.
+func (source *queryGroupSource) Fetch(size int) int {
+	records := source.pending
+	source.pending = nil
+	if size > len(records) && source.f.Fetch(size-len(records)) > 0 {
+		records = append(records, source.f.Data().([][]byte)...)
+	}
+	if len(records) == 0 {
+		source.data = nil
+		return 0
+	}
+	last, ok := source.qname(records[len(records)-1])
+	for ok && source.f.Fetch(1) > 0 {
+		record := source.f.Data().([][]byte)[0]
+		var qname string
+		if qname, ok = source.qname(record); !ok {
+			break
+		}
+		if qname != last {
+			source.pending = [][]byte{record}
+			break
+		}
+		records = append(records, record)
+	}
+	if !ok {
+		source.data = nil
+		return 0
+	}
+	source.data = records
+	return len(records)
+}
+
+// Data implements the method of the pipeline.Source interface.
+func (source *queryGroupSource) Data() interface{} {
+	return source.data
+}
+
+var errNotQueryGrouped = errors.New("filters that process query templates at once require input that is sorted by queryname or grouped by query (GO:query)")
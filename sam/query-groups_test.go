@@ -0,0 +1,110 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryGroups(t *testing.T) {
+	dir := t.TempDir()
+	samData := "@HD\tVN:1.6\tSO:unsorted\tGO:query\n@SQ\tSN:1\tLN:100\n"
+	for _, qname := range []string{"b", "b", "a", "c", "c", "c", "a"} {
+		samData += qname + "\t0\t1\t1\t60\t1M\t*\t0\t0\tA\tI\n"
+	}
+	name := filepath.Join(dir, "grouped.sam")
+	if err := ioutil.WriteFile(name, []byte(samData), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := input.ParseHeader(); err != nil {
+		t.Fatal(err)
+	}
+	source := newQueryGroupSource(input)
+	var sizes []int
+	for n := source.Fetch(1); n > 0; n = source.Fetch(1) {
+		sizes = append(sizes, len(source.Data().([][]byte)))
+	}
+	_ = input.Close()
+	if len(sizes) != 4 || sizes[0] != 2 || sizes[1] != 1 || sizes[2] != 3 || sizes[3] != 1 || source.Err() != nil {
+		t.Error("queryGroupSource failed", sizes, source.Err())
+	}
+
+	var lines []string
+	for _, qname := range []string{"b", "b", "a", "c", "c", "c", "a"} {
+		lines = append(lines, qname+"\t0\tchr1\t1\t60\t1M\t*\t0\t0\tA\tI")
+	}
+	bamName := filepath.Join(dir, "grouped.bam")
+	if err := writeBamWithIndex(t, bamName, NoIndex, lines); err != nil {
+		t.Fatal(err)
+	}
+	input, err = Open(bamName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := input.ParseHeader(); err != nil {
+		t.Fatal(err)
+	}
+	source = newQueryGroupSource(input)
+	sizes = nil
+	for n := source.Fetch(1); n > 0; n = source.Fetch(1) {
+		sizes = append(sizes, len(source.Data().([][]byte)))
+	}
+	_ = input.Close()
+	if len(sizes) != 4 || sizes[0] != 2 || sizes[1] != 1 || sizes[2] != 3 || sizes[3] != 1 || source.Err() != nil {
+		t.Error("queryGroupSource BAM failed", sizes, source.Err())
+	}
+
+	input, err = Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups []int
+	input.SetGroupFilters([]GroupFilter{func(*Header) QueryGroupFilter {
+		return func(group []*Alignment) { groups = append(groups, len(group)) }
+	}})
+	output := NewSam()
+	if err := input.RunPipeline(output, nil, Unsorted); err != nil {
+		t.Fatal(err)
+	}
+	_ = input.Close()
+	if len(groups) != 4 || output.Header.HDGO() != Query || output.Header.HDSO() != Unsorted {
+		t.Error("SetGroupFilters failed", groups, output.Header.HD)
+	}
+
+	name = filepath.Join(dir, "ungrouped.sam")
+	if err := ioutil.WriteFile(name, []byte("@HD\tVN:1.6\tSO:unsorted\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	input, err = Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.SetGroupFilters([]GroupFilter{func(*Header) QueryGroupFilter { return func([]*Alignment) {} }})
+	if err := input.RunPipeline(NewSam(), nil, Keep); err != errNotQueryGrouped {
+		t.Error("SetGroupFilters grouping check failed", err)
+	}
+	_ = input.Close()
+}
@@ -0,0 +1,208 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/exascience/elprep/v4/utils"
+	"github.com/exascience/pargo/pipeline"
+)
+
+// UnassignedReadGroup is used in place of a read group ID in the name
+// of the file that receives the alignments of a ReadGroupOutput that
+// do not belong to any read group of the header.
+const UnassignedReadGroup = "unassigned"
+
+// A ReadGroupOutput is a PipelineOutput that writes the alignments of
+// each read group to a separate SAM/BAM file. The header of each file
+// is the header of the pipeline, except that it only contains the @RG
+// line of its own read group.
+type ReadGroupOutput struct {
+	name   string
+	format OutputFormat
+	index  IndexFormat
+	header *Header
+	files  map[string]*OutputFile
+	// The file for alignments without a known read group, which is
+	// only created when such alignments occur.
+	unassigned *OutputFile
+	names      map[string]bool
+}
+
+// checkSplitOutput checks the arguments for creating a
+// ReadGroupOutput or a ContigOutput.
+func checkSplitOutput(name string, format OutputFormat, index IndexFormat) error {
+	if name == "/dev/stdout" {
+		return fmt.Errorf("cannot write several output files to %v", name)
+	}
+	if index != NoIndex {
+		if resolved := ResolveOutputFormat(name, format); resolved != BamFormat && resolved != UncompressedBamFormat {
+			return fmt.Errorf("cannot write an index for %v: only BAM files can be indexed", name)
+		}
+	}
+	return nil
+}
+
+// CreatePerReadGroup returns a ReadGroupOutput for writing one file
+// per read group. The file names are derived from the given name by
+// inserting the read group ID in front of the file extension, see
+// ReadGroupFileName. The files are created once the header is known,
+// when the pipeline runs. The format and index are handled for each
+// file as by CreateIndexed.
+func CreatePerReadGroup(name string, format OutputFormat, index IndexFormat) (*ReadGroupOutput, error) {
+	if err := checkSplitOutput(name, format, index); err != nil {
+		return nil, err
+	}
+	return &ReadGroupOutput{
+		name:   name,
+		format: format,
+		index:  index,
+		files:  make(map[string]*OutputFile),
+		names:  make(map[string]bool),
+	}, nil
+}
+
+// ReadGroupFileName returns the name of the file that receives the
+// alignments of the read group with the given ID when writing one file
+// per read group to the given name. For example, the alignments of
+// read group lane1 for output.bam are written to output.lane1.bam.
+// Characters in the ID that are not letters, digits, '.', '-', or '_'
+// are replaced by '_'.
+func ReadGroupFileName(name, id string) string {
+	return outputFileName(name, id)
+}
+
+func (output *ReadGroupOutput) create(id string, rgs []utils.StringMap) (*OutputFile, error) {
+	name := ReadGroupFileName(output.name, id)
+	if output.names[name] {
+		return nil, fmt.Errorf("read group %v results in the same file name %v as another read group", id, name)
+	}
+	output.names[name] = true
+	file, err := CreateIndexed(name, output.format, output.index)
+	if err != nil {
+		return nil, err
+	}
+	hdr := *output.header
+	hdr.RG = rgs
+	if err := file.FormatHeader(&hdr); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("%v, while writing a SAM header to %v", err, name)
+	}
+	return file, nil
+}
+
+// A readGroupBatch holds the formatted alignments of a batch for each
+// read group, and the formatted alignments that do not belong to any
+// read group.
+type readGroupBatch struct {
+	records    map[string][][]byte
+	unassigned [][]byte
+}
+
+// AddNodes implements the PipelineOutput interface for ReadGroupOutput values.
+func (output *ReadGroupOutput) AddNodes(p *pipeline.Pipeline, header *Header, sortingOrder SortingOrder) {
+	var nodeCons func(...pipeline.Filter) pipeline.Node
+	switch sortingOrder {
+	case Keep, Unknown:
+		nodeCons = pipeline.StrictOrd
+	case Coordinate, Queryname:
+		p.Add(errorNode(errors.New("sorting on files not supported")))
+		return
+	case Unsorted:
+		nodeCons = pipeline.Seq
+	default:
+		p.Add(errorNode(fmt.Errorf("unknown sorting order %v", sortingOrder)))
+		return
+	}
+	output.header = header
+	for _, rg := range header.RG {
+		id := rg["ID"]
+		file, err := output.create(id, []utils.StringMap{rg})
+		if err != nil {
+			p.Add(errorNode(err))
+			return
+		}
+		output.files[id] = file
+	}
+	formatAlignment := alignmentFormatter(output.name, output.format, header)
+	p.Add(
+		pipeline.LimitedPar(0, pipeline.Receive(func(_ int, data interface{}) interface{} {
+			batch := readGroupBatch{records: make(map[string][][]byte)}
+			var buf []byte
+			var err error
+			for _, aln := range data.([]*Alignment) {
+				buf, err = formatAlignment(aln, buf[:0])
+				if err != nil {
+					p.SetErr(fmt.Errorf("%v in ReadGroupOutput", err))
+				}
+				record := append([]byte(nil), buf...)
+				if id, _ := aln.RG().(string); output.files[id] != nil {
+					batch.records[id] = append(batch.records[id], record)
+				} else {
+					batch.unassigned = append(batch.unassigned, record)
+				}
+			}
+			return batch
+		})),
+		nodeCons(pipeline.Receive(func(_ int, data interface{}) interface{} {
+			batch := data.(readGroupBatch)
+			if len(batch.unassigned) > 0 && output.unassigned == nil {
+				file, err := output.create(UnassignedReadGroup, nil)
+				if err != nil {
+					p.SetErr(err)
+					return data
+				}
+				output.unassigned = file
+			}
+			write := func(file *OutputFile, records [][]byte) bool {
+				for _, record := range records {
+					if _, err := file.Write(record); err != nil {
+						p.SetErr(fmt.Errorf("%v, while writing SAM alignment strings to output", err))
+						return false
+					}
+				}
+				return true
+			}
+			for id, records := range batch.records {
+				if !write(output.files[id], records) {
+					return data
+				}
+			}
+			write(output.unassigned, batch.unassigned)
+			return data
+		})),
+	)
+}
+
+// Close closes all files of a ReadGroupOutput.
+func (output *ReadGroupOutput) Close() (err error) {
+	for _, file := range output.files {
+		if nerr := file.Close(); err == nil {
+			err = nerr
+		}
+	}
+	if output.unassigned != nil {
+		if nerr := output.unassigned.Close(); err == nil {
+			err = nerr
+		}
+	}
+	return
+}
@@ -0,0 +1,103 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReadGroupOutput(t *testing.T) {
+	names := writeSamFiles(t,
+		"@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:1000\n@RG\tID:L1\tSM:s\n@RG\tID:L/2\tSM:s\n@RG\tID:L3\tSM:s\n"+
+			"r1\t0\tchr1\t10\t60\t1M\t*\t0\t0\tA\tI\tRG:Z:L1\n"+
+			"r2\t0\tchr1\t20\t60\t1M\t*\t0\t0\tA\tI\tRG:Z:L/2\n"+
+			"r3\t0\tchr1\t30\t60\t1M\t*\t0\t0\tA\tI\n"+
+			"r4\t0\tchr1\t40\t60\t1M\t*\t0\t0\tA\tI\tRG:Z:L1\n")
+	name := filepath.Join(t.TempDir(), "out.bam")
+	if ReadGroupFileName(name, "L/2") != filepath.Join(filepath.Dir(name), "out.L_2.bam") {
+		t.Error("ReadGroupFileName failed")
+	}
+	output, err := CreatePerReadGroup(name, DefaultFormat, NoIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := input.RunPipeline(output, nil, Keep); err != nil {
+		t.Fatal(err)
+	}
+	if err := input.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[string][]string{
+		"L1":                {"r1", "r4"},
+		"L/2":               {"r2"},
+		"L3":                nil,
+		UnassignedReadGroup: {"r3"},
+	} {
+		input, err := Open(ReadGroupFileName(name, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reads := NewSam()
+		if err := input.RunPipeline(reads, nil, Keep); err != nil {
+			t.Fatal(err)
+		}
+		_ = input.Close()
+		var qnames []string
+		for _, aln := range reads.Alignments {
+			qnames = append(qnames, aln.QNAME)
+		}
+		if !equalNames(qnames, expected...) {
+			t.Error("ReadGroupOutput alignments failed for", id, qnames)
+		}
+		if id == UnassignedReadGroup {
+			if len(reads.Header.RG) != 0 {
+				t.Error("ReadGroupOutput header failed for", id)
+			}
+		} else if len(reads.Header.RG) != 1 || reads.Header.RG[0]["ID"] != id {
+			t.Error("ReadGroupOutput header failed for", id)
+		}
+	}
+}
+
+func TestReadGroupOutputCollision(t *testing.T) {
+	names := writeSamFiles(t,
+		"@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:1000\n@RG\tID:L/2\tSM:s\n@RG\tID:L_2\tSM:s\n"+
+			"r1\t0\tchr1\t10\t60\t1M\t*\t0\t0\tA\tI\tRG:Z:L/2\n")
+	output, err := CreatePerReadGroup(filepath.Join(t.TempDir(), "out.sam"), DefaultFormat, NoIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := input.RunPipeline(output, nil, Keep); err == nil {
+		t.Error("ReadGroupOutput did not report colliding file names")
+	}
+	_ = input.Close()
+	_ = output.Close()
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -283,17 +284,14 @@ func (sc *stringScanner) parseSamNumericArray(tag utils.Symbol) (utils.Symbol, i
 	if sc.err != nil {
 		return tag, nil
 	}
-	ntype, ok := sc.readByteUntil(',')
-	if !ok {
-		if sc.err == nil {
-			sc.err = errors.New("missing entry in numeric array")
-		}
+	ntype, more := sc.readArrayType()
+	if sc.err != nil {
 		return tag, nil
 	}
 	switch ntype {
 	case 'c':
 		var result []int8
-		for {
+		for more {
 			entry, sep := sc.readUntil2(',', '\t')
 			val, err := strconv.ParseInt(entry, 10, 8)
 			if err != nil {
@@ -303,14 +301,12 @@ func (sc *stringScanner) parseSamNumericArray(tag utils.Symbol) (utils.Symbol, i
 				return tag, nil
 			}
 			result = append(result, int8(val))
-			if sep != ',' {
-				break
-			}
+			more = sep == ','
 		}
 		return tag, result
 	case 'C':
 		var result []uint8
-		for {
+		for more {
 			entry, sep := sc.readUntil2(',', '\t')
 			val, err := strconv.ParseUint(entry, 10, 8)
 			if err != nil {
@@ -320,14 +316,12 @@ func (sc *stringScanner) parseSamNumericArray(tag utils.Symbol) (utils.Symbol, i
 				return tag, nil
 			}
 			result = append(result, uint8(val))
-			if sep != ',' {
-				break
-			}
+			more = sep == ','
 		}
 		return tag, result
 	case 's':
 		var result []int16
-		for {
+		for more {
 			entry, sep := sc.readUntil2(',', '\t')
 			val, err := strconv.ParseInt(entry, 10, 16)
 			if err != nil {
@@ -337,14 +331,12 @@ func (sc *stringScanner) parseSamNumericArray(tag utils.Symbol) (utils.Symbol, i
 				return tag, nil
 			}
 			result = append(result, int16(val))
-			if sep != ',' {
-				break
-			}
+			more = sep == ','
 		}
 		return tag, result
 	case 'S':
 		var result []uint16
-		for {
+		for more {
 			entry, sep := sc.readUntil2(',', '\t')
 			val, err := strconv.ParseUint(entry, 10, 16)
 			if err != nil {
@@ -354,14 +346,12 @@ func (sc *stringScanner) parseSamNumericArray(tag utils.Symbol) (utils.Symbol, i
 				return tag, nil
 			}
 			result = append(result, uint16(val))
-			if sep != ',' {
-				break
-			}
+			more = sep == ','
 		}
 		return tag, result
 	case 'i':
 		var result []int32
-		for {
+		for more {
 			entry, sep := sc.readUntil2(',', '\t')
 			val, err := strconv.ParseInt(entry, 10, 32)
 			if err != nil {
@@ -371,14 +361,12 @@ func (sc *stringScanner) parseSamNumericArray(tag utils.Symbol) (utils.Symbol, i
 				return tag, nil
 			}
 			result = append(result, int32(val))
-			if sep != ',' {
-				break
-			}
+			more = sep == ','
 		}
 		return tag, result
 	case 'I':
 		var result []uint32
-		for {
+		for more {
 			entry, sep := sc.readUntil2(',', '\t')
 			val, err := strconv.ParseUint(entry, 10, 32)
 			if err != nil {
@@ -388,14 +376,12 @@ func (sc *stringScanner) parseSamNumericArray(tag utils.Symbol) (utils.Symbol, i
 				return tag, nil
 			}
 			result = append(result, uint32(val))
-			if sep != ',' {
-				break
-			}
+			more = sep == ','
 		}
 		return tag, result
 	case 'f':
 		var result []float32
-		for {
+		for more {
 			entry, sep := sc.readUntil2(',', '\t')
 			val, err := strconv.ParseFloat(entry, 32)
 			if err != nil {
@@ -405,9 +391,7 @@ func (sc *stringScanner) parseSamNumericArray(tag utils.Symbol) (utils.Symbol, i
 				return tag, nil
 			}
 			result = append(result, float32(val))
-			if sep != ',' {
-				break
-			}
+			more = sep == ','
 		}
 		return tag, result
 	default:
@@ -563,13 +547,38 @@ func formatSamString(out []byte, tag, value string) []byte {
 	return out
 }
 
+// The tags that come first in header lines, in this order, if present.
+var leadingHeaderTags = map[string][]string{
+	"@HD": {"VN", "SO", "GO", "SS"},
+	"@SQ": {"SN", "LN"},
+	"@RG": {"ID"},
+	"@PG": {"ID", "PN", "PP", "VN", "CL"},
+}
+
 // formatSamHeaderLine writes a header line in a SAM file header
 // section. See http://samtools.github.io/hts-specs/SAMv1.pdf -
 // Section 1.3.
+//
+// The tags are written in a deterministic order, with the leading tags
+// of the record type first, followed by the remaining tags in sorted
+// order, so that the same header always gives the same output.
 func formatSamHeaderLine(out []byte, code string, record utils.StringMap) []byte {
 	out = append(out, code...)
-	for key, value := range record {
-		out = formatSamString(out, key, value)
+	leading := leadingHeaderTags[code]
+	for _, key := range leading {
+		if value, found := record[key]; found {
+			out = formatSamString(out, key, value)
+		}
+	}
+	keys := make([]string, 0, len(record))
+	for key := range record {
+		if !containsString(leading, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		out = formatSamString(out, key, record[key])
 	}
 	out = append(out, '\n')
 	return out
@@ -724,10 +733,16 @@ func formatSamAlignment(aln *Alignment, out []byte) ([]byte, error) {
 		out = append(out, aln.SEQ.Base(i))
 	}
 	out = append(out, '\t')
-	for _, qual := range aln.QUAL {
-		out = append(out, qual+33)
+	if len(aln.QUAL) > 0 && aln.QUAL[0] == 0xff {
+		// missing QUAL, as in BAM files
+		out = append(out, '*')
+	} else {
+		for _, qual := range aln.QUAL {
+			out = append(out, qual+33)
+		}
 	}
 
+	aln.DecodeTags()
 	var err error
 	for _, entry := range aln.TAGS {
 		if out, err = formatSamTag(out, entry.Key, entry.Value); err != nil {
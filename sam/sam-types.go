@@ -24,6 +24,7 @@ import (
 	"log"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"unicode"
 
@@ -169,13 +170,64 @@ func (hdr *Header) HDSO() SortingOrder {
 // given header. See http://samtools.github.io/hts-specs/SAMv1.pdf -
 // Section 1.3, Tag @HD.
 //
-// This also deletes the value for the GO field if it is set.
+// This also deletes the value for the GO field if the new sorting
+// order is coordinate or queryname, since a sorting order determines
+// the grouping, and the value for the SS field if it does not refine
+// the new sorting order. For the unknown and unsorted sorting orders,
+// the GO field is kept, since alignments can be grouped without being
+// sorted.
 func (hdr *Header) SetHDSO(value SortingOrder) {
 	hd := hdr.EnsureHD()
-	delete(hd, "GO")
+	if value != Unknown && value != Unsorted {
+		delete(hd, "GO")
+	}
+	if !strings.HasPrefix(hd["SS"], string(value)+":") {
+		delete(hd, "SS")
+	}
 	hd["SO"] = string(value)
 }
 
+// QuerynameCollation determines how query template names are
+// compared when sorting by queryname.
+type QuerynameCollation string
+
+// Valid values for QuerynameCollation. The SAM specification records
+// them as sub-sorting orders in the SS field of the @HD line, for
+// example as queryname:natural.
+const (
+	// Lexicographical compares names byte by byte, as Picard does.
+	Lexicographical QuerynameCollation = "lexicographical"
+	// Natural compares runs of digits in names by their numeric
+	// value, as samtools does.
+	Natural QuerynameCollation = "natural"
+)
+
+// HDQuerynameCollation returns the collation for query template names
+// stored in the sub-sorting order (SS) of the @HD line of the given
+// header. See http://samtools.github.io/hts-specs/SAMv1.pdf - Section
+// 1.3, Tag @HD.
+//
+// If the sorting order is not queryname, or the SS field does not
+// specify a known collation, returns Lexicographical.
+func (hdr *Header) HDQuerynameCollation() QuerynameCollation {
+	hd := hdr.EnsureHD()
+	if hd["SO"] == string(Queryname) && hd["SS"] == string(Queryname)+":"+string(Natural) {
+		return Natural
+	}
+	return Lexicographical
+}
+
+// SetHDQuerynameCollation stores the given collation for query
+// template names in the sub-sorting order (SS) of the @HD line of the
+// given header. See http://samtools.github.io/hts-specs/SAMv1.pdf -
+// Section 1.3, Tag @HD.
+//
+// This also sets the sorting order (SO) to queryname.
+func (hdr *Header) SetHDQuerynameCollation(value QuerynameCollation) {
+	hdr.SetHDSO(Queryname)
+	hdr.HD["SS"] = string(Queryname) + ":" + string(value)
+}
+
 // HDGO returns the grouping order (GO) stored in the @HD line of the
 // given header. See http://samtools.github.io/hts-specs/SAMv1.pdf -
 // Section 1.3, Tag @HD.
@@ -194,10 +246,18 @@ func (hdr *Header) HDGO() GroupingOrder {
 // given header. See http://samtools.github.io/hts-specs/SAMv1.pdf -
 // Section 1.3, Tag @HD.
 //
-// This also deletes the value for the SO field if it is set.
+// Setting the grouping order to none deletes the GO field. Otherwise,
+// if the sorting order (SO) is coordinate or queryname, it is changed
+// to unsorted, since the alignments are then only grouped.
 func (hdr *Header) SetHDGO(value GroupingOrder) {
 	hd := hdr.EnsureHD()
-	delete(hd, "SO")
+	if value == None {
+		delete(hd, "GO")
+		return
+	}
+	if so := hd["SO"]; so == string(Coordinate) || so == string(Queryname) {
+		hdr.SetHDSO(Unsorted)
+	}
 	hd["GO"] = string(value)
 }
 
@@ -308,8 +368,17 @@ type Alignment struct {
 	QUAL []byte
 
 	// The optional fields in a read alignment.
+	//
+	// For alignments read from BAM files, the optional fields are only
+	// decoded into TAGS when they are changed, so code that accesses
+	// TAGS directly must call DecodeTags first. The accessors in
+	// alignment-tags.go take care of this.
 	TAGS utils.SmallMap
 
+	// The optional fields of an alignment read from a BAM file in BAM
+	// encoding, as long as they are not decoded into TAGS.
+	rawTags []byte
+
 	// Additional optional fields which are not stored in SAM files, but
 	// reserved for temporary values in filters.
 	Temps utils.SmallMap
@@ -333,12 +402,13 @@ var (
 
 // RG returns the (potentially empty) RG optional field.
 func (aln *Alignment) RG() interface{} {
-	rg, _ := aln.TAGS.Get(RG)
+	rg, _ := aln.getTag(RG)
 	return rg
 }
 
 // SetRG sets the RG optional field.
 func (aln *Alignment) SetRG(rg interface{}) {
+	aln.DecodeTags()
 	aln.TAGS.Set(RG, rg)
 }
 
@@ -411,6 +481,82 @@ func QNAMELess(aln1, aln2 *Alignment) bool {
 	return aln1.QNAME < aln2.QNAME
 }
 
+// NaturalCompare compares two strings like samtools does when sorting
+// by queryname: runs of digits are compared by their numeric value,
+// ignoring leading zeros, and other characters byte by byte. Returns
+// a negative number, zero, or a positive number if a is less than,
+// equal to, or greater than b.
+func NaturalCompare(a, b string) int {
+	isDigit := func(s string, i int) bool { return i < len(s) && s[i] >= '0' && s[i] <= '9' }
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a, i) || !isDigit(b, j) {
+			if a[i] != b[j] {
+				return int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+			continue
+		}
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		for isDigit(a, i) && isDigit(b, j) && a[i] == b[j] {
+			i++
+			j++
+		}
+		var diff int
+		if isDigit(a, i) && isDigit(b, j) {
+			diff = int(a[i]) - int(b[j])
+		}
+		for isDigit(a, i) && isDigit(b, j) {
+			i++
+			j++
+		}
+		switch {
+		case isDigit(a, i):
+			return 1
+		case isDigit(b, j):
+			return -1
+		case diff != 0:
+			return diff
+		}
+	}
+	switch {
+	case i < len(a):
+		return 1
+	case j < len(b):
+		return -1
+	default:
+		return 0
+	}
+}
+
+// QuerynameLess returns a function that compares two alignments
+// according to their query template name using the given collation,
+// as samtools and Picard do when sorting by queryname. Alignments
+// with the same name are ordered so that the first segment of a
+// template comes before the last one, and primary alignments come
+// before secondary and supplementary ones.
+func QuerynameLess(collation QuerynameCollation) func(aln1, aln2 *Alignment) bool {
+	compare := strings.Compare
+	if collation == Natural {
+		compare = NaturalCompare
+	}
+	return func(aln1, aln2 *Alignment) bool {
+		if c := compare(aln1.QNAME, aln2.QNAME); c != 0 {
+			return c < 0
+		}
+		if segment1, segment2 := aln1.FLAG&(First|Last), aln2.FLAG&(First|Last); segment1 != segment2 {
+			return segment1 < segment2
+		}
+		return aln1.FLAG&(Secondary|Supplementary) < aln2.FLAG&(Secondary|Supplementary)
+	}
+}
+
 // Bit values for the FLAG field in the Alignment struct. See
 // http://samtools.github.io/hts-specs/SAMv1.pdf - Section 1.4.2.
 const (
@@ -0,0 +1,59 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestQuerynameLess(t *testing.T) {
+	names := []string{"r10", "r9", "r0010", "a", "r2x", "r2", "r1"}
+	var alns []*Alignment
+	for _, name := range names {
+		alns = append(alns, &Alignment{QNAME: name})
+	}
+	sortNames := func(collation QuerynameCollation) (result []string) {
+		sort.SliceStable(alns, func(i, j int) bool { return QuerynameLess(collation)(alns[i], alns[j]) })
+		for _, aln := range alns {
+			result = append(result, aln.QNAME)
+		}
+		return result
+	}
+	if result := sortNames(Natural); !equalNames(result, "a", "r1", "r2", "r2x", "r9", "r10", "r0010") {
+		t.Error("QuerynameLess natural failed", result)
+	}
+	if result := sortNames(Lexicographical); !equalNames(result, "a", "r0010", "r1", "r10", "r2", "r2x", "r9") {
+		t.Error("QuerynameLess lexicographical failed", result)
+	}
+	mate1 := &Alignment{QNAME: "r", FLAG: Multiple | First}
+	mate2 := &Alignment{QNAME: "r", FLAG: Multiple | Last}
+	if !QuerynameLess(Natural)(mate1, mate2) || QuerynameLess(Natural)(mate2, mate1) {
+		t.Error("QuerynameLess mates failed")
+	}
+
+	hdr := NewHeader()
+	hdr.SetHDQuerynameCollation(Natural)
+	if hdr.HDSO() != Queryname || hdr.HDQuerynameCollation() != Natural {
+		t.Error("SetHDQuerynameCollation failed")
+	}
+	if hdr.SetHDSO(Coordinate); hdr.HD["SS"] != "" {
+		t.Error("SetHDSO failed to remove SS")
+	}
+}
@@ -0,0 +1,164 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/exascience/pargo/pipeline"
+)
+
+// SortingOrderCheck determines whether and how the alignments of an
+// InputFile are checked against the sorting order (SO) claimed in the
+// @HD line of its header, while they are read. Only the coordinate
+// and queryname sorting orders are checked.
+type SortingOrderCheck int
+
+const (
+	// DontCheckSortingOrder accepts the alignments in any order.
+	DontCheckSortingOrder SortingOrderCheck = iota
+	// WarnSortingOrder logs a warning for the first alignment that is
+	// out of order. If the alignments are not sorted again, the
+	// sorting order in the header is then set to unknown, which is
+	// reflected in the output if it is written after the input is read
+	// completely.
+	WarnSortingOrder
+	// EnforceSortingOrder stops the pipeline with an error at the
+	// first alignment that is out of order.
+	EnforceSortingOrder
+)
+
+// ParseSortingOrderCheck parses the name of a SortingOrderCheck, which
+// is either "warn" or "strict". The empty string means
+// DontCheckSortingOrder.
+func ParseSortingOrderCheck(s string) (SortingOrderCheck, error) {
+	switch s {
+	case "":
+		return DontCheckSortingOrder, nil
+	case "warn":
+		return WarnSortingOrder, nil
+	case "strict":
+		return EnforceSortingOrder, nil
+	default:
+		return DontCheckSortingOrder, fmt.Errorf("unknown sorting order check %v", s)
+	}
+}
+
+// CheckSortingOrder determines how the alignments of this InputFile
+// are checked against the sorting order claimed by its header by
+// subsequent calls of RunPipeline and RunPipelineFI.
+func (f *InputFile) CheckSortingOrder(check SortingOrderCheck) {
+	f.check = check
+}
+
+// A sortingOrderChecker compares each alignment with the previous one
+// in a StrictOrd pipeline node.
+type sortingOrderChecker struct {
+	check        SortingOrderCheck
+	sortingOrder SortingOrder
+	dictTable    map[string]int32
+	// The previous alignment, as a reference sequence index and
+	// position, or as a query template name.
+	refID, pos int32
+	qname      string
+	// For queryname order without a sub-sorting order, the
+	// alignments may use either collation.
+	natural, lexicographical bool
+	violation                bool
+}
+
+// Returns a sortingOrderChecker for the claimed sorting order of the
+// given header, or nil if there is nothing to check.
+func newSortingOrderChecker(header *Header, check SortingOrderCheck) *sortingOrderChecker {
+	if check == DontCheckSortingOrder {
+		return nil
+	}
+	checker := &sortingOrderChecker{check: check, sortingOrder: header.HDSO()}
+	switch checker.sortingOrder {
+	case Coordinate:
+		checker.dictTable = make(map[string]int32)
+		for index, entry := range header.SQ {
+			checker.dictTable[entry["SN"]] = int32(index)
+		}
+	case Queryname:
+		switch header.HD["SS"] {
+		case string(Queryname) + ":" + string(Natural):
+			checker.natural = true
+		case string(Queryname) + ":" + string(Lexicographical):
+			checker.lexicographical = true
+		default:
+			checker.natural, checker.lexicographical = true, true
+		}
+	default:
+		return nil
+	}
+	return checker
+}
+
+// Determines whether the given alignment comes after the previous
+// one, and records it as the previous alignment.
+func (checker *sortingOrderChecker) inOrder(aln *Alignment) bool {
+	if checker.sortingOrder == Coordinate {
+		refID, found := checker.dictTable[aln.RNAME]
+		if !found {
+			// Unplaced alignments come last.
+			refID = -1
+		}
+		inOrder := uint32(refID) > uint32(checker.refID) || (refID == checker.refID && aln.POS >= checker.pos)
+		checker.refID, checker.pos = refID, aln.POS
+		return inOrder
+	}
+	if checker.lexicographical && strings.Compare(checker.qname, aln.QNAME) > 0 {
+		checker.lexicographical = false
+	}
+	if checker.natural && NaturalCompare(checker.qname, aln.QNAME) > 0 {
+		checker.natural = false
+	}
+	checker.qname = aln.QNAME
+	return checker.natural || checker.lexicographical
+}
+
+// Returns a StrictOrd pipeline node that checks the alignments it
+// receives, and updates the header at the end if necessary.
+func (checker *sortingOrderChecker) node(p *pipeline.Pipeline, header *Header, sortingOrder SortingOrder) pipeline.Node {
+	return pipeline.StrictOrd(pipeline.ReceiveAndFinalize(func(_ int, data interface{}) interface{} {
+		if checker.violation {
+			return data
+		}
+		for _, aln := range data.([]*Alignment) {
+			if checker.inOrder(aln) {
+				continue
+			}
+			checker.violation = true
+			if checker.check == EnforceSortingOrder {
+				p.SetErr(fmt.Errorf("alignment %v is out of order for sorting order %v claimed in the input header", aln.QNAME, checker.sortingOrder))
+			} else {
+				log.Printf("Warning: alignment %v is out of order for sorting order %v claimed in the input header.\n", aln.QNAME, checker.sortingOrder)
+			}
+			break
+		}
+		return data
+	}, func() {
+		if checker.violation && sortingOrder == Keep && header.HDSO() == checker.sortingOrder {
+			header.SetHDSO(Unknown)
+		}
+	}))
+}
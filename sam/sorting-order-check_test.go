@@ -0,0 +1,84 @@
+// elPrep: a high-performance tool for preparing SAM/BAM files.
+// Copyright (c) 2017, 2018 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/elprep/blob/master/LICENSE.txt>.
+
+package sam
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func runSortingOrderCheck(t *testing.T, name string, check SortingOrderCheck) (*Sam, error) {
+	input, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := input.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	input.CheckSortingOrder(check)
+	output := NewSam()
+	return output, input.RunPipeline(output, nil, Keep)
+}
+
+func TestCheckSortingOrder(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		header, qnames, rnames string
+		pos                    []int32
+		ok                     bool
+	}{
+		{"@HD\tVN:1.6\tSO:coordinate", "abcd", "1122", []int32{5, 10, 1, 1}, true},
+		{"@HD\tVN:1.6\tSO:coordinate", "abcd", "1*22", []int32{5, 0, 1, 1}, false},
+		{"@HD\tVN:1.6\tSO:coordinate", "abcd", "1121", []int32{5, 10, 1, 1}, false},
+		{"@HD\tVN:1.6\tSO:queryname", "abcd", "2121", []int32{1, 1, 1, 1}, true},
+		{"@HD\tVN:1.6\tSO:queryname", "abdc", "1111", []int32{1, 1, 1, 1}, false},
+		{"@HD\tVN:1.6\tSO:unsorted", "dcba", "2121", []int32{1, 1, 1, 1}, true},
+	}
+	for i, test := range tests {
+		samData := test.header + "\n@SQ\tSN:1\tLN:100\n@SQ\tSN:2\tLN:100\n"
+		for j := range test.qnames {
+			samData += test.qnames[j:j+1] + "\t0\t" + test.rnames[j:j+1] + "\t" + strconv.Itoa(int(test.pos[j])) + "\t60\t1M\t*\t0\t0\tA\tI\n"
+		}
+		name := filepath.Join(dir, "test"+strconv.Itoa(i)+".sam")
+		if err := ioutil.WriteFile(name, []byte(samData), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := runSortingOrderCheck(t, name, EnforceSortingOrder); (err == nil) != test.ok {
+			t.Error("EnforceSortingOrder failed", i, err)
+		}
+		output, err := runSortingOrderCheck(t, name, WarnSortingOrder)
+		if err != nil {
+			t.Error(err)
+		} else if (output.Header.HDSO() == Unknown) == test.ok {
+			t.Error("WarnSortingOrder failed", i)
+		}
+	}
+	naturalOrder := "@HD\tVN:1.6\tSO:queryname\n@SQ\tSN:1\tLN:100\nr2\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*\nr10\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*\n"
+	name := filepath.Join(dir, "natural.sam")
+	if err := ioutil.WriteFile(name, []byte(naturalOrder), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runSortingOrderCheck(t, name, EnforceSortingOrder); err != nil {
+		t.Error("EnforceSortingOrder failed for natural order", err)
+	}
+}
@@ -27,7 +27,6 @@ import (
 
 	"github.com/exascience/pargo/pipeline"
 
-	"github.com/exascience/elprep/v4/internal"
 	"github.com/exascience/elprep/v4/utils"
 )
 
@@ -73,21 +72,25 @@ func computeContigGroups(SQ []utils.StringMap, contigGroupSize int) (groups []st
 // all unmapped reads, a file containing all pairs where reads map to
 // different chromosomes, and a file per chromosome containing all
 // pairs where the reads map to that chromosome. There are no
-// requirements on the input file for splitting.
+// requirements on the input file for splitting. If the input is a
+// directory, the files in it are merged with OpenMerged.
 func SplitFilePerChromosome(input, outputPath, outputPrefix, outputExtension string, contigGroupSize int) (funcErr error) {
-	files, err := internal.Directory(input)
+	files, err := InputFiles(input)
 	if err != nil {
 		return fmt.Errorf("%v, while attempting to fetch file(s) %v in SplitFilePerChromosome", err, input)
 	}
-	inputPath := filepath.Dir(input)
-	firstFile := filepath.Join(inputPath, files[0])
-	firstIn, err := Open(firstFile)
+	in, err := OpenMergedRegions(files, nil, nil)
 	if err != nil {
 		return err
 	}
-	header, err := firstIn.ParseHeader()
+	defer func() {
+		if err := in.Close(); funcErr == nil {
+			funcErr = err
+		}
+	}()
+	header, err := in.ParseHeader()
 	if err != nil {
-		return fmt.Errorf("%v, while parsing header of %v in SplitFilePerChromosome", err, firstFile)
+		return fmt.Errorf("%v, while parsing header of %v in SplitFilePerChromosome", err, input)
 	}
 	groups, contigMap, err := computeContigGroups(header.SQ, contigGroupSize)
 	if err != nil {
@@ -156,6 +159,7 @@ func SplitFilePerChromosome(input, outputPath, outputPrefix, outputExtension str
 							p.SetErr(err)
 							return nil
 						}
+						aln.DecodeTags()
 						aln.TAGS.Set(sr, int64(1))
 						tagged, err := out.FormatAlignment(aln, buf[:0])
 						if err != nil {
@@ -174,34 +178,8 @@ func SplitFilePerChromosome(input, outputPath, outputPrefix, outputExtension str
 		p.Run()
 		return p.Err()
 	}
-	if err = processFile(firstIn); err != nil {
-		return fmt.Errorf("%v, while processing file %v in SplitFilePerChromosome", err, firstFile)
-	}
-	if err = firstIn.Close(); err != nil {
-		return err
-	}
-	for _, name := range files[1:] {
-		inFile := filepath.Join(inputPath, name)
-		err = func() (funcErr error) {
-			in, err := Open(inFile)
-			if err != nil {
-				return err
-			}
-			defer func() {
-				if err := in.Close(); funcErr == nil {
-					funcErr = err
-				}
-			}()
-			if err = in.SkipHeader(); err != nil {
-				return fmt.Errorf("%v, while skipping header of file %v in SplitFilePerChromosome", err, inFile)
-			} else if err = processFile(in); err != nil {
-				return fmt.Errorf("%v, while processing file %v in SplitFilePerChromosome", err, inFile)
-			}
-			return nil
-		}()
-		if err != nil {
-			return err
-		}
+	if err = processFile(in); err != nil {
+		return fmt.Errorf("%v, while processing file %v in SplitFilePerChromosome", err, input)
 	}
 	return nil
 }
@@ -541,22 +519,26 @@ func MergeUnsortedFilesSplitPerChromosome(inputPath, output, inputPrefix, inputE
 // SplitSingleEndFilePerChromosome splits a SAM file containing
 // single-end reads into a file for the unmapped reads, and a file per
 // chromosome, containing all reads that map to that chromosome. There
-// are no requirements on the input file for splitting.
+// are no requirements on the input file for splitting. If the input is
+// a directory, the files in it are merged with OpenMerged.
 func SplitSingleEndFilePerChromosome(input, outputPath, outputPrefix, outputExtension string, contigGroupSize int) (funcErr error) {
 
-	files, err := internal.Directory(input)
+	files, err := InputFiles(input)
 	if err != nil {
 		return fmt.Errorf("%v, while attempting to fetch file(s) %v in SplitSingleEndFilePerChromosome", err, input)
 	}
-	inputPath := filepath.Dir(input)
-	firstFile := filepath.Join(inputPath, files[0])
-	firstIn, err := Open(firstFile)
+	in, err := OpenMergedRegions(files, nil, nil)
 	if err != nil {
 		return err
 	}
-	header, err := firstIn.ParseHeader()
+	defer func() {
+		if err := in.Close(); funcErr == nil {
+			funcErr = err
+		}
+	}()
+	header, err := in.ParseHeader()
 	if err != nil {
-		return fmt.Errorf("%v, while parsing header of %v in SplitSingleEndFilePerChromosome", err, firstFile)
+		return fmt.Errorf("%v, while parsing header of %v in SplitSingleEndFilePerChromosome", err, input)
 	}
 	groups, contigMap, err := computeContigGroups(header.SQ, contigGroupSize)
 	if err != nil {
@@ -608,34 +590,8 @@ func SplitSingleEndFilePerChromosome(input, outputPath, outputPrefix, outputExte
 		p.Run()
 		return p.Err()
 	}
-	if err = processFile(firstIn); err != nil {
-		return fmt.Errorf("%v, while processing file %v in SplitSingleEndFilePerChromosome", err, firstFile)
-	}
-	if err = firstIn.Close(); err != nil {
-		return err
-	}
-	for _, name := range files[1:] {
-		inFile := filepath.Join(inputPath, name)
-		err = func() (funcErr error) {
-			in, err := Open(inFile)
-			if err != nil {
-				return err
-			}
-			defer func() {
-				if err := in.Close(); funcErr == nil {
-					funcErr = err
-				}
-			}()
-			if err := in.SkipHeader(); err != nil {
-				return fmt.Errorf("%v, while skipping header of file %v in SplitSingleEndFilePerChromosome", err, inFile)
-			} else if err = processFile(in); err != nil {
-				return fmt.Errorf("%v, while processing file %v in SplitSingleEndFilePerChromosome", err, inFile)
-			}
-			return nil
-		}()
-		if err != nil {
-			return err
-		}
+	if err = processFile(in); err != nil {
+		return fmt.Errorf("%v, while processing file %v in SplitSingleEndFilePerChromosome", err, input)
 	}
 	return nil
 }
@@ -68,6 +68,35 @@ func (sc *stringScanner) readByteUntil(c byte) (b byte, found bool) {
 	}
 }
 
+// readArrayType reads the type of a numeric array, and reports whether
+// it is followed by a comma and the array entries. An empty array has
+// no comma, and is followed by a tabulator or the end of the line.
+func (sc *stringScanner) readArrayType() (b byte, entries bool) {
+	if sc.err != nil {
+		return 0, false
+	}
+	if sc.index >= len(sc.data) {
+		sc.err = fmt.Errorf("missing type in stringScanner.readArrayType")
+		return 0, false
+	}
+	b = sc.data[sc.index]
+	next := sc.index + 1
+	switch {
+	case next >= len(sc.data):
+		sc.index = len(sc.data)
+		return b, false
+	case sc.data[next] == '\t':
+		sc.index = next + 1
+		return b, false
+	case sc.data[next] == ',':
+		sc.index = next + 1
+		return b, true
+	default:
+		sc.err = fmt.Errorf("unexpected character %v in stringScanner.readArrayType", sc.data[next])
+		return 0, false
+	}
+}
+
 func (sc *stringScanner) readUntil(c byte) (s string, found bool) {
 	if sc.err != nil {
 		return "", false